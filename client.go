@@ -18,237 +18,7228 @@ package main
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/fips140"
+	"crypto/hmac"
+	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
+	_ "crypto/sha512" // SHA384 and SHA512 for OpenPGP signatures
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"math/big"
+	"math/bits"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
 	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
 )
 
 var debug bool = false
 
-func copyfile(src string, dst string) error {
+// level of the log output, debug enables the debug level
+var loglevel = new(slog.LevelVar)
 
-	sourceFileStat, err := os.Stat(src)
+// setuplogging sends all log output to stderr as format ("text" or "json"),
+// dropping records below level ("debug", "info", "warn" or "error"). Output
+// of the log package is logged at error level.
+func setuplogging(format string, level string) error {
+
+	if err := loglevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("Unknown log level %s!", level)
+	}
+	if debug {
+		loglevel.Set(slog.LevelDebug)
+	}
+	debug = loglevel.Level() <= slog.LevelDebug
+
+	options := &slog.HandlerOptions{Level: loglevel}
+	switch format {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, options)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, options)))
+	default:
+		return fmt.Errorf("Unknown log format %s!", format)
+	}
+	slog.SetLogLoggerLevel(slog.LevelError)
+	return nil
+}
+
+// FIPS 140-3 mode (GODEBUG=fips140=on, or built with GOFIPS140=latest): only
+// sha256 indices, RSA OpenPGP signatures and FIPS TLS
+var fips bool = fips140.Enabled()
+
+// tolerated deviation of the device clock for certificate validity checks
+var maxclockskew time.Duration = 0
+
+// CA certificates (PEM) trusted for the server instead of the system trust
+// store, "" for the system trust store
+var cacertfile string = ""
+
+// sha256 hashes of the accepted server public keys (SubjectPublicKeyInfo),
+// nil to accept any key with a valid certificate chain
+var pins [][]byte = nil
+
+// device certificate and key presented to servers requiring client
+// certificates
+var certfile string = ""
+var keyfile string = ""
+
+// bearer token sent with every request
+var token string = ""
+
+// OAuth2 token endpoint and client credentials to fetch bearer tokens (e.g.
+// JWTs) from instead of sending a static one, see tokensource
+var tokens = &tokensource{}
+
+// basic auth credentials, credentials embedded in the url are used otherwise
+var authuser string = ""
+var authpassword string = ""
+
+// images are only accepted with a valid signature of this key if set
+var pubkey ed25519.PublicKey = nil
+
+// alternatively, images signed with OpenPGP by one of these keys are accepted
+var keyring []pgpkey = nil
+
+// images are only accepted as targets of TUF metadata trusted from this
+// initial root metadata if set
+var tufrootfile string = ""
+
+// index and diff payloads are decrypted with this AES-256 key, plain
+// payloads are refused if set
+var payloadkey []byte = nil
+
+// only determine the files missing locally, nothing is downloaded
+var checkonly bool = false
+
+// with checkonly, print the files that would be requested and the size of
+// the diff
+var dryrun bool = false
+
+// directory the assembled image is extracted to (-apply -target), "" to
+// only write the tgz
+var applytarget string = ""
+
+// with -slot, the slot applytarget belongs to and the provider marking it
+// bootable once applied
+var applyslot string = ""
+var slots slotprovider
+var slotproviderspec string = ""
+
+// extract images in a confined "extract" helper process (-apply-sandbox),
+// with applyseccomp also behind a seccomp filter
+var applysandbox bool = false
+var applyseccomp bool = false
+
+// apply without root (-rootless): entries are extracted as far as a user
+// can create them and the image manifest is kept in the tree as
+// rootlessmanifest, with the owners, modes, device numbers and attributes
+// the tree lacks
+var rootless bool = false
+
+// name of the image manifest in trees applied with rootless
+const rootlessmanifest = ".ota-manifest"
+
+// with checkonly, compare every entry of the image with the reference
+// directories and print the result
+var verifyonly bool = false
+
+// entries compared and not matching with verifyonly
+var verified, verifyfailed int
+
+// let the server prepare the diff in the background and poll for it
+var asyncdiff bool = false
+
+// request changed gzip members as delta against their old version
+var gzipdeltas bool = true
+
+// index hash requested from the server (see hashbackends), "auto" for the
+// fastest one on this device
+var indexhashname string = "sha1"
+
+// persistent client state, e.g. the installed image version
+var statedir string = "/var/lib/ota-client"
+
+// download budget of a run in bytes and time, 0 for unlimited. Files
+// received within the budget are staged in <statedir>/staging for the next
+// runs.
+var budgetbytes int64 = 0
+var budgettime time.Duration = 0
+
+// errbudget is returned by runs that ran out of their download budget
+var errbudget = errors.New("Download budget exhausted, the files received so far are staged for the next run!")
+
+// parent of the per-run scratch directories, "" for $TMPDIR or /tmp
+var tmproot string = ""
+
+// private scratch directory of the running update, "" if none is running.
+// Guarded by scratchmu, it is removed on SIGINT/SIGTERM.
+var scratchdir string = ""
+var scratchmu sync.Mutex
+
+// accept images older than the installed version
+var allowdowngrade bool = false
+
+// reject indices signed longer ago, 0 to only check their signed max-age
+var maxindexage time.Duration = 0
+
+// release channels are only followed with a valid signature of this key if
+// set, and never to an older epoch than seen before
+var channelpubkey ed25519.PublicKey = nil
+
+// manifest sha256 of the image a signed release channel resolved to, the
+// index must match it
+var channelmanifest string = ""
+
+// accept images containing character and block device nodes
+var allowdevices bool = false
+
+// treat setuid/setgid files and symlinks leaving the image root as unsafe
+var nosetuid bool = false
+var noescapingsymlinks bool = false
+
+// policy for unsafe entries (see checkindexentries), "reject" or
+// "sanitize" (drop them, clear setuid/setgid bits, with a warning)
+var unsafepolicy string = "reject"
+
+// policy for duplicate member paths, "last-wins" (like tar extraction, with
+// a warning) or "error"
+var duplicatepolicy string = "last-wins"
+
+// also treat paths differing only in case as duplicates, for images
+// installed to FAT/exFAT partitions
+var caseinsensitive bool = false
+
+// SELinux labels for the assembled image, nil to keep the labels of the
+// image (SCHILY.xattr.security.selinux records)
+var filecontexts []filecontext = nil
+
+// owner of all entries of the assembled image, -1 to keep the image's
+var defaultuid int = -1
+var defaultgid int = -1
+
+// mode bits cleared on all entries of the assembled image
+var installumask int64 = 0
+
+// destinations of image subtrees written separately from <dst> (-split)
+var splits []splitdest = nil
+
+// progress is called while an update is running, total is -1 if unknown
+var progress func(stage string, done int64, total int64) = nil
+
+// getfilehash returns the index hash hb and, if with256, the sha256 hash of
+// the file src
+func getfilehash(src string, hb *hashbackend, with256 bool) (string, string, error) {
+
+	filein, err := os.Open(src)
+	if err != nil {
+		return "", "", err
+	}
+	defer filein.Close()
+
+	h := hb.new()
+	if hb.name == "sha256" || !with256 {
+		if _, err := io.Copy(h, filein); err != nil {
+			return "", "", err
+		}
+		sum := hex.EncodeToString(h.Sum(nil))
+		if !with256 {
+			return sum, "", nil
+		}
+		return sum, sum, nil
+	}
+	h256 := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(h, h256), filein); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), hex.EncodeToString(h256.Sum(nil)), nil
+
+}
+
+// disables the hash cache of reference files (-no-cache)
+var nocache bool = false
+
+// number of reference files hashed in parallel (-workers)
+var hashworkers int = runtime.NumCPU()
+
+// hashcacheentry holds the hashes of a reference file by hash name, valid
+// while its size, mtime and inode are unchanged
+type hashcacheentry struct {
+	Size   int64             `json:"size"`
+	MTime  int64             `json:"mtime"` // ns
+	Inode  uint64            `json:"inode"`
+	Hashes map[string]string `json:"hashes"`
+}
+
+// hashcache keeps the hashes of reference files across runs in
+// <statedir>/hashcache.json, unchanged files are not read and hashed again.
+// Only the entries used by a run are kept. It is shared by the hashing
+// workers.
+type hashcache struct {
+	mu      sync.Mutex
+	entries map[string]hashcacheentry
+	used    map[string]hashcacheentry
+	start   time.Time
+}
+
+// loadhashcache returns the hash cache, nil if disabled
+func loadhashcache() *hashcache {
+
+	if statedir == "" || nocache {
+		return nil
+	}
+	c := &hashcache{entries: map[string]hashcacheentry{}, used: map[string]hashcacheentry{}, start: time.Now()}
+	data, err := ioutil.ReadFile(path.Join(statedir, "hashcache.json"))
+	if err == nil {
+		err = json.Unmarshal(data, &c.entries)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		slog.Debug("hash cache discarded", "error", err)
+		c.entries = map[string]hashcacheentry{}
+	}
+	return c
+}
+
+// metadata returns the entry for the file with the info fi, without hashes
+func (c *hashcache) metadata(fi os.FileInfo) hashcacheentry {
+
+	e := hashcacheentry{Size: fi.Size(), MTime: fi.ModTime().UnixNano()}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		e.Inode = st.Ino
+	}
+	return e
+}
+
+// lookup returns the cached hashes of the file fname with the info fi, nil
+// if the file changed or is not known
+func (c *hashcache) lookup(fname string, fi os.FileInfo) map[string]string {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, found := c.entries[fname]
+	m := c.metadata(fi)
+	if !found || e.Size != m.Size || e.MTime != m.MTime || e.Inode != m.Inode {
+		return nil
+	}
+	c.used[fname] = e
+	return e.Hashes
+}
+
+// add caches hashes of the file fname with the info fi, taken before
+// hashing. Files modified shortly before the run are not cached, they may
+// change again without a different mtime.
+func (c *hashcache) add(fname string, fi os.FileInfo, hashes map[string]string) {
+
+	if !fi.ModTime().Before(c.start.Add(-2 * time.Second)) {
+		return
+	}
+	e := c.metadata(fi)
+	e.Hashes = hashes
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, found := c.used[fname]; found && old.Size == e.Size && old.MTime == e.MTime && old.Inode == e.Inode {
+		for name, sum := range old.Hashes {
+			if _, found := e.Hashes[name]; !found {
+				e.Hashes[name] = sum
+			}
+		}
+	}
+	c.used[fname] = e
+}
+
+// save persists the entries used by the run
+func (c *hashcache) save() error {
+
+	c.mu.Lock()
+	data, err := json.Marshal(c.used)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(statedir, 0755); err != nil {
+		return err
+	}
+	tmpfile, err := ioutil.TempFile(statedir, "hashcache-")
+	if err != nil {
+		return err
+	}
+	_, err = tmpfile.Write(data)
+	if cerr := tmpfile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpfile.Name(), path.Join(statedir, "hashcache.json"))
+	}
+	if err != nil {
+		os.Remove(tmpfile.Name())
+	}
+	return err
+}
+
+// hashbackend is a hash for the file contents in the index
+type hashbackend struct {
+	name string
+	new  func() hash.Hash
+}
+
+// hashbackends are the supported index hashes, sha1 is the default of
+// protocol version 1
+var hashbackends = []hashbackend{
+	{"sha1", sha1.New},
+	{"sha256", sha256.New},
+	{"blake3", newblake3},
+}
+
+// hashbackendbyname returns the index hash name, nil if unsupported
+func hashbackendbyname(name string) *hashbackend {
+
+	if fips && name != "sha256" {
+		return nil
+	}
+	for i := range hashbackends {
+		if hashbackends[i].name == name {
+			return &hashbackends[i]
+		}
+	}
+	return nil
+}
+
+// indexhash returns the name of the index hash, the "OTA.hash" record
+func indexhash(records map[string]string) string {
+
+	if name := records["OTA.hash"]; name != "" {
+		return name
+	}
+	return "sha1"
+}
+
+// time to hash hashbenchmarksize bytes by hash name, measured once
+var hashtimes map[string]time.Duration
+var hashtimesonce sync.Once
+
+const hashbenchmarksize = 4 << 20
+
+// fastesthash returns the fastest of the index hashes names on this
+// device, for "-hash auto". The sha256 of local files is computed as well
+// when verifying images.
+func fastesthash(names []string) string {
+
+	hashtimesonce.Do(func() {
+		hashtimes = map[string]time.Duration{}
+		data := make([]byte, hashbenchmarksize)
+		for _, hb := range hashbackends {
+			if hashbackendbyname(hb.name) == nil {
+				continue
+			}
+			start := time.Now()
+			h := hb.new()
+			h.Write(data)
+			h.Sum(nil)
+			hashtimes[hb.name] = time.Since(start)
+			slog.Debug("hash benchmark", "hash", hb.name, "mb_per_s", int(float64(hashbenchmarksize)/1e6/hashtimes[hb.name].Seconds()))
+		}
+	})
+
+	verifying := pubkey != nil || keyring != nil || tufrootfile != ""
+	best := "sha1"
+	if fips {
+		best = "sha256"
+	}
+	var bestcost time.Duration = -1
+	for _, name := range names {
+		cost, found := hashtimes[name]
+		if !found {
+			continue
+		}
+		if verifying && name != "sha256" {
+			cost += hashtimes["sha256"]
+		}
+		if bestcost < 0 || cost < bestcost {
+			best, bestcost = name, cost
+		}
+	}
+	return best
+}
+
+// BLAKE3 (https://github.com/BLAKE3-team/BLAKE3-specs), unkeyed with 32
+// byte output. Complete subtrees of 1024 chunks are hashed in parallel.
+const (
+	blake3blocklen   = 64
+	blake3chunklen   = 1024
+	blake3subtreelen = 1024 * blake3chunklen
+
+	blake3chunkstart = 1 << 0
+	blake3chunkend   = 1 << 1
+	blake3parent     = 1 << 2
+	blake3root       = 1 << 3
+)
+
+var blake3iv = [8]uint32{0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19}
+
+var blake3permutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func blake3g(s *[16]uint32, a, b, c, d int, mx, my uint32) {
+
+	s[a] += s[b] + mx
+	s[d] = bits.RotateLeft32(s[d]^s[a], -16)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -12)
+	s[a] += s[b] + my
+	s[d] = bits.RotateLeft32(s[d]^s[a], -8)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -7)
+}
+
+// blake3compress returns the first 8 words of the compression function
+// output, all that is needed for 32 byte hashes
+func blake3compress(cv *[8]uint32, block *[16]uint32, counter uint64, blocklen uint32, flags uint32) [8]uint32 {
+
+	s := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		blake3iv[0], blake3iv[1], blake3iv[2], blake3iv[3],
+		uint32(counter), uint32(counter >> 32), blocklen, flags,
+	}
+	m := *block
+	for round := 0; round < 7; round++ {
+		blake3g(&s, 0, 4, 8, 12, m[0], m[1])
+		blake3g(&s, 1, 5, 9, 13, m[2], m[3])
+		blake3g(&s, 2, 6, 10, 14, m[4], m[5])
+		blake3g(&s, 3, 7, 11, 15, m[6], m[7])
+		blake3g(&s, 0, 5, 10, 15, m[8], m[9])
+		blake3g(&s, 1, 6, 11, 12, m[10], m[11])
+		blake3g(&s, 2, 7, 8, 13, m[12], m[13])
+		blake3g(&s, 3, 4, 9, 14, m[14], m[15])
+		var p [16]uint32
+		for i := range p {
+			p[i] = m[blake3permutation[i]]
+		}
+		m = p
+	}
+	var out [8]uint32
+	for i := range out {
+		out[i] = s[i] ^ s[i+8]
+	}
+	return out
+}
+
+// blake3output is a compression not done yet, it is either a chaining
+// value or the root
+type blake3output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blocklen uint32
+	flags    uint32
+}
+
+func (o *blake3output) chainingvalue() [8]uint32 {
+
+	return blake3compress(&o.cv, &o.block, o.counter, o.blocklen, o.flags)
+}
+
+func (o *blake3output) root() []byte {
+
+	words := blake3compress(&o.cv, &o.block, 0, o.blocklen, o.flags|blake3root)
+	out := make([]byte, 32)
+	for i, w := range words {
+		binary.LittleEndian.PutUint32(out[4*i:], w)
+	}
+	return out
+}
+
+func blake3parentoutput(left, right [8]uint32) blake3output {
+
+	o := blake3output{cv: blake3iv, blocklen: blake3blocklen, flags: blake3parent}
+	copy(o.block[:8], left[:])
+	copy(o.block[8:], right[:])
+	return o
+}
+
+// blake3chunk hashes the chunk number counter, the last block is kept for
+// output
+type blake3chunk struct {
+	cv       [8]uint32
+	counter  uint64
+	block    [blake3blocklen]byte
+	blocklen int
+	blocks   int // compressed
+}
+
+func newblake3chunk(counter uint64) blake3chunk {
+
+	return blake3chunk{cv: blake3iv, counter: counter}
+}
+
+func (c *blake3chunk) len() int {
+
+	return c.blocks*blake3blocklen + c.blocklen
+}
+
+func (c *blake3chunk) flags() uint32 {
+
+	if c.blocks == 0 {
+		return blake3chunkstart
+	}
+	return 0
+}
+
+func (c *blake3chunk) words() [16]uint32 {
+
+	var m [16]uint32
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint32(c.block[4*i:])
+	}
+	return m
+}
+
+func (c *blake3chunk) update(p []byte) {
+
+	for len(p) > 0 {
+		if c.blocklen == blake3blocklen {
+			m := c.words()
+			c.cv = blake3compress(&c.cv, &m, c.counter, blake3blocklen, c.flags())
+			c.blocks++
+			c.block = [blake3blocklen]byte{}
+			c.blocklen = 0
+		}
+		n := copy(c.block[c.blocklen:], p)
+		c.blocklen += n
+		p = p[n:]
+	}
+}
+
+func (c *blake3chunk) output() blake3output {
+
+	return blake3output{cv: c.cv, block: c.words(), counter: c.counter, blocklen: uint32(c.blocklen), flags: c.flags() | blake3chunkend}
+}
+
+// blake3subtree returns the chaining value of a complete subtree of
+// blake3subtreelen bytes starting with chunk number counter
+func blake3subtree(data []byte, counter uint64) [8]uint32 {
+
+	cvs := make([][8]uint32, 0, blake3subtreelen/blake3chunklen)
+	for i := 0; i < len(data); i += blake3chunklen {
+		c := newblake3chunk(counter)
+		c.update(data[i : i+blake3chunklen])
+		o := c.output()
+		cvs = append(cvs, o.chainingvalue())
+		counter++
+	}
+	for len(cvs) > 1 {
+		for i := 0; i < len(cvs)/2; i++ {
+			o := blake3parentoutput(cvs[2*i], cvs[2*i+1])
+			cvs[i] = o.chainingvalue()
+		}
+		cvs = cvs[:len(cvs)/2]
+	}
+	return cvs[0]
+}
+
+// blake3 implements hash.Hash. Input is buffered until complete subtrees
+// followed by more input are available, the root is always hashed in Sum.
+type blake3 struct {
+	buf      []byte
+	stack    [][8]uint32 // chaining values of complete subtrees
+	subtrees uint64
+}
+
+func newblake3() hash.Hash {
+
+	return &blake3{}
+}
+
+func (h *blake3) Size() int      { return 32 }
+func (h *blake3) BlockSize() int { return blake3blocklen }
+
+func (h *blake3) Reset() {
+
+	h.buf = h.buf[:0]
+	h.stack = h.stack[:0]
+	h.subtrees = 0
+}
+
+func (h *blake3) Write(p []byte) (int, error) {
+
+	h.buf = append(h.buf, p...)
+	if len(h.buf) > runtime.GOMAXPROCS(0)*blake3subtreelen {
+		n := (len(h.buf) - 1) / blake3subtreelen
+		for _, cv := range blake3subtrees(h.buf[:n*blake3subtreelen], h.subtrees) {
+			h.subtrees++
+			h.stack = blake3push(h.stack, cv, h.subtrees)
+		}
+		h.buf = h.buf[:copy(h.buf, h.buf[n*blake3subtreelen:])]
+	}
+	return len(p), nil
+}
+
+// blake3subtrees returns the chaining values of the complete subtrees in
+// data, hashed in parallel, starting with subtree number first
+func blake3subtrees(data []byte, first uint64) [][8]uint32 {
+
+	cvs := make([][8]uint32, len(data)/blake3subtreelen)
+	var wg sync.WaitGroup
+	for i := range cvs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cvs[i] = blake3subtree(data[i*blake3subtreelen:(i+1)*blake3subtreelen], (first+uint64(i))*blake3subtreelen/blake3chunklen)
+		}(i)
+	}
+	wg.Wait()
+	return cvs
+}
+
+// blake3push adds the chaining value of the nth chunk (or subtree of
+// chunks) to the stack, merging completed parents
+func blake3push(stack [][8]uint32, cv [8]uint32, n uint64) [][8]uint32 {
+
+	for n&1 == 0 {
+		o := blake3parentoutput(stack[len(stack)-1], cv)
+		cv = o.chainingvalue()
+		stack = stack[:len(stack)-1]
+		n >>= 1
+	}
+	return append(stack, cv)
+}
+
+func (h *blake3) Sum(b []byte) []byte {
+
+	// the buffered rest on a copy of the stack, the last subtree chunk by
+	// chunk as it may hold the root
+	stack := append([][8]uint32{}, h.stack...)
+	subtrees := h.subtrees
+	rest := h.buf
+	if len(rest) > blake3subtreelen {
+		n := (len(rest) - 1) / blake3subtreelen
+		for _, cv := range blake3subtrees(rest[:n*blake3subtreelen], subtrees) {
+			subtrees++
+			stack = blake3push(stack, cv, subtrees)
+		}
+		rest = rest[n*blake3subtreelen:]
+	}
+	counter := subtrees * blake3subtreelen / blake3chunklen
+	chunk := newblake3chunk(counter)
+	chunks := uint64(0)
+	for p := rest; len(p) > 0; {
+		if chunk.len() == blake3chunklen {
+			o := chunk.output()
+			chunks++
+			stack = blake3push(stack, o.chainingvalue(), counter+chunks)
+			chunk = newblake3chunk(counter + chunks)
+		}
+		n := blake3chunklen - chunk.len()
+		if n > len(p) {
+			n = len(p)
+		}
+		chunk.update(p[:n])
+		p = p[n:]
+	}
+
+	o := chunk.output()
+	for i := len(stack) - 1; i >= 0; i-- {
+		o = blake3parentoutput(stack[i], o.chainingvalue())
+	}
+	return append(b, o.root()...)
+}
+
+// parsepins parses the -pin-sha256 argument, a comma separated list of
+// base64 (optionally prefixed "sha256//", like curl) or hex sha256 hashes
+func parsepins(arg string) ([][]byte, error) {
+
+	var hashes [][]byte
+	for _, pin := range strings.Split(arg, ",") {
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256//")
+		hash, err := hex.DecodeString(pin)
+		if err != nil {
+			hash, err = base64.StdEncoding.DecodeString(pin)
+		}
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid public key pin %s", pin)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// pinned reports if the public key of cert is one of pins
+func pinned(cert *x509.Certificate) bool {
+
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if bytes.Equal(pin, hash[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyservercert verifies the server certificate chain against roots (nil
+// for the system trust store) like the default tls verification, but
+// accepts certificates that are only outside of their validity window
+// because of a device clock off by up to maxclockskew. With pins the public
+// key of the server certificate must be pinned, which replaces the chain
+// verification unless roots is set.
+func verifyservercert(cs tls.ConnectionState, roots *x509.CertPool) error {
+
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server did not present a certificate")
+	}
+
+	if pins != nil {
+		if !pinned(cs.PeerCertificates[0]) {
+			return errors.New("server public key does not match -pin-sha256")
+		}
+		if roots == nil {
+			return nil
+		}
+	}
+
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+		Roots:         roots,
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	now := time.Now()
+	var nowerr error
+	for _, t := range []time.Time{now, now.Add(-maxclockskew), now.Add(maxclockskew)} {
+		opts.CurrentTime = t
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		if err == nil {
+			if t != now {
+				slog.Debug("certificate accepted with clock skew", "skew", t.Sub(now))
+			}
+			return nil
+		}
+		if nowerr == nil {
+			nowerr = err
+		}
+		var cie x509.CertificateInvalidError
+		if !errors.As(err, &cie) || cie.Reason != x509.Expired {
+			// only the validity window is subject to the skew tolerance
+			return err
+		}
+	}
+	// report the result for the actual clock
+	return nowerr
+}
+
+// clientversion is reported in the User-Agent, set at build time with
+// -ldflags "-X main.clientversion=<version>"
+var clientversion string = "devel"
+
+// useragent is sent with every request, defaultuseragent() if empty
+var useragent string = ""
+
+// identity of the device sent with every request as X-Device-Id and
+// X-Hardware-Revision, not sent if empty. The server does not verify them,
+// they are for logging and targeting.
+var deviceid string = ""
+var hardwarerevision string = ""
+
+// extra headers sent with every request, e.g. for custom auth schemes,
+// tracing or CDN tokens
+var requestheaders = http.Header{}
+
+// headerflags collects the repeated -header flags, one "Name: value" each
+type headerflags []string
+
+func (h *headerflags) String() string {
+	return strings.Join(*h, "\n")
+}
+
+// Set adds the headers of s, multiple headers are separated by newlines
+// (as passed to the fetch helper)
+func (h *headerflags) Set(s string) error {
+
+	for _, line := range strings.Split(s, "\n") {
+		if err := addheader(line); err != nil {
+			return err
+		}
+		*h = append(*h, line)
+	}
+	return nil
+}
+
+// addheader adds a "Name: value" header to requestheaders
+func addheader(line string) error {
+
+	name, value, found := strings.Cut(line, ":")
+	name = strings.TrimSpace(name)
+	if !found || name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("invalid header %q, expected \"Name: value\"", line)
+	}
+	requestheaders.Add(name, strings.TrimSpace(value))
+	return nil
+}
+
+// loadheaders adds the headers of a file, one "Name: value" per line (#
+// for comments), for values which must not show up in the process list
+func loadheaders(fname string) error {
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := addheader(line); err != nil {
+			return fmt.Errorf("%s:%d: %s", fname, i+1, err)
+		}
+	}
+	return nil
+}
+
+// devicemodel returns the model of the device from the device tree or the
+// DMI product name, "" if unknown
+func devicemodel() string {
+
+	for _, fname := range []string{"/sys/firmware/devicetree/base/model", "/sys/devices/virtual/dmi/id/product_name"} {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			continue
+		}
+		model := strings.TrimSpace(strings.TrimRight(string(data), "\x00"))
+		if model != "" {
+			return model
+		}
+	}
+	return ""
+}
+
+// defaultuseragent returns "ota-client/<version> (<os>/<arch>; <model>)"
+func defaultuseragent() string {
+
+	system := runtime.GOOS + "/" + runtime.GOARCH
+	if model := devicemodel(); model != "" {
+		system += "; " + strings.Map(func(r rune) rune {
+			if r < 0x20 || r == 0x7f || r == '(' || r == ')' {
+				return -1
+			}
+			return r
+		}, model)
+	}
+	return fmt.Sprintf("ota-client/%s (%s)", clientversion, system)
+}
+
+// headertransport sets the User-Agent, the device identity, the installed
+// version and the extra headers of all requests
+type headertransport struct {
+	rt http.RoundTripper
+}
+
+func (t *headertransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	req = req.Clone(req.Context())
+	ua := useragent
+	if ua == "" {
+		ua = defaultuseragent()
+	}
+	req.Header.Set("User-Agent", ua)
+	if deviceid != "" {
+		req.Header.Set("X-Device-Id", deviceid)
+	}
+	if hardwarerevision != "" {
+		req.Header.Set("X-Hardware-Revision", hardwarerevision)
+	}
+	// read for every request, a daemon installs new versions
+	if statedir != "" {
+		if version, found, err := installedversion(); err == nil && found {
+			req.Header.Set("X-Current-Version", strconv.FormatUint(version, 10))
+		}
+	}
+	for name, values := range requestheaders {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	start := time.Now()
+	resp, err := t.rt.RoundTrip(req)
+	if err == nil {
+		slog.Debug("request", "method", req.Method, "url", redacted(req.URL.String()), "status", resp.StatusCode,
+			"request_id", resp.Header.Get("X-Request-ID"), "duration", time.Since(start).Seconds())
+	}
+	return resp, err
+}
+
+// tlsproxies dials the connections to https proxies, with TLS verified
+// by the system CAs: the certificates, CAs and pins of the client are for
+// the server. The transport sees them as http proxies, so CONNECT and
+// forwarded requests are sent through the TLS connection.
+type tlsproxies struct {
+	proxy func(*http.Request) (*url.URL, error)
+	dial  func(ctx context.Context, network string, addr string) (net.Conn, error)
+	addrs sync.Map // host:port of https proxies
+}
+
+func (p *tlsproxies) Proxy(req *http.Request) (*url.URL, error) {
+
+	u, err := p.proxy(req)
+	if err != nil || u == nil || u.Scheme != "https" {
+		return u, err
+	}
+	plain := *u
+	plain.Scheme = "http"
+	if u.Port() == "" {
+		plain.Host = net.JoinHostPort(u.Hostname(), "443")
+	}
+	p.addrs.Store(plain.Host, u.Hostname())
+	return &plain, nil
+}
+
+func (p *tlsproxies) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+
+	name, found := p.addrs.Load(addr)
+	if !found {
+		return p.dial(ctx, network, addr)
+	}
+	config := &tls.Config{ServerName: name.(string)}
+	if fips {
+		config.MinVersion = tls.VersionTLS12
+	}
+	conn, err := p.dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsconn := tls.Client(conn, config)
+	if err := tlsconn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %s", addr, err)
+	}
+	return tlsconn, nil
+}
+
+// newhttpclient returns the client for all requests. Proxies are taken from
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY, which -proxy sets.
+func newhttpclient() (*http.Client, error) {
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	proxies := &tlsproxies{proxy: transport.Proxy, dial: (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext}
+	transport.Proxy = proxies.Proxy
+	transport.DialContext = proxies.DialContext
+	transport.TLSClientConfig = &tls.Config{}
+	if fips {
+		transport.TLSClientConfig.MinVersion = tls.VersionTLS12
+	}
+
+	if certfile != "" {
+		cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	var roots *x509.CertPool
+	if cacertfile != "" {
+		pem, err := ioutil.ReadFile(cacertfile)
+		if err != nil {
+			return nil, err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", cacertfile)
+		}
+		transport.TLSClientConfig.RootCAs = roots
+	}
+
+	if maxclockskew > 0 || pins != nil {
+		// disable the built-in verification, verifyservercert does the
+		// same checks with a relaxed clock and checks the pins
+		transport.TLSClientConfig.InsecureSkipVerify = true
+		transport.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyservercert(cs, roots)
+		}
+	}
+
+	return &http.Client{Transport: &headertransport{rt: transport}}, nil
+}
+
+// refmount maps a mount point of the device to the directory holding the
+// reference files for everything below it
+type refmount struct {
+	dir    string // mount point
+	source string // reference directory, "" if the mount has no reference files
+}
+
+// filesystems that never contain files of an installed image
+var volatilefstypes = map[string]bool{
+	"autofs": true, "binfmt_misc": true, "bpf": true, "cgroup": true,
+	"cgroup2": true, "configfs": true, "debugfs": true, "devpts": true,
+	"devtmpfs": true, "efivarfs": true, "fusectl": true, "hugetlbfs": true,
+	"mqueue": true, "nsfs": true, "proc": true, "pstore": true,
+	"ramfs": true, "rpc_pipefs": true, "securityfs": true, "selinuxfs": true,
+	"sysfs": true, "tmpfs": true, "tracefs": true,
+}
+
+// unescapemount decodes the octal escapes (e.g. "\040" for space) used in
+// /proc/mounts
+func unescapemount(s string) string {
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// autorefs derives the reference directories from the mount table: the
+// booted root filesystem is the reference, for an overlay root its read-only
+// lower layer is used, and pseudo or volatile filesystems are excluded
+func autorefs(mountsfile string) ([]refmount, error) {
+
+	data, err := ioutil.ReadFile(mountsfile)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := []refmount{{dir: "/", source: "/"}}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		dir := path.Clean(unescapemount(fields[1]))
+		fstype := fields[2]
+
+		ref := refmount{dir: dir, source: dir}
+		if volatilefstypes[fstype] {
+			ref.source = ""
+		} else if fstype == "overlay" {
+			for _, option := range strings.Split(fields[3], ",") {
+				if !strings.HasPrefix(option, "lowerdir=") {
+					continue
+				}
+				lowerdir := unescapemount(strings.TrimPrefix(option, "lowerdir="))
+				if strings.Contains(lowerdir, ":") {
+					// stacked layers, no single pristine copy
+					break
+				}
+				if fi, err := os.Stat(lowerdir); err == nil && fi.IsDir() {
+					ref.source = lowerdir
+				}
+			}
+		}
+
+		// later mounts hide earlier ones on the same mount point
+		replaced := false
+		for i := range refs {
+			if refs[i].dir == dir {
+				refs[i] = ref
+				replaced = true
+			}
+		}
+		if !replaced {
+			refs = append(refs, ref)
+		}
+	}
+
+	return refs, nil
+}
+
+// resolveref returns the reference file for the image entry name, false if
+// there is no reference for this path
+func resolveref(refs []refmount, name string) (string, bool) {
+
+	fname := path.Clean("/" + name)
+
+	var best *refmount
+	for i := range refs {
+		dir := refs[i].dir
+		if dir == "/" || fname == dir || strings.HasPrefix(fname, dir+"/") {
+			if best == nil || len(dir) > len(best.dir) {
+				best = &refs[i]
+			}
+		}
+	}
+	if best == nil || best.source == "" {
+		return "", false
+	}
+
+	rel := strings.TrimPrefix(fname, best.dir)
+	return path.Join(best.source, rel), true
+}
+
+// transport moves the protocol messages between the client and the image
+// server. The diff and assembly logic in update only depends on this
+// interface, so the protocol can be routed over other links than http.
+type transport interface {
+	// getindex returns the index tgz of the image
+	getindex() (io.ReadCloser, error)
+	// postdiff sends the gzipped request bitmap and returns the diff tgz.
+	// params are the gzip delta parameters (see gzipdeltaparams), nil if
+	// there are none.
+	postdiff(bitmap io.Reader, params url.Values) (io.ReadCloser, error)
+	// getmetadata returns a TUF metadata file, errmetanotfound if the
+	// server has none with this name
+	getmetadata(name string) (io.ReadCloser, error)
+}
+
+// httptransport talks to server.go over http or https
+type httptransport struct {
+	client *http.Client
+	url    string
+
+	// server capabilities, fetched once per session
+	caps *capabilities
+
+	// token of the last index response, sent with the diff request based
+	// on it
+	indextoken string
+}
+
+// header of index responses and diff requests with the index token
+const indextokenheader = "OTA-Index-Token"
+
+// wire format version of the index and diff protocol implemented by the
+// client, see README.md
+const protocolversion = 1
+
+// capabilities describes the protocol versions and optional features of a
+// server
+type capabilities struct {
+	Protocols    []int    `json:"protocols"`
+	Hashes       []string `json:"hashes"`
+	Compressions []string `json:"compressions"`
+	MaxRequest   int64    `json:"max_request"`
+	Features     []string `json:"features"`
+	Auth         []string `json:"auth"`
+}
+
+// has reports whether the server supports an optional feature
+func (c *capabilities) has(feature string) bool {
+
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// hashes reports whether the server supports an index hash
+func (c *capabilities) hashes(name string) bool {
+
+	for _, h := range c.Hashes {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+// getcapabilities fetches the capabilities of the server from
+// <image dir>/capabilities. Servers without capability discovery are
+// assumed to speak protocol version 1 without optional features.
+func (t *httptransport) getcapabilities() (*capabilities, error) {
+
+	if t.caps != nil {
+		return t.caps, nil
+	}
+
+	u, err := url.Parse(t.url)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.send(http.MethodGet, u.ResolveReference(&url.URL{Path: "capabilities"}).String(), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	caps := &capabilities{Protocols: []int{1}}
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(caps); err != nil {
+			return nil, fmt.Errorf("invalid server capabilities: %s", err)
+		}
+	}
+
+	supported := false
+	for _, v := range caps.Protocols {
+		supported = supported || v == protocolversion
+	}
+	if !supported {
+		return nil, fmt.Errorf("server does not support protocol version %d (supports %v)", protocolversion, caps.Protocols)
+	}
+
+	slog.Debug("server features", "features", strings.Join(caps.Features, " "))
+	t.caps = caps
+	return caps, nil
+}
+
+// send sends a request with the configured credentials
+func (t *httptransport) send(method string, u string, body io.Reader, header http.Header) (*http.Response, error) {
+
+	// buffer the body to repeat the request with a new token
+	var data []byte
+	if body != nil && tokens.enabled() {
+		var err error
+		data, err = ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for refresh := false; ; refresh = true {
+		if data != nil {
+			body = bytes.NewReader(data)
+		}
+		req, err := http.NewRequest(method, u, body)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/octet-stream")
+		}
+		if method == http.MethodPost && t.indextoken != "" {
+			req.Header.Set(indextokenheader, t.indextoken)
+		}
+		if tokens.enabled() {
+			bearer, err := tokens.get(t.client, refresh)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		} else if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else if authuser != "" {
+			req.SetBasicAuth(authuser, authpassword)
+		}
+
+		resp, err := t.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		// the token may have been revoked early, fetch a new one once
+		if resp.StatusCode == http.StatusUnauthorized && tokens.enabled() && !refresh {
+			resp.Body.Close()
+			continue
+		}
+		if indextoken := resp.Header.Get(indextokenheader); indextoken != "" {
+			t.indextoken = indextoken
+		}
+		return resp, nil
+	}
+}
+
+// tokensource fetches bearer tokens from an OAuth2 token endpoint with the
+// client credentials grant (RFC 6749 4.4). Tokens are cached and refreshed
+// when 90% of their lifetime has passed.
+type tokensource struct {
+	url    string
+	id     string
+	secret string
+
+	token  string
+	expiry time.Time
+	issuer string // url and id the cached token was issued for
+}
+
+// enabled reports if tokens are fetched from a token endpoint
+func (s *tokensource) enabled() bool {
+	return s.url != ""
+}
+
+// get returns a valid token, refresh forces fetching a new one
+func (s *tokensource) get(client *http.Client, refresh bool) (string, error) {
+
+	issuer := s.url + "\n" + s.id
+	if !refresh && s.token != "" && s.issuer == issuer && time.Now().Before(s.expiry) {
+		return s.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequest(http.MethodPost, s.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if s.id != "" {
+		// without client id the device authenticates by its certificate
+		req.SetBasicAuth(url.QueryEscape(s.id), url.QueryEscape(s.secret))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed: %s", resp.Status)
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return "", fmt.Errorf("invalid token response: %s", err)
+	}
+	if result.AccessToken == "" {
+		return "", errors.New("invalid token response: no access_token")
+	}
+	if result.TokenType != "" && strings.EqualFold(result.TokenType, "bearer") == false {
+		return "", fmt.Errorf("unsupported token type %s", result.TokenType)
+	}
+
+	lifetime := 5 * time.Minute
+	if result.ExpiresIn > 0 {
+		lifetime = time.Duration(result.ExpiresIn) * time.Second
+	}
+	s.token = result.AccessToken
+	s.expiry = time.Now().Add(lifetime - lifetime/10)
+	s.issuer = issuer
+
+	slog.Debug("token fetched", "lifetime", lifetime)
+	return s.token, nil
+}
+
+// withquery returns the image url with the parameters query added
+func (t *httptransport) withquery(query url.Values) (string, error) {
+
+	if len(query) == 0 {
+		return t.url, nil
+	}
+	u, err := url.Parse(t.url)
+	if err != nil {
+		return "", err
+	}
+	values := u.Query()
+	for k, v := range query {
+		values[k] = v
+	}
+	u.RawQuery = values.Encode()
+	return u.String(), nil
+}
+
+// do sends a request to the image url with the parameters query and
+// returns the body of a 200 response
+func (t *httptransport) do(method string, query url.Values, body io.Reader) (io.ReadCloser, error) {
+
+	u, err := t.withquery(query)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.send(method, u, body, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s request failed: %s", method, resp.Status)
+	}
+	return &lengthbody{ReadCloser: resp.Body, length: resp.ContentLength}, nil
+}
+
+// changed reports if the index of the image differs from the one with the
+// ETag etag and returns its current ETag. It asks with HEAD, so the server
+// does not generate the index, and with a conditional GET for the full
+// index on servers without HEAD support.
+func (t *httptransport) changed(etag string) (string, bool, error) {
+
+	var header http.Header
+	if etag != "" {
+		header = http.Header{"If-None-Match": {etag}}
+	}
+	method := http.MethodHead
+	resp, err := t.send(method, t.url, nil, header)
+	if err == nil && resp.StatusCode == http.StatusMethodNotAllowed {
+		resp.Body.Close()
+		method = http.MethodGet
+		resp, err = t.send(method, t.url, nil, header)
+	}
+	if err != nil {
+		return "", false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return etag, false, nil
+	case http.StatusOK:
+		return resp.Header.Get("ETag"), true, nil
+	}
+	return "", false, fmt.Errorf("%s request failed: %s", method, resp.Status)
+}
+
+func (t *httptransport) getindex() (io.ReadCloser, error) {
+	caps, err := t.getcapabilities()
+	if err != nil {
+		return nil, err
+	}
+	if caps.has("encrypted-payloads") && payloadkey == nil {
+		return nil, errors.New("server encrypts payloads, a payload key is required")
+	}
+	base, err := loadindexbase()
+	if err != nil {
+		slog.Debug("no index delta", "error", err)
+	}
+	if !caps.has("delta-index") {
+		base = nil
+	}
+	hashname := indexhashname
+	if hashname == "auto" {
+		hashname = fastesthash(caps.Hashes)
+	}
+	if fips && hashname == "sha1" {
+		hashname = "sha256"
+	}
+	if hashname != "sha1" && !caps.hashes(hashname) {
+		if fips {
+			return nil, fmt.Errorf("Server does not support the %s index hash required in FIPS mode!", hashname)
+		}
+		slog.Debug("server does not support the hash, using sha1", "hash", hashname)
+		hashname = "sha1"
+	}
+	if base != nil || hashname != "sha1" {
+		return t.getindexdelta(base, hashname)
+	}
+	body, err := t.do(http.MethodGet, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decryptpayload(body)
+}
+
+// getindexdelta requests the index with the index hash hashname, as delta
+// against the kept index base if not nil, and returns the rebuilt index
+// tgz. Servers answer with the full index if they do not have the base.
+func (t *httptransport) getindexdelta(base *indexbase, hashname string) (io.ReadCloser, error) {
+
+	u, err := url.Parse(t.url)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	if base != nil {
+		query.Set("base", base.Image)
+		query.Set("base-sha256", base.SHA256)
+	}
+	if hashname != "sha1" {
+		query.Set("hash", hashname)
+	}
+	u.RawQuery = query.Encode()
+
+	resp, err := t.send(http.MethodGet, u.String(), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET request failed: %s", resp.Status)
+	}
+	body, err := decryptpayload(&lengthbody{ReadCloser: resp.Body, length: resp.ContentLength})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.Get("Content-Type") != deltacontenttype || base == nil {
+		return body, nil
+	}
+	slog.Debug("index delta", "base", base.Image)
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer body.Close()
+		archiveout, _ := gzip.NewWriterLevel(pw, gzip.BestSpeed)
+		err := applyindexdelta(archiveout, body)
+		if err == nil {
+			err = archiveout.Close()
+		}
+		if err != nil {
+			// the next update requests the full index
+			removeindexbase()
+			err = fmt.Errorf("index delta: %s", err)
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+func (t *httptransport) postdiff(bitmap io.Reader, params url.Values) (io.ReadCloser, error) {
+	caps, err := t.getcapabilities()
+	if err != nil {
+		return nil, err
+	}
+	if !caps.has("gzip-delta") {
+		params = nil
+	}
+	var body io.ReadCloser
+	if asyncdiff && caps.has("async") {
+		body, err = t.postdiffasync(bitmap, params)
+	} else {
+		if asyncdiff {
+			slog.Info("server does not support async diffs, downloading directly")
+		}
+		body, err = t.postdiffsync(bitmap, params)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decryptpayload(body)
+}
+
+// simulatediff asks the server for the size of the diff of the gzipped
+// request bitmap
+func (t *httptransport) simulatediff(bitmap io.Reader) (*diffstats, error) {
+
+	caps, err := t.getcapabilities()
+	if err != nil {
+		return nil, err
+	}
+	if !caps.has("simulate") {
+		return nil, errors.New("server does not simulate diffs")
+	}
+	body, err := t.do(http.MethodPost, url.Values{"simulate": {""}}, bitmap)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	stats := &diffstats{}
+	if err := json.NewDecoder(body).Decode(stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// getmetadata fetches TUF metadata from <dir>/tuf/ of the image url
+func (t *httptransport) getmetadata(name string) (io.ReadCloser, error) {
+
+	u, err := url.Parse(t.url)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(path.Dir(u.Path), "tuf", name)
+	u.RawQuery = ""
+
+	resp, err := t.send(http.MethodGet, u.String(), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errmetanotfound
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET request of %s failed: %s", name, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// encrypted payloads, the format must match server.go (see README.md)
+const payloadmagic = "OTAGCM1\n"
+const payloadchunk = 64 * 1024
+
+// parsepayloadkey decodes an AES-256 payload key given as 64 hex digits
+func parsepayloadkey(hexkey string) ([]byte, error) {
+
+	key, err := hex.DecodeString(strings.TrimSpace(hexkey))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("payload key must be 64 hex digits")
+	}
+	return key, nil
+}
+
+// loadpayloadkey reads a payload key file
+func loadpayloadkey(fname string) ([]byte, error) {
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsepayloadkey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fname, err)
+	}
+	return key, nil
+}
+
+// payloadreader decrypts an encrypted index or diff payload on the fly
+type payloadreader struct {
+	body    io.ReadCloser
+	in      *bufio.Reader
+	aead    cipher.AEAD
+	counter uint64
+	buf     []byte // decrypted, not yet read
+	last    bool   // the final chunk was read
+}
+
+// decryptpayload returns a reader of the plaintext of body, if payloadkey
+// is set. Plain payloads are refused then.
+func decryptpayload(body io.ReadCloser) (io.ReadCloser, error) {
+
+	if payloadkey == nil {
+		return body, nil
+	}
+
+	in := bufio.NewReader(body)
+	header := make([]byte, len(payloadmagic)+8+sha256.Size)
+	if _, err := io.ReadFull(in, header); err != nil || string(header[:len(payloadmagic)]) != payloadmagic {
+		body.Close()
+		return nil, errors.New("payload is not encrypted")
+	}
+	keyid := sha256.Sum256(payloadkey)
+	if !bytes.Equal(header[len(payloadmagic):len(payloadmagic)+8], keyid[:8]) {
+		body.Close()
+		return nil, errors.New("payload is encrypted with another key")
+	}
+
+	mac := hmac.New(sha256.New, payloadkey)
+	mac.Write(header[len(payloadmagic)+8:])
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return &payloadreader{body: body, in: in, aead: aead}, nil
+}
+
+func (p *payloadreader) Read(b []byte) (int, error) {
+
+	for len(p.buf) == 0 {
+		if p.last {
+			return 0, io.EOF
+		}
+		length := make([]byte, 4)
+		if _, err := io.ReadFull(p.in, length); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		n := binary.BigEndian.Uint32(length)
+		if n > payloadchunk+uint32(p.aead.Overhead()) {
+			return 0, errors.New("invalid payload chunk")
+		}
+		sealed := make([]byte, n)
+		if _, err := io.ReadFull(p.in, sealed); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		nonce := make([]byte, p.aead.NonceSize())
+		binary.BigEndian.PutUint64(nonce[4:], p.counter)
+		p.counter++
+		plaintext, err := p.aead.Open(nil, nonce, sealed, []byte{0})
+		if err != nil {
+			plaintext, err = p.aead.Open(nil, nonce, sealed, []byte{1})
+			if err != nil {
+				return 0, errors.New("payload decryption failed")
+			}
+			if _, err := p.in.Peek(1); err != io.EOF {
+				return 0, errors.New("trailing data after payload")
+			}
+			p.last = true
+		}
+		p.buf = plaintext
+	}
+
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
+func (p *payloadreader) Close() error {
+	return p.body.Close()
+}
+
+func (p *payloadreader) contentlength() int64 {
+	return contentlength(p.body)
+}
+
+// postdiffsync downloads the diff directly. Servers keeping the diff for
+// resuming send its url in Content-Location, an interrupted download is
+// resumed from it.
+func (t *httptransport) postdiffsync(bitmap io.Reader, params url.Values) (io.ReadCloser, error) {
+
+	u, err := t.withquery(params)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.send(http.MethodPost, u, bitmap, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s request failed: %s", http.MethodPost, resp.Status)
+	}
+	location := resp.Header.Get("Content-Location")
+	if location == "" {
+		return &lengthbody{ReadCloser: resp.Body, length: resp.ContentLength}, nil
+	}
+	resumeurl, err := resp.Request.URL.Parse(location)
+	if err != nil {
+		slog.Debug("invalid resume url", "url", location, "error", err)
+		return &lengthbody{ReadCloser: resp.Body, length: resp.ContentLength}, nil
+	}
+	return &resumingbody{t: t, url: resumeurl.String(), length: resp.ContentLength, body: resp.Body}, nil
+}
+
+// number of attempts to poll a diff job or resume its download
+const maxretries = 5
+
+// postdiffasync lets the server generate the diff as a background job,
+// polls the job until it is done and downloads the diff from it. Lost
+// connections are retried and interrupted downloads resumed.
+func (t *httptransport) postdiffasync(bitmap io.Reader, params url.Values) (io.ReadCloser, error) {
+
+	query := url.Values{"async": {""}}
+	for k, v := range params {
+		query[k] = v
+	}
+	u, err := t.withquery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.send(http.MethodPost, u, bitmap, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return nil, fmt.Errorf("%s request failed: %s", http.MethodPost, resp.Status)
+	}
+	joburl, err := resp.Location()
+	if err != nil {
+		return nil, err
+	}
+
+	failures := 0
+	for {
+		resp, err := t.send(http.MethodGet, joburl.String(), nil, nil)
+		if err != nil {
+			failures++
+			if failures >= maxretries {
+				return nil, err
+			}
+			slog.Debug("polling diff job failed", "error", err)
+			time.Sleep(time.Duration(failures) * 2 * time.Second)
+			continue
+		}
+		failures = 0
+
+		if resp.StatusCode == http.StatusOK {
+			return &resumingbody{t: t, url: joburl.String(), lastmodified: resp.Header.Get("Last-Modified"), length: resp.ContentLength, body: resp.Body}, nil
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			return nil, fmt.Errorf("%s request failed: %s", http.MethodGet, resp.Status)
+		}
+
+		wait := 2 * time.Second
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			wait = time.Duration(seconds) * time.Second
+		}
+		slog.Debug("diff is being prepared", "poll", wait)
+		time.Sleep(wait)
+	}
+}
+
+// resumingbody is the body of a download, which continues with a range
+// request where the connection was lost
+type resumingbody struct {
+	t            *httptransport
+	url          string
+	lastmodified string
+	length       int64 // of the whole download, -1 if unknown
+	body         io.ReadCloser
+	offset       int64
+}
+
+func (b *resumingbody) Read(p []byte) (int, error) {
+
+	n, err := b.body.Read(p)
+	b.offset += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+	b.body.Close()
+
+	for retry := 1; ; retry++ {
+		slog.Debug("download interrupted, resuming", "offset", b.offset, "error", err)
+		rerr := b.resume()
+		if rerr == nil {
+			return n, nil
+		}
+		if retry >= maxretries {
+			return n, err
+		}
+		time.Sleep(time.Duration(retry) * 2 * time.Second)
+	}
+}
+
+// resume requests the rest of the download from offset
+func (b *resumingbody) resume() error {
+
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-", b.offset))
+	if b.lastmodified != "" {
+		// only continue if the job has not been regenerated meanwhile
+		header.Set("If-Range", b.lastmodified)
+	}
+	resp, err := b.t.send(http.MethodGet, b.url, nil, header)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return fmt.Errorf("resume failed: %s", resp.Status)
+	}
+	b.body = resp.Body
+	return nil
+}
+
+func (b *resumingbody) Close() error {
+	return b.body.Close()
+}
+
+func (b *resumingbody) contentlength() int64 {
+	return b.length
+}
+
+// exectransport runs an external command for every request, e.g. a helper
+// that tunnels the protocol over a serial or modem management channel.
+// The command is called with the arguments "index <src>" or "diff <src>",
+// gets the gzipped request bitmap on stdin for diff requests and has to
+// write the response tgz to stdout. With -tuf it is also called with "tuf
+// <src> <name>" to write TUF metadata, and exits with exitmetanotfound if
+// there is none. Secrets are passed in OTA_TOKEN, OTA_PASSWORD,
+// OTA_CLIENT_SECRET and OTA_PAYLOAD_KEY. The index token of the server is
+// written to the file descriptor OTA_INDEX_TOKEN_FD for index requests and
+// passed in OTA_INDEX_TOKEN for diff requests.
+type exectransport struct {
+	command []string
+	src     string
+
+	// run the command as another user, nil to keep the current one
+	credential *syscall.Credential
+
+	// index token, valid once tokenread is closed
+	indextoken string
+	tokenread  chan struct{}
+	extrafiles []*os.File
+
+	// gzip delta parameters of the diff request, url encoded
+	diffparams string
+}
+
+// cmdoutput is the stdout of a running command, Close waits for the command
+// to exit and reports its failure
+type cmdoutput struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (o *cmdoutput) Close() error {
+
+	o.ReadCloser.Close()
+	return o.cmd.Wait()
+}
+
+// exit status of transport commands for missing TUF metadata. It is part
+// of the transport command contract, not one of the exit statuses of the
+// client, and must not collide with them: a command passing on the status
+// of a failed client would otherwise report metadata as missing.
+const exitmetanotfound = 10
+
+func (t *exectransport) run(op string, stdin io.Reader, extra ...string) (io.ReadCloser, error) {
+
+	args := append(append(append([]string{}, t.command[1:]...), op, t.src), extra...)
+	cmd := exec.Command(t.command[0], args...)
+	cmd.Stdin = stdin
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	if token != "" {
+		cmd.Env = append(cmd.Env, "OTA_TOKEN="+token)
+	}
+	if authpassword != "" {
+		cmd.Env = append(cmd.Env, "OTA_PASSWORD="+authpassword)
+	}
+	if tokens.secret != "" {
+		cmd.Env = append(cmd.Env, "OTA_CLIENT_SECRET="+tokens.secret)
+	}
+	if payloadkey != nil {
+		cmd.Env = append(cmd.Env, "OTA_PAYLOAD_KEY="+hex.EncodeToString(payloadkey))
+	}
+	if t.indextoken != "" {
+		cmd.Env = append(cmd.Env, "OTA_INDEX_TOKEN="+t.indextoken)
+	}
+	if t.diffparams != "" {
+		cmd.Env = append(cmd.Env, "OTA_DIFF_PARAMS="+t.diffparams)
+	}
+	if len(t.extrafiles) > 0 {
+		cmd.ExtraFiles = t.extrafiles
+		cmd.Env = append(cmd.Env, "OTA_INDEX_TOKEN_FD=3")
+	}
+	if t.credential != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: t.credential}
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdoutput{stdout, cmd}, nil
+}
+
+func (t *exectransport) getindex() (io.ReadCloser, error) {
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	t.extrafiles = []*os.File{pw}
+	body, err := t.run("index", nil)
+	t.extrafiles = nil
+	pw.Close()
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+
+	// commands not writing a token keep the pipe open until they exit
+	t.tokenread = make(chan struct{})
+	go func() {
+		defer close(t.tokenread)
+		defer pr.Close()
+		data, _ := ioutil.ReadAll(io.LimitReader(pr, 4096))
+		t.indextoken = strings.TrimSpace(string(data))
+	}()
+	return body, nil
+}
+
+func (t *exectransport) postdiff(bitmap io.Reader, params url.Values) (io.ReadCloser, error) {
+
+	if t.tokenread != nil {
+		<-t.tokenread
+	}
+	t.diffparams = params.Encode()
+	return t.run("diff", bitmap)
+}
+
+func (t *exectransport) getmetadata(name string) (io.ReadCloser, error) {
+
+	body, err := t.run("tuf", nil, name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, tufmaxsize+1))
+	cerr := body.Close()
+	var exiterr *exec.ExitError
+	if errors.As(cerr, &exiterr) && exiterr.ExitCode() == exitmetanotfound {
+		return nil, errmetanotfound
+	}
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// lookupcredential returns the ids of a local user to drop privileges to
+func lookupcredential(name string) (*syscall.Credential, error) {
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: []uint32{}}, nil
+}
+
+// privseptransport runs all network communication in a "fetch" helper
+// process of this binary with the privileges of user privsepuser, so the
+// network facing code does not run as root. The calling process only does
+// the file system work.
+func privseptransport(tgzsrc string, privsepuser string) (transport, error) {
+
+	credential, err := lookupcredential(privsepuser)
+	if err != nil {
+		return nil, err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	command := []string{self, "fetch"}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "src", "dst", "ref", "transport-cmd", "privsep-user", "token", "password", "client-secret", "payload-key", "proxy":
+			// not needed by the helper, secrets and the proxy are passed in
+			// the environment
+		default:
+			command = append(command, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+
+	return &exectransport{command: command, src: tgzsrc, credential: credential}, nil
+}
+
+// fetch implements the helper side of exectransport using http: the
+// arguments are "index <src>", "diff <src>" or "tuf <src> <name>", the diff
+// request bitmap is read from stdin and the response is written to stdout
+func fetch(args []string) error {
+
+	if len(args) != 2 && !(len(args) == 3 && args[0] == "tuf") {
+		return errors.New("usage: fetch [flags] index|diff <src> | tuf <src> <name>")
+	}
+
+	// stdout carries the response, send all other output to stderr
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+
+	t, err := newtransport(args[1], "")
+	if err != nil {
+		return err
+	}
+
+	// the index token is passed through exectransport, see there
+	ht, _ := t.(*httptransport)
+	var body io.ReadCloser
+	switch args[0] {
+	case "index":
+		body, err = t.getindex()
+		if fd, ferr := strconv.Atoi(os.Getenv("OTA_INDEX_TOKEN_FD")); err == nil && ferr == nil && ht != nil {
+			tokenout := os.NewFile(uintptr(fd), "index-token")
+			io.WriteString(tokenout, ht.indextoken)
+			tokenout.Close()
+		}
+	case "diff":
+		if ht != nil {
+			ht.indextoken = os.Getenv("OTA_INDEX_TOKEN")
+		}
+		params, _ := url.ParseQuery(os.Getenv("OTA_DIFF_PARAMS"))
+		body, err = t.postdiff(os.Stdin, params)
+	case "tuf":
+		body, err = t.getmetadata(args[2])
+	default:
+		return fmt.Errorf("unknown request %s", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	_, err = io.Copy(stdout, body)
+	return err
+}
+
+// newtransport selects the transport for the image url tgzsrc
+func newtransport(tgzsrc string, transportcmd string) (transport, error) {
+
+	if transportcmd != "" {
+		command := strings.Fields(transportcmd)
+		return &exectransport{command: command, src: tgzsrc}, nil
+	}
+
+	if strings.HasPrefix(tgzsrc, "http://") || strings.HasPrefix(tgzsrc, "https://") {
+		client, err := newhttpclient()
+		if err != nil {
+			return nil, err
+		}
+		return &httptransport{client: client, url: tgzsrc}, nil
+	}
+
+	return nil, fmt.Errorf("no transport for %s", redacted(tgzsrc))
+}
+
+// bundlemeta describes a protocol exchange recorded with -record. The
+// bundle directory holds meta.json, the responses index.tgz and diff.tgz,
+// the request bitmap.gz with its gzip delta parameters diff-params, the
+// manifest rebuilt from the index and the TUF metadata as tuf-<name>.
+type bundlemeta struct {
+	Src      string    `json:"src"` // without credentials and query
+	Image    string    `json:"image"`
+	Recorded time.Time `json:"recorded"`
+}
+
+// readbundlemeta reads meta.json of a recorded bundle
+func readbundlemeta(dir string) (bundlemeta, error) {
+
+	var meta bundlemeta
+	data, err := ioutil.ReadFile(path.Join(dir, "meta.json"))
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+// recordtransport saves the protocol exchange of another transport in a
+// bundle directory, see bundlemeta
+type recordtransport struct {
+	transport
+	dir string
+}
+
+// newrecordtransport starts a new recording of the exchange for tgzsrc
+func newrecordtransport(t transport, dir string, tgzsrc string) (*recordtransport, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"index.tgz", "bitmap.gz", "diff.tgz", "manifest"} {
+		os.Remove(path.Join(dir, name)) // of an earlier recording
+	}
+	if names, err := filepath.Glob(path.Join(dir, "tuf-*")); err == nil {
+		for _, name := range names {
+			os.Remove(name)
+		}
+	}
+
+	src := tgzsrc
+	if u, err := url.Parse(tgzsrc); err == nil {
+		u.User = nil
+		u.RawQuery = ""
+		src = u.String()
+	}
+	meta, err := json.MarshalIndent(bundlemeta{Src: src, Image: imagename(tgzsrc), Recorded: time.Now().UTC()}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "meta.json"), append(meta, '\n'), 0644); err != nil {
+		return nil, err
+	}
+	return &recordtransport{transport: t, dir: dir}, nil
+}
+
+// record stores body in the bundle file name and returns it for reading
+func (t *recordtransport) record(body io.ReadCloser, name string) (io.ReadCloser, error) {
+
+	fname := path.Join(t.dir, name)
+	fileout, err := os.Create(fname)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	_, err = io.Copy(fileout, body)
+	if cerr := body.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := fileout.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(fname)
+}
+
+func (t *recordtransport) getindex() (io.ReadCloser, error) {
+
+	body, err := t.transport.getindex()
+	if err != nil {
+		return nil, err
+	}
+	body, err = t.record(body, "index.tgz")
+	if err != nil {
+		return nil, err
+	}
+
+	// the manifest documents the recorded image independent of the index
+	// encoding
+	indexname := path.Join(t.dir, "index.tgz")
+	records, err := readindexrecords(indexname)
+	if err == nil {
+		var manifest []byte
+		manifest, _, err = buildmanifest(indexname, records)
+		if err == nil {
+			err = ioutil.WriteFile(path.Join(t.dir, "manifest"), manifest, 0644)
+		}
+	}
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return body, nil
+}
+
+func (t *recordtransport) postdiff(bitmap io.Reader, params url.Values) (io.ReadCloser, error) {
+
+	request, err := ioutil.ReadAll(bitmap)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path.Join(t.dir, "bitmap.gz"), request, 0644); err != nil {
+		return nil, err
+	}
+	if len(params) > 0 {
+		if err := ioutil.WriteFile(path.Join(t.dir, "diff-params"), []byte(params.Encode()+"\n"), 0644); err != nil {
+			return nil, err
+		}
+	}
+	body, err := t.transport.postdiff(bytes.NewReader(request), params)
+	if err != nil {
+		return nil, err
+	}
+	return t.record(body, "diff.tgz")
+}
+
+func (t *recordtransport) getmetadata(name string) (io.ReadCloser, error) {
+
+	body, err := t.transport.getmetadata(name)
+	if err != nil {
+		return nil, err
+	}
+	return t.record(body, "tuf-"+name)
+}
+
+// replaytransport answers from a recorded bundle without network access.
+// The request bitmap has to match the recorded one, so replaying against
+// the reference directory of the recording reproduces the exchange.
+type replaytransport struct {
+	dir string
+}
+
+func (t *replaytransport) getindex() (io.ReadCloser, error) {
+	return os.Open(path.Join(t.dir, "index.tgz"))
+}
+
+func (t *replaytransport) postdiff(bitmap io.Reader, params url.Values) (io.ReadCloser, error) {
+
+	recorded, err := readgzip(path.Join(t.dir, "bitmap.gz"))
+	if os.IsNotExist(err) {
+		return nil, errors.New("Replay requests a diff, but none was recorded!")
+	}
+	if err != nil {
+		return nil, err
+	}
+	gr, err := gzip.NewReader(bitmap)
+	if err != nil {
+		return nil, err
+	}
+	requested, err := ioutil.ReadAll(gr)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(requested, recorded) {
+		return nil, fmt.Errorf("Request bitmap differs from the recording (%d of %d bytes equal)!", commonprefix(requested, recorded), len(recorded))
+	}
+	return os.Open(path.Join(t.dir, "diff.tgz"))
+}
+
+func (t *replaytransport) getmetadata(name string) (io.ReadCloser, error) {
+
+	body, err := os.Open(path.Join(t.dir, "tuf-"+name))
+	if os.IsNotExist(err) {
+		return nil, errmetanotfound
+	}
+	return body, err
+}
+
+// readgzip returns the uncompressed content of a gzip file
+func readgzip(fname string) ([]byte, error) {
+
+	filein, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer filein.Close()
+	gr, err := gzip.NewReader(filein)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(gr)
+}
+
+// commonprefix returns the length of the common prefix of a and b
+func commonprefix(a []byte, b []byte) int {
+
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// redacted hides a password embedded in the url for log output
+func redacted(src string) string {
+
+	u, err := url.Parse(src)
+	if err != nil {
+		return src
+	}
+	return u.Redacted()
+}
+
+// imagename returns the file name of the image url without query
+func imagename(src string) string {
+
+	u, err := url.Parse(src)
+	if err != nil {
+		return path.Base(src)
+	}
+	return path.Base(u.Path)
+}
+
+// channelurl reports if src is a release channel url
+// (<dir>/channel/<name>/latest) instead of an image
+func channelurl(src string) bool {
+
+	u, err := url.Parse(src)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	return path.Base(u.Path) == "latest" && path.Base(path.Dir(path.Dir(u.Path))) == "channel"
+}
+
+// resolvechannel returns the url of the current image of the release
+// channel url src
+func resolvechannel(src string) (string, error) {
+
+	client, err := newhttpclient()
+	if err != nil {
+		return "", err
+	}
+	t := &httptransport{client: client, url: src}
+	resp, err := t.send(http.MethodGet, src, nil, http.Header{"Accept": {"application/json"}})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", errors.New("Unknown release channel!")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Cannot resolve release channel: %s!", resp.Status)
+	}
+	var entry channelentry
+	if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil || entry.URL == "" {
+		return "", errors.New("Invalid release channel response!")
+	}
+	base, _ := url.Parse(src)
+	ref, err := url.Parse(entry.URL)
+	if err != nil {
+		return "", errors.New("Invalid release channel response!")
+	}
+	resolved := base.ResolveReference(ref)
+	resolved.RawQuery = base.RawQuery
+
+	if channelpubkey != nil {
+		if err := checkchannel(base, entry, path.Base(resolved.Path)); err != nil {
+			return "", err
+		}
+	}
+	return resolved.String(), nil
+}
+
+// channelentry is the response of a release channel
+type channelentry struct {
+	Channel   string `json:"channel"`
+	Image     string `json:"image"`
+	Version   string `json:"version"`
+	Epoch     uint64 `json:"epoch"`
+	URL       string `json:"url"`
+	Signature string `json:"signature"`
+
+	ManifestSHA256 string `json:"manifest_sha256"`
+}
+
+// channelmessage returns the signed message of the channel entry, the
+// format must match server.go (see README.md)
+func channelmessage(entry channelentry) []byte {
+
+	message := fmt.Sprintf("ota-channel 1\nchannel %q\nimage %q\nversion %q\nepoch %d\n", entry.Channel, entry.Image, entry.Version, entry.Epoch)
+	if entry.ManifestSHA256 != "" {
+		message += fmt.Sprintf("manifest-sha256 %q\n", entry.ManifestSHA256)
+	}
+	return []byte(message)
+}
+
+// checkchannel verifies the signature of the release channel entry of the
+// channel url u leading to image, and refuses epochs older than the last
+// one persisted in statedir, which protects against replayed old channel
+// metadata independent of the clock
+func checkchannel(u *url.URL, entry channelentry, image string) error {
+
+	signature, err := base64.StdEncoding.DecodeString(entry.Signature)
+	if err != nil || entry.Signature == "" || !ed25519.Verify(channelpubkey, channelmessage(entry), signature) {
+		return errors.New("Release channel signature verification failed!")
+	}
+	if entry.Image != image || path.Base(path.Dir(u.Path)) != entry.Channel {
+		return errors.New("Release channel response does not match its signature!")
+	}
+	channelmanifest = entry.ManifestSHA256
+	if statedir == "" {
+		return nil
+	}
+
+	fname := path.Join(statedir, "channels.json")
+	epochs := map[string]uint64{}
+	data, err := ioutil.ReadFile(fname)
+	if err == nil {
+		err = json.Unmarshal(data, &epochs)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", fname, err)
+	}
+	key := u.Scheme + "://" + u.Host + u.Path
+	if entry.Epoch < epochs[key] {
+		return fmt.Errorf("Release channel epoch %d is older than the last seen epoch %d!", entry.Epoch, epochs[key])
+	}
+	if entry.Epoch == epochs[key] {
+		return nil
+	}
+	epochs[key] = entry.Epoch
+
+	if err := os.MkdirAll(statedir, 0755); err != nil {
+		return err
+	}
+	data, err = json.MarshalIndent(epochs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpfile, err := ioutil.TempFile(statedir, "channels-")
+	if err != nil {
+		return err
+	}
+	_, err = tmpfile.Write(append(data, '\n'))
+	if cerr := tmpfile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpfile.Name(), fname)
+	}
+	if err != nil {
+		os.Remove(tmpfile.Name())
+	}
+	return err
+}
+
+// gzipbitmap returns the request bitmap gzipped as sent to the server
+func gzipbitmap(bitmap []byte) (*bytes.Buffer, error) {
+
+	var w bytes.Buffer
+	gw, err := gzip.NewWriterLevel(&w, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	gw.Write(bitmap)
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// diffstats is the size of a diff as simulated by the server
+type diffstats struct {
+	Files    uint32 `json:"files"`
+	Size     int64  `json:"size"`     // of the files
+	Transfer int64  `json:"transfer"` // of the diff tgz
+}
+
+// simulator is a transport which can ask the server for the size of a diff
+// without downloading it
+type simulator interface {
+	simulatediff(bitmap io.Reader) (*diffstats, error)
+}
+
+// reportdiffsize prints the size of the diff for the request bitmap, for
+// -dry-run
+func reportdiffsize(t transport, bitmap []byte, missingfiles uint32) {
+
+	if missingfiles == 0 {
+		fmt.Println("nothing would be downloaded")
+		return
+	}
+	s, ok := t.(simulator)
+	if !ok {
+		fmt.Println("download size unknown, the transport cannot ask the server")
+		return
+	}
+	w, err := gzipbitmap(bitmap)
+	if err == nil {
+		var stats *diffstats
+		if stats, err = s.simulatediff(w); err == nil {
+			fmt.Printf("%s would be downloaded (%s of files)\n", formatbytes(stats.Transfer), formatbytes(stats.Size))
+			return
+		}
+	}
+	slog.Warn("cannot determine the download size", "error", err)
+}
+
+// progressreader reports the bytes read so far to progress, of total (-1
+// if unknown) until the end
+type progressreader struct {
+	r     io.Reader
+	stage string
+	done  int64
+	total int64
+}
+
+func (p *progressreader) Read(b []byte) (int, error) {
+
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+	if err == io.EOF {
+		p.total = p.done
+	}
+	progress(p.stage, p.done, p.total)
+	return n, err
+}
+
+// lengthbody is a response body with the length announced by the server
+type lengthbody struct {
+	io.ReadCloser
+	length int64 // -1 if unknown
+}
+
+func (b *lengthbody) contentlength() int64 {
+	return b.length
+}
+
+// contentlength returns the length of the response body announced by the
+// server, -1 if unknown. Wrappers of bodies pass it on.
+func contentlength(body io.Reader) int64 {
+
+	if l, ok := body.(interface{ contentlength() int64 }); ok {
+		return l.contentlength()
+	}
+	return -1
+}
+
+// progressdisplay shows the progress of an update on stderr (-progress), as
+// a redrawn bar or as plain lines, with the rate and ETA of downloads
+type progressdisplay struct {
+	bar bool
+	out io.Writer
+
+	stage string
+	start time.Time // of the stage
+	shown time.Time // of the last output
+	line  string    // last line, "" once it was shown
+	open  bool      // the bar line is not ended yet
+	ended bool      // the stage reached its total
+}
+
+// display is the progress display of the command line client, nil if
+// disabled
+var display *progressdisplay = nil
+
+// minimum intervals between outputs of a stage
+const (
+	barinterval   = 200 * time.Millisecond
+	plaininterval = 5 * time.Second
+)
+
+// newprogressdisplay returns the display for -progress mode, nil for
+// "none". "auto" shows a bar if stderr is a terminal.
+func newprogressdisplay(mode string) (*progressdisplay, error) {
+
+	switch mode {
+	case "auto":
+		fi, err := os.Stderr.Stat()
+		if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+			return nil, nil
+		}
+		return &progressdisplay{bar: true, out: os.Stderr}, nil
+	case "bar":
+		return &progressdisplay{bar: true, out: os.Stderr}, nil
+	case "plain":
+		return &progressdisplay{out: os.Stderr}, nil
+	case "none":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("invalid progress display %q", mode)
+}
+
+// report is the progress callback of the display
+func (d *progressdisplay) report(stage string, done int64, total int64) {
+
+	now := time.Now()
+	if stage != d.stage {
+		d.end()
+		d.stage = stage
+		d.start = now
+		d.shown = time.Time{}
+		d.ended = false
+	}
+	if d.ended {
+		return
+	}
+
+	line := fmt.Sprintf("%-6s %d files", stage, done)
+	if stage != "check" {
+		line = fmt.Sprintf("%-6s %s", stage, formatbytes(done))
+		if total > 0 {
+			line += " of " + formatbytes(total)
+		}
+		if elapsed := now.Sub(d.start).Seconds(); elapsed > 0 && done > 0 {
+			rate := float64(done) / elapsed
+			line += fmt.Sprintf(", %s/s", formatbytes(int64(rate)))
+			if total > done {
+				eta := time.Duration(float64(total-done) / rate * float64(time.Second))
+				line += ", ETA " + eta.Round(time.Second).String()
+			}
+		}
+	}
+	if d.bar && total > 0 {
+		line = progressbar(done, total) + " " + line
+	}
+	d.line = line
+
+	d.ended = total >= 0 && done >= total
+	interval := plaininterval
+	if d.bar {
+		interval = barinterval
+	}
+	if d.ended {
+		d.end()
+	} else if now.Sub(d.shown) >= interval {
+		d.show()
+		d.shown = now
+	}
+}
+
+// files shows how many files of the image were reused from the reference
+// and how many are fetched
+func (d *progressdisplay) files(reused uint32, fetched uint32) {
+
+	d.end()
+	fmt.Fprintf(d.out, "files  %d reused, %d to fetch\n", reused, fetched)
+}
+
+// show writes the last line
+func (d *progressdisplay) show() {
+
+	if d.line == "" {
+		return
+	}
+	if d.bar {
+		fmt.Fprintf(d.out, "\r\033[K%s", d.line)
+		d.open = true
+	} else {
+		fmt.Fprintln(d.out, d.line)
+	}
+	d.line = ""
+}
+
+// end shows the last line of the stage if it was skipped and ends the bar
+// line
+func (d *progressdisplay) end() {
+
+	d.show()
+	if d.open {
+		fmt.Fprintln(d.out)
+		d.open = false
+	}
+}
+
+// progressbar renders done of total as a bar with percentage
+func progressbar(done int64, total int64) string {
+
+	const width = 30
+	if done > total {
+		done = total
+	}
+	filled := int(done * width / total)
+	return fmt.Sprintf("[%s%s] %3d%%", strings.Repeat("=", filled), strings.Repeat(" ", width-filled), done*100/total)
+}
+
+// formatbytes formats n bytes for humans, e.g. 12.3 MiB
+func formatbytes(n int64) string {
+
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// savetotmp stores a response in a new tmp file in the scratch directory
+// dir and returns its name
+func savetotmp(body io.ReadCloser, dir string, prefix string) (string, error) {
+
+	tmpfile, err := ioutil.TempFile(dir, prefix)
+	if err != nil {
+		body.Close()
+		return "", err
+	}
+	var src io.Reader = body
+	if limitrate > 0 {
+		src = &ratereader{r: src, start: time.Now()}
+	}
+	if progress != nil {
+		src = &progressreader{r: src, stage: strings.TrimSuffix(prefix, "-"), total: contentlength(body)}
+	}
+	n, err := io.Copy(tmpfile, src)
+	laststatus.Bytes += n
+	if cerr := body.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := tmpfile.Close(); err == nil {
+		err = cerr
+	}
+	if err == errbudget {
+		// the files received completely can be staged
+		return tmpfile.Name(), err
+	}
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		// writes fail with path errors, the rest is the download
+		return "", classify(err, exitnetwork)
+	}
+	return tmpfile.Name(), nil
+}
+
+// max download rate in bytes per second (-limit-rate), 0 if unlimited
+var limitrate int64 = 0
+
+// ratereader limits the rate a download is read at to limitrate, the
+// sender is slowed down by TCP flow control
+type ratereader struct {
+	r     io.Reader
+	start time.Time
+	n     int64
+}
+
+func (l *ratereader) Read(p []byte) (int, error) {
+
+	// small reads, so the rate is even within a second
+	if chunk := max(limitrate/10, 1024); int64(len(p)) > chunk {
+		p = p[:chunk]
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	due := l.start.Add(time.Duration(float64(l.n) / float64(limitrate) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+// parserate parses a rate in bytes per second with an optional k, m or g
+// suffix (1024 based), e.g. 500k
+func parserate(s string) (int64, error) {
+
+	num, mult := s, int64(1)
+	switch strings.ToLower(s[len(s)-min(len(s), 1):]) {
+	case "k":
+		mult = 1 << 10
+	case "m":
+		mult = 1 << 20
+	case "g":
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		num = s[:len(s)-1]
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return int64(v * float64(mult)), nil
+}
+
+// budgetreader ends a download with errbudget after left bytes or at the
+// deadline, left is -1 and the deadline zero if unlimited
+type budgetreader struct {
+	r        io.ReadCloser
+	left     int64
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func (b *budgetreader) contentlength() int64 {
+	return contentlength(b.r)
+}
+
+// newbudgetreader limits body to what is left of the budget of the run
+// started at start
+func newbudgetreader(body io.ReadCloser, start time.Time) *budgetreader {
+
+	b := &budgetreader{r: body, left: -1}
+	if budgetbytes > 0 {
+		b.left = max(budgetbytes-laststatus.Bytes, 0)
+	}
+	if budgettime > 0 {
+		b.deadline = start.Add(budgettime)
+		// unblocks a stalled read
+		b.timer = time.AfterFunc(time.Until(b.deadline), func() { body.Close() })
+	}
+	return b
+}
+
+func (b *budgetreader) Read(p []byte) (int, error) {
+
+	if !b.deadline.IsZero() && !time.Now().Before(b.deadline) {
+		return 0, errbudget
+	}
+	if b.left == 0 {
+		return 0, errbudget
+	}
+	if b.left > 0 && int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.r.Read(p)
+	if b.left > 0 {
+		b.left -= int64(n)
+	}
+	if err != nil && err != io.EOF && !b.deadline.IsZero() && !time.Now().Before(b.deadline) {
+		err = errbudget
+	}
+	return n, err
+}
+
+func (b *budgetreader) Close() error {
+
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	return b.r.Close()
+}
+
+// stagingdir keeps the files received by runs that ran out of their budget
+func stagingdir() string {
+	return path.Join(statedir, "staging")
+}
+
+// stagedfile returns the staged file with the index hash hashstr, "" if
+// there is none
+func stagedfile(hb *hashbackend, hashstr string) string {
+
+	fname := path.Join(stagingdir(), hb.name+"-"+hashstr)
+	if _, err := os.Stat(fname); err != nil {
+		return ""
+	}
+	return fname
+}
+
+// exit statuses of the client, listed by -help
+const (
+	exitfailure      = 1 // anything else
+	exitusage        = 2 // invalid command line
+	exitnoupdate     = 3 // no file needs to be downloaded
+	exitnetwork      = 4 // the server failed or was not reached, or the download budget ran out
+	exitverification = 5 // the image was rejected: signature, manifest, hash format, version or age; -verify: entries differ
+	exitdisk         = 6 // local files could not be read or written
+)
+
+// classederror is an error of the class with exit status status
+type classederror struct {
+	error
+	status int
+}
+
+func (e classederror) Unwrap() error {
+	return e.error
+}
+
+// classify assigns err to the class with exit status status, unless its
+// class is known already
+func classify(err error, status int) error {
+
+	if err == nil || exitstatus(err) != exitfailure {
+		return err
+	}
+	return classederror{error: err, status: status}
+}
+
+// exitstatus returns the exit status for the failure err
+func exitstatus(err error) int {
+
+	var classed classederror
+	var urlerr *url.Error
+	var operr *net.OpError
+	var patherr *os.PathError
+	var linkerr *os.LinkError
+	var syscallerr *os.SyscallError
+	switch {
+	case errors.As(err, &classed):
+		return classed.status
+	// before the disk errors, network errors wrap syscall errors
+	case errors.As(err, &urlerr), errors.As(err, &operr), errors.Is(err, errbudget):
+		return exitnetwork
+	case errors.Is(err, errsignature), errors.Is(err, errassembled), errors.Is(err, errhashformat):
+		return exitverification
+	case errors.As(err, &patherr), errors.As(err, &linkerr), errors.As(err, &syscallerr):
+		return exitdisk
+	}
+	return exitfailure
+}
+
+// usageerror reports an invalid command line and exits with exitusage
+func usageerror(format string, v ...interface{}) {
+
+	log.Printf(format+"\n", v...)
+	os.Exit(exitusage)
+}
+
+// errhashformat is returned if the index contains an unknown hash format
+var errhashformat = errors.New("Server responded with an unknown file hash format!")
+
+// manifestline describes a tar entry in the image manifest, which is what
+// image signatures cover: the header fields, user and group names and the
+// pax records (xattrs, SELinux labels) except the OTA.* records of the
+// index. sha256hex is the content hash of regular files. The format has to
+// be identical in client.go and server.go.
+func manifestline(hdr *tar.Header, sha256hex string) string {
+
+	if sha256hex == "" {
+		sha256hex = "-"
+	}
+	line := fmt.Sprintf("%c %o %d:%d %d %d:%d %s %s %s %s:%s", hdr.Typeflag, hdr.Mode, hdr.Uid, hdr.Gid,
+		hdr.ModTime.Unix(), hdr.Devmajor, hdr.Devminor, sha256hex, strconv.Quote(hdr.Name), strconv.Quote(hdr.Linkname),
+		strconv.Quote(hdr.Uname), strconv.Quote(hdr.Gname))
+	var keys []string
+	for k := range hdr.PAXRecords {
+		if !strings.HasPrefix(k, "OTA.") && !paxheaderrecords[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		line += " " + strconv.Quote(k) + "=" + strconv.Quote(hdr.PAXRecords[k])
+	}
+	return line + "\n"
+}
+
+// paxheaderrecords are the standard pax records, they hold header fields
+// (or times which are not signed)
+var paxheaderrecords = map[string]bool{"path": true, "linkpath": true, "size": true, "uid": true, "gid": true,
+	"uname": true, "gname": true, "mtime": true, "atime": true, "ctime": true}
+
+// manifestheader is the first line of every manifest
+const manifestheader = "ota-manifest 2\n"
+
+// signedrecords are the image wide records covered by the image signature
+var signedrecords = []string{"OTA.version", "OTA.signed-at", "OTA.max-age"}
+
+// manifestrecords describes the signed records in the manifest, they follow
+// the manifest header. The format has to be identical in client.go and
+// server.go.
+func manifestrecords(records map[string]string) string {
+
+	lines := ""
+	for _, k := range signedrecords {
+		if v, found := records[k]; found {
+			lines += fmt.Sprintf("record %s %s\n", k, strconv.Quote(v))
+		}
+	}
+	return lines
+}
+
+// installedversion returns the version of the last assembled image stored
+// in statedir, found is false if none is known
+func installedversion() (uint64, bool, error) {
+
+	data, err := ioutil.ReadFile(path.Join(statedir, "version"))
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	version, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("%s: %s", path.Join(statedir, "version"), err)
+	}
+	return version, true, nil
+}
+
+// checkversion refuses images older than the installed version, unless
+// downgrades are allowed
+func checkversion(records map[string]string) error {
+
+	if statedir == "" || allowdowngrade {
+		return nil
+	}
+	installed, found, err := installedversion()
+	if err != nil || !found {
+		return err
+	}
+
+	v, found := records["OTA.version"]
+	if !found {
+		return fmt.Errorf("Image has no version, installed version is %d!", installed)
+	}
+	version, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Image has an invalid version %q!", v)
+	}
+	if version < installed {
+		return fmt.Errorf("Image version %d is older than the installed version %d!", version, installed)
+	}
+	return nil
+}
+
+// checkindexage refuses indices signed longer ago than their max-age or
+// maxindexage, which protects against replayed old indices
+func checkindexage(records map[string]string) error {
+
+	v, found := records["OTA.signed-at"]
+	if !found {
+		if maxindexage > 0 {
+			return errors.New("Index has no signing time, cannot check its age!")
+		}
+		return nil
+	}
+	signedat, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Index has an invalid signing time %q!", v)
+	}
+	signed := time.Unix(signedat, 0)
+	age := time.Since(signed)
+
+	if v, found := records["OTA.max-age"]; found {
+		maxage, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Index has an invalid max-age %q!", v)
+		}
+		if age > time.Duration(maxage)*time.Second {
+			return fmt.Errorf("Index signed at %s expired after %s!", signed.UTC().Format(time.RFC3339), time.Duration(maxage)*time.Second)
+		}
+	}
+	if maxindexage > 0 && age > maxindexage {
+		return fmt.Errorf("Index signed at %s is older than %s!", signed.UTC().Format(time.RFC3339), maxindexage)
+	}
+	return nil
+}
+
+// saveversion persists the version of the assembled image in statedir
+func saveversion(records map[string]string) error {
+
+	v, found := records["OTA.version"]
+	if statedir == "" || !found {
+		return nil
+	}
+	if err := os.MkdirAll(statedir, 0755); err != nil {
+		return err
+	}
+	tmpfile, err := ioutil.TempFile(statedir, "version-")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(tmpfile, v)
+	if cerr := tmpfile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpfile.Name(), path.Join(statedir, "version"))
+	}
+	if err != nil {
+		os.Remove(tmpfile.Name())
+	}
+	return err
+}
+
+// updatestatus is the outcome of the last update, persisted as
+// <statedir>/status.json for the "status" command
+type updatestatus struct {
+	Image    string    `json:"image"`
+	Source   string    `json:"source"`
+	Version  string    `json:"version,omitempty"`
+	Result   string    `json:"result"` // "success", "partial" (budget exhausted) or "failure"
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Bytes    int64     `json:"bytes"`          // index and diff
+	Files    uint32    `json:"files"`          // downloaded
+	Slot     string    `json:"slot,omitempty"` // marked bootable (-slot)
+
+	// regular files of the image and the parts of them taken from the
+	// reference, and from the staging directory of earlier runs out of
+	// their budget, instead of downloaded
+	ImageBytes  int64 `json:"image_bytes,omitempty"`
+	ReusedBytes int64 `json:"reused_bytes,omitempty"`
+	StagedBytes int64 `json:"staged_bytes,omitempty"`
+}
+
+// status of the running update
+var laststatus updatestatus
+
+// runupdate runs update for the image src and persists its outcome in
+// statedir, checks are not recorded
+func runupdate(t transport, src string, tgzdst string, refs []refmount) (uint32, error) {
+
+	image := imagename(src)
+	laststatus = updatestatus{Image: image, Source: redacted(src), Started: time.Now().UTC()}
+	missingfiles, err := update(t, image, tgzdst, refs)
+	if checkonly {
+		return missingfiles, err
+	}
+	var manifest []string
+	if err == nil && applytarget != "" {
+		if manifest, err = applyimage(tgzdst, applytarget, applyslot == "" && statedir != ""); err == nil {
+			slog.Info("image applied", "image", image, "target", applytarget)
+		}
+	}
+	if err == nil && applyslot != "" {
+		if err = slots.markbootable(applyslot); err == nil {
+			slog.Info("slot marked bootable", "slot", applyslot)
+		}
+		laststatus.Slot = applyslot
+	}
+	// the installed version changes only once the image is applied
+	if err == nil && laststatus.Version != "" {
+		if verr := saveversion(map[string]string{"OTA.version": laststatus.Version}); verr != nil {
+			slog.Error("cannot persist the image version", "error", verr)
+		}
+	}
+	if err == nil && applytarget != "" && statedir != "" {
+		entry := journalentry{Action: "apply", Image: image, Version: laststatus.Version, Target: applytarget, Slot: applyslot, SlotProvider: slotproviderspec}
+		if jerr := appendjournal(entry, manifest); jerr != nil {
+			slog.Error("cannot record update in journal", "error", jerr)
+		}
+	}
+
+	laststatus.Finished = time.Now().UTC()
+	laststatus.Result = "success"
+	laststatus.Files = missingfiles
+	if err != nil {
+		laststatus.Result = "failure"
+		laststatus.Error = err.Error()
+	}
+	if err == errbudget {
+		laststatus.Result = "partial"
+	}
+	slog.Info("update finished", "image", image, "version", laststatus.Version, "bytes", laststatus.Bytes, "files", missingfiles,
+		"image_bytes", laststatus.ImageBytes, "reused_bytes", laststatus.ReusedBytes, "staged_bytes", laststatus.StagedBytes,
+		"duration", laststatus.Finished.Sub(laststatus.Started).Seconds(), "outcome", laststatus.Result)
+	if statedir == "" {
+		return missingfiles, err
+	}
+	if serr := savestatus(); serr != nil {
+		if err == nil {
+			return missingfiles, serr
+		}
+		slog.Error("cannot save status", "error", serr)
+	}
+	return missingfiles, err
+}
+
+// savings summarizes what the delta update s saved compared to downloading
+// the image, "" if unknown
+func savings(s updatestatus) string {
+
+	if s.ImageBytes == 0 {
+		return ""
+	}
+	summary := fmt.Sprintf("image %s, %s (%.1f%%) reused from the reference, %s of new files",
+		formatbytes(s.ImageBytes), formatbytes(s.ReusedBytes), 100*float64(s.ReusedBytes)/float64(s.ImageBytes),
+		formatbytes(s.ImageBytes-s.ReusedBytes))
+	if s.StagedBytes > 0 {
+		summary += fmt.Sprintf(" (%s staged by earlier runs)", formatbytes(s.StagedBytes))
+	}
+	summary += fmt.Sprintf(", %s downloaded", formatbytes(s.Bytes))
+	if s.Bytes > 0 {
+		summary += fmt.Sprintf(" (ratio %.1f:1, %.1f%% saved)", float64(s.ImageBytes)/float64(s.Bytes), 100*(1-float64(s.Bytes)/float64(s.ImageBytes)))
+	}
+	return summary
+}
+
+// savestatus persists laststatus in statedir
+func savestatus() error {
+
+	data, err := json.MarshalIndent(laststatus, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(statedir, 0755); err != nil {
+		return err
+	}
+	tmpfile, err := ioutil.TempFile(statedir, "status-")
+	if err != nil {
+		return err
+	}
+	_, err = tmpfile.Write(append(data, '\n'))
+	if cerr := tmpfile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmpfile.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpfile.Name(), path.Join(statedir, "status.json"))
+	}
+	if err != nil {
+		os.Remove(tmpfile.Name())
+	}
+	return err
+}
+
+// status implements the "status" command, which prints the outcome of the
+// last update. Exits with 1 if it failed and 2 if none is known.
+func status(args []string) int {
+
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	pstatedir := flags.String("statedir", statedir, "client state directory")
+	pjson := flags.Bool("json", false, "print the status as JSON")
+	flags.Parse(args)
+
+	data, err := ioutil.ReadFile(path.Join(*pstatedir, "status.json"))
+	if os.IsNotExist(err) {
+		fmt.Println("no update recorded")
+		return 2
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	var s updatestatus
+	if err := json.Unmarshal(data, &s); err != nil {
+		fmt.Printf("%s: %s\n", path.Join(*pstatedir, "status.json"), err)
+		return 2
+	}
+
+	if *pjson {
+		os.Stdout.Write(data)
+	} else {
+		fmt.Printf("image:    %s\n", s.Image)
+		fmt.Printf("source:   %s\n", s.Source)
+		if s.Version != "" {
+			fmt.Printf("version:  %s\n", s.Version)
+		}
+		fmt.Printf("result:   %s\n", s.Result)
+		if s.Error != "" {
+			fmt.Printf("error:    %s\n", s.Error)
+		}
+		fmt.Printf("started:  %s\n", s.Started.Format(time.RFC3339))
+		fmt.Printf("finished: %s (%s)\n", s.Finished.Format(time.RFC3339), s.Finished.Sub(s.Started).Round(time.Millisecond))
+		fmt.Printf("bytes:    %d\n", s.Bytes)
+		fmt.Printf("files:    %d\n", s.Files)
+		if summary := savings(s); summary != "" {
+			fmt.Printf("savings:  %s\n", summary)
+		}
+		if s.Slot != "" {
+			fmt.Printf("slot:     %s\n", s.Slot)
+		}
+	}
+	if s.Result != "success" {
+		return 1
+	}
+	return 0
+}
+
+// sdnotifier sends state changes to systemd (sd_notify), a no-op if the
+// service is not of Type=notify
+type sdnotifier struct {
+	conn     net.Conn
+	watchdog time.Duration // WATCHDOG_USEC, 0 if disabled
+	pinged   time.Time
+}
+
+// newsdnotifier connects to NOTIFY_SOCKET, which is not passed on to
+// transport commands
+func newsdnotifier() (*sdnotifier, error) {
+
+	addr := os.Getenv("NOTIFY_SOCKET")
+	usec, _ := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	pid, _ := strconv.Atoi(os.Getenv("WATCHDOG_PID"))
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+
+	n := &sdnotifier{}
+	if addr == "" {
+		return n, nil
+	}
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:] // abstract socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	n.conn = conn
+	if usec > 0 && (pid == 0 || pid == os.Getpid()) {
+		n.watchdog = time.Duration(usec) * time.Microsecond
+	}
+	return n, nil
+}
+
+// notify sends state, e.g. "READY=1"
+func (n *sdnotifier) notify(state string) {
+
+	if n.conn == nil {
+		return
+	}
+	if _, err := n.conn.Write([]byte(state)); err != nil {
+		slog.Warn("cannot notify systemd", "state", state, "error", err)
+	}
+}
+
+// ping pings the systemd watchdog, at most every quarter of its interval.
+// It is called as the daemon makes progress, so systemd restarts a daemon
+// stuck in a poll or an update.
+func (n *sdnotifier) ping() {
+
+	if n.conn == nil || n.watchdog == 0 || time.Since(n.pinged) < n.watchdog/4 {
+		return
+	}
+	n.pinged = time.Now()
+	n.notify("WATCHDOG=1")
+}
+
+// sleep waits for d, pinging the watchdog at half its interval
+func (n *sdnotifier) sleep(d time.Duration) {
+
+	for end := time.Now().Add(d); ; {
+		n.ping()
+		left := time.Until(end)
+		if left <= 0 {
+			return
+		}
+		if n.watchdog > 0 {
+			left = min(left, n.watchdog/2)
+		}
+		time.Sleep(left)
+	}
+}
+
+// polled is the image last installed by -daemon and the ETag of its index,
+// persisted as <statedir>/poll.json
+type polled struct {
+	Source string `json:"source"` // without credentials
+	ETag   string `json:"etag"`
+}
+
+// daemonstate is the state of -daemon, served as JSON on its status socket
+type daemonstate struct {
+	State     string        `json:"state"` // "checking", "updating" or "idle"
+	Source    string        `json:"source"`
+	Started   time.Time     `json:"started"`
+	LastCheck time.Time     `json:"last_check"`
+	NextCheck time.Time     `json:"next_check,omitempty"`
+	Error     string        `json:"error,omitempty"` // of the last check or update
+	Updates   int           `json:"updates"`         // installed since the start
+	Last      *updatestatus `json:"last_update,omitempty"`
+}
+
+// daemon polls the image or release channel url src every interval and
+// installs new images (-daemon). Images are only downloaded if the ETag of
+// their index differs from the one of the last installed image.
+type daemon struct {
+	src      string
+	dst      string
+	refs     []refmount
+	interval time.Duration
+
+	last polled
+	sd   *sdnotifier
+
+	mu    sync.Mutex
+	state daemonstate
+}
+
+func newdaemon(src string, dst string, refs []refmount, interval time.Duration) (*daemon, error) {
+
+	sd, err := newsdnotifier()
+	if err != nil {
+		return nil, err
+	}
+	d := &daemon{src: src, dst: dst, refs: refs, interval: interval, sd: sd}
+	d.state = daemonstate{State: "idle", Source: redacted(src), Started: time.Now().UTC()}
+	if statedir == "" {
+		return d, nil
+	}
+	data, err := ioutil.ReadFile(path.Join(statedir, "poll.json"))
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &d.last)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path.Join(statedir, "poll.json"), err)
+	}
+	return d, nil
+}
+
+// savepolled persists the image last installed in statedir
+func (d *daemon) savepolled() error {
+
+	if statedir == "" {
+		return nil
+	}
+	data, err := json.Marshal(d.last)
+	if err != nil {
+		return err
+	}
+	tmpfile, err := ioutil.TempFile(statedir, "poll-")
+	if err != nil {
+		return err
+	}
+	_, err = tmpfile.Write(data)
+	if cerr := tmpfile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpfile.Name(), path.Join(statedir, "poll.json"))
+	}
+	if err != nil {
+		os.Remove(tmpfile.Name())
+	}
+	return err
+}
+
+func (d *daemon) setstate(state string) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.state.State = state
+	d.sd.notify("STATUS=" + state)
+}
+
+// serve answers every request on the status socket l with the state
+func (d *daemon) serve(l net.Listener) {
+
+	err := http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		state := d.state
+		d.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	}))
+	slog.Error("status socket failed", "error", err)
+}
+
+// poll checks for a new image and installs it
+func (d *daemon) poll() error {
+
+	src := d.src
+	if channelurl(src) {
+		resolved, err := resolvechannel(src)
+		if err != nil {
+			return err
+		}
+		src = resolved
+	}
+	if !strings.HasSuffix(imagename(src), ".tgz") {
+		return fmt.Errorf("%s: <src> requires .tgz suffix", redacted(src))
+	}
+	t, err := newtransport(src, "")
+	if err != nil {
+		return err
+	}
+
+	// servers without ETags get an update every interval
+	etag := ""
+	if d.last.Source == redacted(src) {
+		etag = d.last.ETag
+	}
+	etag, changed, err := t.(*httptransport).changed(etag)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		slog.Debug("no update", "src", redacted(src))
+		return nil
+	}
+
+	slog.Info("update available", "src", redacted(src))
+	d.setstate("updating")
+	_, err = runupdate(t, src, destination(src, d.dst), d.refs)
+	if display != nil {
+		display.end()
+	}
+	d.mu.Lock()
+	last := laststatus
+	d.state.Last = &last
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.state.Updates++
+	d.mu.Unlock()
+	d.last = polled{Source: redacted(src), ETag: etag}
+	return d.savepolled()
+}
+
+// run polls every interval, it does not return
+func (d *daemon) run() {
+
+	// updates ping the watchdog as they progress
+	report := progress
+	progress = func(stage string, done int64, total int64) {
+		if report != nil {
+			report(stage, done, total)
+		}
+		d.sd.ping()
+	}
+
+	d.sd.notify("READY=1")
+	for {
+		d.sd.ping()
+		d.setstate("checking")
+		d.mu.Lock()
+		d.state.LastCheck = time.Now().UTC()
+		d.mu.Unlock()
+
+		err := d.poll()
+		if err == errbudget {
+			slog.Warn("update incomplete, continuing with the next poll", "error", err)
+		} else if err != nil {
+			slog.Error("update failed", "error", err)
+		}
+
+		next := time.Now().Add(d.interval).UTC()
+		d.mu.Lock()
+		d.state.State = "idle"
+		d.state.NextCheck = next
+		d.state.Error = ""
+		status := "idle, next check " + next.Format(time.RFC3339)
+		if err != nil {
+			d.state.Error = err.Error()
+			status += ", last failed: " + err.Error()
+		}
+		d.mu.Unlock()
+		d.sd.notify("STATUS=" + status)
+		d.sd.sleep(d.interval)
+	}
+}
+
+// journalentry records an applied update or a rollback in
+// <statedir>/journal, one JSON object per line
+type journalentry struct {
+	Seq          int       `json:"seq"`
+	Time         time.Time `json:"time"`
+	Action       string    `json:"action"` // "apply" or "rollback" (to the image recorded)
+	Image        string    `json:"image"`
+	Version      string    `json:"version,omitempty"`
+	Target       string    `json:"target"`
+	Slot         string    `json:"slot,omitempty"`
+	SlotProvider string    `json:"slot_provider,omitempty"`
+	Manifest     string    `json:"manifest"` // file in <statedir>/manifests
+}
+
+// readjournal returns the entries of the journal in statedir
+func readjournal(statedir string) ([]journalentry, error) {
+
+	data, err := ioutil.ReadFile(path.Join(statedir, "journal"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []journalentry
+	for i, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		var e journalentry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path.Join(statedir, "journal"), i+1, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// appendjournal records entry in the journal in statedir, with the manifest
+// lines of its image unless it refers to the manifest of an earlier entry.
+// Only the manifests of the last two entries are kept, as only the last
+// update can be rolled back.
+func appendjournal(entry journalentry, manifest []string) error {
+
+	entries, err := readjournal(statedir)
+	if err != nil {
+		return err
+	}
+	entry.Seq = 1
+	if len(entries) > 0 {
+		entry.Seq = entries[len(entries)-1].Seq + 1
+	}
+	entry.Time = time.Now().UTC()
+
+	manifests := path.Join(statedir, "manifests")
+	if err := os.MkdirAll(manifests, 0755); err != nil {
+		return err
+	}
+	if entry.Manifest == "" {
+		entry.Manifest = strconv.Itoa(entry.Seq)
+		data := []byte(strings.Join(manifest, ""))
+		if err := ioutil.WriteFile(path.Join(manifests, entry.Manifest), data, 0644); err != nil {
+			return err
+		}
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path.Join(statedir, "journal"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	keep := map[string]bool{entry.Manifest: true}
+	if len(entries) > 0 {
+		keep[entries[len(entries)-1].Manifest] = true
+	}
+	files, err := os.ReadDir(manifests)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !keep[file.Name()] {
+			os.Remove(path.Join(manifests, file.Name()))
+		}
+	}
+	return nil
+}
+
+// rollback implements the "rollback" command, which reverts the last update
+// applied with -apply or -slot: the previous slot is marked bootable again,
+// or the target is exchanged with the tree kept as <target>.previous. The
+// previous tree is checked against its manifest first.
+func rollback(args []string) int {
+
+	flags := flag.NewFlagSet("rollback", flag.ExitOnError)
+	pstatedir := flags.String("statedir", statedir, "client state directory")
+	flags.Parse(args)
+	statedir = *pstatedir
+
+	entries, err := readjournal(statedir)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if len(entries) < 2 || entries[len(entries)-1].Action != "apply" {
+		fmt.Println("no update to roll back")
+		return 2
+	}
+	last, prev := entries[len(entries)-1], entries[len(entries)-2]
+
+	data, err := ioutil.ReadFile(path.Join(statedir, "manifests", prev.Manifest))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	manifest := strings.SplitAfter(string(data), "\n")
+	manifest = manifest[:len(manifest)-1]
+
+	if last.Slot != "" {
+		if prev.Slot == "" || prev.Slot == last.Slot {
+			fmt.Printf("slot %s does not hold the previous image\n", last.Slot)
+			return 1
+		}
+		if err := verifydir(prev.Target, manifest); err != nil {
+			fmt.Printf("slot %s: %s\n", prev.Slot, err)
+			return 1
+		}
+		p, err := newslotprovider(last.SlotProvider)
+		if err == nil {
+			err = p.markbootable(prev.Slot)
+		}
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Printf("slot %s marked bootable (%s)\n", prev.Slot, prev.Image)
+	} else {
+		if prev.Target != last.Target {
+			fmt.Printf("%s does not hold the previous image\n", last.Target)
+			return 1
+		}
+		previous := last.Target + ".previous"
+		if err := verifydir(previous, manifest); err != nil {
+			fmt.Printf("%s: %s\n", previous, err)
+			return 1
+		}
+		if err := exchange(previous, last.Target); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Printf("%s restored (%s)\n", last.Target, prev.Image)
+	}
+
+	// the version before the update, so it can be installed again
+	if prev.Version != "" {
+		err = saveversion(map[string]string{"OTA.version": prev.Version})
+	} else if err = os.Remove(path.Join(statedir, "version")); os.IsNotExist(err) {
+		err = nil
+	}
+	if err == nil {
+		prev.Action = "rollback"
+		err = appendjournal(prev, nil)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// index deltas, the format must match server.go (see README.md)
+const deltamagic = "ota-index-delta 1\n"
+const deltacontenttype = "application/x-ota-index-delta"
+const (
+	deltacopy    = 'c'
+	deltaliteral = 'l'
+	deltaend     = 'e'
+)
+
+// indexbase describes the index of the last assembled image, which is kept
+// in statedir as base for index deltas
+type indexbase struct {
+	Image  string `json:"image"`
+	SHA256 string `json:"sha256"` // of the uncompressed index tar
+}
+
+// loadindexbase returns the kept index, nil if there is none
+func loadindexbase() (*indexbase, error) {
+
+	if statedir == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path.Join(statedir, "index.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	base := &indexbase{}
+	if err := json.Unmarshal(data, base); err != nil {
+		return nil, fmt.Errorf("%s: %s", path.Join(statedir, "index.json"), err)
+	}
+	return base, nil
+}
+
+// removeindexbase drops the kept index, e.g. if it is damaged
+func removeindexbase() {
+
+	os.Remove(path.Join(statedir, "index.json"))
+	os.Remove(path.Join(statedir, "index.tgz"))
+}
+
+// saveindexbase keeps the index tgz indexname of the assembled image in
+// statedir
+func saveindexbase(indexname string, image string) error {
+
+	if statedir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(statedir, 0755); err != nil {
+		return err
+	}
+
+	in, err := os.Open(indexname)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmpfile, err := ioutil.TempFile(statedir, "index-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+
+	// copy the index and hash its uncompressed tar
+	tee := io.TeeReader(in, tmpfile)
+	archivein, err := gzip.NewReader(tee)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, archivein); err != nil {
+		return err
+	}
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return err
+	}
+	if err := tmpfile.Close(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(indexbase{Image: image, SHA256: hex.EncodeToString(h.Sum(nil))})
+	if err != nil {
+		return err
+	}
+	removeindexbase()
+	if err := os.Rename(tmpfile.Name(), path.Join(statedir, "index.tgz")); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(statedir, "index.json"), data, 0644)
+}
+
+// gzipdeltabases returns the image of the kept index, whose gzip members
+// the server can send deltas against, and the sha256 hashes of its regular
+// files. The image is "" without a kept index.
+func gzipdeltabases() (string, map[string]bool) {
+
+	base, err := loadindexbase()
+	if base == nil || err != nil {
+		return "", nil
+	}
+	filein, err := os.Open(path.Join(statedir, "index.tgz"))
+	if err != nil {
+		return "", nil
+	}
+	defer filein.Close()
+	archivein, err := gzip.NewReader(filein)
+	if err != nil {
+		return "", nil
+	}
+	tr := tar.NewReader(archivein)
+
+	sums := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if sum := hdr.PAXRecords["OTA.sha256"]; sum != "" {
+			sums[sum] = true
+		}
+	}
+	return base.Image, sums
+}
+
+// gzipbasesum returns the sha256 of the gzip file fname if it is one of
+// sums, "" otherwise
+func gzipbasesum(fname string, sums map[string]bool) string {
+
+	filein, err := os.Open(fname)
+	if err != nil {
+		return ""
+	}
+	defer filein.Close()
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(filein, magic); err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		return ""
+	}
+	h := sha256.New()
+	h.Write(magic)
+	if _, err := io.Copy(h, filein); err != nil {
+		return ""
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sums[sum] {
+		return sum
+	}
+	return ""
+}
+
+// gzip deltas, the format must match server.go (see README.md)
+const gzipdeltaheader = "ota-gzip-delta 1\n"
+
+// errgzipdelta is returned for gzip deltas which cannot be applied
+var errgzipdelta = errors.New("invalid gzip delta")
+
+// rebuildgzip rebuilds a gzip member of at most size bytes from its delta
+// against the old version oldgz: the decompressed contents, gzipped again
+// with the level of the delta, corrected to the original member
+func rebuildgzip(oldgz []byte, delta []byte, size int64) ([]byte, error) {
+
+	if !bytes.HasPrefix(delta, []byte(gzipdeltaheader)) {
+		return nil, errgzipdelta
+	}
+	r := bytes.NewReader(delta[len(gzipdeltaheader):])
+
+	gr, err := gzip.NewReader(bytes.NewReader(oldgz))
+	if err != nil {
+		return nil, err
+	}
+	oldcontent, err := ioutil.ReadAll(gr)
+	if err != nil {
+		return nil, err
+	}
+	// deflate compresses by 1032:1 at most
+	content, err := applybytedelta(oldcontent, r, size*1032+1024)
+	if err != nil {
+		return nil, err
+	}
+
+	level, err := r.ReadByte()
+	if err != nil || (int8(level) < gzip.HuffmanOnly || int8(level) > gzip.BestCompression) {
+		return nil, errgzipdelta
+	}
+	var recompressed bytes.Buffer
+	gw, err := gzip.NewWriterLevel(&recompressed, int(int8(level)))
+	if err != nil {
+		return nil, err
+	}
+	gw.Write(content)
+	gw.Close()
+	return applybytedelta(recompressed.Bytes(), r, size)
+}
+
+// rebuildgzipfile rebuilds the gzip member hdr of at most size bytes from
+// its delta against the local file with the sha256 basesum
+func rebuildgzipfile(refs []refmount, hdr *tar.Header, basesum string, delta io.Reader, size int64) ([]byte, error) {
+
+	reffile, found := resolveref(refs, hdr.Name)
+	if !found {
+		return nil, errors.New("no local version")
+	}
+	oldgz, err := ioutil.ReadFile(reffile)
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(oldgz); hex.EncodeToString(sum[:]) != basesum {
+		return nil, errors.New("local version changed")
+	}
+	data, err := ioutil.ReadAll(delta)
+	if err != nil {
+		return nil, err
+	}
+	return rebuildgzip(oldgz, data, size)
+}
+
+// applybytedelta rebuilds the target of a delta of server.go's bytedelta
+// from source, up to limit bytes
+func applybytedelta(source []byte, r *bytes.Reader, limit int64) ([]byte, error) {
+
+	var out bytes.Buffer
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return nil, errgzipdelta
+		}
+		switch op {
+		case 'c':
+			start, err1 := binary.ReadUvarint(r)
+			count, err2 := binary.ReadUvarint(r)
+			if err1 != nil || err2 != nil || start > uint64(len(source)) || count > uint64(len(source))-start {
+				return nil, errgzipdelta
+			}
+			out.Write(source[start : start+count])
+		case 'l':
+			count, err := binary.ReadUvarint(r)
+			if err != nil || count > uint64(r.Len()) {
+				return nil, errgzipdelta
+			}
+			if _, err := io.CopyN(&out, r, int64(count)); err != nil {
+				return nil, errgzipdelta
+			}
+		case 'e':
+			return out.Bytes(), nil
+		default:
+			return nil, errgzipdelta
+		}
+		if int64(out.Len()) > limit {
+			return nil, errgzipdelta
+		}
+	}
+}
+
+// basereader reads blocks of the kept index tar, copies are mostly in
+// order, the index is reopened for backward ones
+type basereader struct {
+	f   *os.File
+	r   *gzip.Reader
+	pos int64
+}
+
+func (b *basereader) copyblocks(out io.Writer, start uint64, count uint64) error {
+
+	if start > 1<<40 || count > 1<<40 {
+		return errors.New("invalid copy")
+	}
+	offset := int64(start) * 512
+	if b.r == nil || offset < b.pos {
+		b.close()
+		f, err := os.Open(path.Join(statedir, "index.tgz"))
+		if err != nil {
+			return err
+		}
+		b.f = f
+		b.r, err = gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		b.pos = 0
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, b.r, offset-b.pos); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(out, b.r, int64(count)*512); err != nil {
+		return err
+	}
+	b.pos = offset + int64(count)*512
+	return nil
+}
+
+func (b *basereader) close() {
+
+	if b.f != nil {
+		b.f.Close()
+	}
+}
+
+// applyindexdelta writes the index tar rebuilt from the kept index and the
+// gzipped delta to out
+func applyindexdelta(out io.Writer, delta io.Reader) error {
+
+	archivein, err := gzip.NewReader(delta)
+	if err != nil {
+		return err
+	}
+	in := bufio.NewReader(archivein)
+
+	magic := make([]byte, len(deltamagic))
+	if _, err := io.ReadFull(in, magic); err != nil || string(magic) != deltamagic {
+		return errors.New("unsupported delta format")
+	}
+
+	base := &basereader{}
+	defer base.close()
+	h := sha256.New()
+	out = io.MultiWriter(out, h)
+
+	for {
+		op, err := in.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case deltacopy:
+			start, err := binary.ReadUvarint(in)
+			if err != nil {
+				return err
+			}
+			count, err := binary.ReadUvarint(in)
+			if err != nil {
+				return err
+			}
+			if err := base.copyblocks(out, start, count); err != nil {
+				return err
+			}
+		case deltaliteral:
+			count, err := binary.ReadUvarint(in)
+			if err != nil {
+				return err
+			}
+			if count > 1<<40 {
+				return errors.New("invalid literal")
+			}
+			if _, err := io.CopyN(out, in, int64(count)*512); err != nil {
+				return err
+			}
+		case deltaend:
+			sum := make([]byte, sha256.Size)
+			if _, err := io.ReadFull(in, sum); err != nil {
+				return err
+			}
+			if !bytes.Equal(sum, h.Sum(nil)) {
+				return errors.New("rebuilt index does not match")
+			}
+			return nil
+		default:
+			return fmt.Errorf("unknown delta operation %q", op)
+		}
+	}
+}
+
+// errsignature is returned if the image signature does not match pubkey
+var errsignature = errors.New("Image signature verification failed!")
+
+// loadpubkey reads a PEM encoded ed25519 public key
+func loadpubkey(fname string) (ed25519.PublicKey, error) {
+
+	if fips {
+		return nil, errors.New("Ed25519 signatures are not allowed in FIPS mode, use an OpenPGP keyring with RSA keys!")
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", fname)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", fname)
+	}
+	return pub, nil
+}
+
+// readindexrecords returns the image wide records sent in the leading pax
+// global headers of the index tgz indexname
+func readindexrecords(indexname string) (map[string]string, error) {
+
+	filein, err := os.Open(indexname)
+	if err != nil {
+		return nil, err
+	}
+	defer filein.Close()
+
+	archivein, err := gzip.NewReader(filein)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(archivein)
+
+	records := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeXGlobalHeader {
+			break
+		}
+		for k, v := range hdr.PAXRecords {
+			records[k] = v
+		}
+	}
+	return records, nil
+}
+
+// buildmanifest rebuilds the image manifest from the index tgz indexname and
+// its records. It also returns the manifest line of every regular file in
+// image order.
+func buildmanifest(indexname string, records map[string]string) ([]byte, []string, error) {
+
+	filein, err := os.Open(indexname)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer filein.Close()
+
+	archivein, err := gzip.NewReader(filein)
+	if err != nil {
+		return nil, nil, err
+	}
+	tr := tar.NewReader(archivein)
+
+	var manifest bytes.Buffer
+	manifest.WriteString(manifestheader)
+	manifest.WriteString(manifestrecords(records))
+	lines := []string{}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		var sha256hex string
+		if hdr.Typeflag == '0' && hdr.Size > 0 {
+			sha256hex = hdr.PAXRecords["OTA.sha256"]
+			if sha256hex == "" {
+				return nil, nil, errhashformat
+			}
+		}
+		line := manifestline(hdr, sha256hex)
+		if sha256hex != "" {
+			lines = append(lines, line)
+		}
+		manifest.WriteString(line)
+	}
+	return manifest.Bytes(), lines, nil
+}
+
+var errassembled = errors.New("Assembled image does not match the image manifest!")
+
+// manifestlinesof returns the manifest lines of all entries of the image
+// tgz tgzname
+func manifestlinesof(tgzname string) ([]string, error) {
+
+	filein, err := os.Open(tgzname)
+	if err != nil {
+		return nil, err
+	}
+	defer filein.Close()
+
+	archivein, err := gzip.NewReader(filein)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(archivein)
+
+	var lines []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var sha256hex string
+		if hdr.Typeflag == '0' && hdr.Size > 0 {
+			h := sha256.New()
+			if _, err := io.Copy(h, tr); err != nil {
+				return nil, err
+			}
+			sha256hex = hex.EncodeToString(h.Sum(nil))
+		}
+		lines = append(lines, manifestline(hdr, sha256hex))
+	}
+	return lines, nil
+}
+
+// verifyindex checks the manifest rebuilt from the index tgz indexname and
+// its records against the image signature sent with the index. It returns
+// the manifest line of every regular file in image order.
+func verifyindex(indexname string, records map[string]string) ([]string, error) {
+
+	manifest, lines, err := buildmanifest(indexname, records)
+	if err != nil {
+		return nil, err
+	}
+
+	signature := records["OTA.signature"]
+	pgpsignature := records["OTA.pgp-signature"]
+	if signature == "" && pgpsignature == "" {
+		return nil, errors.New("Image is not signed!")
+	}
+
+	// either signature is accepted
+	if pubkey != nil && signature != "" {
+		sig, err := base64.StdEncoding.DecodeString(signature)
+		if err == nil && ed25519.Verify(pubkey, manifest, sig) {
+			return lines, nil
+		}
+	}
+	if keyring != nil && pgpsignature != "" {
+		err := verifypgp(keyring, manifest, pgpsignature)
+		if err == nil {
+			return lines, nil
+		}
+		slog.Debug("OpenPGP signature not accepted", "error", err)
+	}
+	return nil, errsignature
+}
+
+// TUF (The Update Framework) metadata protects the update channel against
+// freeze, rollback and key compromise attacks. The targets describe the
+// image manifests. The format has to be identical in client.go and
+// server.go, see README.md.
+type tufkey struct {
+	KeyType string `json:"keytype"`
+	Scheme  string `json:"scheme"`
+	KeyVal  struct {
+		Public string `json:"public"` // hex
+	} `json:"keyval"`
+}
+
+type tufrole struct {
+	KeyIDs    []string `json:"keyids"`
+	Threshold int      `json:"threshold"`
+}
+
+// tufheader holds the fields common to the signed part of all metadata
+type tufheader struct {
+	Type        string    `json:"_type"`
+	SpecVersion string    `json:"spec_version"`
+	Version     int64     `json:"version"`
+	Expires     time.Time `json:"expires"`
+}
+
+type tufroot struct {
+	tufheader
+	ConsistentSnapshot bool               `json:"consistent_snapshot"`
+	Keys               map[string]tufkey  `json:"keys"`
+	Roles              map[string]tufrole `json:"roles"`
+}
+
+type tuftarget struct {
+	Length int64             `json:"length"`
+	Hashes map[string]string `json:"hashes"`
+	Custom map[string]string `json:"custom,omitempty"`
+}
+
+type tuftargets struct {
+	tufheader
+	Targets map[string]tuftarget `json:"targets"`
+}
+
+type tufmetafile struct {
+	Version int64             `json:"version"`
+	Length  int64             `json:"length,omitempty"`
+	Hashes  map[string]string `json:"hashes,omitempty"`
+}
+
+// tufmeta is the signed part of snapshot and timestamp metadata
+type tufmeta struct {
+	tufheader
+	Meta map[string]tufmetafile `json:"meta"`
+}
+
+type tufsignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"` // hex
+}
+
+// tufenvelope is a metadata file, the signatures cover the canonical JSON
+// encoding of signed
+type tufenvelope struct {
+	Signed     json.RawMessage `json:"signed"`
+	Signatures []tufsignature  `json:"signatures"`
+}
+
+// errmetanotfound is returned by transports for missing metadata files
+var errmetanotfound = errors.New("metadata not found")
+
+// metadata files are never larger
+const tufmaxsize = 1 << 20
+
+// canonicaljson encodes v as canonical JSON (sorted keys, no whitespace,
+// integers only), the signed form of TUF metadata
+func canonicaljson(v interface{}) ([]byte, error) {
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := writecanonical(&buf, generic); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writecanonical(buf *bytes.Buffer, v interface{}) error {
+
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case json.Number:
+		if _, err := strconv.ParseInt(string(v), 10, 64); err != nil {
+			return fmt.Errorf("canonical json: %s is no integer", v)
+		}
+		buf.WriteString(string(v))
+	case string:
+		// only quote and backslash are escaped
+		buf.WriteByte('"')
+		for i := 0; i < len(v); i++ {
+			if v[i] == '"' || v[i] == '\\' {
+				buf.WriteByte('\\')
+			}
+			buf.WriteByte(v[i])
+		}
+		buf.WriteByte('"')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writecanonical(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writecanonical(buf, k)
+			buf.WriteByte(':')
+			if err := writecanonical(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("canonical json: unsupported type %T", v)
+	}
+	return nil
+}
+
+// tufverify checks that the metadata env is signed by the threshold of the
+// keys of role in root and decodes its signed part into signed
+func tufverify(env *tufenvelope, root *tufroot, role string, signed interface{}) error {
+
+	data, err := canonicaljson(env.Signed)
+	if err != nil {
+		return err
+	}
+	r, found := root.Roles[role]
+	if !found || r.Threshold < 1 {
+		return fmt.Errorf("TUF root has no valid %s role!", role)
+	}
+
+	valid := map[string]bool{}
+	for _, sig := range env.Signatures {
+		authorized := false
+		for _, keyid := range r.KeyIDs {
+			authorized = authorized || keyid == sig.KeyID
+		}
+		key, found := root.Keys[sig.KeyID]
+		if !authorized || !found || key.KeyType != "ed25519" || key.Scheme != "ed25519" {
+			continue
+		}
+		pub, err := hex.DecodeString(key.KeyVal.Public)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			continue
+		}
+		sigbytes, err := hex.DecodeString(sig.Sig)
+		if err == nil && ed25519.Verify(pub, data, sigbytes) {
+			valid[sig.KeyID] = true
+		}
+	}
+	if len(valid) < r.Threshold {
+		return fmt.Errorf("TUF %s metadata has %d of %d required signatures!", role, len(valid), r.Threshold)
+	}
+
+	var header tufheader
+	if err := json.Unmarshal(env.Signed, &header); err != nil {
+		return err
+	}
+	if header.Type != role {
+		return fmt.Errorf("TUF %s metadata has the type %q!", role, header.Type)
+	}
+	return json.Unmarshal(env.Signed, signed)
+}
+
+// tufexpired reports metadata past its expiry, which is how clients notice
+// a server withholding updates (freeze attack)
+func tufexpired(header tufheader, now time.Time) error {
+
+	if now.After(header.Expires) {
+		return fmt.Errorf("TUF %s metadata expired at %s!", header.Type, header.Expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// tufstate returns the file name of the trusted metadata name, "" without
+// statedir
+func tufstate(name string) string {
+
+	if statedir == "" {
+		return ""
+	}
+	return path.Join(statedir, "tuf", name)
+}
+
+// loadtufstate decodes the signed part of the trusted metadata name into
+// signed, it was verified before it was saved
+func loadtufstate(name string, signed interface{}) error {
+
+	fname := tufstate(name)
+	if fname == "" {
+		return os.ErrNotExist
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	var env tufenvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return err
+	}
+	return json.Unmarshal(env.Signed, signed)
+}
+
+// savetufstate keeps the verified metadata name as trusted metadata
+func savetufstate(name string, data []byte) error {
+
+	fname := tufstate(name)
+	if fname == "" {
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(fname), 0755); err != nil {
+		return err
+	}
+	tmpfile, err := ioutil.TempFile(path.Dir(fname), name+"-")
+	if err != nil {
+		return err
+	}
+	_, err = tmpfile.Write(data)
+	if cerr := tmpfile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpfile.Name(), fname)
+	}
+	if err != nil {
+		os.Remove(tmpfile.Name())
+	}
+	return err
+}
+
+// fetchtuf downloads the metadata name, checks it against its description
+// info if known and verifies it with the keys of role in root
+func fetchtuf(t transport, name string, info *tufmetafile, root *tufroot, role string, signed interface{}) ([]byte, error) {
+
+	body, err := t.getmetadata(name)
+	if err != nil {
+		return nil, err
+	}
+	limit := int64(tufmaxsize)
+	if info != nil && info.Length > 0 {
+		limit = info.Length
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if cerr := body.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("TUF metadata %s is too large!", name)
+	}
+
+	if info != nil {
+		sum := sha256.Sum256(data)
+		if info.Length > 0 && int64(len(data)) != info.Length {
+			return nil, fmt.Errorf("TUF metadata %s has the wrong length!", name)
+		}
+		if h, found := info.Hashes["sha256"]; found && h != hex.EncodeToString(sum[:]) {
+			return nil, fmt.Errorf("TUF metadata %s has the wrong hash!", name)
+		}
+	}
+
+	var env tufenvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("TUF metadata %s: %s", name, err)
+	}
+	if err := tufverify(&env, root, role, signed); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// samekeys reports if role has the same keys in the roots a and b
+func samekeys(a *tufroot, b *tufroot, role string) bool {
+
+	ra, rb := a.Roles[role], b.Roles[role]
+	if ra.Threshold != rb.Threshold || len(ra.KeyIDs) != len(rb.KeyIDs) {
+		return false
+	}
+	for i := range ra.KeyIDs {
+		if ra.KeyIDs[i] != rb.KeyIDs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// tufrefresh updates the trusted TUF metadata from the server following the
+// TUF client workflow and returns the trusted targets. The trusted metadata
+// is kept in statedir/tuf, the initial root is read from -tuf.
+func tufrefresh(t transport) (*tuftargets, error) {
+
+	now := time.Now()
+
+	data, err := ioutil.ReadFile(tufstate("root.json"))
+	if tufstate("root.json") == "" || os.IsNotExist(err) {
+		data, err = ioutil.ReadFile(tufrootfile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var env tufenvelope
+	root := &tufroot{}
+	if err := json.Unmarshal(data, &env); err == nil {
+		err = json.Unmarshal(env.Signed, root)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("trusted TUF root: %s", err)
+	}
+
+	// every root version is signed by the keys of the previous one and
+	// its own keys
+	rotated := false
+	for {
+		name := fmt.Sprintf("%d.root.json", root.Version+1)
+		next := &tufroot{}
+		data, err := fetchtuf(t, name, nil, root, "root", next)
+		if err == errmetanotfound {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		json.Unmarshal(data, &env)
+		if err := tufverify(&env, next, "root", next); err != nil {
+			return nil, err
+		}
+		if next.Version != root.Version+1 {
+			return nil, fmt.Errorf("TUF metadata %s has the version %d!", name, next.Version)
+		}
+		rotated = rotated || !samekeys(root, next, "timestamp") || !samekeys(root, next, "snapshot")
+		root = next
+		if err := savetufstate("root.json", data); err != nil {
+			return nil, err
+		}
+		slog.Debug("TUF root updated", "version", root.Version)
+	}
+	if err := tufexpired(root.tufheader, now); err != nil {
+		return nil, err
+	}
+	if rotated && statedir != "" {
+		// recovers from fast-forward attacks with the replaced keys
+		os.Remove(tufstate("timestamp.json"))
+		os.Remove(tufstate("snapshot.json"))
+	}
+
+	timestamp := &tufmeta{}
+	data, err = fetchtuf(t, "timestamp.json", nil, root, "timestamp", timestamp)
+	if err != nil {
+		return nil, err
+	}
+	info, found := timestamp.Meta["snapshot.json"]
+	if !found {
+		return nil, errors.New("TUF timestamp metadata does not describe the snapshot!")
+	}
+	var trustedtimestamp tufmeta
+	if loadtufstate("timestamp.json", &trustedtimestamp) == nil {
+		if timestamp.Version < trustedtimestamp.Version || info.Version < trustedtimestamp.Meta["snapshot.json"].Version {
+			return nil, errors.New("TUF timestamp metadata is older than the trusted one (rollback attack?)!")
+		}
+	}
+	if err := tufexpired(timestamp.tufheader, now); err != nil {
+		return nil, err
+	}
+	if err := savetufstate("timestamp.json", data); err != nil {
+		return nil, err
+	}
+
+	snapshot := &tufmeta{}
+	data, err = fetchtuf(t, "snapshot.json", &info, root, "snapshot", snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.Version != info.Version {
+		return nil, fmt.Errorf("TUF snapshot metadata has the version %d instead of %d!", snapshot.Version, info.Version)
+	}
+	var trustedsnapshot tufmeta
+	if loadtufstate("snapshot.json", &trustedsnapshot) == nil {
+		for name, trusted := range trustedsnapshot.Meta {
+			if m, found := snapshot.Meta[name]; !found || m.Version < trusted.Version {
+				return nil, fmt.Errorf("TUF snapshot lists %s older than the trusted one (rollback attack?)!", name)
+			}
+		}
+	}
+	if err := tufexpired(snapshot.tufheader, now); err != nil {
+		return nil, err
+	}
+	if err := savetufstate("snapshot.json", data); err != nil {
+		return nil, err
+	}
+
+	info, found = snapshot.Meta["targets.json"]
+	if !found {
+		return nil, errors.New("TUF snapshot metadata does not describe the targets!")
+	}
+	targets := &tuftargets{}
+	data, err = fetchtuf(t, "targets.json", &info, root, "targets", targets)
+	if err != nil {
+		return nil, err
+	}
+	if targets.Version != info.Version {
+		return nil, fmt.Errorf("TUF targets metadata has the version %d instead of %d!", targets.Version, info.Version)
+	}
+	if err := tufexpired(targets.tufheader, now); err != nil {
+		return nil, err
+	}
+	if err := savetufstate("targets.json", data); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+// checktuftarget refreshes the TUF metadata and checks the manifest rebuilt
+// from the index tgz indexname against the target of image. It returns the
+// manifest line of every regular file in image order.
+func checktuftarget(t transport, image string, indexname string, records map[string]string) ([]string, error) {
+
+	if fips {
+		return nil, errors.New("TUF metadata signed with Ed25519 is not allowed in FIPS mode!")
+	}
+	targets, err := tufrefresh(t)
+	if err != nil {
+		return nil, err
+	}
+	target, found := targets.Targets[image]
+	if !found {
+		return nil, fmt.Errorf("Image %s is no TUF target!", image)
+	}
+
+	manifest, lines, err := buildmanifest(indexname, records)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(manifest)
+	if int64(len(manifest)) != target.Length || target.Hashes["sha256"] != hex.EncodeToString(sum[:]) {
+		return nil, errors.New("Image does not match its TUF target!")
+	}
+	slog.Debug("image matches TUF targets", "version", targets.Version)
+	return lines, nil
+}
+
+// verifyarchive implements the "verify-archive" command, which checks an
+// assembled image tgz offline against a signed manifest (see server
+// manifest and server sign) and prints the result of every entry
+func verifyarchive(args []string) int {
+
+	flags := flag.NewFlagSet("verify-archive", flag.ExitOnError)
+	pmanifest := flags.String("manifest", "", "manifest of the image, as written by \"server manifest\" (required)")
+	psig := flags.String("sig", "", "ed25519 signature of the manifest (<image>.tgz.sig of \"server sign\")")
+	pasc := flags.String("asc", "", "armored OpenPGP signature of the manifest (<image>.tgz.asc)")
+	ppubkey := flags.String("pubkey", "", "ed25519 public key (PEM) for -sig")
+	pkeyring := flags.String("keyring", "", "OpenPGP keyring (gpg --export) for -asc")
+	pquiet := flags.Bool("quiet", false, "only print entries which do not match")
+	pdebug := flags.Bool("debug", false, "print the manifest lines of mismatching entries")
+	flags.Usage = func() {
+		fmt.Println("usage: verify-archive [flags] <image.tgz>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	debug = *pdebug
+
+	if *pmanifest == "" || flags.NArg() != 1 || (*psig == "" && *pasc == "") ||
+		(*psig != "") != (*ppubkey != "") || (*pasc != "") != (*pkeyring != "") {
+		flags.Usage()
+		return 2
+	}
+
+	manifest, err := ioutil.ReadFile(*pmanifest)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	if !bytes.HasPrefix(manifest, []byte(manifestheader)) {
+		fmt.Printf("%s: not an image manifest\n", *pmanifest)
+		return 2
+	}
+
+	// either signature is accepted, like for the index
+	signed := false
+	if *psig != "" {
+		key, err := loadpubkey(*ppubkey)
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		data, err := ioutil.ReadFile(*psig)
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		signed = err == nil && ed25519.Verify(key, manifest, sig)
+	}
+	if *pasc != "" && !signed {
+		keys, err := loadkeyring(*pkeyring)
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		armored, err := ioutil.ReadFile(*pasc)
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		err = verifypgp(keys, manifest, string(armored))
+		signed = err == nil
+		if debug && err != nil {
+			fmt.Printf("OpenPGP signature: %s\n", err)
+		}
+	}
+	if !signed {
+		fmt.Printf("FAIL signature: %s\n", errsignature)
+		return 1
+	}
+	fmt.Println("ok signature")
+
+	// entries are compared by name, the client appends downloaded files
+	// after the local ones and names may occur more than once
+	expected := map[string][]string{}
+	var names []string
+	for _, line := range strings.Split(strings.TrimPrefix(string(manifest), manifestheader), "\n") {
+		if line == "" || strings.HasPrefix(line, "record ") {
+			continue
+		}
+		name := manifestlinename(line)
+		if _, found := expected[name]; !found {
+			names = append(names, name)
+		}
+		expected[name] = append(expected[name], line+"\n")
+	}
+
+	lines, err := manifestlinesof(flags.Arg(0))
+	if err != nil {
+		fmt.Printf("%s: %s\n", flags.Arg(0), err)
+		return 1
+	}
+	actual := map[string][]string{}
+	var extra []string
+	for _, line := range lines {
+		name := manifestlinename(line)
+		if _, found := expected[name]; !found && actual[name] == nil {
+			extra = append(extra, name)
+		}
+		actual[name] = append(actual[name], line)
+	}
+
+	failed := 0
+	for _, name := range names {
+		want, got := expected[name], actual[name]
+		sort.Strings(want)
+		sort.Strings(got)
+		result := "ok"
+		switch {
+		case len(got) == 0:
+			result = "MISSING"
+		case strings.Join(want, "") != strings.Join(got, ""):
+			result = "MISMATCH"
+		}
+		if result != "ok" {
+			failed++
+		}
+		if result != "ok" || !*pquiet {
+			fmt.Printf("%s %s\n", result, strconv.Quote(name))
+		}
+		if result == "MISMATCH" && debug {
+			fmt.Printf("  expected: %s  found:    %s", strings.Join(want, "  "), strings.Join(got, "  "))
+		}
+	}
+	for _, name := range extra {
+		failed++
+		fmt.Printf("EXTRA %s\n", strconv.Quote(name))
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d entries do not match the manifest\n", failed, len(names)+len(extra))
+		return 1
+	}
+	fmt.Printf("all %d entries match the manifest\n", len(names))
+	return 0
+}
+
+// pgpkey is an OpenPGP public key or subkey
+type pgpkey struct {
+	algo byte
+	rsa  *rsa.PublicKey
+	ed   ed25519.PublicKey
+}
+
+// pgppacket is an OpenPGP packet
+type pgppacket struct {
+	tag  byte
+	body []byte
+}
+
+// OID of the Ed25519 curve in OpenPGP EdDSA keys
+var pgped25519oid = []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0xda, 0x47, 0x0f, 0x01}
+
+// pgpdearmor returns the binary data of the ASCII armored blocks, keyrings
+// may be exports of several keys concatenated
+func pgpdearmor(armored string) ([]byte, error) {
+
+	var data []byte
+	var b64 strings.Builder
+	found, inbody := false, false
+	for _, line := range strings.Split(armored, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "-----BEGIN PGP "):
+			found, inbody = true, true
+			b64.Reset()
+		case strings.HasPrefix(line, "-----END PGP ") && inbody:
+			inbody = false
+			block, err := base64.StdEncoding.DecodeString(b64.String())
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, block...)
+		case !inbody || line == "" || strings.Contains(line, ": ") || strings.HasPrefix(line, "="):
+			// armor headers and checksum
+		default:
+			b64.WriteString(line)
+		}
+	}
+	if !found {
+		return nil, errors.New("no OpenPGP armor found")
+	}
+	if inbody {
+		return nil, errors.New("unterminated OpenPGP armor")
+	}
+	return data, nil
+}
+
+// pgpreadpackets splits binary OpenPGP data into packets
+func pgpreadpackets(data []byte) ([]pgppacket, error) {
+
+	var packets []pgppacket
+	for len(data) > 0 {
+		ctb := data[0]
+		if ctb&0x80 == 0 {
+			return nil, errors.New("invalid OpenPGP packet header")
+		}
+		var tag byte
+		var length, hdrlen int
+		if ctb&0x40 == 0 { // old format
+			tag = (ctb >> 2) & 0x0f
+			switch ctb & 3 {
+			case 0:
+				if len(data) < 2 {
+					return nil, io.ErrUnexpectedEOF
+				}
+				length, hdrlen = int(data[1]), 2
+			case 1:
+				if len(data) < 3 {
+					return nil, io.ErrUnexpectedEOF
+				}
+				length, hdrlen = int(data[1])<<8|int(data[2]), 3
+			case 2:
+				if len(data) < 5 {
+					return nil, io.ErrUnexpectedEOF
+				}
+				length, hdrlen = int(binary.BigEndian.Uint32(data[1:5])), 5
+			default:
+				length, hdrlen = len(data)-1, 1
+			}
+		} else { // new format
+			tag = ctb & 0x3f
+			if len(data) < 2 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			switch o := int(data[1]); {
+			case o < 192:
+				length, hdrlen = o, 2
+			case o < 224:
+				if len(data) < 3 {
+					return nil, io.ErrUnexpectedEOF
+				}
+				length, hdrlen = (o-192)<<8+int(data[2])+192, 3
+			case o == 255:
+				if len(data) < 6 {
+					return nil, io.ErrUnexpectedEOF
+				}
+				length, hdrlen = int(binary.BigEndian.Uint32(data[2:6])), 6
+			default:
+				return nil, errors.New("partial OpenPGP packets are not supported")
+			}
+		}
+		if length < 0 || len(data)-hdrlen < length {
+			return nil, io.ErrUnexpectedEOF
+		}
+		packets = append(packets, pgppacket{tag: tag, body: data[hdrlen : hdrlen+length]})
+		data = data[hdrlen+length:]
+	}
+	return packets, nil
+}
+
+// pgpreadmpi returns the value of the multiprecision integer at the start
+// of data and the remaining data
+func pgpreadmpi(data []byte) ([]byte, []byte, error) {
+
+	if len(data) < 2 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	n := (int(binary.BigEndian.Uint16(data)) + 7) / 8
+	if len(data)-2 < n {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	return data[2 : 2+n], data[2+n:], nil
+}
+
+// pgpparsekey parses a version 4 public key packet, other versions and
+// algorithms return nil
+func pgpparsekey(body []byte) (*pgpkey, error) {
+
+	if len(body) < 6 || body[0] != 4 {
+		return nil, nil
+	}
+	key := &pgpkey{algo: body[5]}
+	data := body[6:]
+	switch key.algo {
+	case 1, 3: // RSA
+		n, data, err := pgpreadmpi(data)
+		if err != nil {
+			return nil, err
+		}
+		e, _, err := pgpreadmpi(data)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("unsupported RSA exponent")
+		}
+		key.rsa = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+	case 22: // EdDSA
+		if len(data) < 1 || len(data)-1 < int(data[0]) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if !bytes.Equal(data[1:1+int(data[0])], pgped25519oid) {
+			return nil, nil
+		}
+		point, _, err := pgpreadmpi(data[1+int(data[0]):])
+		if err != nil {
+			return nil, err
+		}
+		if len(point) != 1+ed25519.PublicKeySize || point[0] != 0x40 {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		key.ed = ed25519.PublicKey(point[1:])
+	case 27: // Ed25519
+		if len(data) < ed25519.PublicKeySize {
+			return nil, io.ErrUnexpectedEOF
+		}
+		key.ed = ed25519.PublicKey(data[:ed25519.PublicKeySize])
+	default:
+		return nil, nil
+	}
+	return key, nil
+}
+
+// loadkeyring reads all supported public keys and subkeys from an OpenPGP
+// keyring file, binary or armored (gpg --export [--armor])
+func loadkeyring(fname string) ([]pgpkey, error) {
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(data, []byte("-----BEGIN PGP ")) {
+		data, err = pgpdearmor(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fname, err)
+		}
+	}
+	packets, err := pgpreadpackets(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fname, err)
+	}
+
+	var keys []pgpkey
+	for _, packet := range packets {
+		if packet.tag != 6 && packet.tag != 14 { // public key, public subkey
+			continue
+		}
+		key, err := pgpparsekey(packet.body)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fname, err)
+		}
+		if key != nil {
+			keys = append(keys, *key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no supported OpenPGP keys found", fname)
+	}
+	return keys, nil
+}
+
+// pgphashes maps OpenPGP hash algorithm ids to hash functions
+var pgphashes = map[byte]crypto.Hash{
+	8:  crypto.SHA256,
+	9:  crypto.SHA384,
+	10: crypto.SHA512,
+	11: crypto.SHA224,
+}
+
+// verifypgp checks the armored OpenPGP detached signature of signed against
+// the keys
+func verifypgp(keys []pgpkey, signed []byte, armored string) error {
+
+	data, err := pgpdearmor(armored)
+	if err != nil {
+		return err
+	}
+	packets, err := pgpreadpackets(data)
+	if err != nil {
+		return err
+	}
+
+	lasterr := errors.New("no signature packet found")
+	for _, packet := range packets {
+		if packet.tag != 2 {
+			continue
+		}
+		lasterr = pgpverifysignature(keys, signed, packet.body)
+		if lasterr == nil {
+			return nil
+		}
+	}
+	return lasterr
+}
+
+// pgpverifysignature checks a single version 4 signature packet
+func pgpverifysignature(keys []pgpkey, signed []byte, sig []byte) error {
+
+	if len(sig) < 6 || sig[0] != 4 {
+		return errors.New("unsupported signature version")
+	}
+	sigtype, algo, hashalgo := sig[1], sig[2], sig[3]
+	if fips && algo != 1 && algo != 3 {
+		return fmt.Errorf("signature algorithm %d not allowed in FIPS mode", algo)
+	}
+	hashedlen := int(binary.BigEndian.Uint16(sig[4:6]))
+	if len(sig) < 6+hashedlen+2 {
+		return io.ErrUnexpectedEOF
+	}
+	hashed := sig[:6+hashedlen]
+	unhashedlen := int(binary.BigEndian.Uint16(sig[6+hashedlen:]))
+	rest := sig[6+hashedlen+2:]
+	if len(rest) < unhashedlen+2 {
+		return io.ErrUnexpectedEOF
+	}
+	left16 := rest[unhashedlen : unhashedlen+2]
+	values := rest[unhashedlen+2:]
+
+	hashfunc, found := pgphashes[hashalgo]
+	if !found {
+		return fmt.Errorf("unsupported hash algorithm %d", hashalgo)
+	}
+	h := hashfunc.New()
+	switch sigtype {
+	case 0x00: // binary document
+		h.Write(signed)
+	case 0x01: // canonical text document
+		h.Write(bytes.Replace(signed, []byte("\n"), []byte("\r\n"), -1))
+	default:
+		return fmt.Errorf("unsupported signature type %d", sigtype)
+	}
+	h.Write(hashed)
+	var trailer [6]byte
+	trailer[0], trailer[1] = 4, 0xff
+	binary.BigEndian.PutUint32(trailer[2:], uint32(len(hashed)))
+	h.Write(trailer[:])
+	digest := h.Sum(nil)
+	if !bytes.Equal(digest[:2], left16) {
+		return errors.New("signature does not match")
+	}
+
+	var edsig []byte
+	switch algo {
+	case 22: // EdDSA r, s
+		r, values, err := pgpreadmpi(values)
+		if err != nil {
+			return err
+		}
+		s, _, err := pgpreadmpi(values)
+		if err != nil {
+			return err
+		}
+		if len(r) > 32 || len(s) > 32 {
+			return errors.New("invalid EdDSA signature")
+		}
+		edsig = make([]byte, ed25519.SignatureSize)
+		copy(edsig[32-len(r):32], r)
+		copy(edsig[64-len(s):], s)
+	case 27: // Ed25519
+		if len(values) < ed25519.SignatureSize {
+			return io.ErrUnexpectedEOF
+		}
+		edsig = values[:ed25519.SignatureSize]
+	}
+
+	for _, key := range keys {
+		switch {
+		case key.rsa != nil && (algo == 1 || algo == 3):
+			s, _, err := pgpreadmpi(values)
+			if err != nil {
+				return err
+			}
+			size := (key.rsa.N.BitLen() + 7) / 8
+			if len(s) > size {
+				continue
+			}
+			padded := make([]byte, size)
+			copy(padded[size-len(s):], s)
+			if rsa.VerifyPKCS1v15(key.rsa, hashfunc, digest, padded) == nil {
+				return nil
+			}
+		case key.ed != nil && edsig != nil:
+			if ed25519.Verify(key.ed, digest, edsig) {
+				return nil
+			}
+		}
+	}
+	return errors.New("signature does not match any key in the keyring")
+}
+
+// unsafepath reports whether an entry name is empty, absolute or escapes
+// the image root with ".." elements
+func unsafepath(name string) bool {
+
+	if name == "" || strings.HasPrefix(name, "/") {
+		return true
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// pathset detects duplicate member paths of an image. Directories may
+// appear more than once.
+type pathset struct {
+	caseinsensitive bool
+	seen            map[string]*tar.Header
+}
+
+func newpathset(caseinsensitive bool) *pathset {
+	return &pathset{caseinsensitive: caseinsensitive, seen: map[string]*tar.Header{}}
+}
+
+// add returns the name of an earlier entry with the same path as hdr, ""
+// if there is none
+func (s *pathset) add(hdr *tar.Header) string {
+
+	key := path.Clean("/" + hdr.Name)
+	if s.caseinsensitive {
+		key = strings.ToLower(key)
+	}
+	prev, found := s.seen[key]
+	if found && !(prev.Typeflag == tar.TypeDir && hdr.Typeflag == tar.TypeDir) {
+		return prev.Name
+	}
+	s.seen[key] = &tar.Header{Name: hdr.Name, Typeflag: hdr.Typeflag}
+	return ""
+}
+
+// checkentry rejects tar entries which are unsafe to install. Names are not
+// normalized, as that would change what the image signature covers.
+func checkentry(hdr *tar.Header) error {
+
+	if unsafepath(hdr.Name) {
+		return fmt.Errorf("Unsafe entry name %q!", hdr.Name)
+	}
+	if hdr.Typeflag == tar.TypeLink && unsafepath(hdr.Linkname) {
+		return fmt.Errorf("Unsafe hard link target %q in %s!", hdr.Linkname, hdr.Name)
+	}
+	return nil
+}
+
+// escapingsymlink reports whether the symlink hdr leaves the image root: a
+// relative target climbing above it, or an absolute target which is no
+// entry of the image (names holds the clean absolute entry names)
+func escapingsymlink(hdr *tar.Header, names map[string]bool) bool {
+
+	if strings.HasPrefix(hdr.Linkname, "/") {
+		return !names[path.Clean(hdr.Linkname)]
+	}
+	depth := 0 // of the directory holding the link
+	if dir := path.Dir(path.Clean("/" + hdr.Name)); dir != "/" {
+		depth = strings.Count(dir, "/")
+	}
+	for _, elem := range strings.Split(hdr.Linkname, "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+	return false
+}
+
+// unsafeentry returns why an entry is unsafe to install, "" if it is not
+func unsafeentry(hdr *tar.Header, names map[string]bool) string {
+
+	switch {
+	case (hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock) && !allowdevices:
+		return "device node without -allow-devices"
+	case hdr.Typeflag == tar.TypeSymlink && noescapingsymlinks && escapingsymlink(hdr, names):
+		return fmt.Sprintf("symlink to %s leaves the image", hdr.Linkname)
+	case hdr.Typeflag == tar.TypeReg && nosetuid && hdr.Mode&06000 != 0:
+		return "setuid/setgid file"
+	}
+	return ""
+}
+
+// checkindexentries is the validation pass over the index indexname before
+// anything is written. Unsafe entries fail with -unsafe-entries reject,
+// otherwise the entries to drop are returned by their number (pax global
+// headers not counted), setuid/setgid bits are cleared by installheader.
+// Hard links to dropped entries are dropped as well.
+func checkindexentries(indexname string) (map[int]bool, error) {
+
+	filein, err := os.Open(indexname)
+	if err != nil {
+		return nil, err
+	}
+	defer filein.Close()
+	archivein, err := gzip.NewReader(filein)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(archivein)
+
+	var hdrs []*tar.Header
+	names := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		hdrs = append(hdrs, hdr)
+		names[path.Clean("/"+hdr.Name)] = true
+	}
+
+	drop := map[int]bool{}
+	dropped := map[string]bool{}
+	for n, hdr := range hdrs {
+		reason := unsafeentry(hdr, names)
+		if reason == "" && hdr.Typeflag == tar.TypeLink && dropped[path.Clean("/"+hdr.Linkname)] {
+			reason = "hard link to a dropped entry"
+		}
+		if reason == "" {
+			continue
+		}
+		if unsafepolicy == "reject" {
+			return nil, fmt.Errorf("Unsafe entry %s (%s) rejected (see -unsafe-entries)!", hdr.Name, reason)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			slog.Warn("clearing setuid/setgid bits", "path", hdr.Name, "reason", reason)
+			continue
+		}
+		slog.Warn("unsafe entry dropped", "path", hdr.Name, "reason", reason)
+		drop[n] = true
+		dropped[path.Clean("/"+hdr.Name)] = true
+	}
+	return drop, nil
+}
+
+// stripotarecords removes the records added to the index by the server
+func stripotarecords(hdr *tar.Header) {
+
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "OTA.") {
+			delete(hdr.PAXRecords, k)
+		}
+	}
+}
+
+// selinuxrecord is the pax record holding the SELinux label of an entry
+const selinuxrecord = "SCHILY.xattr.security.selinux"
+
+// filecontext is a line of a SELinux file_contexts spec
+type filecontext struct {
+	re       *regexp.Regexp
+	typeflag byte // 0 for all types
+	context  string
+}
+
+// file type fields of file_contexts specs
+var filecontexttypes = map[string]byte{
+	"--": tar.TypeReg, "-d": tar.TypeDir, "-l": tar.TypeSymlink,
+	"-c": tar.TypeChar, "-b": tar.TypeBlock, "-p": tar.TypeFifo, "-s": 0xff,
+}
+
+// loadfilecontexts reads a SELinux file_contexts spec
+// ("<path regex> [<file type>] <context>" per line)
+func loadfilecontexts(fname string) ([]filecontext, error) {
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var specs []filecontext
+	for n, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var spec filecontext
+		switch len(fields) {
+		case 2:
+			spec.context = fields[1]
+		case 3:
+			typeflag, found := filecontexttypes[fields[1]]
+			if !found {
+				return nil, fmt.Errorf("%s:%d: unknown file type %s", fname, n+1, fields[1])
+			}
+			spec.typeflag = typeflag
+			spec.context = fields[2]
+		default:
+			return nil, fmt.Errorf("%s:%d: invalid spec", fname, n+1)
+		}
+		spec.re, err = regexp.Compile("^(?:" + fields[0] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", fname, n+1, err)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// filecontextof returns the label of the spec line matching hdr last, ""
+// if none matches or the label is <<none>>
+func filecontextof(specs []filecontext, hdr *tar.Header) string {
+
+	name := path.Clean("/" + hdr.Name)
+	typeflag := hdr.Typeflag
+	if typeflag == tar.TypeRegA || typeflag == tar.TypeLink {
+		typeflag = tar.TypeReg
+	}
+	for i := len(specs) - 1; i >= 0; i-- {
+		if specs[i].typeflag != 0 && specs[i].typeflag != typeflag {
+			continue
+		}
+		if specs[i].re.MatchString(name) {
+			if specs[i].context == "<<none>>" {
+				return ""
+			}
+			return specs[i].context
+		}
+	}
+	return ""
+}
+
+// parseowner parses the -owner argument "<uid>:<gid>"
+func parseowner(owner string) (int, int, error) {
+
+	var uid, gid int
+	if _, err := fmt.Sscanf(owner, "%d:%d", &uid, &gid); err != nil || uid < 0 || gid < 0 {
+		return -1, -1, fmt.Errorf("invalid owner %s, expected <uid>:<gid>", owner)
+	}
+	return uid, gid, nil
+}
+
+// installheader returns the header written to the assembled image for the
+// image entry hdr, with the SELinux label, owner and umask applied, and
+// setuid/setgid bits cleared with -unsafe-entries sanitize. hdr is not
+// changed, it is still checked against the manifest.
+func installheader(hdr *tar.Header) *tar.Header {
+
+	sanitize := nosetuid && unsafepolicy == "sanitize" && hdr.Typeflag == tar.TypeReg && hdr.Mode&06000 != 0
+	if filecontexts == nil && defaultuid < 0 && installumask == 0 && !sanitize {
+		return hdr
+	}
+	out := *hdr
+	if filecontexts != nil {
+		if label := filecontextof(filecontexts, hdr); label != "" {
+			out.Xattrs = nil // deprecated, duplicated in PAXRecords
+			out.PAXRecords = map[string]string{selinuxrecord: label}
+			for k, v := range hdr.PAXRecords {
+				if k != selinuxrecord {
+					out.PAXRecords[k] = v
+				}
+			}
+			out.Format = tar.FormatPAX
+		}
+	}
+	if defaultuid >= 0 {
+		out.Uid = defaultuid
+		out.Gid = defaultgid
+		out.Uname = ""
+		out.Gname = ""
+	}
+	out.Mode = hdr.Mode &^ installumask
+	if sanitize {
+		out.Mode &^= 06000
+	}
+	return &out
+}
+
+// splitdest is the destination of the entries below an image subtree, a
+// .tgz file or a directory, with names relative to the subtree
+type splitdest struct {
+	subtree string // absolute and clean, e.g. "/boot"
+	dst     string
+}
+
+// parsesplits parses the -split argument, a comma separated list of
+// <subtree>=<.tgz file or directory>
+func parsesplits(arg string) ([]splitdest, error) {
+
+	var dests []splitdest
+	for _, split := range strings.Split(arg, ",") {
+		parts := strings.SplitN(split, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid split %s, expected <subtree>=<dst>", split)
+		}
+		subtree := path.Clean("/" + parts[0])
+		if subtree == "/" {
+			return nil, fmt.Errorf("invalid split %s, use -dst for the whole image", split)
+		}
+		for _, d := range dests {
+			if d.subtree == subtree {
+				return nil, fmt.Errorf("subtree %s is split twice", subtree)
+			}
+		}
+		dests = append(dests, splitdest{subtree: subtree, dst: parts[1]})
+	}
+	return dests, nil
+}
+
+// routeentry returns the index in splits of the destination of hdr, -1 for
+// <dst>, and the header with the name relative to the subtree. The longest
+// matching subtree wins.
+func routeentry(hdr *tar.Header) (int, *tar.Header, error) {
+
+	name := path.Clean("/" + hdr.Name)
+	index := -1
+	for i, d := range splits {
+		if (name == d.subtree || strings.HasPrefix(name, d.subtree+"/")) && (index < 0 || len(d.subtree) > len(splits[index].subtree)) {
+			index = i
+		}
+	}
+	if index < 0 {
+		return -1, hdr, nil
+	}
+
+	subtree := splits[index].subtree
+	out := *hdr
+	out.Name = "." + strings.TrimPrefix(name, subtree)
+	if out.Name == "." {
+		out.Name = "./"
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		target := path.Clean("/" + hdr.Linkname)
+		if !strings.HasPrefix(target, subtree+"/") {
+			return 0, nil, fmt.Errorf("Hard link %s to %s crosses the split of %s!", hdr.Name, hdr.Linkname, subtree)
+		}
+		out.Linkname = "." + strings.TrimPrefix(target, subtree)
+	}
+	return index, &out, nil
+}
+
+// entrywriter receives the entries of an output, like tar.Writer
+type entrywriter interface {
+	WriteHeader(hdr *tar.Header) error
+	Write(b []byte) (int, error)
+	Close() error
+}
+
+// splitoutput is an opened -split destination
+type splitoutput struct {
+	splitdest
+	w        entrywriter
+	file     *os.File // of .tgz destinations
+	expected []string // manifest lines
+}
+
+// outputs routes the entries of the assembled image to <dst> and the -split
+// destinations
+type outputs struct {
+	main    *tar.Writer
+	dests   []*splitoutput
+	current entrywriter
+}
+
+// newoutputs opens the -split destinations, main receives all other entries
+func newoutputs(main *tar.Writer) (*outputs, error) {
+
+	o := &outputs{main: main, current: main}
+	for _, d := range splits {
+		out := &splitoutput{splitdest: d}
+		if strings.HasSuffix(d.dst, ".tgz") {
+			f, err := os.Create(d.dst)
+			if err != nil {
+				o.abort()
+				return nil, err
+			}
+			out.file = f
+			out.w = newtgzwriter(f)
+		} else {
+			if err := os.MkdirAll(d.dst, 0755); err != nil {
+				o.abort()
+				return nil, err
+			}
+			out.w = &dirwriter{root: d.dst}
+		}
+		o.dests = append(o.dests, out)
+	}
+	return o, nil
+}
+
+func (o *outputs) WriteHeader(hdr *tar.Header) error {
+
+	index, routed, err := routeentry(hdr)
+	if err != nil {
+		return err
+	}
+	o.current = o.main
+	if index >= 0 {
+		o.current = o.dests[index].w
+	}
+	return o.current.WriteHeader(routed)
+}
+
+func (o *outputs) Write(b []byte) (int, error) {
+	return o.current.Write(b)
+}
+
+// close closes the -split destinations, the main output is closed by the
+// caller
+func (o *outputs) close() error {
+
+	for _, d := range o.dests {
+		if err := d.w.Close(); err != nil {
+			return err
+		}
+		if d.file != nil {
+			if err := d.file.Close(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// abort removes the .tgz destinations after a failure, directories can
+// not be rolled back
+func (o *outputs) abort() {
+
+	for _, d := range o.dests {
+		if d.file != nil {
+			d.file.Close()
+			os.Remove(d.dst)
+		}
+	}
+}
+
+// verify reads the -split destinations back and checks them against their
+// expected manifest lines
+func (o *outputs) verify() error {
+
+	for _, d := range o.dests {
+		var err error
+		if d.file != nil {
+			var lines []string
+			lines, err = manifestlinesof(d.dst)
+			if err == nil {
+				sort.Strings(lines)
+				sort.Strings(d.expected)
+				if strings.Join(lines, "") != strings.Join(d.expected, "") {
+					err = errassembled
+				}
+			}
+		} else {
+			err = verifydir(d.dst, d.expected)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", d.dst, err)
+		}
+		slog.Debug("split destination verified", "dst", d.dst)
+	}
+	return nil
+}
+
+// tgzwriter writes a gzipped tar
+type tgzwriter struct {
+	*tar.Writer
+	gz *gzip.Writer
+}
+
+func newtgzwriter(out io.Writer) *tgzwriter {
+
+	gz := gzip.NewWriter(out)
+	return &tgzwriter{Writer: tar.NewWriter(gz), gz: gz}
+}
+
+func (t *tgzwriter) Close() error {
+
+	if err := t.Writer.Close(); err != nil {
+		return err
+	}
+	return t.gz.Close() // write gzip footer
+}
+
+// dirwriter extracts entries into the directory root. Entries replace
+// existing files, but never follow symlinks below root.
+type dirwriter struct {
+	root    string
+	file    *os.File
+	pending *tar.Header   // attributes to set when file is complete
+	dirs    []*tar.Header // attributes set on Close, after their content
+	links   []*tar.Header // hard links to downloaded files, which follow
+}
+
+// dirheader returns the header of an entry as extracted by a dirwriter:
+// only permission bits, the owner only when running as root, and symlinks
+// always have mode 0777. User and group names and pax records are not
+// compared with the extracted tree.
+func dirheader(hdr *tar.Header) *tar.Header {
+
+	out := *hdr
+	out.Uname, out.Gname = "", ""
+	out.PAXRecords = nil
+	out.Mode = hdr.Mode & 07777
+	if hdr.Typeflag == tar.TypeSymlink {
+		out.Mode = 0777
+	}
+	if os.Geteuid() != 0 {
+		out.Uid = os.Geteuid()
+		out.Gid = os.Getegid()
+	}
+	return &out
+}
+
+// checkparents fails if a parent of the entry name below root is not a
+// directory, e.g. a symlink created by an earlier entry
+func (d *dirwriter) checkparents(name string) error {
+
+	dir := d.root
+	elems := strings.Split(path.Dir(path.Clean("/"+name)), "/")
+	for _, elem := range elems {
+		if elem == "" {
+			continue
+		}
+		dir = filepath.Join(dir, elem)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return os.MkdirAll(dir, 0755)
+		}
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("Entry %s is below %s, which is no directory!", name, dir)
+		}
+	}
+	return nil
+}
+
+func (d *dirwriter) WriteHeader(hdr *tar.Header) error {
+
+	if err := d.finish(); err != nil {
+		return err
+	}
+	if err := d.checkparents(hdr.Name); err != nil {
+		return err
+	}
+	name := filepath.Join(d.root, hdr.Name)
+
+	// replace what is there, except directories
+	fi, err := os.Lstat(name)
+	if err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(name); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(name, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+		d.dirs = append(d.dirs, hdr)
+		return nil
+	case tar.TypeReg:
+		d.file, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	case tar.TypeSymlink:
+		err = os.Symlink(hdr.Linkname, name)
+	case tar.TypeLink:
+		if _, err := os.Lstat(filepath.Join(d.root, hdr.Linkname)); os.IsNotExist(err) {
+			d.links = append(d.links, hdr)
+			return nil
+		}
+		return d.link(hdr)
+	case tar.TypeChar:
+		err = syscall.Mknod(name, syscall.S_IFCHR|0600, int(mkdev(hdr.Devmajor, hdr.Devminor)))
+	case tar.TypeBlock:
+		err = syscall.Mknod(name, syscall.S_IFBLK|0600, int(mkdev(hdr.Devmajor, hdr.Devminor)))
+	case tar.TypeFifo:
+		err = syscall.Mkfifo(name, 0600)
+	default:
+		return fmt.Errorf("Cannot extract %s of type %c!", hdr.Name, hdr.Typeflag)
+	}
+	if err != nil {
+		return err
+	}
+	d.pending = hdr
+	return nil
+}
+
+// link creates the hard link hdr
+func (d *dirwriter) link(hdr *tar.Header) error {
+
+	if err := d.checkparents(hdr.Linkname); err != nil {
+		return err
+	}
+	return os.Link(filepath.Join(d.root, hdr.Linkname), filepath.Join(d.root, hdr.Name))
+}
+
+func (d *dirwriter) Write(b []byte) (int, error) {
+
+	if d.file == nil {
+		return 0, errors.New("write of an entry without content")
+	}
+	return d.file.Write(b)
+}
+
+// finish closes the current entry and sets its attributes
+func (d *dirwriter) finish() error {
+
+	if d.file != nil {
+		err := d.file.Close()
+		d.file = nil
+		if err != nil {
+			return err
+		}
+	}
+	if d.pending != nil {
+		hdr := d.pending
+		d.pending = nil
+		return setattrs(filepath.Join(d.root, hdr.Name), hdr)
+	}
+	return nil
+}
+
+func (d *dirwriter) Close() error {
+
+	if err := d.finish(); err != nil {
+		return err
+	}
+	for _, hdr := range d.links {
+		if err := d.link(hdr); err != nil {
+			return err
+		}
+	}
+	// innermost first, their parents' times change otherwise
+	for i := len(d.dirs) - 1; i >= 0; i-- {
+		if err := setattrs(filepath.Join(d.root, d.dirs[i].Name), d.dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mkdev returns the device number of major and minor
+func mkdev(major int64, minor int64) uint64 {
+	return uint64(major&0xfff)<<8 | uint64(minor&0xff) | uint64(minor&^0xff)<<12 | uint64(major&^0xfff)<<32
+}
+
+// setattrs sets the owner (when running as root), mode, extended
+// attributes and modification time of the extracted entry name
+func setattrs(name string, hdr *tar.Header) error {
+
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(name, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return lutimes(name, hdr.ModTime)
+	}
+	// after chown, which clears setuid bits
+	if err := syscall.Chmod(name, uint32(hdr.Mode&07777)); err != nil {
+		return err
+	}
+	for k, v := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "SCHILY.xattr.") {
+			if err := syscall.Setxattr(name, strings.TrimPrefix(k, "SCHILY.xattr."), []byte(v), 0); err != nil {
+				return fmt.Errorf("%s: %s: %s", name, strings.TrimPrefix(k, "SCHILY.xattr."), err)
+			}
+		}
+	}
+	return os.Chtimes(name, hdr.ModTime, hdr.ModTime)
+}
+
+// lutimes sets the times of the symlink name, utimensat with
+// AT_SYMLINK_NOFOLLOW
+func lutimes(name string, t time.Time) error {
+
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	ts := [2]syscall.Timespec{syscall.NsecToTimespec(t.UnixNano()), syscall.NsecToTimespec(t.UnixNano())}
+	atfdcwd := -100
+	const atsymlinknofollow = 0x100
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(atfdcwd), uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&ts[0])), atsymlinknofollow, 0, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "lutimes", Path: name, Err: errno}
+	}
+	return nil
+}
+
+// RENAME_EXCHANGE of renameat2, and its syscall numbers, not all of them
+// are in package syscall
+const renameexchange = 1 << 1
+
+var renameat2syscall = map[string]uintptr{"386": 353, "amd64": 316, "arm": 382, "arm64": 276, "loong64": 276, "ppc64": 357, "ppc64le": 357, "riscv64": 276, "s390x": 347}
+
+// exchange swaps the directories a and b atomically with renameat2, or by
+// three renames if the kernel or architecture lacks it
+func exchange(a string, b string) error {
+
+	if nr, found := renameat2syscall[runtime.GOARCH]; found {
+		pa, err := syscall.BytePtrFromString(a)
+		if err != nil {
+			return err
+		}
+		pb, err := syscall.BytePtrFromString(b)
+		if err != nil {
+			return err
+		}
+		atfdcwd := -100
+		_, _, errno := syscall.Syscall6(nr, uintptr(atfdcwd), uintptr(unsafe.Pointer(pa)), uintptr(atfdcwd), uintptr(unsafe.Pointer(pb)), renameexchange, 0)
+		if errno == 0 {
+			return nil
+		}
+		if errno != syscall.ENOSYS && errno != syscall.EINVAL {
+			return &os.LinkError{Op: "renameat2", Old: a, New: b, Err: errno}
+		}
+		slog.Debug("renameat2 not supported, renaming", "error", errno)
+	}
+
+	swap := a + ".old"
+	if err := os.Rename(b, swap); err != nil {
+		return err
+	}
+	if err := os.Rename(a, b); err != nil {
+		os.Rename(swap, b)
+		return err
+	}
+	return os.Rename(swap, a)
+}
+
+// applyimage extracts the assembled image tgzname into the directory target
+// (-apply). The image is extracted into a staging directory next to target
+// and checked, then exchanged with target, so target never holds a partly
+// updated tree. With keep the old tree is kept as <target>.previous for
+// rollback, else it is removed. Returns the manifest lines of the image.
+func applyimage(tgzname string, target string, keep bool) ([]string, error) {
+
+	target = filepath.Clean(target)
+	staging, err := os.MkdirTemp(filepath.Dir(target), "."+filepath.Base(target)+".ota-")
+	if err != nil {
+		return nil, err
+	}
+	// the old tree after the exchange
+	defer os.RemoveAll(staging)
+	if err := os.Chmod(staging, 0755); err != nil {
+		return nil, err
+	}
+
+	extract := extractimage
+	if applysandbox {
+		extract = sandboxextract
+	}
+	expected, err := extract(tgzname, staging)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifydir(staging, expected); err != nil {
+		return nil, err
+	}
+	slog.Debug("extracted image verified", "dir", staging)
+
+	if _, err := os.Lstat(target); os.IsNotExist(err) {
+		return expected, os.Rename(staging, target)
+	}
+	if err := exchange(staging, target); err != nil {
+		return nil, err
+	}
+	if keep {
+		if err := os.RemoveAll(target + ".previous"); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(staging, target+".previous"); err != nil {
+			return nil, err
+		}
+	}
+	return expected, nil
+}
+
+// extractimage extracts the image tgzname into the directory root and
+// returns the manifest lines of the extracted entries
+func extractimage(tgzname string, root string) ([]string, error) {
+
+	filein, err := os.Open(tgzname)
+	if err != nil {
+		return nil, err
+	}
+	defer filein.Close()
+	return extractarchive(filein, root)
+}
+
+// extractarchive extracts the gzipped tar read from in into the directory
+// root, see extractimage
+func extractarchive(in io.Reader, root string) ([]string, error) {
+
+	archivein, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(archivein)
+
+	out := &dirwriter{root: root}
+	var expected []string
+	manifest := manifestheader
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		extracted := hdr
+		if rootless {
+			extracted = rootlessheader(hdr)
+		}
+		if err := out.WriteHeader(extracted); err != nil {
+			return nil, err
+		}
+		var sha256hex string
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+			h := sha256.New()
+			if _, err := io.Copy(io.MultiWriter(out, h), tr); err != nil {
+				return nil, err
+			}
+			sha256hex = hex.EncodeToString(h.Sum(nil))
+		}
+		expected = append(expected, manifestline(dirheader(extracted), sha256hex))
+		manifest += manifestline(hdr, sha256hex)
+	}
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+	if rootless {
+		if err := ioutil.WriteFile(filepath.Join(root, rootlessmanifest), []byte(manifest), 0644); err != nil {
+			return nil, err
+		}
+	}
+	return expected, nil
+}
+
+// rootlessheader returns the header of an entry as extracted by a user: the
+// user owns it, without setuid and setgid bits, device nodes become empty
+// files and only user.* extended attributes are set. The image manifest in
+// rootlessmanifest keeps what is dropped.
+func rootlessheader(hdr *tar.Header) *tar.Header {
+
+	out := *hdr
+	out.Uid, out.Gid = os.Geteuid(), os.Getegid()
+	out.Mode = hdr.Mode &^ 06000
+	if hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock {
+		out.Typeflag = tar.TypeReg
+		out.Devmajor, out.Devminor = 0, 0
+	}
+	out.PAXRecords = map[string]string{}
+	for k, v := range hdr.PAXRecords {
+		if !strings.HasPrefix(k, "SCHILY.xattr.") || strings.HasPrefix(k, "SCHILY.xattr.user.") {
+			out.PAXRecords[k] = v
+		}
+	}
+	return &out
+}
+
+// sandboxextract extracts the image tgzname into the directory root like
+// extractimage, but in an "extract" helper process of this binary in new
+// mount, network, IPC and UTS namespaces. The helper confines itself to
+// root, see confine, so a crafted archive cannot reach the rest of the
+// system even if the entry checks miss an escape. The image is passed on
+// stdin, the manifest lines come back on stdout.
+func sandboxextract(tgzname string, root string) ([]string, error) {
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	filein, err := os.Open(tgzname)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer filein.Close()
+
+	args := []string{"extract", "-log-level", loglevel.Level().String()}
+	if applyseccomp {
+		args = append(args, "-seccomp")
+	}
+	if rootless {
+		args = append(args, "-rootless")
+	}
+	cmd := exec.Command(self, append(args, root)...)
+	cmd.Stdin = filein
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("extract helper: %s", err)
 	}
+	expected := strings.SplitAfter(string(out), "\n")
+	return expected[:len(expected)-1], nil
+}
+
+// extracthelper implements the helper side of sandboxextract: it confines
+// itself to the directory argument, extracts the image read from stdin into
+// it and writes the manifest lines to stdout
+func extracthelper(args []string) int {
 
-	if !sourceFileStat.Mode().IsRegular() {
-		return fmt.Errorf("%s is not a regular file", src)
+	flags := flag.NewFlagSet("extract", flag.ExitOnError)
+	plevel := flags.String("log-level", "info", "log level")
+	pseccomp := flags.Bool("seccomp", false, "install the seccomp filter")
+	flags.BoolVar(&rootless, "rootless", false, "extract like -rootless")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: extract [-log-level <level>] [-seccomp] [-rootless] <dir>")
+		return exitusage
+	}
+	if err := setuplogging("text", *plevel); err != nil {
+		log.Println(err)
+		return exitusage
 	}
 
-	source, err := os.Open(src)
+	if err := confine(flags.Arg(0), *pseccomp); err != nil {
+		log.Println(err)
+		return exitfailure
+	}
+	slog.Debug("extracting in sandbox", "dir", flags.Arg(0), "seccomp", *pseccomp)
+	expected, err := extractarchive(os.Stdin, "/")
 	if err != nil {
+		log.Println(err)
+		return exitstatus(err)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	for _, line := range expected {
+		w.WriteString(line)
+	}
+	if err := w.Flush(); err != nil {
+		log.Println(err)
+		return exitfailure
+	}
+	return 0
+}
+
+// capabilities the extract helper keeps: owners, modes of files of other
+// users, setuid bits, device nodes and file capabilities
+var extractcaps = []uint{
+	0,  // CAP_CHOWN
+	3,  // CAP_FOWNER
+	4,  // CAP_FSETID
+	27, // CAP_MKNOD
+	31, // CAP_SETFCAP
+}
+
+// confine restricts the extract helper to the directory root: mounts are
+// made private to its mount namespace, it changes its root to root and
+// drops all capabilities but extractcaps, including CAP_SYS_CHROOT and
+// CAP_SYS_ADMIN needed to leave the chroot again. With seccomp the syscalls
+// of seccompdenied fail. Capabilities are per thread, like the filter they
+// are dropped on all threads of the go runtime, which requires a
+// CGO_ENABLED=0 build.
+func confine(root string, seccomp bool) error {
+
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("mount: %s", err)
+	}
+	if err := syscall.Chroot(root); err != nil {
+		return fmt.Errorf("chroot %s: %s", root, err)
+	}
+	if err := syscall.Chdir("/"); err != nil {
 		return err
 	}
-	defer source.Close()
 
-	destination, err := os.Create(dst)
+	const (
+		prCapbsetDrop          = 24
+		linuxCapabilityVersion = 0x20080522 // _LINUX_CAPABILITY_VERSION_3
+	)
+	// the bounding set, up to the last capability of the kernel
+	for c := uintptr(0); c < 64; c++ {
+		_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prCapbsetDrop, c, 0)
+		if errno == syscall.EINVAL {
+			break
+		}
+		if errno != 0 {
+			return fmt.Errorf("prctl(PR_CAPBSET_DROP): %s (sandbox requires a CGO_ENABLED=0 build)", errno)
+		}
+	}
+	var keep uint32
+	for _, c := range extractcaps {
+		keep |= 1 << c
+	}
+	header := struct {
+		version uint32
+		pid     int32
+	}{linuxCapabilityVersion, 0}
+	data := [2]struct{ effective, permitted, inheritable uint32 }{{keep, keep, 0}, {0, 0, 0}}
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("capset: %s", errno)
+	}
+
+	if seccomp {
+		return seccompfilter()
+	}
+	return nil
+}
+
+// syscalls extraction never needs, blocked by the seccomp filter, the list
+// of the server's -sandbox
+var seccompdenied = map[string][]uint32{
+	// execve, execveat, ptrace, mount, umount2, pivot_root, chroot,
+	// kexec_load, kexec_file_load, init_module, finit_module, delete_module,
+	// bpf, process_vm_readv, process_vm_writev, reboot, swapon, swapoff,
+	// unshare, setns, keyctl, add_key, request_key, perf_event_open,
+	// userfaultfd, open_by_handle_at
+	"amd64": {59, 322, 101, 165, 166, 155, 161, 246, 320, 175, 313, 176, 321, 310, 311, 169, 167, 168, 272, 308, 250, 248, 249, 298, 323, 304},
+	"arm64": {221, 281, 117, 40, 39, 41, 51, 104, 294, 105, 273, 106, 280, 270, 271, 142, 224, 225, 97, 268, 219, 217, 218, 241, 282, 265},
+}
+
+var seccomparch = map[string]uint32{
+	"amd64": 0xc000003e, // AUDIT_ARCH_X86_64
+	"arm64": 0xc00000b7, // AUDIT_ARCH_AARCH64
+}
+
+var seccompsyscall = map[string]uintptr{
+	"amd64": 317,
+	"arm64": 277,
+}
+
+// sockfilter is a classic bpf instruction (struct sock_filter)
+type sockfilter struct {
+	code uint16
+	jt   uint8
+	jf   uint8
+	k    uint32
+}
+
+// sockfprog is struct sock_fprog
+type sockfprog struct {
+	len    uint16
+	filter *sockfilter
+}
+
+// seccompfilter installs a filter on all threads that fails the syscalls in
+// seccompdenied with EPERM
+func seccompfilter() error {
+
+	denied, ok := seccompdenied[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("seccomp filter not available for %s", runtime.GOARCH)
+	}
+
+	const (
+		bpfLdWAbs       = 0x20
+		bpfJeqK         = 0x15
+		bpfJgeK         = 0x35
+		bpfRetK         = 0x06
+		retAllow        = 0x7fff0000
+		retErrno        = 0x00050000
+		retKill         = 0x80000000 // kill process
+		x32SyscallB     = 0x40000000
+		prSetNoNewPrivs = 38
+	)
+
+	filter := []sockfilter{
+		{bpfLdWAbs, 0, 0, 4}, // seccomp_data.arch
+		{bpfJeqK, 1, 0, seccomparch[runtime.GOARCH]},
+		{bpfRetK, 0, 0, retKill},
+		{bpfLdWAbs, 0, 0, 0}, // seccomp_data.nr
+		{bpfJgeK, 0, 1, x32SyscallB},
+		{bpfRetK, 0, 0, retErrno | uint32(syscall.EPERM)},
+	}
+	for _, nr := range denied {
+		filter = append(filter,
+			sockfilter{bpfJeqK, 0, 1, nr},
+			sockfilter{bpfRetK, 0, 0, retErrno | uint32(syscall.EPERM)})
+	}
+	filter = append(filter, sockfilter{bpfRetK, 0, 0, retAllow})
+
+	prog := sockfprog{len: uint16(len(filter)), filter: &filter[0]}
+
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("prctl(PR_SET_NO_NEW_PRIVS): %s (sandbox requires a CGO_ENABLED=0 build)", errno)
+	}
+
+	const seccompSetModeFilter = 1
+	const seccompFilterFlagTsync = 1
+	_, _, errno := syscall.Syscall(seccompsyscall[runtime.GOARCH], seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&prog)))
+	runtime.KeepAlive(filter)
+	if errno != 0 {
+		return fmt.Errorf("seccomp: %s", errno)
+	}
+	return nil
+}
+
+// slots of dual-slot devices (-slot)
+var slotnames = []string{"a", "b"}
+
+// bootloader environment variable of the slot to boot
+const slotvariable = "ota_slot"
+
+// slotprovider reads and sets the slot the device boots (-slot-provider)
+type slotprovider interface {
+	// booted returns the slot marked for booting
+	booted() (string, error)
+	// markbootable makes the device boot slot from the next boot on
+	markbootable(slot string) error
+}
+
+// newslotprovider returns the slot provider of spec: "fw_printenv" (U-Boot
+// environment), "grub[:<grubenv file>]" or "file:<state file>"
+func newslotprovider(spec string) (slotprovider, error) {
+
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "fw_printenv":
+		return &cmdslots{get: []string{"fw_printenv", "-n", slotvariable}, set: []string{"fw_setenv", slotvariable}}, nil
+	case "grub":
+		if arg == "" {
+			arg = "/boot/grub/grubenv"
+		}
+		return &cmdslots{get: []string{"grub-editenv", arg, "list"}, set: []string{"grub-editenv", arg, "set"}, assign: true}, nil
+	case "file":
+		if arg == "" {
+			return nil, fmt.Errorf("slot provider %s: no state file", spec)
+		}
+		return &fileslots{name: arg}, nil
+	}
+	return nil, fmt.Errorf("unknown slot provider %s", spec)
+}
+
+// cmdslots keeps the slot in a bootloader environment variable read and set
+// by commands, assign is set for the "grub-editenv" syntax
+type cmdslots struct {
+	get    []string
+	set    []string
+	assign bool
+}
+
+func (c *cmdslots) booted() (string, error) {
+
+	out, err := exec.Command(c.get[0], c.get[1:]...).Output()
 	if err != nil {
+		return "", fmt.Errorf("%s: %s", c.get[0], err)
+	}
+	if !c.assign {
+		return strings.TrimSpace(string(out)), nil
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if v, found := strings.CutPrefix(line, slotvariable+"="); found {
+			return strings.TrimSpace(v), nil
+		}
+	}
+	return "", nil
+}
+
+func (c *cmdslots) markbootable(slot string) error {
+
+	args := append([]string{}, c.set[1:]...)
+	if c.assign {
+		args = append(args, slotvariable+"="+slot)
+	} else {
+		args = append(args, slot)
+	}
+	cmd := exec.Command(c.set[0], args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s", c.set[0], err)
+	}
+	return nil
+}
+
+// fileslots keeps the slot in a state file, for bootloaders reading it or
+// for testing
+type fileslots struct {
+	name string
+}
+
+func (f *fileslots) booted() (string, error) {
+
+	data, err := ioutil.ReadFile(f.name)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(data)), err
+}
+
+func (f *fileslots) markbootable(slot string) error {
+
+	if err := os.MkdirAll(filepath.Dir(f.name), 0755); err != nil {
 		return err
 	}
-	defer destination.Close()
-	_, err = io.Copy(destination, source)
+	tmpfile, err := ioutil.TempFile(filepath.Dir(f.name), filepath.Base(f.name)+"-")
 	if err != nil {
 		return err
 	}
-
-	return nil
+	_, err = fmt.Fprintln(tmpfile, slot)
+	if err == nil {
+		err = tmpfile.Sync()
+	}
+	if cerr := tmpfile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpfile.Name(), f.name)
+	}
+	if err != nil {
+		os.Remove(tmpfile.Name())
+	}
+	return err
 }
 
-func getfilehash(src string) (string, error) {
+// file identifying the current boot
+var bootidfile = "/proc/sys/kernel/random/boot_id"
 
-	filein, err := os.Open(src)
+// runningslot returns the slot the device runs: ota.slot= of the kernel
+// command line if given, else the slot of the provider ("a" if none is
+// set) at the first call in this boot. The provider names the updated slot
+// as soon as it is marked bootable, so that slot is kept with the boot id
+// in <statedir>/booted-slot until the next boot. Without either the
+// running slot is unknown.
+func runningslot(p slotprovider) (string, error) {
+
+	if cmdline, err := ioutil.ReadFile("/proc/cmdline"); err == nil {
+		for _, arg := range strings.Fields(string(cmdline)) {
+			if v, found := strings.CutPrefix(arg, "ota.slot="); found {
+				return v, nil
+			}
+		}
+	}
+	data, err := ioutil.ReadFile(bootidfile)
+	if statedir == "" || err != nil {
+		return "", errors.New("cannot tell the running slot without ota.slot= on the kernel command line, or -statedir and a boot id")
+	}
+	bootid := strings.TrimSpace(string(data))
+	record := &fileslots{name: path.Join(statedir, "booted-slot")} // written like a slot state file
+	if kept, err := record.booted(); err != nil {
+		return "", err
+	} else if slot, id, _ := strings.Cut(kept, " "); slot != "" && id == bootid {
+		return slot, nil
+	}
+
+	slot, err := p.booted()
 	if err != nil {
 		return "", err
 	}
-	defer filein.Close()
+	if slot == "" {
+		slot = slotnames[0]
+	}
+	if err := record.markbootable(slot + " " + bootid); err != nil {
+		return "", err
+	}
+	return slot, nil
+}
 
-	h := sha1.New()
-	if _, err := io.Copy(h, filein); err != nil {
+// inactiveslot returns the slot the device does not run
+func inactiveslot(p slotprovider) (string, error) {
+
+	running, err := runningslot(p)
+	if err != nil {
 		return "", err
 	}
-	sum := h.Sum(nil)
-	return hex.EncodeToString(sum), nil
+	switch running {
+	case slotnames[0]:
+		return slotnames[1], nil
+	case slotnames[1]:
+		return slotnames[0], nil
+	}
+	return "", fmt.Errorf("unknown running slot %q", running)
+}
 
+// verifydir checks the entries extracted to root against their manifest
+// lines (of headers from dirheader), the last entry of a path wins
+func verifydir(root string, expected []string) error {
+
+	want := map[string]string{}
+	for _, line := range expected {
+		want[path.Clean("/"+manifestlinename(line))] = line
+	}
+	for _, line := range want {
+		name := manifestlinename(line)
+		fname := filepath.Join(root, name)
+		fi, err := os.Lstat(fname)
+		if err != nil {
+			return err
+		}
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(fname); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		hdr.Uname, hdr.Gname = "", "" // see dirheader
+		if strings.HasPrefix(line, string(tar.TypeLink)+" ") {
+			// hard links only by identity, they share the target's
+			// attributes
+			target, err := os.Lstat(filepath.Join(root, manifestlinelink(line)))
+			if err == nil && os.SameFile(fi, target) {
+				continue
+			}
+			return fmt.Errorf("%s: %w", name, errassembled)
+		}
+		var sha256hex string
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+			_, sha256hex, err = getfilehash(fname, hashbackendbyname("sha256"), true)
+			if err != nil {
+				return err
+			}
+		}
+		// lines journaled before manifest version 2 end after the link
+		// target
+		if found := manifestline(hdr, sha256hex); found != line && found != strings.TrimSuffix(line, "\n")+` "":""`+"\n" {
+			slog.Debug("manifest mismatch", "expected", strings.TrimSuffix(line, "\n"), "found", strings.TrimSuffix(found, "\n"))
+			return fmt.Errorf("%s: %w", name, errassembled)
+		}
+	}
+	return nil
 }
 
-func main() {
+// manifestlinename returns the name of the entry of a manifest line
+func manifestlinename(line string) string {
 
-	defaulturl := "http://localhost:8090/image-1234.tgz"
+	name, _ := manifestlinenames(line)
+	return name
+}
 
-	ptgzsrc := flag.String("src", defaulturl, "image download url (required argument)")
-	ptgzdst := flag.String("dst", "./", "Save archive to <dst> directory")
-	ptgzref := flag.String("ref", "/", "Reference directory")
-	pdebug := flag.Bool("debug", false, "enable debug output")
+// manifestlinelink returns the link target of the entry of a manifest line
+func manifestlinelink(line string) string {
 
-	flag.Parse()
+	_, link := manifestlinenames(line)
+	return link
+}
 
-	if *ptgzsrc == defaulturl {
-		fmt.Println("usage:")
-		flag.PrintDefaults()
-		os.Exit(1)
+// manifestlinenames returns the name and link target of a manifest line,
+// quoted after the sha256 field
+func manifestlinenames(line string) (string, string) {
+
+	fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 7)
+	if len(fields) < 7 {
+		return "", ""
 	}
-	if *pdebug {
-		debug = true
+	name, err := strconv.QuotedPrefix(fields[6])
+	if err != nil {
+		return "", ""
 	}
-
-	tgzsrc := *ptgzsrc
-	tgzdst := *ptgzdst
-	tgzref := *ptgzref
-
-	if strings.HasSuffix(tgzsrc, ".tgz") == false {
-		log.Fatalln("<src> argument requires .tgz suffix")
-		os.Exit(2)
+	link, err := strconv.QuotedPrefix(strings.TrimPrefix(fields[6][len(name):], " "))
+	if err != nil {
+		link = `""`
 	}
+	name, _ = strconv.Unquote(name)
+	link, _ = strconv.Unquote(link)
+	return name, link
+}
 
-	if strings.HasSuffix(tgzref, "/") == false {
-		// ensure "/" suffix
-		tgzref = tgzref + "/"
-	}
+// destination returns the output filename for the image tgzsrc, tgzdst is
+// a directory or a .tgz filename
+func destination(tgzsrc string, tgzdst string) string {
 
 	if strings.HasSuffix(tgzdst, "/") {
 		// <dst> is directory
-		tgzdst = tgzdst + path.Base(tgzsrc)
+		return tgzdst + imagename(tgzsrc)
 	} else if strings.HasSuffix(tgzdst, ".tgz") {
 		// <dst> is .tgz filename
-	} else {
-		// ensure "/" suffix
-		tgzdst = tgzdst + "/"
-		tgzdst = tgzdst + path.Base(tgzsrc)
+		return tgzdst
+	}
+	// ensure "/" suffix
+	return tgzdst + "/" + imagename(tgzsrc)
+}
+
+// resolverefs returns the reference mounts for the -ref argument tgzref
+func resolverefs(tgzref string) ([]refmount, error) {
+
+	if tgzref != "auto" {
+		return []refmount{{dir: "/", source: tgzref}}, nil
 	}
 
+	refs, err := autorefs("/proc/mounts")
+	if err != nil {
+		return nil, err
+	}
 	if debug {
+		for _, ref := range refs {
+			if ref.source != "" {
+				slog.Debug("reference", "dir", ref.dir, "source", ref.source)
+			}
+		}
+	}
+	return refs, nil
+}
 
-		fmt.Printf("src: %s\n", tgzsrc)
-		fmt.Printf("dst: %s\n", tgzdst)
-		fmt.Printf("ref: %s\n", tgzref)
+// verifyref compares the type, link target, mode and owner of the entry
+// hdr with its file in the reference directories refs, for -verify. The
+// content of regular files is compared by the caller. It returns "ok",
+// "MISSING" or "MISMATCH".
+func verifyref(refs []refmount, hdr *tar.Header) string {
 
+	fname, found := resolveref(refs, hdr.Name)
+	if !found {
+		return "MISSING"
+	}
+	fi, err := os.Lstat(fname)
+	if err != nil {
+		return "MISSING"
 	}
 
-	// step 1 : load "index" from server
+	mode := fi.Mode()
+	match := false
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		match = mode.IsRegular() && fi.Size() == hdr.Size
+	case tar.TypeDir:
+		match = mode.IsDir()
+	case tar.TypeSymlink:
+		target, err := os.Readlink(fname)
+		match = err == nil && target == hdr.Linkname
+	case tar.TypeLink:
+		if linked, found := resolveref(refs, hdr.Linkname); found {
+			lfi, err := os.Lstat(linked)
+			match = err == nil && os.SameFile(fi, lfi)
+		}
+	case tar.TypeChar:
+		match = mode&os.ModeCharDevice != 0
+	case tar.TypeBlock:
+		match = mode&os.ModeDevice != 0 && mode&os.ModeCharDevice == 0
+	case tar.TypeFifo:
+		match = mode&os.ModeNamedPipe != 0
+	}
+	if !match {
+		return "MISMATCH"
+	}
+
+	if hdr.Typeflag != tar.TypeSymlink && hdr.Typeflag != tar.TypeLink {
+		perm := int64(mode.Perm())
+		if mode&os.ModeSetuid != 0 {
+			perm |= 04000
+		}
+		if mode&os.ModeSetgid != 0 {
+			perm |= 02000
+		}
+		if mode&os.ModeSticky != 0 {
+			perm |= 01000
+		}
+		if perm != hdr.Mode&07777 {
+			return "MISMATCH"
+		}
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && (int(st.Uid) != hdr.Uid || int(st.Gid) != hdr.Gid) {
+		return "MISMATCH"
+	}
+	return "ok"
+}
+
+// reportverify prints the -verify result of the entry name
+func reportverify(name string, result string) {
+
+	verified++
+	if result != "ok" {
+		verifyfailed++
+	}
+	fmt.Printf("%s %s\n", result, strconv.Quote(name))
+}
+
+// indexentry is an entry of the index, read ahead of the assembly while
+// the reference files of the regular files are hashed in parallel
+type indexentry struct {
+	hdr  *tar.Header
+	hash string       // index hash of regular files
+	data []byte       // contents of other entries
+	ref  chan refhash // the hashed reference file of regular files
+	err  error
+}
+
+// refhash is the reference file of a regular file in the index, with its
+// info when hashed and its hashes (cached or hashed). fi is nil if there
+// is no usable reference file.
+type refhash struct {
+	file   string
+	fi     os.FileInfo
+	sum    string // index hash
+	sum256 string // only if needed for the manifest
+	staged bool   // file is in the staging directory
+	err    error
+}
+
+// hashref finds and hashes the reference file of the regular file name with
+// the index hash hashstr
+func hashref(refs []refmount, staging bool, hb *hashbackend, cache *hashcache, name string, hashstr string, with256 bool) refhash {
+
+	var r refhash
+	file, found := resolveref(refs, name)
+	if staging {
+		if staged := stagedfile(hb, hashstr); staged != "" {
+			file, found = staged, true
+			r.staged = true
+		}
+	}
+	if !found {
+		return r
+	}
+	fi, err := os.Stat(file)
+	if err != nil || !fi.Mode().IsRegular() {
+		return r
+	}
+	r.file, r.fi = file, fi
+
+	var cached map[string]string
+	if cache != nil {
+		cached = cache.lookup(file, fi)
+	}
+	r.sum, r.sum256 = cached[hb.name], cached["sha256"]
+	if r.sum != "" && r.sum != hashstr {
+		slog.Debug("file exists, cached hash does not match", "path", name)
+		return r
+	}
+	if r.sum == "" || (with256 && r.sum256 == "") {
+		r.sum, r.sum256, r.err = getfilehash(file, hb, with256)
+		if r.err == nil && cache != nil {
+			hashes := map[string]string{hb.name: r.sum}
+			if r.sum256 != "" {
+				hashes["sha256"] = r.sum256
+			}
+			cache.add(file, fi, hashes)
+		}
+	}
+	return r
+}
+
+// readindex reads the index tr ahead and hands the reference files of its
+// regular files to -workers hashing workers. The entries are returned in
+// index order, each regular file with a channel receiving its hashed
+// reference file. Dropped (drop) and unsafe entries are not hashed. Reading
+// stops when done is closed.
+func readindex(tr *tar.Reader, drop map[int]bool, refs []refmount, staging bool, hb *hashbackend, cache *hashcache, with256 bool, done <-chan struct{}) <-chan indexentry {
+
+	type job struct {
+		name string
+		hash string
+		ref  chan refhash
+	}
+	jobs := make(chan job)
+	for i := 0; i < hashworkers; i++ {
+		go func() {
+			for j := range jobs {
+				j.ref <- hashref(refs, staging, hb, cache, j.name, j.hash, with256)
+			}
+		}()
+	}
+
+	entries := make(chan indexentry, 16*hashworkers)
+	go func() {
+		defer close(entries)
+		defer close(jobs)
+
+		send := func(e indexentry) bool {
+			select {
+			case entries <- e:
+				return true
+			case <-done:
+				return false
+			}
+		}
+		hash := make([]byte, hb.new().Size())
+		index := -1
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				send(indexentry{err: err})
+				return
+			}
+			e := indexentry{hdr: hdr}
+			if hdr.Typeflag != tar.TypeXGlobalHeader {
+				index++
+			}
+			if hdr.Typeflag == tar.TypeXGlobalHeader || drop[index] {
+				// nothing to read
+			} else if hdr.Typeflag == '0' && hdr.Size > 0 {
+				if _, err := io.ReadFull(tr, hash); err != nil {
+					send(indexentry{err: errhashformat})
+					return
+				}
+				e.hash = hex.EncodeToString(hash)
+				if checkentry(hdr) == nil {
+					e.ref = make(chan refhash, 1)
+					select {
+					case jobs <- job{name: hdr.Name, hash: e.hash, ref: e.ref}:
+					case <-done:
+						return
+					}
+				}
+			} else if hdr.Size > 0 {
+				if e.data, err = ioutil.ReadAll(tr); err != nil {
+					send(indexentry{err: err})
+					return
+				}
+			}
+			if !send(e) {
+				return
+			}
+		}
+	}()
+	return entries
+}
+
+// update assembles the image into the tgz file tgzdst. All regular files
+// found with matching hash in the reference directories refs are taken
+// from there, only the missing files are requested from the server. It
+// returns the number of missing files. The index is kept as delta base for
+// the next update of image.
+func update(t transport, image string, tgzdst string, refs []refmount) (uint32, error) {
 
-	fmt.Printf("downloading index from %s to %s\n", tgzsrc, tgzdst)
+	start := time.Now()
+	budgeted := (budgetbytes > 0 || budgettime > 0) && !checkonly
+	// files staged by runs which ran out of their budget
+	staging := false
+	if statedir != "" {
+		_, err := os.Stat(stagingdir())
+		staging = err == nil
+	}
 
-	resp, err := http.Get(tgzsrc)
+	// all scratch files of this run go to a private directory, names in
+	// the shared tmp directory would be predictable and clash across runs
+	tmpdir, err := os.MkdirTemp(tmproot, "ota-client-")
 	if err != nil {
-		panic(err)
+		return 0, err
+	}
+	scratchmu.Lock()
+	scratchdir = tmpdir
+	scratchmu.Unlock()
+	defer func() {
+		scratchmu.Lock()
+		os.RemoveAll(tmpdir)
+		scratchdir = ""
+		scratchmu.Unlock()
+	}()
+
+	// step 1 : load "index" from server
+
+	body, err := t.getindex()
+	if err != nil {
+		return 0, classify(err, exitnetwork)
 	}
-	defer resp.Body.Close()
 
 	// save index file to tmp filename
-	tmpindexfile, err := ioutil.TempFile("/tmp/", "index-")
+	tmpindexname, err := savetotmp(body, tmpdir, "index-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmpindexname)
+
+	records, err := readindexrecords(tmpindexname)
 	if err != nil {
-		panic(err)
+		return 0, err
+	}
+	laststatus.Version = records["OTA.version"]
+
+	// manifest lines of verified regular files, nil if not verifying
+	var manifestlines []string
+	if pubkey != nil || keyring != nil {
+		manifestlines, err = verifyindex(tmpindexname, records)
+		if err != nil {
+			return 0, classify(err, exitverification)
+		}
+	}
+
+	// the manifest has to match the image's target in the TUF metadata
+	if tufrootfile != "" {
+		manifestlines, err = checktuftarget(t, image, tmpindexname, records)
+		if err != nil {
+			return 0, classify(err, exitverification)
+		}
 	}
-	if _, err := io.Copy(tmpindexfile, resp.Body); err != nil {
-		panic(err)
+
+	// rollback protection, only tamper proof with signature verification
+	if err := checkversion(records); err != nil {
+		return 0, classify(err, exitverification)
+	}
+	if err := checkindexage(records); err != nil {
+		return 0, classify(err, exitverification)
+	}
+
+	// unsafe entries are rejected before anything is written
+	drop, err := checkindexentries(tmpindexname)
+	if err != nil {
+		return 0, err
 	}
-	tmpindexfile.Close()
-	defer os.Remove(tmpindexfile.Name())
 
-	tmpindexin, err := os.Open(tmpindexfile.Name())
+	tmpindexin, err := os.Open(tmpindexname)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
 	defer tmpindexin.Close()
 
 	archivein, err := gzip.NewReader(tmpindexin)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
 	tr := tar.NewReader(archivein)
 
-	fileout, err := os.Create(tgzdst)
-	if err != nil {
-		panic(err)
+	var fileout *os.File
+	var out io.Writer = ioutil.Discard
+	complete := false
+	if !checkonly {
+		fileout, err = os.Create(tgzdst)
+		if err != nil {
+			return 0, err
+		}
+		defer func() {
+			fileout.Close()
+			if !complete { // never leave a partial image behind
+				os.Remove(tgzdst)
+			}
+		}()
+		out = fileout
 	}
-	defer fileout.Close()
-	archiveout := gzip.NewWriter(fileout)
+	archiveout := gzip.NewWriter(out)
 	trout := tar.NewWriter(archiveout)
 
+	// entries below -split subtrees go to their own destinations
+	outs := &outputs{main: trout, current: trout}
+	if !checkonly {
+		outs, err = newoutputs(trout)
+		if err != nil {
+			return 0, err
+		}
+		defer func() {
+			if !complete {
+				outs.abort()
+			}
+		}()
+	}
+
 	var requestefilesbitmap bytes.Buffer
 
-	var hash = make([]byte, sha1.Size)
+	// the hash of the regular files in the index
+	hb := hashbackendbyname(indexhash(records))
+	if hb == nil {
+		return 0, fmt.Errorf("Unsupported index hash %s!", indexhash(records))
+	}
+
+	cache := loadhashcache()
+	if cache != nil && !checkonly {
+		defer func() {
+			if err := cache.save(); err != nil {
+				slog.Warn("cannot save hash cache", "error", err)
+			}
+		}()
+	}
 
 	var regularfileindex uint32 = 0
 	var bitmapbyte byte = 0
 
 	var missingfiles uint32 = 0
 
-	for {
+	// files requested from the server in image order, with their manifest
+	// lines. Names are not unique if the image has duplicate paths.
+	type requestedfile struct {
+		name   string
+		line   string
+		sha256 string
+		hash   string // index hash
+	}
+	requested := []requestedfile{}
 
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
+	// old versions of gzip members the server can send deltas against,
+	// the sha256 of the kept index's files, and the requested members
+	// with an old version as <regular file number>:<sha256>
+	var gzipbase string
+	var gzipsums map[string]bool
+	var gzipfiles []string
+	if gzipdeltas && !checkonly {
+		gzipbase, gzipsums = gzipdeltabases()
+	}
+
+	paths := newpathset(caseinsensitive)
+
+	// manifest of the index, and the manifest lines of the image to
+	// assemble (with the install policy applied). Old servers send no
+	// OTA.sha256 records.
+	indexmanifest := sha256.New()
+	io.WriteString(indexmanifest, manifestheader+manifestrecords(records))
+	var expected []string
+	verifiable := true
+	serverdigest := ""
+	entryindex := -1 // the position in drop
+
+	// the reference files are hashed ahead by the workers
+	done := make(chan struct{})
+	defer close(done)
+	entries := readindex(tr, drop, refs, staging, hb, cache, manifestlines != nil, done)
+
+	for e := range entries {
+
+		if e.err != nil {
+			return 0, e.err
 		}
-		if err != nil {
+		hdr := e.hdr
 
-			log.Fatal(err)
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			// image wide records are not part of the image, the
+			// manifest digest follows the entries
+			if digest := hdr.PAXRecords["OTA.manifest-sha256"]; digest != "" {
+				serverdigest = digest
+			}
+			continue
+		}
+		entryindex++
+		if err := checkentry(hdr); err != nil {
+			return 0, err
 		}
+		if prev := paths.add(hdr); prev != "" {
+			if duplicatepolicy == "error" {
+				return 0, fmt.Errorf("Duplicate path %s (%s) rejected (see -duplicates)!", hdr.Name, prev)
+			}
+			slog.Warn("duplicate path, the last one wins", "path", hdr.Name, "previous", prev)
+		}
+		var sha256hex string
+		if hdr.Typeflag == '0' && hdr.Size > 0 {
+			sha256hex = hdr.PAXRecords["OTA.sha256"]
+			verifiable = verifiable && sha256hex != ""
+		}
+		io.WriteString(indexmanifest, manifestline(hdr, sha256hex))
+		if drop[entryindex] {
+			continue
+		}
+		if index, routed, err := routeentry(installheader(hdr)); err != nil {
+			return 0, err
+		} else if index < 0 || checkonly {
+			expected = append(expected, manifestline(routed, sha256hex))
+		} else if dest := outs.dests[index]; dest.file == nil {
+			dest.expected = append(dest.expected, manifestline(dirheader(routed), sha256hex))
+		} else {
+			dest.expected = append(dest.expected, manifestline(routed, sha256hex))
+		}
+		stripotarecords(hdr)
 
 		if hdr.Typeflag == '0' && hdr.Size > 0 {
 
 			var bitindex = 7 - (regularfileindex % 8)
 
 			regularfileindex++
-
-			var hashstr string
-			{ // parse hash
-				n, err := tr.Read(hash)
-				if (err != nil && err != io.EOF) || (n != sha1.Size) {
-					log.Fatalln("Server responded with an unknown file hash format!")
-					os.Exit(3)
-				}
-				hashstr = hex.EncodeToString(hash)
+			if progress != nil {
+				progress("check", int64(regularfileindex), -1)
 			}
 
-			tmpfilename := "/tmp/" + hashstr + ".tmp"
+			hashstr := e.hash
+			ref := <-e.ref
+			reffile, reffi := ref.file, ref.fi
 
 			var uselocalfile bool = true
-			{ // copy file to tmp
-				err = copyfile(tgzref+hdr.Name, tmpfilename)
-				if err != nil {
-					// cannot copy file => request from server
-
-					if debug {
-						fmt.Printf("file does not (yet) exists: %s\n", hdr.Name)
-					}
-
-					uselocalfile = false
-				}
-			}
+			if reffi == nil {
+				// no local file => request from server
 
-			if uselocalfile { // get file size
-				fi, err := os.Stat(tmpfilename)
-				if err != nil {
-
-					if debug {
-						fmt.Printf("file exists, cannot get file size : %s\n", hdr.Name)
-					}
+				slog.Debug("file does not exist (yet)", "path", hdr.Name)
 
-					uselocalfile = false
-				}
+				uselocalfile = false
+			} else { // compare file hashes
 				// change size to actual size of file
-				hdr.Size = fi.Size()
-			}
+				hdr.Size = reffi.Size()
 
-			if uselocalfile { // compare file hashes
-				filehashstr, err := getfilehash(tmpfilename)
-				if err != nil || filehashstr != hashstr {
+				err := ref.err
+				if err == nil && manifestlines != nil && manifestline(hdr, ref.sum256) != manifestlines[regularfileindex-1] {
+					err = errsignature
+				}
+				if err != nil || ref.sum != hashstr {
 
-					if debug {
-						fmt.Printf("file exists, hash does not match: %s\n", hdr.Name)
-					}
+					slog.Debug("file exists, hash does not match", "path", hdr.Name)
 
 					uselocalfile = false
 				}
@@ -257,6 +7248,13 @@ func main() {
 			if uselocalfile == false {
 				// set bit to 1 = request this file
 				bitmapbyte = bitmapbyte | (1 << bitindex)
+			} else {
+				laststatus.ImageBytes += hdr.Size
+				if ref.staged {
+					laststatus.StagedBytes += hdr.Size
+				} else {
+					laststatus.ReusedBytes += hdr.Size
+				}
 			}
 			if bitindex == 0 {
 				requestefilesbitmap.WriteByte(bitmapbyte)
@@ -264,39 +7262,73 @@ func main() {
 			}
 
 			if uselocalfile == false {
-				os.Remove(tmpfilename)
+				if verifyonly {
+					result := "MISSING"
+					if reffile, found := resolveref(refs, hdr.Name); found {
+						if _, err := os.Lstat(reffile); err == nil {
+							result = "MISMATCH"
+						}
+					}
+					reportverify(hdr.Name, result)
+				}
 				// request file from server
 				missingfiles++
+				file := requestedfile{name: hdr.Name, sha256: sha256hex, hash: hashstr}
+				if manifestlines != nil {
+					file.line = manifestlines[regularfileindex-1]
+				}
+				requested = append(requested, file)
+				if reffile, found := resolveref(refs, hdr.Name); found && gzipsums != nil {
+					if sum := gzipbasesum(reffile, gzipsums); sum != "" {
+						gzipfiles = append(gzipfiles, fmt.Sprintf("%d:%s", regularfileindex-1, sum))
+					}
+				}
+				continue
+			}
+			if checkonly {
+				if verifyonly {
+					reportverify(hdr.Name, verifyref(refs, installheader(hdr)))
+				}
 				continue
 			}
 
 			// write header of this file
-			trout.WriteHeader(hdr)
+			if err := outs.WriteHeader(installheader(hdr)); err != nil {
+				return 0, err
+			}
 
-			{ // write tmp file to output archive
-				fi, err := os.Open(tmpfilename)
+			{ // write the reference file to output archive, it has to be
+				// unchanged since it was hashed
+				f, err := os.Open(reffile)
 				if err != nil {
-					panic("cannot read local file. should never happen, because getfilehash was successful before!")
+					return 0, err
 				}
-
-				if _, err := io.Copy(trout, fi); err != nil {
-					panic(err)
+				n, err := io.Copy(outs, f)
+				if err == nil {
+					var fi os.FileInfo
+					fi, err = f.Stat()
+					if err == nil && (!os.SameFile(fi, reffi) || !fi.ModTime().Equal(reffi.ModTime()) || fi.Size() != n) {
+						err = fmt.Errorf("Reference file %s changed during the update!", reffile)
+					}
+				}
+				f.Close()
+				if err != nil {
+					return 0, err
 				}
-				fi.Close()
-				os.Remove(tmpfilename)
 			}
 
-			if debug {
-				fmt.Printf("> %s\n", hdr.Name)
-
-			}
+			slog.Debug("reused", "path", hdr.Name)
 		} else {
+			if verifyonly {
+				reportverify(hdr.Name, verifyref(refs, installheader(hdr)))
+			}
 			// include dirs, links .. without changes
-			trout.WriteHeader(hdr)
-			if hdr.Size > 0 {
-				if _, err := io.Copy(trout, tr); err != nil {
-
-					log.Fatal(err)
+			if err := outs.WriteHeader(installheader(hdr)); err != nil {
+				return 0, err
+			}
+			if len(e.data) > 0 {
+				if _, err := outs.Write(e.data); err != nil {
+					return 0, err
 				}
 			}
 		}
@@ -306,47 +7338,77 @@ func main() {
 	// always include current bitmapbyte (even if empty)
 	requestefilesbitmap.WriteByte(bitmapbyte)
 
+	if progress != nil {
+		progress("check", int64(regularfileindex), int64(regularfileindex))
+	}
+	if display != nil {
+		display.files(regularfileindex-missingfiles, missingfiles)
+	}
+
+	if serverdigest != "" && serverdigest != hex.EncodeToString(indexmanifest.Sum(nil)) {
+		return 0, classify(errors.New("Index does not match the image manifest of the server!"), exitverification)
+	}
+	if channelmanifest != "" && channelmanifest != hex.EncodeToString(indexmanifest.Sum(nil)) {
+		return 0, classify(errors.New("Index does not match the image promoted to the release channel!"), exitverification)
+	}
+
+	if checkonly {
+		if dryrun {
+			for _, file := range requested {
+				fmt.Println(file.name)
+			}
+			reportdiffsize(t, requestefilesbitmap.Bytes(), missingfiles)
+		}
+		return missingfiles, nil
+	}
+
 	// step 2 : "load missing files" from server
 
 	if missingfiles > 0 {
 
-		fmt.Printf("downloading %d missing files from %s\n", missingfiles, tgzsrc)
+		slog.Info("downloading missing files", "files", missingfiles)
 
-		var w bytes.Buffer
-		gw, err := gzip.NewWriterLevel(&w, gzip.BestCompression)
+		w, err := gzipbitmap(requestefilesbitmap.Bytes())
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
-		gw.Write(requestefilesbitmap.Bytes())
-		gw.Close()
 
-		respp, err := http.Post(tgzsrc, "application/octet-stream", &w)
-		if err != nil {
-			panic(err)
+		var params url.Values
+		if len(gzipfiles) > 0 {
+			params = url.Values{"gzip-base": {gzipbase}, "gzip-files": {strings.Join(gzipfiles, ",")}}
 		}
-
-		defer respp.Body.Close()
-
-		// save diff file to tmp filename
-		tmpdifffile, err := ioutil.TempFile("/tmp/", "diff-")
+		body, err := t.postdiff(w, params)
 		if err != nil {
-			panic(err)
+			return 0, classify(err, exitnetwork)
+		}
+		if budgeted {
+			body = newbudgetreader(body, start)
+			if err := os.MkdirAll(stagingdir(), 0700); err != nil {
+				body.Close()
+				return 0, err
+			}
 		}
 
-		if _, err := io.Copy(tmpdifffile, respp.Body); err != nil {
-			panic(err)
+		// save diff file to tmp filename, with a budget maybe only a part
+		tmpdiffname, err := savetotmp(body, tmpdir, "diff-")
+		exhausted := err == errbudget
+		if err != nil && !exhausted {
+			return 0, err
 		}
-		tmpdifffile.Close()
+		defer os.Remove(tmpdiffname)
 
-		tmpdiffin, err := os.Open(tmpdifffile.Name())
+		tmpdiffin, err := os.Open(tmpdiffname)
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
 		defer tmpdiffin.Close()
 
 		archivein, err = gzip.NewReader(tmpdiffin)
+		if err != nil && exhausted {
+			return 0, errbudget
+		}
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
 		tr = tar.NewReader(archivein)
 
@@ -355,30 +7417,634 @@ func main() {
 			if err == io.EOF {
 				break
 			}
+			if err != nil && exhausted {
+				return 0, errbudget
+			}
 			if err != nil {
-				log.Fatal(err)
+				return 0, err
+			}
+
+			slog.Debug("downloaded", "path", hdr.Name)
+
+			// the diff is in image order
+			if len(requested) == 0 || requested[0].name != hdr.Name || hdr.Typeflag != '0' {
+				return 0, fmt.Errorf("Server sent a file which was not requested: %s", hdr.Name)
 			}
+			file := requested[0]
+			requested = requested[1:]
 
-			if debug {
-				fmt.Printf("< %s \n", hdr.Name)
+			// gzip members sent as delta against the local old version
+			var content io.Reader = tr
+			if basesum := hdr.PAXRecords["OTA.gzip-delta-base"]; basesum != "" {
+				size, _ := strconv.ParseInt(hdr.PAXRecords["OTA.gzip-delta-size"], 10, 64)
+				data, err := rebuildgzipfile(refs, hdr, basesum, tr, size)
+				if err != nil {
+					return 0, fmt.Errorf("Cannot rebuild %s from its gzip delta: %s!", hdr.Name, err)
+				}
+				if sum := sha256.Sum256(data); file.sha256 != "" && hex.EncodeToString(sum[:]) != file.sha256 {
+					return 0, fmt.Errorf("Cannot rebuild %s from its gzip delta, retry with -gzip-delta=false!", hdr.Name)
+				}
+				delete(hdr.PAXRecords, "OTA.gzip-delta-base")
+				delete(hdr.PAXRecords, "OTA.gzip-delta-size")
+				if len(hdr.PAXRecords) == 0 {
+					hdr.PAXRecords = nil
+					hdr.Format = tar.FormatUnknown
+				}
+				hdr.Size = int64(len(data))
+				content = bytes.NewReader(data)
 			}
+			laststatus.ImageBytes += hdr.Size
 
 			// include downloaded files into archive
-			trout.WriteHeader(hdr)
+			if err := outs.WriteHeader(installheader(hdr)); err != nil {
+				return 0, err
+			}
+			h256 := sha256.New()
+			var dst io.Writer = io.MultiWriter(outs, h256)
+			// files are staged for later runs if the budget runs out
+			var stage *os.File
+			stagehash := hb.new()
+			discard := func() {
+				if stage != nil {
+					stage.Close()
+					os.Remove(stage.Name())
+				}
+			}
+			if budgeted {
+				if stage, err = os.CreateTemp(stagingdir(), ".part-"); err != nil {
+					return 0, err
+				}
+				dst = io.MultiWriter(dst, stage, stagehash)
+			}
 			if hdr.Size > 0 {
-				if _, err := io.Copy(trout, tr); err != nil {
-
-					log.Fatal(err)
+				if _, err := io.Copy(dst, content); err != nil {
+					discard()
+					if exhausted {
+						return 0, errbudget
+					}
+					return 0, err
+				}
+			}
+			if manifestlines != nil && manifestline(hdr, hex.EncodeToString(h256.Sum(nil))) != file.line {
+				discard()
+				return 0, fmt.Errorf("%s: %w", hdr.Name, errsignature)
+			}
+			if stage != nil {
+				err := stage.Close()
+				if err == nil && hex.EncodeToString(stagehash.Sum(nil)) == file.hash {
+					err = os.Rename(stage.Name(), path.Join(stagingdir(), hb.name+"-"+file.hash))
+				}
+				if err != nil {
+					discard()
+					return 0, err
 				}
+				os.Remove(stage.Name()) // not renamed if the hash differs
+			}
+
+		}
+
+		if len(requested) > 0 && exhausted {
+			return 0, errbudget
+		}
+		if len(requested) > 0 {
+			return 0, fmt.Errorf("Server did not send %d of %d missing files", len(requested), missingfiles)
+		}
+	}
+
+	if err := trout.Close(); err != nil {
+		return 0, err
+	}
+	if err := archiveout.Close(); err != nil { // write gzip footer
+		return 0, err
+	}
+	if err := fileout.Close(); err != nil {
+		return 0, err
+	}
+	if err := outs.close(); err != nil {
+		return 0, err
+	}
+
+	// read the assembled image back, it has to match the index. The
+	// downloaded files follow the local ones, so the order differs.
+	if verifiable {
+		lines, err := manifestlinesof(tgzdst)
+		if err != nil {
+			return 0, err
+		}
+		sort.Strings(lines)
+		sort.Strings(expected)
+		if strings.Join(lines, "") != strings.Join(expected, "") {
+			return 0, errassembled
+		}
+		if err := outs.verify(); err != nil {
+			return 0, err
+		}
+		slog.Debug("assembled image verified")
+	}
+	complete = true
+
+	if err := saveindexbase(tmpindexname, image); err != nil {
+		slog.Error("cannot keep the index", "error", err)
+	}
+	if statedir != "" {
+		os.RemoveAll(stagingdir())
+	}
+	return missingfiles, nil
+}
+
+func main() {
+
+	defaulturl := "http://localhost:8090/image-1234.tgz"
+
+	ptgzsrc := flag.String("src", defaulturl, "image download url (required argument)")
+	ptgzdst := flag.String("dst", "./", "Save archive to <dst> directory")
+	psplit := flag.String("split", "", "write image subtrees to separate destinations, comma separated <subtree>=<dst> with a .tgz file or a directory to extract to (e.g. /boot=/mnt/boot,/opt/app=/data/app.tgz)")
+	ptgzref := flag.String("ref", "/", "Reference directory, \"auto\" to derive it from the mounted root filesystem")
+	pdebug := flag.Bool("debug", false, "enable debug output (same as -log-level debug)")
+	plogformat := flag.String("log-format", "text", "log output format: \"text\" or \"json\" (one object per line)")
+	ploglevel := flag.String("log-level", "info", "log records of this level and above: \"debug\", \"info\", \"warn\" or \"error\"")
+	pmaxclockskew := flag.Duration("max-clock-skew", 0, "accept server certificates outside their validity window by up to this duration (e.g. devices booting with a wrong clock)")
+	pcacert := flag.String("cacert", "", "trust the CA certificates (PEM) in this file for the server instead of the system trust store")
+	ppins := flag.String("pin-sha256", "", "only accept servers with this public key, comma separated sha256 hashes of the SubjectPublicKeyInfo (base64 or hex), replaces the CA verification unless -cacert is given")
+	pcertfile := flag.String("cert", "", "present this device certificate (PEM) to the server")
+	pkeyfile := flag.String("key", "", "private key file (PEM) for -cert")
+	ptoken := flag.String("token", "", "send this bearer token with every request (default $OTA_TOKEN)")
+	ptokenurl := flag.String("token-url", "", "fetch bearer tokens (e.g. JWTs) from this OAuth2 token endpoint with the client credentials grant, refreshed before they expire")
+	pclientid := flag.String("client-id", "", "OAuth2 client id for -token-url (without, the device authenticates by its -cert)")
+	pclientsecret := flag.String("client-secret", "", "OAuth2 client secret for -token-url (default $OTA_CLIENT_SECRET)")
+	puser := flag.String("user", "", "basic auth user name (credentials in the <src> url work as well)")
+	ppassword := flag.String("password", "", "basic auth password (default $OTA_PASSWORD)")
+	flag.Var(&headerflags{}, "header", "add this \"Name: value\" header to all requests (repeatable)")
+	pheaderfile := flag.String("header-file", "", "add the headers in this file to all requests, one \"Name: value\" per line")
+	puseragent := flag.String("user-agent", "", "send this User-Agent instead of ota-client/<version> (<os>/<arch>; <device model>)")
+	pdeviceid := flag.String("device-id", "", "send this device id as X-Device-Id with every request, for the server's log (the installed version from -statedir is sent as X-Current-Version, which server device groups can select)")
+	phardwarerevision := flag.String("hardware-revision", "", "send this hardware revision as X-Hardware-Revision with every request")
+	ptransportcmd := flag.String("transport-cmd", "", "run this command for every request instead of using http (called with \"index <src>\", \"diff <src>\" or \"tuf <src> <name>\", bitmap on stdin, response on stdout, exit status 10 for missing TUF metadata)")
+	pprivsepuser := flag.String("privsep-user", "", "run all network communication in a helper process as this unprivileged user")
+	pasync := flag.Bool("async", false, "let the server prepare the diff in the background, poll for it and resume interrupted downloads (huge diffs, unreliable connections)")
+	pprogress := flag.String("progress", "auto", "show the progress of downloads with rate and ETA on stderr: \"bar\", \"plain\" (a line every 5s), \"none\" or \"auto\" (a bar on terminals)")
+	pstatedir := flag.String("statedir", statedir, "keep client state (installed image version) in this directory, \"\" to disable")
+	pdaemon := flag.Bool("daemon", false, "run persistently: poll the image or release channel every -interval and install new images, only the http transport is supported; as systemd service use Type=notify, WatchdogSec= is supported")
+	pinterval := flag.Duration("interval", time.Hour, "poll interval of -daemon")
+	pstatussocket := flag.String("status-socket", "", "unix socket -daemon serves its state on as JSON (e.g. curl --unix-socket <socket> http://ota/), default <statedir>/daemon.sock")
+	pproxy := flag.String("proxy", "", "proxy for all requests, e.g. http://[user:password@]proxy:3128 or https://proxy:3129 for TLS to the proxy (verified with the system CAs), \"direct\" for none; default $HTTPS_PROXY or $HTTP_PROXY, except hosts in $NO_PROXY")
+	plimitrate := flag.String("limit-rate", "", "limit downloads (index and diff) to this many bytes per second, with k, m or g suffix (e.g. 500k), so updates leave bandwidth to other applications")
+	pnocache := flag.Bool("no-cache", false, "hash all reference files, instead of reusing the hashes of files with unchanged size, mtime and inode kept in <statedir>/hashcache.json")
+	pworkers := flag.Int("workers", hashworkers, "hash this many reference files in parallel, the default is the number of CPUs")
+	pbudgetbytes := flag.Int64("budget-bytes", 0, "download at most this many bytes per run, files received completely are staged in <statedir>/staging and later runs continue from there (exit status 4 while incomplete)")
+	pbudgettime := flag.Duration("budget-time", 0, "download for at most this long per run, like -budget-bytes")
+	ptmpdir := flag.String("tmpdir", "", "create the private scratch directory of each run below this directory (default $TMPDIR or /tmp)")
+	pallowdowngrade := flag.Bool("allow-downgrade", false, "accept images older than the installed version")
+	pchannelpubkey := flag.String("channel-pubkey", "", "only follow release channels signed with this ed25519 public key (PEM, see server -channel-key), never to an older epoch")
+	pmaxindexage := flag.Duration("max-index-age", 0, "reject indices signed longer ago than this (signed with server sign -timestamp), in addition to their signed max-age")
+	pallowdevices := flag.Bool("allow-devices", false, "accept images containing device nodes (e.g. root filesystems with a static /dev)")
+	pnosetuid := flag.Bool("no-setuid", false, "treat setuid/setgid files as unsafe entries")
+	pnoescapingsymlinks := flag.Bool("no-escaping-symlinks", false, "treat symlinks leaving the image root (relative targets climbing above it, absolute targets not in the image) as unsafe entries")
+	punsafeentries := flag.String("unsafe-entries", unsafepolicy, "policy for unsafe entries (device nodes, and see -no-setuid and -no-escaping-symlinks): \"reject\" the image or \"sanitize\" (drop them, clear setuid/setgid bits)")
+	pduplicates := flag.String("duplicates", duplicatepolicy, "policy for images with duplicate paths: \"last-wins\" (with a warning) or \"error\"")
+	pcaseinsensitive := flag.Bool("case-insensitive", false, "treat paths differing only in case as duplicates (FAT/exFAT targets)")
+	pselinuxcontexts := flag.String("selinux-contexts", "", "label the entries of the assembled image from this SELinux file_contexts spec, instead of keeping the image's labels")
+	powner := flag.String("owner", "", "own all entries of the assembled image by <uid>:<gid> (e.g. images built unprivileged)")
+	pumask := flag.String("umask", "", "clear these mode bits (octal, e.g. 022) on all entries of the assembled image")
+	precord := flag.String("record", "", "record the protocol exchange into this bundle directory")
+	preplay := flag.String("replay", "", "replay a recorded bundle directory offline instead of contacting the server (<src> defaults to the recorded one)")
+	pcheck := flag.Bool("check", false, "only report the number of files missing locally, nothing is downloaded")
+	papply := flag.Bool("apply", false, "also extract the assembled image to the -target directory, via a staging directory next to it which is exchanged with the target atomically once checked (modes, owners and links are kept); with -statedir the update is recorded and the old tree kept as <target>.previous for the \"rollback\" command")
+	ptarget := flag.String("target", "", "directory the image is extracted to with -apply, replaced as a whole (no mount point), with -slot %s is replaced by the slot")
+	pslot := flag.String("slot", "", "install to a slot of a dual-slot device: \"auto\" for the slot not running (from ota.slot= on the kernel command line, else the bootable slot at the first run after boot, kept in -statedir), or \"a\" or \"b\"; the image is applied to -target with %s replaced by the slot and the slot is marked bootable once verified")
+	papplysandbox := flag.Bool("apply-sandbox", false, "with -apply as root, extract the image in a helper process chrooted to the staging directory, in new mount, network, IPC and UTS namespaces and with only the capabilities for owners, modes, device nodes and file capabilities (linux, CGO_ENABLED=0 build)")
+	prootless := flag.Bool("rootless", false, "with -apply as a user other than root: extract device nodes as empty files, without setuid and setgid bits and only with user.* extended attributes, and keep the image manifest with the real owners, modes, device numbers and attributes as <target>/"+rootlessmanifest+" for tools packing the tree, like the save file of fakeroot")
+	papplyseccomp := flag.Bool("apply-seccomp", false, "with -apply-sandbox, also fail syscalls extraction never needs (exec, ptrace, mount, chroot, namespaces, module loading, bpf, ...) with a seccomp filter")
+	pslotprovider := flag.String("slot-provider", "", "where the bootable slot is kept: \"fw_printenv\" (U-Boot environment), \"grub[:<grubenv>]\" or \"file:<path>\", default file:<statedir>/slot")
+	pverify := flag.Bool("verify", false, "only compare the reference directory with the image: print ok, MISSING or MISMATCH (content, type, link target, mode or owner) for every entry and exit with status 1 unless all match, nothing is downloaded")
+	pdryrun := flag.Bool("dry-run", false, "like -check, and print the files that would be requested and the size of their download, no diff is requested and nothing written")
+	ppayloadkey := flag.String("payload-key", "", "decrypt index and diff payloads with the AES-256 key in this file (64 hex digits, default $OTA_PAYLOAD_KEY), plain payloads are refused")
+	ppubkey := flag.String("pubkey", "", "only accept images signed with this ed25519 public key (PEM, see server genkey)")
+	ptuf := flag.String("tuf", "", "only accept images listed in the server's TUF metadata, trusting this initial root.json (see server tuf)")
+	pkeyring := flag.String("keyring", "", "only accept images with an OpenPGP signature by a key in this keyring (gpg --export), alternatively to -pubkey")
+	pgzipdelta := flag.Bool("gzip-delta", gzipdeltas, "request changed gzip members (e.g. app bundles) as delta against their old version, if the server supports it")
+	if fips {
+		indexhashname = "sha256"
+	}
+	phash := flag.String("hash", indexhashname, "index hash to request: \"sha1\", \"sha256\", \"blake3\" (parallel, for large files) or \"auto\" for the fastest on this device the server supports")
+
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "usage: %s -src <url> -dst <dir/ or .tgz> [-ref <dir>] [options]\n", os.Args[0])
+		fmt.Fprintf(out, "       %s verify-archive|status|rollback [options]\n\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(out, "\nexit status:\n")
+		fmt.Fprintf(out, "  0  success\n")
+		fmt.Fprintf(out, "  %d  other failures\n", exitfailure)
+		fmt.Fprintf(out, "  %d  invalid command line\n", exitusage)
+		fmt.Fprintf(out, "  %d  no update needed: no file needs to be downloaded, the image is assembled from the reference alone (-check and -dry-run write nothing)\n", exitnoupdate)
+		fmt.Fprintf(out, "  %d  network: the server failed or was not reached, or the download budget ran out (run again)\n", exitnetwork)
+		fmt.Fprintf(out, "  %d  verification: the image was rejected (signature, manifest or hash mismatch, unknown hash format, version, age); -verify: entries differ\n", exitverification)
+		fmt.Fprintf(out, "  %d  disk: local files could not be read or written\n", exitdisk)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "verify-archive" {
+		os.Exit(verifyarchive(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		os.Exit(status(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rollback" {
+		os.Exit(rollback(os.Args[2:]))
+	}
+	// "extract" runs the sandboxed helper of -apply-sandbox
+	if len(os.Args) > 1 && os.Args[1] == "extract" {
+		os.Exit(extracthelper(os.Args[2:]))
+	}
+
+	// "fetch" runs the http helper for -privsep-user and -transport-cmd
+	fetchmode := len(os.Args) > 1 && os.Args[1] == "fetch"
+	if fetchmode {
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
+
+	if *ptgzsrc == defaulturl && *preplay != "" {
+		meta, err := readbundlemeta(*preplay)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		*ptgzsrc = meta.Src
+	}
+	if *ptgzsrc == defaulturl && !fetchmode {
+		flag.Usage()
+		os.Exit(exitusage)
+	}
+	if *pdebug {
+		debug = true
+	}
+	if err := setuplogging(*plogformat, *ploglevel); err != nil {
+		log.Fatalln(err)
+	}
+	var err error
+	if display, err = newprogressdisplay(*pprogress); err != nil {
+		log.Fatalln(err)
+	}
+	if display != nil {
+		progress = display.report
+	}
+	maxclockskew = *pmaxclockskew
+	cacertfile = *pcacert
+	if *ppins != "" {
+		hashes, err := parsepins(*ppins)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		pins = hashes
+	}
+	if (*pcertfile == "") != (*pkeyfile == "") {
+		usageerror("-cert and -key are required together")
+	}
+	certfile = *pcertfile
+	keyfile = *pkeyfile
+	token = *ptoken
+	if token == "" {
+		token = os.Getenv("OTA_TOKEN")
+	}
+	tokens.url = *ptokenurl
+	tokens.id = *pclientid
+	tokens.secret = *pclientsecret
+	if tokens.secret == "" {
+		tokens.secret = os.Getenv("OTA_CLIENT_SECRET")
+	}
+	authuser = *puser
+	asyncdiff = *pasync
+	if *phash != "auto" && hashbackendbyname(*phash) == nil {
+		usageerror("unknown hash %s", *phash)
+	}
+	indexhashname = *phash
+	gzipdeltas = *pgzipdelta
+	statedir = *pstatedir
+	tmproot = *ptmpdir
+	if *preplay != "" {
+		// a replay must neither depend on nor change the device state
+		statedir = ""
+	}
+	if *pproxy == "direct" {
+		os.Setenv("NO_PROXY", "*")
+	} else if *pproxy != "" {
+		u, err := url.Parse(*pproxy)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") || u.Host == "" {
+			usageerror("invalid -proxy, expected http://, https:// or socks5://<host>:<port>")
+		}
+		// also for the fetch helper and -transport-cmd
+		os.Setenv("HTTP_PROXY", *pproxy)
+		os.Setenv("HTTPS_PROXY", *pproxy)
+	}
+	if *plimitrate != "" {
+		rate, err := parserate(*plimitrate)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		limitrate = rate
+	}
+	budgetbytes = *pbudgetbytes
+	nocache = *pnocache
+	if *pworkers < 1 {
+		usageerror("-workers must be at least 1")
+	}
+	hashworkers = *pworkers
+	budgettime = *pbudgettime
+	if (budgetbytes > 0 || budgettime > 0) && statedir == "" {
+		usageerror("-budget-bytes and -budget-time need a -statedir to stage the files in")
+	}
+	allowdowngrade = *pallowdowngrade
+	maxindexage = *pmaxindexage
+	allowdevices = *pallowdevices
+	nosetuid = *pnosetuid
+	noescapingsymlinks = *pnoescapingsymlinks
+	if *punsafeentries != "reject" && *punsafeentries != "sanitize" {
+		usageerror("unknown unsafe entries policy %s", *punsafeentries)
+	}
+	unsafepolicy = *punsafeentries
+	if *pduplicates != "last-wins" && *pduplicates != "error" {
+		usageerror("unknown duplicate policy %s", *pduplicates)
+	}
+	duplicatepolicy = *pduplicates
+	caseinsensitive = *pcaseinsensitive
+	if *powner != "" {
+		uid, gid, err := parseowner(*powner)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defaultuid, defaultgid = uid, gid
+	}
+	if *psplit != "" {
+		dests, err := parsesplits(*psplit)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		splits = dests
+	}
+	if *pumask != "" {
+		umask, err := strconv.ParseInt(*pumask, 8, 64)
+		if err != nil || umask&^0777 != 0 {
+			usageerror("invalid umask %s", *pumask)
+		}
+		installumask = umask
+	}
+	authpassword = *ppassword
+	if *pheaderfile != "" {
+		if err := loadheaders(*pheaderfile); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	useragent = *puseragent
+	deviceid = *pdeviceid
+	hardwarerevision = *phardwarerevision
+	if authpassword == "" {
+		authpassword = os.Getenv("OTA_PASSWORD")
+	}
+	if *ppayloadkey != "" {
+		key, err := loadpayloadkey(*ppayloadkey)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		payloadkey = key
+	} else if os.Getenv("OTA_PAYLOAD_KEY") != "" {
+		key, err := parsepayloadkey(os.Getenv("OTA_PAYLOAD_KEY"))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		payloadkey = key
+	}
+
+	if fetchmode {
+		if err := fetch(flag.Args()); err == errmetanotfound {
+			os.Exit(exitmetanotfound)
+		} else if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	tgzsrc := *ptgzsrc
+	tgzref := *ptgzref
+	checkonly = *pcheck || *pdryrun || *pverify
+	verifyonly = *pverify
+	if *papply {
+		if *ptarget == "" || checkonly {
+			usageerror("-apply requires -target and cannot be combined with -check, -dry-run or -verify")
+		}
+		applytarget = *ptarget
+	}
+	if *pdaemon {
+		if checkonly || *ptransportcmd != "" || *pprivsepuser != "" || *preplay != "" || *precord != "" || *pinterval <= 0 {
+			usageerror("-daemon requires the http transport and a positive -interval, and cannot be combined with -check, -dry-run or -verify")
+		}
+	}
+	if *pslot != "" {
+		if checkonly || !strings.Contains(*ptarget, "%s") {
+			usageerror("-slot requires a -target containing %%s and cannot be combined with -check, -dry-run or -verify")
+		}
+		spec := *pslotprovider
+		if spec == "" {
+			if statedir == "" {
+				usageerror("-slot requires -slot-provider without -statedir")
 			}
+			spec = "file:" + path.Join(statedir, "slot")
+		}
+		p, err := newslotprovider(spec)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		slot := *pslot
+		if slot == "auto" {
+			if slot, err = inactiveslot(p); err != nil {
+				log.Fatalln(err)
+			}
+		} else if slot != slotnames[0] && slot != slotnames[1] {
+			usageerror("unknown slot %s", slot)
+		}
+		slots = p
+		slotproviderspec = spec
+		applyslot = slot
+		applytarget = strings.ReplaceAll(*ptarget, "%s", slot)
+		slog.Info("installing to slot", "slot", slot, "target", applytarget)
+	}
+	if (*papplysandbox || *papplyseccomp) && (applytarget == "" || !*papplysandbox || os.Geteuid() != 0) {
+		usageerror("-apply-sandbox requires -apply and root, -apply-seccomp requires -apply-sandbox")
+	}
+	applysandbox = *papplysandbox
+	applyseccomp = *papplyseccomp
+	if *prootless && applytarget == "" {
+		usageerror("-rootless requires -apply")
+	}
+	rootless = *prootless
+	dryrun = *pdryrun
+
+	if channelurl(tgzsrc) {
+		if *ptransportcmd != "" || *pprivsepuser != "" || *preplay != "" {
+			usageerror("Release channels need the http transport!")
+		}
+		if *pchannelpubkey != "" {
+			key, err := loadpubkey(*pchannelpubkey)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			channelpubkey = key
+		}
+		if !*pdaemon {
+			resolved, err := resolvechannel(tgzsrc)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			slog.Info("channel resolved", "channel", redacted(tgzsrc), "src", redacted(resolved))
+			tgzsrc = resolved
+		}
+	}
+
+	if !channelurl(tgzsrc) && strings.HasSuffix(imagename(tgzsrc), ".tgz") == false {
+		usageerror("<src> argument requires .tgz suffix")
+	}
+
+	tgzdst := destination(tgzsrc, *ptgzdst)
+
+	slog.Debug("options", "src", redacted(tgzsrc), "dst", tgzdst, "ref", tgzref)
+
+	refs, err := resolverefs(tgzref)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if *ppubkey != "" {
+		pubkey, err = loadpubkey(*ppubkey)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *pkeyring != "" {
+		keyring, err = loadkeyring(*pkeyring)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *pselinuxcontexts != "" {
+		filecontexts, err = loadfilecontexts(*pselinuxcontexts)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	tufrootfile = *ptuf
+
+	var t transport
+	if *preplay != "" {
+		t = &replaytransport{dir: *preplay}
+	} else if *pprivsepuser != "" && *ptransportcmd == "" {
+		t, err = privseptransport(tgzsrc, *pprivsepuser)
+	} else {
+		t, err = newtransport(tgzsrc, *ptransportcmd)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if *precord != "" {
+		t, err = newrecordtransport(t, *precord, tgzsrc)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
 
+	// remove the scratch directory when interrupted
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		scratchmu.Lock()
+		if scratchdir != "" {
+			os.RemoveAll(scratchdir)
 		}
+		os.Exit(128 + int(sig.(syscall.Signal)))
+	}()
 
-		os.Remove(tmpdifffile.Name())
+	if *pdaemon {
+		d, err := newdaemon(tgzsrc, *ptgzdst, refs, *pinterval)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		socket := *pstatussocket
+		if socket == "" && statedir != "" {
+			if err := os.MkdirAll(statedir, 0755); err != nil {
+				log.Fatalln(err)
+			}
+			socket = path.Join(statedir, "daemon.sock")
+		}
+		if socket != "" {
+			os.Remove(socket)
+			l, err := net.Listen("unix", socket)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			if err := os.Chmod(socket, 0660); err != nil {
+				log.Fatalln(err)
+			}
+			go d.serve(l)
+		}
+		// a supervisor stopping the daemon is no failure, a running update
+		// is abandoned as on interrupts
+		signal.Stop(sigs)
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-stop
+			d.sd.notify("STOPPING=1")
+			scratchmu.Lock()
+			if scratchdir != "" {
+				os.RemoveAll(scratchdir)
+			}
+			if socket != "" {
+				os.Remove(socket)
+			}
+			slog.Info("stopped", "signal", sig.String())
+			os.Exit(0)
+		}()
+		slog.Info("polling for updates", "src", redacted(tgzsrc), "interval", *pinterval, "status_socket", socket)
+		d.run()
 	}
 
-	trout.Close()
-	archiveout.Close() // write gzip footer
+	if checkonly {
+		slog.Info("checking index", "src", redacted(tgzsrc))
+	} else {
+		slog.Info("downloading index", "src", redacted(tgzsrc), "dst", tgzdst)
+	}
 
-	fmt.Println("done")
+	missingfiles, err := runupdate(t, tgzsrc, tgzdst, refs)
+	if display != nil {
+		display.end()
+	}
+	if err == errbudget {
+		slog.Warn(err.Error())
+		os.Exit(exitnetwork)
+	}
+	if err != nil {
+		log.Println(err)
+		os.Exit(exitstatus(err))
+	}
+	if verifyonly {
+		if verifyfailed > 0 {
+			fmt.Printf("%d of %d entries do not match the image\n", verifyfailed, verified)
+			os.Exit(exitverification)
+		}
+		fmt.Printf("all %d entries match the image\n", verified)
+		return
+	}
+	if checkonly {
+		fmt.Printf("%d files need to be downloaded\n", missingfiles)
+		if missingfiles == 0 {
+			os.Exit(exitnoupdate)
+		}
+		return
+	}
+	if summary := savings(laststatus); summary != "" {
+		fmt.Println(summary)
+	}
+	if missingfiles == 0 {
+		os.Exit(exitnoupdate)
+	}
 }
@@ -0,0 +1,1170 @@
+package main
+
+// client.go and server.go are separate programs, run the tests of each
+// with its own file: go test client.go client_test.go
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testcert issues a certificate for name valid from notbefore to notafter,
+// signed by ca (self-signed if ca is nil)
+func testcert(t *testing.T, name string, notbefore, notafter time.Time, ca *x509.Certificate, cakey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    notbefore,
+		NotAfter:     notafter,
+	}
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		ca, cakey = tmpl, key
+	} else {
+		tmpl.DNSNames = []string{name}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, cakey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestVerifyServerCert(t *testing.T) {
+
+	now := time.Now()
+	ca, cakey := testcert(t, "test ca", now.Add(-24*time.Hour), now.Add(24*time.Hour), nil, nil)
+
+	// the system roots are loaded once, with the test ca only
+	cafile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(cafile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SSL_CERT_FILE", cafile)
+	t.Setenv("SSL_CERT_DIR", "")
+
+	tests := []struct {
+		name       string
+		servername string
+		notbefore  time.Duration
+		notafter   time.Duration
+		skew       time.Duration
+		ok         bool
+	}{
+		{"valid", "ota.example", -time.Hour, time.Hour, 0, true},
+		{"expired", "ota.example", -2 * time.Hour, -time.Hour, 0, false},
+		{"expired within skew", "ota.example", -2 * time.Hour, -time.Hour, 2 * time.Hour, true},
+		{"not yet valid within skew", "ota.example", time.Hour, 3 * time.Hour, 2 * time.Hour, true},
+		{"expired beyond skew", "ota.example", -4 * time.Hour, -3 * time.Hour, 2 * time.Hour, false},
+		{"wrong name within skew", "other.example", -2 * time.Hour, -time.Hour, 2 * time.Hour, false},
+	}
+	for _, tt := range tests {
+		cert, _ := testcert(t, "ota.example", now.Add(tt.notbefore), now.Add(tt.notafter), ca, cakey)
+		maxclockskew = tt.skew
+		err := verifyservercert(tls.ConnectionState{ServerName: tt.servername, PeerCertificates: []*x509.Certificate{cert}}, nil)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+	maxclockskew = 0
+
+	// a ca outside of the system roots, trusted with -cacert or pinned
+	other, otherkey := testcert(t, "other ca", now.Add(-24*time.Hour), now.Add(24*time.Hour), nil, nil)
+	otherroots := x509.NewCertPool()
+	otherroots.AddCert(other)
+	caroots := x509.NewCertPool()
+	caroots.AddCert(ca)
+	cert, _ := testcert(t, "ota.example", now.Add(-time.Hour), now.Add(time.Hour), other, otherkey)
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	wrong := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+
+	pintests := []struct {
+		name  string
+		roots *x509.CertPool
+		pins  [][]byte
+		ok    bool
+	}{
+		{"system roots", nil, nil, false},
+		{"cacert", otherroots, nil, true},
+		{"pinned", nil, [][]byte{wrong[:], hash[:]}, true},
+		{"other pin", nil, [][]byte{wrong[:]}, false},
+		{"pinned with cacert", otherroots, [][]byte{hash[:]}, true},
+		{"other pin with cacert", otherroots, [][]byte{wrong[:]}, false},
+		{"pinned with another cacert", caroots, [][]byte{hash[:]}, false},
+	}
+	for _, tt := range pintests {
+		pins = tt.pins
+		err := verifyservercert(tls.ConnectionState{ServerName: "ota.example", PeerCertificates: []*x509.Certificate{cert}}, tt.roots)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+	pins = nil
+}
+
+func TestAutorefs(t *testing.T) {
+
+	lower := t.TempDir()
+	mounts := filepath.Join(t.TempDir(), "mounts")
+	table := strings.Join([]string{
+		"/dev/root / ext4 ro,relatime 0 0",
+		"proc /proc proc rw 0 0",
+		"tmpfs /tmp tmpfs rw 0 0",
+		"overlay /etc overlay rw,lowerdir=" + lower + ",upperdir=/data/etc,workdir=/data/work 0 0",
+		"overlay /opt overlay rw,lowerdir=/a:/b,upperdir=/data/opt 0 0",
+		"/dev/sda3 /mnt/my\\040disk ext4 rw 0 0",
+		"tmpfs /var tmpfs rw 0 0",
+		"/dev/sda4 /var ext4 rw 0 0",
+	}, "\n")
+	if err := os.WriteFile(mounts, []byte(table), 0644); err != nil {
+		t.Fatal(err)
+	}
+	refs, err := autorefs(mounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		ref  string
+		ok   bool
+	}{
+		{"usr/bin/ls", "/usr/bin/ls", true},
+		{"./bin/sh", "/bin/sh", true},
+		{"proc/cpuinfo", "", false},
+		{"tmp/x", "", false},
+		{"etc/hostname", lower + "/hostname", true},
+		{"opt/app", "/opt/app", true},
+		{"mnt/my disk/f", "/mnt/my disk/f", true},
+		{"var/lib/x", "/var/lib/x", true},
+		{"tmpfoo", "/tmpfoo", true},
+	}
+	for _, tt := range tests {
+		ref, ok := resolveref(refs, tt.name)
+		if ref != tt.ref || ok != tt.ok {
+			t.Errorf("%s: got %q %v, want %q %v", tt.name, ref, ok, tt.ref, tt.ok)
+		}
+	}
+}
+
+const testmanifest = "ota-manifest 2\n0644 0 0 \"etc/hello\" 6 5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03\n"
+
+const testedkey = `-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+mDMEatDQxhYJKwYBBAHaRw8BAQdATtDMvT/ftJHP6Roc0Y2sf9yH91lWsOnPNGFx
+RI83kz20E2VkIDxlZEBleGFtcGxlLmNvbT6IkAQTFggAOBYhBNzn4Yn+wDLA88D9
+nLIVa7aHIQaXBQJq0NDGAhsDBQsJCAcCBhUKCQgLAgQWAgMBAh4BAheAAAoJELIV
+a7aHIQaXlOsA/itxbCheCJlJDxFhLgwdG3Yt0QJAQUj/iAiHVs2OhAzDAQCqToaO
+9ITcAE9Et4N0gHUwb0v/HU7wuBc3EfX6UWYRDg==
+=3UAL
+-----END PGP PUBLIC KEY BLOCK-----
+`
+
+const testrsakey = `-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+mQENBGrQ0MYBCADXoXgfNLllJRJLM1eHV+sQ9MTRrxTGULl6Blh84huhxvZCmi3x
+9SkYq/UtWTpAQZUFkzdFdbsyQqBoF5mOM99jKKl3qymHyyy3Au6kkSIKozWPvmz5
+WGs7MeYesQJk69qEgj3CXazQ+verQ97WzBahlQhbHemeEhTsINsE74SXN4cNv/7X
+1j7JKIHb8/dpPlN5y7XG3L8GxgvXxsxl0L2bIHY3CuLj3vDrdLnv3Z5ejSLcqad3
+YY+33iZiTVm7mRd43xIbPH0UW5J2s70rOxZbnoOmCrnkHwMh60jQ0UBVewJYc1jR
+6uZSD04AnCw88XFdgdICkX1OA+xpYeXJvdCxABEBAAG0FXJzYSA8cnNhQGV4YW1w
+bGUuY29tPokBTgQTAQoAOBYhBGgUog/lBpnYaQwgFl3phWAUe0RTBQJq0NDGAhsD
+BQsJCAcCBhUKCQgLAgQWAgMBAh4BAheAAAoJEF3phWAUe0RTPS0H/0vODL7j/iJF
+80eh/PxTumKhuGyXpYvas7mMX+ex3zW0LeL7bU10ZI0I9OKq+J8LWeFzrgYFpqGD
+PphqPr9fBQsdxWiRHBDjw/+AYxdYToruvgWhZ+EXfsHkHC84ym8q8mI/Ze6UpM86
+8k4LrQOqzEg5JpTiKeatuqclgVajNYuSB3jHkm7k8sZL/57zfZwvDZxl84KaO8UM
+F9dI9+mEeQazWYBgXJBe6vgSlosswCBNwbmn4Yy8nd7C+KeQcOda9DVFlTx4fa4K
+8/Fj/hmqrh7tS+vUd/7juTWBP8MzH1VXftI0CNemB454zj9pU/dPzGhl74/jXe0j
+ZiVQrU1phO0=
+=Teqv
+-----END PGP PUBLIC KEY BLOCK-----
+`
+
+const testedsig = `-----BEGIN PGP SIGNATURE-----
+
+iIUEABYIAC0WIQTc5+GJ/sAywPPA/ZyyFWu2hyEGlwUCatDQyQ8cZWRAZXhhbXBs
+ZS5jb20ACgkQshVrtochBpeNhgEA9toYID0hx77OB5iLlmaTCeo44nNd1/8wZK/A
+7kBwjWMBAN6iemel8Mkf0IOj9E0aDFImyZk+cd59TlcO0qmRDq4B
+=vDdL
+-----END PGP SIGNATURE-----
+`
+
+const testedtextsig = `-----BEGIN PGP SIGNATURE-----
+
+iIUEARYIAC0WIQTc5+GJ/sAywPPA/ZyyFWu2hyEGlwUCatDQyQ8cZWRAZXhhbXBs
+ZS5jb20ACgkQshVrtochBpdaQAD+IHdAwB70DyDBnrdhccHjcEH7jQv5/X+HzCkR
+JzWYAj8BAPsB3sNW7WOH/STPoXPLIDVr8RrZOsnhh02OK+FF/XwK
+=6dSa
+-----END PGP SIGNATURE-----
+`
+
+const testrsasig = `-----BEGIN PGP SIGNATURE-----
+
+iQFEBAABCgAuFiEEaBSiD+UGmdhpDCAWXemFYBR7RFMFAmrQ0MkQHHJzYUBleGFt
+cGxlLmNvbQAKCRBd6YVgFHtEU+z9CAChZZwaLjA1fkS6qFj0C6R74nPN0322C+XX
+Alh2G/jPENRWNKPFuyA8j4Qzj5z2gjnYUEVWCDWT6zNlH75bBf4tAGmil5SnQquu
+rm/W6ugTxTqDaJIgTkEbObYQCUizKCW9nwBl1RHL5HKVZRxhSrzzu3HKg/ybH5ej
+/fz3h0H5ZAqhsPehMAPnoBefgh2dKmNPvspaxrFlAuZbt62bUaVO9kO64hE8+0Iu
+OOWkghAb0468z5a/td4Nymh8ej+JDe+ftUMIFItJ/0DN5LOhfKEKrD+5jDHqoVPQ
+y5W9tBjcgnLhyy+3NzLfhj9iXdA6MXJKNaUWjRAeVMLOU24XpqeN
+=Q23H
+-----END PGP SIGNATURE-----
+`
+
+const testrsasha1sig = `-----BEGIN PGP SIGNATURE-----
+
+iQFEBAABAgAuFiEEaBSiD+UGmdhpDCAWXemFYBR7RFMFAmrQ0MkQHHJzYUBleGFt
+cGxlLmNvbQAKCRBd6YVgFHtEU/1JCACQH7TvVFLvEXYnd5gIuVvttg+4NVYfXCj7
+niMisiM0b6rW6DMpRU6IUbdy/O5c1aZV7PmEZMYOSpUJ4fdbTVSJ3nc0Mnu05139
+CVDRJOQsvrq8SkW/yz6cjiDL6EuLoTwzO+8pJwXmkujKBzLFwAYtSD+r9lEinhdx
+tThy1SJlR0gR7b4w+lBXD815uyA0dqGu4At/JRp0d+xF0T7dDAwzaMOeMBkBOj3h
+Rp9K/VwGzTKJa9rPku7XXm4YIJlT/+IOG2G6v1XYLK42/pXLi6ZzvicetzdspIFW
+25WGQymeM4FE79xqqhzHcoHHeS7nLYPLS0y3j91h8R86/XWGEMju
+=uiEx
+-----END PGP SIGNATURE-----
+`
+
+func testkeyring(t *testing.T, armored ...string) []pgpkey {
+
+	fname := filepath.Join(t.TempDir(), "keyring.asc")
+	if err := os.WriteFile(fname, []byte(strings.Join(armored, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadkeyring(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func testsigpacket(t *testing.T, armored string) []byte {
+
+	data, err := pgpdearmor(armored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets, err := pgpreadpackets(data)
+	if err != nil || len(packets) != 1 || packets[0].tag != 2 {
+		t.Fatalf("no signature packet: %v", err)
+	}
+	return packets[0].body
+}
+
+func TestPGPReadPackets(t *testing.T) {
+
+	body192 := append([]byte{0xc6, 0xc0, 0x00}, make([]byte, 192)...)
+	tests := []struct {
+		name    string
+		data    []byte
+		tags    []byte
+		lengths []int
+		err     string
+	}{
+		{name: "empty", data: []byte{}},
+		{name: "new one-octet length", data: []byte{0xc2, 0x02, 0xaa, 0xbb}, tags: []byte{2}, lengths: []int{2}},
+		{name: "new two-octet length", data: body192, tags: []byte{6}, lengths: []int{192}},
+		{name: "new five-octet length", data: []byte{0xce, 0xff, 0, 0, 0, 1, 0xaa}, tags: []byte{14}, lengths: []int{1}},
+		{name: "old one-octet length", data: []byte{0x88, 0x02, 0xaa, 0xbb}, tags: []byte{2}, lengths: []int{2}},
+		{name: "old two-octet length", data: []byte{0x99, 0x00, 0x01, 0xaa}, tags: []byte{6}, lengths: []int{1}},
+		{name: "old indeterminate length", data: []byte{0x8b, 1, 2, 3}, tags: []byte{2}, lengths: []int{3}},
+		{name: "two packets", data: []byte{0xc6, 0x01, 0xaa, 0x88, 0x00}, tags: []byte{6, 2}, lengths: []int{1, 0}},
+		{name: "no packet header", data: []byte{0x00, 0x01}, err: "invalid OpenPGP packet header"},
+		{name: "new header truncated", data: []byte{0xc2}, err: io.ErrUnexpectedEOF.Error()},
+		{name: "new two-octet length truncated", data: []byte{0xc2, 0xc0}, err: io.ErrUnexpectedEOF.Error()},
+		{name: "new five-octet length truncated", data: []byte{0xc2, 0xff, 0, 0, 0}, err: io.ErrUnexpectedEOF.Error()},
+		{name: "new partial length", data: []byte{0xc2, 0xe0, 0xaa}, err: "partial OpenPGP packets are not supported"},
+		{name: "body shorter than length", data: []byte{0xc2, 0x05, 1, 2}, err: io.ErrUnexpectedEOF.Error()},
+		{name: "huge length", data: []byte{0xc2, 0xff, 0xff, 0xff, 0xff, 0xff, 1}, err: io.ErrUnexpectedEOF.Error()},
+		{name: "old header truncated", data: []byte{0x88}, err: io.ErrUnexpectedEOF.Error()},
+		{name: "old four-octet length truncated", data: []byte{0x8a, 0, 0}, err: io.ErrUnexpectedEOF.Error()},
+		{name: "second packet truncated", data: []byte{0xc6, 0x01, 0xaa, 0xc2, 0x02, 0xaa}, err: io.ErrUnexpectedEOF.Error()},
+	}
+	for _, tt := range tests {
+		packets, err := pgpreadpackets(tt.data)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: got error %v, want %s", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if len(packets) != len(tt.tags) {
+			t.Errorf("%s: got %d packets, want %d", tt.name, len(packets), len(tt.tags))
+			continue
+		}
+		for i, packet := range packets {
+			if packet.tag != tt.tags[i] || len(packet.body) != tt.lengths[i] {
+				t.Errorf("%s: packet %d is tag %d with %d bytes, want tag %d with %d", tt.name, i, packet.tag, len(packet.body), tt.tags[i], tt.lengths[i])
+			}
+		}
+	}
+}
+
+func TestPGPParseKey(t *testing.T) {
+
+	edpoint := append([]byte{0x01, 0x07, 0x40}, make([]byte, 32)...)
+	eddsa := append(append([]byte{4, 0, 0, 0, 0, 22, byte(len(pgped25519oid))}, pgped25519oid...), edpoint...)
+	tests := []struct {
+		name string
+		body []byte
+		kind string // "rsa", "ed" or "" for unsupported keys
+		err  string
+	}{
+		{name: "eddsa", body: eddsa, kind: "ed"},
+		{name: "ed25519", body: append([]byte{4, 0, 0, 0, 0, 27}, make([]byte, 32)...), kind: "ed"},
+		{name: "rsa", body: []byte{4, 0, 0, 0, 0, 1, 0x00, 0x09, 0x01, 0x00, 0x00, 0x11, 0x01, 0x00, 0x01}, kind: "rsa"},
+		{name: "version 3", body: []byte{3, 0, 0, 0, 0, 1, 0, 0}},
+		{name: "dsa", body: []byte{4, 0, 0, 0, 0, 17, 0, 0}},
+		{name: "too short", body: []byte{4, 0, 0}},
+		{name: "other curve", body: []byte{4, 0, 0, 0, 0, 22, 3, 0x2b, 0x81, 0x04}},
+		{name: "rsa modulus truncated", body: []byte{4, 0, 0, 0, 0, 1, 0x08, 0x00, 0xff}, err: io.ErrUnexpectedEOF.Error()},
+		{name: "rsa exponent missing", body: []byte{4, 0, 0, 0, 0, 1, 0x00, 0x08, 0xff}, err: io.ErrUnexpectedEOF.Error()},
+		{name: "rsa exponent too large", body: []byte{4, 0, 0, 0, 0, 1, 0x00, 0x08, 0xff, 0x00, 0x21, 1, 0, 0, 0, 1}, err: "unsupported RSA exponent"},
+		{name: "eddsa oid truncated", body: []byte{4, 0, 0, 0, 0, 22, 9, 0x2b}, err: io.ErrUnexpectedEOF.Error()},
+		{name: "eddsa point without prefix", body: append(append([]byte{4, 0, 0, 0, 0, 22, byte(len(pgped25519oid))}, pgped25519oid...), append([]byte{0x01, 0x00}, make([]byte, 32)...)...), err: "invalid Ed25519 key"},
+		{name: "eddsa point truncated", body: eddsa[:len(eddsa)-1], err: io.ErrUnexpectedEOF.Error()},
+		{name: "ed25519 truncated", body: append([]byte{4, 0, 0, 0, 0, 27}, make([]byte, 31)...), err: io.ErrUnexpectedEOF.Error()},
+	}
+	for _, tt := range tests {
+		key, err := pgpparsekey(tt.body)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: got error %v, want %s", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		kind := ""
+		switch {
+		case key == nil:
+		case key.rsa != nil:
+			kind = "rsa"
+		case key.ed != nil:
+			kind = "ed"
+		}
+		if kind != tt.kind {
+			t.Errorf("%s: got key %q, want %q", tt.name, kind, tt.kind)
+		}
+	}
+}
+
+func TestPGPDearmor(t *testing.T) {
+
+	if _, err := pgpdearmor("no armor"); err == nil {
+		t.Error("data without armor accepted")
+	}
+	if _, err := pgpdearmor("-----BEGIN PGP SIGNATURE-----\n\n!!!!\n-----END PGP SIGNATURE-----\n"); err == nil {
+		t.Error("invalid base64 accepted")
+	}
+	if _, err := pgpdearmor(strings.TrimSuffix(testedsig, "-----END PGP SIGNATURE-----\n")); err == nil {
+		t.Error("unterminated armor accepted")
+	}
+	data, err := pgpdearmor(strings.ReplaceAll(testedsig, "\n", "\r\n"))
+	if err != nil || len(data) == 0 {
+		t.Errorf("crlf armor: %v", err)
+	}
+	ed, _ := pgpdearmor(testedkey)
+	rsa, _ := pgpdearmor(testrsakey)
+	both, err := pgpdearmor(testedkey + testrsakey)
+	if err != nil || !bytes.Equal(both, append(ed, rsa...)) {
+		t.Errorf("concatenated armor: %v", err)
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+
+	keys := testkeyring(t, testedkey, testrsakey)
+	if len(keys) != 2 || keys[0].ed == nil || keys[1].rsa == nil || keys[1].rsa.N.BitLen() != 2048 {
+		t.Fatalf("got %d keys, want the ed25519 and the rsa2048 key", len(keys))
+	}
+
+	binary, err := pgpdearmor(testedkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{
+		"empty":     {},
+		"no keys":   []byte(testedsig),
+		"truncated": binary[:len(binary)-5],
+		"garbage":   []byte("ota"),
+	} {
+		fname := filepath.Join(dir, name)
+		if err := os.WriteFile(fname, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadkeyring(fname); err == nil {
+			t.Errorf("%s keyring accepted", name)
+		}
+	}
+}
+
+func TestVerifyPGP(t *testing.T) {
+
+	edkeys := testkeyring(t, testedkey)
+	rsakeys := testkeyring(t, testrsakey)
+	bothkeys := testkeyring(t, testedkey, testrsakey)
+	tampered := strings.Replace(testmanifest, "0644", "4755", 1)
+
+	tests := []struct {
+		name   string
+		keys   []pgpkey
+		signed string
+		sig    string
+		ok     bool
+	}{
+		{name: "ed25519", keys: edkeys, signed: testmanifest, sig: testedsig, ok: true},
+		{name: "ed25519 text", keys: edkeys, signed: testmanifest, sig: testedtextsig, ok: true},
+		{name: "rsa sha512", keys: rsakeys, signed: testmanifest, sig: testrsasig, ok: true},
+		{name: "rsa in keyring of both", keys: bothkeys, signed: testmanifest, sig: testrsasig, ok: true},
+		{name: "ed25519 in keyring of both", keys: bothkeys, signed: testmanifest, sig: testedsig, ok: true},
+		{name: "ed25519 tampered", keys: edkeys, signed: tampered, sig: testedsig},
+		{name: "rsa tampered", keys: rsakeys, signed: tampered, sig: testrsasig},
+		{name: "ed25519 signature, rsa key", keys: rsakeys, signed: testmanifest, sig: testedsig},
+		{name: "rsa signature, ed25519 key", keys: edkeys, signed: testmanifest, sig: testrsasig},
+		{name: "rsa sha1", keys: rsakeys, signed: testmanifest, sig: testrsasha1sig},
+		{name: "key instead of signature", keys: edkeys, signed: testmanifest, sig: testedkey},
+		{name: "no keys", signed: testmanifest, sig: testedsig},
+	}
+	for _, tt := range tests {
+		err := verifypgp(tt.keys, []byte(tt.signed), tt.sig)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+}
+
+func TestPGPVerifySignature(t *testing.T) {
+
+	edkeys := testkeyring(t, testedkey)
+	rsakeys := testkeyring(t, testrsakey)
+	edsig := testsigpacket(t, testedsig)
+	rsasig := testsigpacket(t, testrsasig)
+	hashedlen := int(edsig[4])<<8 | int(edsig[5])
+	left16 := 6 + hashedlen + 2 + (int(edsig[6+hashedlen])<<8 | int(edsig[7+hashedlen]))
+
+	modified := func(sig []byte, f func(sig []byte) []byte) []byte {
+		return f(append([]byte{}, sig...))
+	}
+	tests := []struct {
+		name string
+		keys []pgpkey
+		sig  []byte
+		err  string
+	}{
+		{name: "ed25519", keys: edkeys, sig: edsig},
+		{name: "rsa", keys: rsakeys, sig: rsasig},
+		{name: "empty", keys: edkeys, sig: []byte{}, err: "unsupported signature version"},
+		{name: "version 3", keys: edkeys, sig: modified(edsig, func(s []byte) []byte { s[0] = 3; return s }), err: "unsupported signature version"},
+		{name: "hashed length beyond packet", keys: edkeys, sig: modified(edsig, func(s []byte) []byte { s[4], s[5] = 0xff, 0xff; return s }), err: io.ErrUnexpectedEOF.Error()},
+		{name: "unhashed length beyond packet", keys: edkeys, sig: modified(edsig, func(s []byte) []byte { s[6+hashedlen], s[7+hashedlen] = 0xff, 0xff; return s }), err: io.ErrUnexpectedEOF.Error()},
+		{name: "truncated before unhashed length", keys: edkeys, sig: edsig[:6+hashedlen+1], err: io.ErrUnexpectedEOF.Error()},
+		{name: "truncated values", keys: edkeys, sig: edsig[:len(edsig)-10], err: io.ErrUnexpectedEOF.Error()},
+		{name: "unsupported signature type", keys: edkeys, sig: modified(edsig, func(s []byte) []byte { s[1] = 0x13; return s }), err: "unsupported signature type 19"},
+		{name: "unsupported hash", keys: edkeys, sig: modified(edsig, func(s []byte) []byte { s[3] = 2; return s }), err: "unsupported hash algorithm 2"},
+		{name: "hash prefix mismatch", keys: edkeys, sig: modified(edsig, func(s []byte) []byte { s[left16] ^= 1; return s }), err: "signature does not match"},
+		{name: "ed25519 signature modified", keys: edkeys, sig: modified(edsig, func(s []byte) []byte { s[len(s)-1] ^= 1; return s }), err: "signature does not match any key in the keyring"},
+		{name: "rsa signature modified", keys: rsakeys, sig: modified(rsasig, func(s []byte) []byte { s[len(s)-1] ^= 1; return s }), err: "signature does not match any key in the keyring"},
+		{name: "ed25519 signature, rsa key", keys: rsakeys, sig: edsig, err: "signature does not match any key in the keyring"},
+		{name: "rsa signature, ed25519 key", keys: edkeys, sig: rsasig, err: "signature does not match any key in the keyring"},
+	}
+	for _, tt := range tests {
+		err := pgpverifysignature(tt.keys, []byte(testmanifest), tt.sig)
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		} else if tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("%s: got error %v, want %s", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestCheckEntry(t *testing.T) {
+
+	tests := []struct {
+		hdr tar.Header
+		ok  bool
+	}{
+		{tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg}, true},
+		{tar.Header{Name: "./etc/", Typeflag: tar.TypeDir}, true},
+		{tar.Header{Name: "etc/..hidden", Typeflag: tar.TypeReg}, true},
+		{tar.Header{Name: "", Typeflag: tar.TypeReg}, false},
+		{tar.Header{Name: "/etc/passwd", Typeflag: tar.TypeReg}, false},
+		{tar.Header{Name: "../etc/passwd", Typeflag: tar.TypeReg}, false},
+		{tar.Header{Name: "etc/../../passwd", Typeflag: tar.TypeReg}, false},
+		{tar.Header{Name: "etc/..", Typeflag: tar.TypeDir}, false},
+		{tar.Header{Name: "etc/link", Typeflag: tar.TypeLink, Linkname: "etc/hostname"}, true},
+		{tar.Header{Name: "etc/link", Typeflag: tar.TypeLink, Linkname: "../hostname"}, false},
+		{tar.Header{Name: "etc/link", Typeflag: tar.TypeLink, Linkname: "/etc/shadow"}, false},
+		{tar.Header{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "../hostname"}, true},
+		{tar.Header{Name: "dev/fifo", Typeflag: tar.TypeFifo}, true},
+	}
+	for _, tt := range tests {
+		err := checkentry(&tt.hdr)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q %c %q: got %v", tt.hdr.Name, tt.hdr.Typeflag, tt.hdr.Linkname, err)
+		}
+	}
+}
+
+func TestUnsafeEntry(t *testing.T) {
+
+	names := map[string]bool{"/etc": true, "/etc/hostname": true, "/usr/bin/app": true}
+	tests := []struct {
+		hdr     tar.Header
+		devices bool
+		strict  bool // -no-setuid and -no-escaping-symlinks
+		safe    bool
+	}{
+		{tar.Header{Name: "dev/sda", Typeflag: tar.TypeBlock}, false, false, false},
+		{tar.Header{Name: "dev/null", Typeflag: tar.TypeChar}, false, false, false},
+		{tar.Header{Name: "dev/null", Typeflag: tar.TypeChar}, true, false, true},
+		{tar.Header{Name: "usr/bin/su", Typeflag: tar.TypeReg, Mode: 04755}, false, false, true},
+		{tar.Header{Name: "usr/bin/su", Typeflag: tar.TypeReg, Mode: 04755}, false, true, false},
+		{tar.Header{Name: "usr/bin/wall", Typeflag: tar.TypeReg, Mode: 02755}, false, true, false},
+		{tar.Header{Name: "usr/bin/ls", Typeflag: tar.TypeReg, Mode: 0755}, false, true, true},
+		{tar.Header{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 02755}, false, true, true},
+		{tar.Header{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "../../outside"}, false, false, true},
+		{tar.Header{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "../../outside"}, false, true, false},
+		{tar.Header{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "../usr/bin/app"}, false, true, true},
+		{tar.Header{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "./../.."}, false, true, false},
+		{tar.Header{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "a/../../.."}, false, true, false},
+		{tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: ".."}, false, true, false},
+		{tar.Header{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "/etc/hostname"}, false, true, true},
+		{tar.Header{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "/etc/../etc/hostname"}, false, true, true},
+		{tar.Header{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "/etc/shadow"}, false, true, false},
+	}
+	for _, tt := range tests {
+		allowdevices = tt.devices
+		nosetuid, noescapingsymlinks = tt.strict, tt.strict
+		reason := unsafeentry(&tt.hdr, names)
+		if (reason == "") != tt.safe {
+			t.Errorf("%q %c %o %q: got %q", tt.hdr.Name, tt.hdr.Typeflag, tt.hdr.Mode, tt.hdr.Linkname, reason)
+		}
+	}
+	allowdevices, nosetuid, noescapingsymlinks = false, false, false
+}
+
+// testdelta returns the gzipped index delta of the operations ops
+func testdelta(t *testing.T, ops ...[]byte) io.Reader {
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte(deltamagic))
+	for _, op := range ops {
+		gw.Write(op)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestApplyIndexDelta(t *testing.T) {
+
+	defer func(old string) { statedir = old }(statedir)
+	statedir = t.TempDir()
+
+	// a base of the blocks A, B, C, D
+	var base, gzbase bytes.Buffer
+	for _, c := range "ABCD" {
+		base.Write(bytes.Repeat([]byte{byte(c)}, 512))
+	}
+	gw := gzip.NewWriter(&gzbase)
+	gw.Write(base.Bytes())
+	gw.Close()
+	if err := os.WriteFile(filepath.Join(statedir, "index.tgz"), gzbase.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	block := func(c byte) []byte { return bytes.Repeat([]byte{c}, 512) }
+	copyop := func(start, count uint64) []byte {
+		op := binary.AppendUvarint([]byte{deltacopy}, start)
+		return binary.AppendUvarint(op, count)
+	}
+	literal := func(blocks ...[]byte) []byte {
+		return append(binary.AppendUvarint([]byte{deltaliteral}, uint64(len(blocks))), bytes.Join(blocks, nil)...)
+	}
+	end := func(data ...[]byte) []byte {
+		sum := sha256.Sum256(bytes.Join(data, nil))
+		return append([]byte{deltaend}, sum[:]...)
+	}
+
+	// C D A X, copying backwards
+	want := bytes.Join([][]byte{block('C'), block('D'), block('A'), block('X')}, nil)
+	var out bytes.Buffer
+	if err := applyindexdelta(&out, testdelta(t, copyop(2, 2), copyop(0, 1), literal(block('X')), end(want))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("rebuilt %d bytes, want %d", out.Len(), len(want))
+	}
+
+	tests := []struct {
+		name string
+		ops  [][]byte
+	}{
+		{"wrong sha256", [][]byte{copyop(0, 1), end(block('B'))}},
+		{"copy beyond the base", [][]byte{copyop(3, 2), end(block('D'), block('D'))}},
+		{"huge copy", [][]byte{copyop(0, 1<<41), end()}},
+		{"short literal", [][]byte{{deltaliteral, 1, 'X'}}},
+		{"no end", [][]byte{copyop(0, 1)}},
+		{"unknown operation", [][]byte{{'x'}}},
+	}
+	for _, tt := range tests {
+		if err := applyindexdelta(io.Discard, testdelta(t, tt.ops...)); err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+	var bad bytes.Buffer
+	gw = gzip.NewWriter(&bad)
+	gw.Write([]byte("ota-index-delta 2\n"))
+	gw.Write(end())
+	gw.Close()
+	if err := applyindexdelta(io.Discard, &bad); err == nil {
+		t.Errorf("unknown delta version accepted")
+	}
+}
+
+func TestCanonicalJSON(t *testing.T) {
+
+	tests := []struct {
+		name string
+		v    interface{}
+		want string
+		err  bool
+	}{
+		{name: "sorted keys", v: map[string]interface{}{"b": 1, "a": []interface{}{true, nil, "x"}}, want: `{"a":[true,null,"x"],"b":1}`},
+		{name: "escapes", v: "q\"b\\<>&é", want: `"q\"b\\<>&é"`},
+		{name: "struct", v: tufheader{Type: "root", Version: 2, Expires: time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)}, want: `{"_type":"root","expires":"2030-01-02T03:04:05Z","spec_version":"","version":2}`},
+		{name: "raw message", v: json.RawMessage("{ \"b\" : 1,\n \"a\" : 2 }"), want: `{"a":2,"b":1}`},
+		{name: "float", v: map[string]interface{}{"a": 1.5}, err: true},
+		{name: "exponent", v: json.RawMessage(`{"a":1e3}`), err: true},
+	}
+	for _, tt := range tests {
+		data, err := canonicaljson(tt.v)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: got %s, want error", tt.name, data)
+			}
+			continue
+		}
+		if err != nil || string(data) != tt.want {
+			t.Errorf("%s: got %s (%v), want %s", tt.name, data, err, tt.want)
+		}
+	}
+}
+
+// testtufkey returns a new ed25519 key and its key id
+func testtufkey(t *testing.T) (string, tufkey, ed25519.PrivateKey) {
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := tufkey{KeyType: "ed25519", Scheme: "ed25519"}
+	key.KeyVal.Public = hex.EncodeToString(pub)
+	data, err := canonicaljson(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := sha256.Sum256(data)
+	return hex.EncodeToString(id[:]), key, priv
+}
+
+// testtufsign returns the envelope of signed with signatures of the keys
+func testtufsign(t *testing.T, signed interface{}, keyids []string, keys []ed25519.PrivateKey) *tufenvelope {
+
+	data, err := canonicaljson(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &tufenvelope{Signed: raw}
+	for i, key := range keys {
+		env.Signatures = append(env.Signatures, tufsignature{KeyID: keyids[i], Sig: hex.EncodeToString(ed25519.Sign(key, data))})
+	}
+	return env
+}
+
+func TestTUFVerify(t *testing.T) {
+
+	id1, key1, priv1 := testtufkey(t)
+	id2, key2, priv2 := testtufkey(t)
+	id3, key3, priv3 := testtufkey(t)
+	rsakey := key3
+	rsakey.KeyType, rsakey.Scheme = "rsa", "rsassa-pss-sha256"
+	root := &tufroot{
+		Keys: map[string]tufkey{id1: key1, id2: key2, id3: key3, "rsa": rsakey},
+		Roles: map[string]tufrole{
+			"timestamp": {KeyIDs: []string{id1}, Threshold: 1},
+			"snapshot":  {KeyIDs: []string{id1, id2}, Threshold: 2},
+			"targets":   {KeyIDs: []string{id1, "rsa"}, Threshold: 1},
+			"mirror":    {KeyIDs: []string{id1}, Threshold: 0},
+		},
+	}
+	meta := func(role string, version int64) tufmeta {
+		return tufmeta{tufheader: tufheader{Type: role, SpecVersion: "1.0.31", Version: version, Expires: time.Now().Add(time.Hour).UTC().Truncate(time.Second)}, Meta: map[string]tufmetafile{"snapshot.json": {Version: 3}}}
+	}
+
+	reformatted := testtufsign(t, meta("timestamp", 1), []string{id1}, []ed25519.PrivateKey{priv1})
+	var indented bytes.Buffer
+	json.Indent(&indented, reformatted.Signed, "", "  ")
+	reformatted.Signed = indented.Bytes()
+
+	modified := testtufsign(t, meta("timestamp", 1), []string{id1}, []ed25519.PrivateKey{priv1})
+	modified.Signed = bytes.Replace(modified.Signed, []byte(`"version":1`), []byte(`"version":9`), 1)
+
+	badhex := testtufsign(t, meta("timestamp", 1), []string{id1}, []ed25519.PrivateKey{priv1})
+	badhex.Signatures[0].Sig = "zz" + badhex.Signatures[0].Sig[2:]
+
+	tests := []struct {
+		name string
+		role string
+		env  *tufenvelope
+		err  string
+	}{
+		{name: "threshold 1", role: "timestamp", env: testtufsign(t, meta("timestamp", 1), []string{id1}, []ed25519.PrivateKey{priv1})},
+		{name: "threshold 2", role: "snapshot", env: testtufsign(t, meta("snapshot", 1), []string{id2, id1}, []ed25519.PrivateKey{priv2, priv1})},
+		{name: "whitespace in signed", role: "timestamp", env: reformatted},
+		{name: "unsigned", role: "timestamp", env: testtufsign(t, meta("timestamp", 1), nil, nil), err: "TUF timestamp metadata has 0 of 1 required signatures!"},
+		{name: "below threshold", role: "snapshot", env: testtufsign(t, meta("snapshot", 1), []string{id1}, []ed25519.PrivateKey{priv1}), err: "TUF snapshot metadata has 1 of 2 required signatures!"},
+		{name: "same key twice", role: "snapshot", env: testtufsign(t, meta("snapshot", 1), []string{id1, id1}, []ed25519.PrivateKey{priv1, priv1}), err: "TUF snapshot metadata has 1 of 2 required signatures!"},
+		{name: "key of another role", role: "timestamp", env: testtufsign(t, meta("timestamp", 1), []string{id3}, []ed25519.PrivateKey{priv3}), err: "TUF timestamp metadata has 0 of 1 required signatures!"},
+		{name: "key id of another key", role: "timestamp", env: testtufsign(t, meta("timestamp", 1), []string{id1}, []ed25519.PrivateKey{priv2}), err: "TUF timestamp metadata has 0 of 1 required signatures!"},
+		{name: "unknown key id", role: "timestamp", env: testtufsign(t, meta("timestamp", 1), []string{"unknown"}, []ed25519.PrivateKey{priv1}), err: "TUF timestamp metadata has 0 of 1 required signatures!"},
+		{name: "key type confusion", role: "targets", env: testtufsign(t, meta("targets", 1), []string{"rsa"}, []ed25519.PrivateKey{priv3}), err: "TUF targets metadata has 0 of 1 required signatures!"},
+		{name: "modified after signing", role: "timestamp", env: modified, err: "TUF timestamp metadata has 0 of 1 required signatures!"},
+		{name: "invalid hex signature", role: "timestamp", env: badhex, err: "TUF timestamp metadata has 0 of 1 required signatures!"},
+		{name: "type of another role", role: "timestamp", env: testtufsign(t, meta("snapshot", 1), []string{id1}, []ed25519.PrivateKey{priv1}), err: `TUF timestamp metadata has the type "snapshot"!`},
+		{name: "unknown role", role: "delegation", env: testtufsign(t, meta("delegation", 1), []string{id1}, []ed25519.PrivateKey{priv1}), err: "TUF root has no valid delegation role!"},
+		{name: "threshold 0", role: "mirror", env: testtufsign(t, meta("mirror", 1), nil, nil), err: "TUF root has no valid mirror role!"},
+		{name: "not canonical", role: "timestamp", env: &tufenvelope{Signed: json.RawMessage(`{"_type":"timestamp","version":1.5}`)}, err: "canonical json: 1.5 is no integer"},
+	}
+	for _, tt := range tests {
+		var signed tufmeta
+		err := tufverify(tt.env, root, tt.role, &signed)
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		} else if tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("%s: got error %v, want %s", tt.name, err, tt.err)
+		}
+		if tt.err == "" && (signed.Version != 1 || signed.Meta["snapshot.json"].Version != 3) {
+			t.Errorf("%s: decoded %+v", tt.name, signed)
+		}
+	}
+}
+
+func TestTUFExpired(t *testing.T) {
+
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		expires time.Time
+		expired bool
+	}{
+		{expires: now.Add(time.Second)},
+		{expires: now},
+		{expires: now.Add(-time.Second), expired: true},
+		{expires: time.Time{}, expired: true},
+	}
+	for _, tt := range tests {
+		err := tufexpired(tufheader{Type: "timestamp", Expires: tt.expires}, now)
+		if (err != nil) != tt.expired {
+			t.Errorf("expires %s: got %v, want expired %v", tt.expires, err, tt.expired)
+		}
+	}
+}
+
+func TestBLAKE3(t *testing.T) {
+
+	// the official test vectors, input bytes i % 251, and lengths across the
+	// subtree size of the reference implementation, 32 bytes of output
+	tests := []struct {
+		length int
+		hash   string
+	}{
+		{0, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+		{1, "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+		{1023, "10108970eeda3eb932baac1428c7a2163b0e924c9a9e25b35bba72b28f70bd11"},
+		{1024, "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+		{1025, "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+		{2048, "e776b6028c7cd22a4d0ba182a8bf62205d2ef576467e838ed6f2529b85fba24a"},
+		{2049, "5f4d72f40d7a5f82b15ca2b2e44b1de3c2ef86c426c95c1af0b6879522563030"},
+		{3072, "b98cb0ff3623be03326b373de6b9095218513e64f1ee2edd2525c7ad1e5cffd2"},
+		{3073, "7124b49501012f81cc7f11ca069ec9226cecb8a2c850cfe644e327d22d3e1cd3"},
+		{4096, "015094013f57a5277b59d8475c0501042c0b642e531b0a1c8f58d2163229e969"},
+		{4097, "9b4052b38f1c5fc8b1f9ff7ac7b27cd242487b3d890d15c96a1c25b8aa0fb995"},
+		{5120, "9cadc15fed8b5d854562b26a9536d9707cadeda9b143978f319ab34230535833"},
+		{5121, "628bd2cb2004694adaab7bbd778a25df25c47b9d4155a55f8fbd79f2fe154cff"},
+		{6144, "3e2e5b74e048f3add6d21faab3f83aa44d3b2278afb83b80b3c35164ebeca205"},
+		{6145, "f1323a8631446cc50536a9f705ee5cb619424d46887f3c376c695b70e0f0507f"},
+		{7168, "61da957ec2499a95d6b8023e2b0e604ec7f6b50e80a9678b89d2628e99ada77a"},
+		{7169, "a003fc7a51754a9b3c7fae0367ab3d782dccf28855a03d435f8cfe74605e7817"},
+		{8192, "aae792484c8efe4f19e2ca7d371d8c467ffb10748d8a5a1ae579948f718a2a63"},
+		{8193, "bab6c09cb8ce8cf459261398d2e7aef35700bf488116ceb94a36d0f5f1b7bc3b"},
+		{16384, "f875d6646de28985646f34ee13be9a576fd515f76b5b0a26bb324735041ddde4"},
+		{31744, "62b6960e1a44bcc1eb1a611a8d6235b6b4b78f32e7abc4fb4c6cdcce94895c47"},
+		{102400, "bc3e3d41a1146b069abffad3c0d44860cf664390afce4d9661f7902e7943e085"},
+		{1048576, "74cb441fd087764ca9c3694da742ebe30cbeb3060a17009ca81825c7a8d10343"},
+		{1049601, "860f19b5fefff01454de342be87a20059449529116a20fb22a21da665aafa071"},
+		{3146752, "f50b9c7a909d3a613ef6d072d3a17eb3818537b26bd1d708094ec887b344ea37"},
+	}
+	input := make([]byte, 3146752)
+	for i := range input {
+		input[i] = byte(i % 251)
+	}
+	// writes not aligned to blocks and chunks
+	pieces := []int{1, 63, 64, 65, 1000, 1024, 1025, 4096, 70000}
+
+	for _, tt := range tests {
+		h := newblake3()
+		h.Write(input[:tt.length])
+		if got := hex.EncodeToString(h.Sum(nil)); got != tt.hash {
+			t.Errorf("%d bytes: got %s, want %s", tt.length, got, tt.hash)
+		}
+
+		h.Reset()
+		for i, n := 0, 0; n < tt.length; i++ {
+			end := n + pieces[i%len(pieces)]
+			if end > tt.length {
+				end = tt.length
+			}
+			h.Write(input[n:end])
+			n = end
+			// Sum does not change the state
+			if i == 3 {
+				h.Sum(nil)
+			}
+		}
+		if got := hex.EncodeToString(h.Sum([]byte{})); got != tt.hash {
+			t.Errorf("%d bytes incrementally: got %s, want %s", tt.length, got, tt.hash)
+		}
+	}
+	if h := newblake3(); h.Size() != 32 || h.BlockSize() != 64 {
+		t.Errorf("got size %d, block size %d", h.Size(), h.BlockSize())
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{12*1024*1024 + 300*1024, "12.3 MiB"},
+		{3 << 30, "3.0 GiB"},
+	}
+	for _, tt := range tests {
+		if got := formatbytes(tt.n); got != tt.want {
+			t.Errorf("formatbytes(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+	if got := progressbar(15, 30); got != "[===============               ]  50%" {
+		t.Errorf("got %q", got)
+	}
+	if got := progressbar(40, 30); got != "[==============================] 100%" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestProgressDisplay(t *testing.T) {
+
+	var out bytes.Buffer
+	d := &progressdisplay{out: &out}
+	d.report("check", 1, -1)
+	d.report("check", 2, 2)
+	d.files(1, 1)
+	d.report("diff", 0, 2048)
+	// within the interval of plain lines only the end of a stage is shown
+	d.report("diff", 1024, 2048)
+	d.report("diff", 2048, 2048)
+	d.report("diff", 2048, 2048)
+	d.end()
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 5 || lines[0] != "check  1 files" || lines[1] != "check  2 files" || lines[2] != "files  1 reused, 1 to fetch" ||
+		lines[3] != "diff   0 B of 2.0 KiB" || !strings.HasPrefix(lines[4], "diff   2.0 KiB of 2.0 KiB, ") || strings.Contains(lines[4], "ETA") {
+		t.Errorf("got\n%s", out.String())
+	}
+
+	// a bar is redrawn on its line
+	out.Reset()
+	d = &progressdisplay{bar: true, out: &out}
+	d.report("full", 512, 1024)
+	d.report("full", 1024, 1024)
+	if got := out.String(); !strings.HasPrefix(got, "\r\033[K[===============               ]  50% full   512 B of 1.0 KiB") || !strings.HasSuffix(got, "\n") ||
+		strings.Count(got, "\r\033[K") != 2 || !strings.Contains(got, "] 100% full   1.0 KiB of 1.0 KiB") {
+		t.Errorf("got %q", got)
+	}
+
+	if _, err := newprogressdisplay("fancy"); err == nil {
+		t.Error("invalid mode accepted")
+	}
+}
+
+func TestExchange(t *testing.T) {
+
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	for _, name := range []string{a, b} {
+		os.Mkdir(name, 0755)
+		os.WriteFile(filepath.Join(name, "file"), []byte(filepath.Base(name)), 0644)
+	}
+	if err := exchange(a, b); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{a: "b", b: "a"} {
+		if data, err := os.ReadFile(filepath.Join(name, "file")); err != nil || string(data) != want {
+			t.Errorf("%s: got %q, %v", name, data, err)
+		}
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 2 {
+		t.Errorf("got %v", files)
+	}
+	if err := exchange(a, filepath.Join(dir, "missing")); err == nil {
+		t.Error("exchange with a missing directory succeeded")
+	}
+}
+
+func TestSlotProvider(t *testing.T) {
+
+	p, err := newslotprovider("file:" + filepath.Join(t.TempDir(), "state", "slot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slot, err := p.booted(); err != nil || slot != "" {
+		t.Errorf("unset: got %q, %v", slot, err)
+	}
+	if err := p.markbootable("b"); err != nil {
+		t.Fatal(err)
+	}
+	if slot, err := p.booted(); err != nil || slot != "b" {
+		t.Errorf("got %q, %v", slot, err)
+	}
+
+	for _, spec := range []string{"file:", "uefi", ""} {
+		if _, err := newslotprovider(spec); err == nil {
+			t.Errorf("%q accepted", spec)
+		}
+	}
+	if p, err := newslotprovider("grub"); err != nil || p.(*cmdslots).get[1] != "/boot/grub/grubenv" {
+		t.Errorf("grub: got %+v, %v", p, err)
+	}
+}
+
+func TestRunningSlot(t *testing.T) {
+
+	dir := t.TempDir()
+	statedir = filepath.Join(dir, "state")
+	bootidfile = filepath.Join(dir, "boot_id")
+	defer func() { statedir, bootidfile = "", "/proc/sys/kernel/random/boot_id" }()
+	os.WriteFile(bootidfile, []byte("boot-1\n"), 0644)
+	p := &fileslots{name: filepath.Join(dir, "slot")}
+
+	running := func(want string) {
+		t.Helper()
+		if slot, err := runningslot(p); err != nil || slot != want {
+			t.Errorf("got %q, %v, want %s", slot, err, want)
+		}
+	}
+	running("a")
+	// marked bootable, the device still runs a until the next boot
+	p.markbootable("b")
+	running("a")
+	if slot, err := inactiveslot(p); err != nil || slot != "b" {
+		t.Errorf("inactive: got %q, %v", slot, err)
+	}
+	os.WriteFile(bootidfile, []byte("boot-2\n"), 0644)
+	running("b")
+	p.markbootable("a")
+	running("b")
+
+	statedir = ""
+	if slot, err := runningslot(p); err == nil {
+		t.Errorf("without -statedir: got %q", slot)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+
+	tests := []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"1000", 1000, true},
+		{"500k", 500 << 10, true},
+		{"1.5M", 3 << 19, true},
+		{"2g", 2 << 30, true},
+		{"0", 0, true},
+		{"k", 0, false},
+		{"-1k", 0, false},
+		{"fast", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parserate(tt.s)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("parserate(%q) = %d, %v", tt.s, got, err)
+		}
+	}
+}
+
+func TestRateReader(t *testing.T) {
+
+	limitrate = 20000
+	defer func() { limitrate = 0 }()
+	start := time.Now()
+	n, err := io.Copy(io.Discard, &ratereader{r: bytes.NewReader(make([]byte, 6000)), start: start})
+	if elapsed := time.Since(start); err != nil || n != 6000 || elapsed < 250*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("read %d bytes in %s, %v", n, elapsed, err)
+	}
+}
+
+func TestSavings(t *testing.T) {
+
+	tests := []struct {
+		s    updatestatus
+		want string
+	}{
+		{updatestatus{}, ""},
+		{updatestatus{ImageBytes: 4096, ReusedBytes: 3072, Bytes: 1024}, "image 4.0 KiB, 3.0 KiB (75.0%) reused from the reference, 1.0 KiB of new files, 1.0 KiB downloaded (ratio 4.0:1, 75.0% saved)"},
+		{updatestatus{ImageBytes: 100, ReusedBytes: 100}, "image 100 B, 100 B (100.0%) reused from the reference, 0 B of new files, 0 B downloaded"},
+		{updatestatus{ImageBytes: 4096, ReusedBytes: 1024, StagedBytes: 2048, Bytes: 1024}, "image 4.0 KiB, 1.0 KiB (25.0%) reused from the reference, 3.0 KiB of new files (2.0 KiB staged by earlier runs), 1.0 KiB downloaded (ratio 4.0:1, 75.0% saved)"},
+	}
+	for _, tt := range tests {
+		if got := savings(tt.s); got != tt.want {
+			t.Errorf("savings(%+v) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestManifestLineNames(t *testing.T) {
+
+	tests := []struct {
+		line string
+		name string
+		link string
+	}{
+		{`0 644 0:0 1500000000 0:0 - "etc/a b" "" "root":"root"` + "\n", "etc/a b", ""},
+		{`2 777 0:0 1500000000 0:0 - "etc/link" "same" "":"" "SCHILY.xattr.user.x"="y"` + "\n", "etc/link", "same"},
+		// journaled before manifest version 2
+		{`2 777 0:0 1500000000 0:0 - "etc/link" "same"` + "\n", "etc/link", "same"},
+	}
+	for _, tt := range tests {
+		if name, link := manifestlinenames(tt.line); name != tt.name || link != tt.link {
+			t.Errorf("%q: got %q %q", tt.line, name, link)
+		}
+	}
+}
+
+func TestExecTransportMetadata(t *testing.T) {
+
+	tests := []struct {
+		script string
+		err    string
+	}{
+		{"printf '{}'", ""},
+		{"exit 10", "metadata not found"},
+		// a network failure passed on from a client is no missing metadata
+		{"exit 4", "exit status 4"},
+	}
+	for _, tt := range tests {
+		tr := &exectransport{command: []string{"sh", "-c", tt.script, "transport"}, src: "http://ota.test/image-1.tgz"}
+		body, err := tr.getmetadata("root.json")
+		if body != nil {
+			body.Close()
+		}
+		if (tt.err == "" && err != nil) || (tt.err != "" && (err == nil || err.Error() != tt.err)) {
+			t.Errorf("%s: got %v, want %q", tt.script, err, tt.err)
+		}
+	}
+}
+
+func TestWatchdogPing(t *testing.T) {
+
+	name := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", name)
+	t.Setenv("WATCHDOG_USEC", "200000")
+	n, err := newsdnotifier()
+	if err != nil || n.watchdog != 200*time.Millisecond {
+		t.Fatalf("got %+v, %v", n, err)
+	}
+	pings := func() int {
+		count := 0
+		buf := make([]byte, 64)
+		for {
+			conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+			m, err := conn.Read(buf)
+			if err != nil {
+				return count
+			}
+			if string(buf[:m]) == "WATCHDOG=1" {
+				count++
+			}
+		}
+	}
+
+	// progress pings are rate limited
+	for i := 0; i < 100; i++ {
+		n.ping()
+	}
+	if got := pings(); got != 1 {
+		t.Errorf("got %d pings", got)
+	}
+	// sleeping pings at half the interval
+	n.sleep(250 * time.Millisecond)
+	if got := pings(); got < 2 {
+		t.Errorf("sleep: got %d pings", got)
+	}
+}
@@ -0,0 +1,357 @@
+/*
+ * This file is part of the ota-imageserver distribution (https://github.com/britnex/ota-imageserver).
+ * Copyright (c) 2019 Andre Massow britnex@gmail.com
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// C API of the client, build with
+//
+//	go build -buildmode=c-shared -o libotaclient.so client.go libotaclient.go
+//
+// which also writes the header libotaclient.h. Calls are serialized, all
+// options set with ota_set_option apply to every following call.
+
+package main
+
+/*
+#include <stdlib.h>
+
+// progress callback, stage is "index", "check" or "diff", total is -1 if
+// unknown
+typedef void (*ota_progress_fn)(const char *stage, long long done, long long total, void *userdata);
+
+static inline void ota_call_progress(ota_progress_fn fn, const char *stage, long long done, long long total, void *userdata)
+{
+	fn(stage, done, total, userdata);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// serializes all calls, the client keeps its configuration in globals
+var libmu sync.Mutex
+
+// message of the last failed call
+var liberror *C.char = nil
+
+// transport command set by the "transport-cmd" option
+var libtransportcmd string = ""
+
+// log output set by the "log-format" and "log-level" options
+var liblogformat string = "text"
+var libloglevel string = "info"
+
+// seterror stores the message returned by ota_last_error
+func seterror(err error) {
+
+	if liberror != nil {
+		C.free(unsafe.Pointer(liberror))
+	}
+	liberror = C.CString(err.Error())
+}
+
+// ota_last_error returns the message of the last failed call. The string is
+// owned by the library and valid until the next failed call.
+//
+//export ota_last_error
+func ota_last_error() *C.char {
+
+	libmu.Lock()
+	defer libmu.Unlock()
+	return liberror
+}
+
+// ota_set_option sets a client option by its command line flag name, e.g.
+// "cacert", "pin-sha256", "cert", "key", "token", "token-url", "client-id",
+// "client-secret", "user", "password", "header" (adds one "Name: value"
+// header, "" removes all), "user-agent", "device-id", "hardware-revision",
+// "payload-key", "pubkey", "channel-pubkey", "keyring", "tuf",
+// "max-clock-skew", "transport-cmd", "statedir", "budget-bytes",
+// "budget-time", "tmpdir", "no-cache", "workers", "allow-downgrade",
+// "max-index-age", "allow-devices", "no-setuid", "no-escaping-symlinks",
+// "unsafe-entries", "duplicates", "case-insensitive", "selinux-contexts",
+// "owner", "umask", "split", "async", "hash", "gzip-delta", "log-format",
+// "log-level" or "debug".
+// Returns 0 on success, -1 on error.
+//
+//export ota_set_option
+func ota_set_option(name *C.char, value *C.char) C.int {
+
+	libmu.Lock()
+	defer libmu.Unlock()
+
+	v := C.GoString(value)
+	var err error
+	switch C.GoString(name) {
+	case "cacert":
+		cacertfile = v
+	case "pin-sha256":
+		pins = nil
+		if v != "" {
+			pins, err = parsepins(v)
+		}
+	case "cert":
+		certfile = v
+	case "key":
+		keyfile = v
+	case "token":
+		token = v
+	case "token-url":
+		tokens.url = v
+	case "client-id":
+		tokens.id = v
+	case "client-secret":
+		tokens.secret = v
+	case "user":
+		authuser = v
+	case "password":
+		authpassword = v
+	case "payload-key":
+		payloadkey = nil
+		if v != "" {
+			payloadkey, err = loadpayloadkey(v)
+		}
+	case "pubkey":
+		pubkey = nil
+		if v != "" {
+			pubkey, err = loadpubkey(v)
+		}
+	case "header":
+		if v == "" {
+			requestheaders = http.Header{}
+		} else {
+			err = addheader(v)
+		}
+	case "user-agent":
+		useragent = v
+	case "device-id":
+		deviceid = v
+	case "hardware-revision":
+		hardwarerevision = v
+	case "channel-pubkey":
+		channelpubkey = nil
+		if v != "" {
+			channelpubkey, err = loadpubkey(v)
+		}
+	case "keyring":
+		keyring = nil
+		if v != "" {
+			keyring, err = loadkeyring(v)
+		}
+	case "tuf":
+		tufrootfile = v
+	case "max-clock-skew":
+		maxclockskew, err = time.ParseDuration(v)
+	case "transport-cmd":
+		libtransportcmd = v
+	case "statedir":
+		statedir = v
+	case "budget-bytes":
+		budgetbytes, err = strconv.ParseInt(v, 10, 64)
+	case "budget-time":
+		budgettime, err = time.ParseDuration(v)
+	case "tmpdir":
+		tmproot = v
+	case "no-cache":
+		nocache = v == "1" || v == "true"
+	case "workers":
+		var n int
+		n, err = strconv.Atoi(v)
+		if err == nil && n < 1 {
+			err = errors.New("invalid workers " + v)
+		}
+		if err == nil {
+			hashworkers = n
+		}
+	case "allow-downgrade":
+		allowdowngrade = v == "1" || v == "true"
+	case "max-index-age":
+		maxindexage, err = time.ParseDuration(v)
+	case "allow-devices":
+		allowdevices = v == "1" || v == "true"
+	case "no-setuid":
+		nosetuid = v == "1" || v == "true"
+	case "no-escaping-symlinks":
+		noescapingsymlinks = v == "1" || v == "true"
+	case "unsafe-entries":
+		if v != "reject" && v != "sanitize" {
+			err = errors.New("unknown unsafe entries policy " + v)
+		} else {
+			unsafepolicy = v
+		}
+	case "duplicates":
+		if v != "last-wins" && v != "error" {
+			err = errors.New("unknown duplicate policy " + v)
+		} else {
+			duplicatepolicy = v
+		}
+	case "case-insensitive":
+		caseinsensitive = v == "1" || v == "true"
+	case "selinux-contexts":
+		filecontexts = nil
+		if v != "" {
+			filecontexts, err = loadfilecontexts(v)
+		}
+	case "owner":
+		defaultuid, defaultgid = -1, -1
+		if v != "" {
+			defaultuid, defaultgid, err = parseowner(v)
+		}
+	case "umask":
+		installumask = 0
+		if v != "" {
+			installumask, err = strconv.ParseInt(v, 8, 64)
+			if err == nil && installumask&^0777 != 0 {
+				installumask, err = 0, errors.New("invalid umask "+v)
+			}
+		}
+	case "split":
+		splits = nil
+		if v != "" {
+			splits, err = parsesplits(v)
+		}
+	case "async":
+		asyncdiff = v == "1" || v == "true"
+	case "gzip-delta":
+		gzipdeltas = v == "1" || v == "true"
+	case "hash":
+		if v != "auto" && hashbackendbyname(v) == nil {
+			err = errors.New("unknown hash " + v)
+		} else {
+			indexhashname = v
+		}
+	case "log-format":
+		if err = setuplogging(v, libloglevel); err == nil {
+			liblogformat = v
+		}
+	case "log-level":
+		if err = setuplogging(liblogformat, v); err == nil {
+			libloglevel = v
+		}
+	case "debug":
+		debug = v == "1" || v == "true"
+		err = setuplogging(liblogformat, libloglevel)
+	default:
+		err = errors.New("unknown option " + C.GoString(name))
+	}
+	if err != nil {
+		seterror(err)
+		return -1
+	}
+	return 0
+}
+
+// libupdate runs update for the C API
+func libupdate(src *C.char, dst *C.char, ref *C.char, check bool, fn C.ota_progress_fn, userdata unsafe.Pointer) (uint32, error) {
+
+	tgzsrc := C.GoString(src)
+	channelmanifest = ""
+	if channelurl(tgzsrc) && libtransportcmd == "" {
+		resolved, err := resolvechannel(tgzsrc)
+		if err != nil {
+			return 0, err
+		}
+		tgzsrc = resolved
+	}
+	if strings.HasSuffix(imagename(tgzsrc), ".tgz") == false {
+		return 0, errors.New("<src> argument requires .tgz suffix")
+	}
+	tgzdst := ""
+	if dst != nil {
+		tgzdst = destination(tgzsrc, C.GoString(dst))
+	}
+	tgzref := "/"
+	if ref != nil {
+		tgzref = C.GoString(ref)
+	}
+
+	refs, err := resolverefs(tgzref)
+	if err != nil {
+		return 0, err
+	}
+	t, err := newtransport(tgzsrc, libtransportcmd)
+	if err != nil {
+		return 0, err
+	}
+
+	checkonly = check
+	progress = nil
+	if fn != nil {
+		progress = func(stage string, done int64, total int64) {
+			cstage := C.CString(stage)
+			C.ota_call_progress(fn, cstage, C.longlong(done), C.longlong(total), userdata)
+			C.free(unsafe.Pointer(cstage))
+		}
+	}
+	defer func() {
+		checkonly = false
+		progress = nil
+	}()
+
+	return runupdate(t, tgzsrc, tgzdst, refs)
+}
+
+// ota_check returns the number of files of the image src which are not
+// found in the reference directory ref (NULL for "/", "auto" to derive it
+// from the mounted root filesystem), or -1 on error.
+//
+//export ota_check
+func ota_check(src *C.char, ref *C.char) C.longlong {
+
+	libmu.Lock()
+	defer libmu.Unlock()
+
+	missingfiles, err := libupdate(src, nil, ref, true, nil, nil)
+	if err != nil {
+		seterror(err)
+		return -1
+	}
+	return C.longlong(missingfiles)
+}
+
+// ota_download assembles the image src into dst (directory or .tgz
+// filename), downloading only the files not found in ref. fn may be
+// NULL. Returns the number of downloaded files, -2 if the download budget
+// ran out (call again later), or -1 on error.
+//
+//export ota_download
+func ota_download(src *C.char, dst *C.char, ref *C.char, fn C.ota_progress_fn, userdata unsafe.Pointer) C.longlong {
+
+	libmu.Lock()
+	defer libmu.Unlock()
+
+	if dst == nil {
+		seterror(errors.New("dst is required"))
+		return -1
+	}
+	missingfiles, err := libupdate(src, dst, ref, false, fn, userdata)
+	if err == errbudget {
+		seterror(err)
+		return -2
+	}
+	if err != nil {
+		seterror(err)
+		return -1
+	}
+	return C.longlong(missingfiles)
+}
@@ -0,0 +1,6226 @@
+package main
+
+// roundtrip_test.go builds server.go and client.go and updates images from
+// the one with the other, run it on its own: go test roundtrip_test.go
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	neturl "net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var serverbin, clientbin string
+
+func TestMain(m *testing.M) {
+
+	dir, err := os.MkdirTemp("", "roundtrip-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// the privsep helper runs the client as another user
+	os.Chmod(dir, 0755)
+	serverbin = filepath.Join(dir, "server")
+	clientbin = filepath.Join(dir, "client")
+	for _, p := range []string{"server", "client"} {
+		// -sandbox needs a build without cgo
+		cmd := exec.Command("go", "build", "-o", filepath.Join(dir, p), p+".go")
+		cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s%s\n", out, err)
+			os.RemoveAll(dir)
+			os.Exit(1)
+		}
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testentry is an entry of a test image, body is the content of regular
+// files and the target of symlinks
+type testentry struct {
+	name     string
+	typeflag byte
+	body     string
+}
+
+// testimage has a file of each kind the client handles: reused from the
+// reference directory, changed, added, empty, plus a directory and a link
+var testimage = []testentry{
+	{"etc/", tar.TypeDir, ""},
+	{"etc/same", tar.TypeReg, "unchanged content\n"},
+	{"etc/changed", tar.TypeReg, "new content\n"},
+	{"etc/added", tar.TypeReg, "added file\n"},
+	{"etc/empty", tar.TypeReg, ""},
+	{"etc/link", tar.TypeSymlink, "same"},
+}
+
+// testref is the reference directory of testimage, before the update
+var testref = []testentry{
+	{"etc/", tar.TypeDir, ""},
+	{"etc/same", tar.TypeReg, "unchanged content\n"},
+	{"etc/changed", tar.TypeReg, "old content\n"},
+}
+
+func writetgz(t *testing.T, name string, entries []testentry) {
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0644, ModTime: time.Unix(1500000000, 0)}
+		switch e.typeflag {
+		case tar.TypeDir:
+			hdr.Mode = 0755
+		case tar.TypeSymlink, tar.TypeLink:
+			hdr.Linkname = e.body
+		case tar.TypeReg:
+			hdr.Size = int64(len(e.body))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if e.typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeref creates the reference directory dir with entries
+func writeref(t *testing.T, dir string, entries []testentry) {
+
+	for _, e := range entries {
+		name := filepath.Join(dir, e.name)
+		var err error
+		switch e.typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(name, 0755)
+		case tar.TypeSymlink:
+			err = os.Symlink(e.body, name)
+		case tar.TypeReg:
+			err = os.WriteFile(name, []byte(e.body), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readtgz returns the entries of a tgz in archive order
+func readtgz(t *testing.T, r io.Reader) []testentry {
+
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	var entries []testentry
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := testentry{name: hdr.Name, typeflag: hdr.Typeflag, body: hdr.Linkname}
+		if hdr.Typeflag == tar.TypeReg {
+			body, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.body = string(body)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// checktgz fails unless the tgz file name holds exactly entries, in any
+// order
+func checktgz(t *testing.T, name string, entries []testentry) {
+
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got := map[string]testentry{}
+	for _, e := range readtgz(t, f) {
+		got[e.name] = e
+	}
+	for _, e := range entries {
+		if got[e.name] != e {
+			t.Errorf("%s: got %+v, want %+v", e.name, got[e.name], e)
+		}
+		delete(got, e.name)
+	}
+	for name := range got {
+		t.Errorf("%s: unexpected entry", name)
+	}
+}
+
+// startserver runs the server on a free port publishing the directory src
+// and returns its url
+func startserver(t *testing.T, src string, args ...string) string {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	var out bytes.Buffer
+	cmd := exec.Command(serverbin, append([]string{"-src", src, "-bind", addr}, args...)...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("server output:\n%s", out.String())
+		}
+	})
+
+	scheme := "http://"
+	for _, arg := range args {
+		if arg == "-tls-cert" {
+			scheme = "https://"
+		}
+	}
+	for i := 0; i < 100; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+			return scheme + addr + "/"
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("server did not start:\n%s", out.String())
+	return ""
+}
+
+// runclient runs the client and returns its output
+func runclient(t *testing.T, args ...string) (string, error) {
+
+	return runclientenv(t, nil, args...)
+}
+
+// statedirs holds the client state directory of each test
+var statedirs = map[*testing.T]string{}
+
+// runclientenv runs the client with the additional environment variables
+// env and returns its output. Unless args set -statedir, the client keeps
+// its state in a directory of the test.
+func runclientenv(t *testing.T, env []string, args ...string) (string, error) {
+
+	hasstatedir := false
+	for _, arg := range args {
+		if arg == "-statedir" || strings.HasPrefix(arg, "-statedir=") {
+			hasstatedir = true
+		}
+	}
+	if !hasstatedir {
+		if statedirs[t] == "" {
+			statedirs[t] = t.TempDir()
+		}
+		args = append([]string{"-statedir", statedirs[t]}, args...)
+	}
+
+	cmd := exec.Command(clientbin, args...)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// noupdate is the exit status of client runs which download no file
+const noupdate = 3
+
+// exitcode returns the exit status of a client run from its error
+func exitcode(err error) int {
+
+	if exit, ok := err.(*exec.ExitError); ok {
+		return exit.ExitCode()
+	}
+	if err != nil {
+		return -1
+	}
+	return 0
+}
+
+// writepem writes a pem block of type typ to the file name
+func writepem(t *testing.T, name, typ string, der []byte) {
+
+	if err := os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testcert writes a certificate for 127.0.0.1 with extended key usage
+// usage signed by ca to dir/name.pem and its key to dir/name-key.pem
+func testcert(t *testing.T, dir, name string, usage x509.ExtKeyUsage, ca *x509.Certificate, cakey *ecdsa.PrivateKey) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, cakey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writepem(t, filepath.Join(dir, name+".pem"), "CERTIFICATE", der)
+	der, err = x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writepem(t, filepath.Join(dir, name+"-key.pem"), "PRIVATE KEY", der)
+}
+
+// testpki writes a ca certificate to dir/ca.pem, a server certificate for
+// 127.0.0.1 signed by it to dir/cert.pem with its key in dir/cert-key.pem and
+// a client certificate to dir/device.pem and dir/device-key.pem
+func testpki(t *testing.T, dir string) {
+
+	cakey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, ca, ca, &cakey.PublicKey, cakey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writepem(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", der)
+
+	testcert(t, dir, "cert", x509.ExtKeyUsageServerAuth, ca, cakey)
+	testcert(t, dir, "device", x509.ExtKeyUsageClientAuth, ca, cakey)
+}
+
+// testsetup writes image to src/image-1.tgz and ref to a reference
+// directory, starts the server and returns the image url, the reference
+// and an empty destination directory
+func testsetup(t *testing.T, image, ref []testentry, args ...string) (string, string, string) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), image)
+	refdir := t.TempDir()
+	writeref(t, refdir, ref)
+	url := startserver(t, src, args...)
+	return url + "image-1.tgz", refdir, t.TempDir()
+}
+
+func TestUpdate(t *testing.T) {
+
+	url, ref, dst := testsetup(t, testimage, testref)
+
+	out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref)
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	if !strings.Contains(out, `msg="downloading missing files" files=2`) {
+		t.Errorf("changed and added file not requested:\n%s", out)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+
+	// nothing to download from an up to date reference
+	writeref(t, ref, testimage[2:4])
+	os.WriteFile(filepath.Join(ref, "etc/changed"), []byte("new content\n"), 0644)
+	out, err = runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref)
+	if exitcode(err) != noupdate {
+		t.Fatalf("%s%s", out, err)
+	}
+	if strings.Contains(out, "missing files") {
+		t.Errorf("files requested from an up to date reference:\n%s", out)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+}
+
+// testbitmap returns the gzipped request bitmap
+func testbitmap(t *testing.T, bitmap []byte) io.Reader {
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(bitmap)
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestIndexAndDiff(t *testing.T) {
+
+	url, _, _ := testsetup(t, testimage, nil)
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.ContentLength != int64(len(body)) || resp.Header.Get("Content-Type") != "application/octet-stream" {
+		t.Fatalf("index: %s, Content-Length %d for %d bytes, Content-Type %q", resp.Status, resp.ContentLength, len(body), resp.Header.Get("Content-Type"))
+	}
+	// the manifest digest follows the entries
+	index := readtgz(t, bytes.NewReader(body))
+	if len(index) != len(testimage)+1 || index[len(testimage)].typeflag != tar.TypeXGlobalHeader {
+		t.Fatalf("index has %d entries, want %d and the manifest digest", len(index), len(testimage))
+	}
+	for i, e := range testimage {
+		want := e.body
+		if e.typeflag == tar.TypeReg && len(e.body) > 0 {
+			h := sha1.Sum([]byte(e.body))
+			want = string(h[:])
+		}
+		if index[i].name != e.name || index[i].body != want {
+			t.Errorf("index entry %d: got %q %x, want %q %x", i, index[i].name, index[i].body, e.name, want)
+		}
+	}
+
+	// the second of the non-empty regular files
+	resp, err = http.Post(url, "application/octet-stream", testbitmap(t, []byte{0x40}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.ContentLength != int64(len(body)) || resp.Header.Get("Accept-Ranges") != "none" {
+		t.Fatalf("diff: %s, Content-Length %d for %d bytes, Accept-Ranges %q", resp.Status, resp.ContentLength, len(body), resp.Header.Get("Accept-Ranges"))
+	}
+	diff := readtgz(t, bytes.NewReader(body))
+	if len(diff) != 1 || diff[0] != testimage[2] {
+		t.Errorf("diff: got %+v, want %+v", diff, testimage[2:3])
+	}
+
+	// a bitmap shorter than the regular files
+	resp, err = http.Post(url, "application/octet-stream", testbitmap(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("empty bitmap: got %s, want 400", resp.Status)
+	}
+
+	resp, err = http.Get(strings.TrimSuffix(url, "image-1.tgz") + "missing.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing image: got %s, want 404", resp.Status)
+	}
+}
+
+func TestTLS(t *testing.T) {
+
+	pki := t.TempDir()
+	testpki(t, pki)
+	url, ref, dst := testsetup(t, testimage, testref, "-tls-cert", filepath.Join(pki, "cert.pem"), "-tls-key", filepath.Join(pki, "cert-key.pem"))
+	if !strings.HasPrefix(url, "https://") {
+		t.Fatalf("got %s", url)
+	}
+
+	out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref)
+	if err == nil {
+		t.Fatalf("server certificate of an unknown ca accepted:\n%s", out)
+	}
+
+	out, err = runclientenv(t, []string{"SSL_CERT_FILE=" + filepath.Join(pki, "ca.pem")}, "-src", url, "-dst", dst+"/", "-ref", ref)
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+
+	data, err := os.ReadFile(filepath.Join(pki, "cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := hex.EncodeToString(hash[:])
+	other := strings.Repeat("00", sha256.Size)
+
+	tests := []struct {
+		name string
+		args []string
+		ok   bool
+	}{
+		{"cacert", []string{"-cacert", filepath.Join(pki, "ca.pem")}, true},
+		{"cacert without the ca", []string{"-cacert", filepath.Join(pki, "device.pem")}, false},
+		{"hex pin", []string{"-pin-sha256", other + "," + pin}, true},
+		{"base64 pin", []string{"-pin-sha256", "sha256//" + base64.StdEncoding.EncodeToString(hash[:])}, true},
+		{"other pin", []string{"-pin-sha256", other}, false},
+		{"pin and cacert", []string{"-pin-sha256", pin, "-cacert", filepath.Join(pki, "ca.pem")}, true},
+		{"pin and cacert without the ca", []string{"-pin-sha256", pin, "-cacert", filepath.Join(pki, "device.pem")}, false},
+	}
+	for _, tt := range tests {
+		out, err := runclient(t, append([]string{"-src", url, "-dst", dst + "/", "-ref", ref}, tt.args...)...)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v\n%s", tt.name, err, out)
+		}
+	}
+}
+
+func TestSimulate(t *testing.T) {
+
+	url, _, _ := testsetup(t, testimage, nil)
+
+	// the changed and the added file
+	resp, err := http.Post(url+"?simulate", "application/octet-stream", testbitmap(t, []byte{0x60}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats struct {
+		Files    int   `json:"files"`
+		Size     int64 `json:"size"`
+		Transfer int64 `json:"transfer"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("%s: %v", resp.Status, err)
+	}
+
+	resp, err = http.Post(url, "application/octet-stream", testbitmap(t, []byte{0x60}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	size := int64(len(testimage[2].body) + len(testimage[3].body))
+	if stats.Files != 2 || stats.Size != size || stats.Transfer != int64(len(body)) {
+		t.Errorf("got %+v, want 2 files, size %d, transfer %d", stats, size, len(body))
+	}
+}
+
+func TestClientCert(t *testing.T) {
+
+	pki := t.TempDir()
+	testpki(t, pki)
+	url, ref, dst := testsetup(t, testimage, testref, "-tls-cert", filepath.Join(pki, "cert.pem"), "-tls-key", filepath.Join(pki, "cert-key.pem"), "-tls-client-ca", filepath.Join(pki, "ca.pem"))
+	env := []string{"SSL_CERT_FILE=" + filepath.Join(pki, "ca.pem")}
+
+	out, err := runclientenv(t, env, "-src", url, "-dst", dst+"/", "-ref", ref)
+	if err == nil {
+		t.Fatalf("client without certificate accepted:\n%s", out)
+	}
+
+	// the server certificate is no client certificate
+	out, err = runclientenv(t, env, "-src", url, "-dst", dst+"/", "-ref", ref, "-cert", filepath.Join(pki, "cert.pem"), "-key", filepath.Join(pki, "cert-key.pem"))
+	if err == nil {
+		t.Fatalf("server certificate accepted as client certificate:\n%s", out)
+	}
+
+	out, err = runclientenv(t, env, "-src", url, "-dst", dst+"/", "-ref", ref, "-cert", filepath.Join(pki, "device.pem"), "-key", filepath.Join(pki, "device-key.pem"))
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+}
+
+func TestBearerToken(t *testing.T) {
+
+	tokens := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(tokens, []byte("# devices\nsecret1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	url, ref, dst := testsetup(t, testimage, testref, "-token-file", tokens)
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("without token: got %s, WWW-Authenticate %q", resp.Status, resp.Header.Get("WWW-Authenticate"))
+	}
+
+	tests := []struct {
+		name  string
+		env   []string
+		token string
+		ok    bool
+	}{
+		{"no token", nil, "", false},
+		{"wrong token", nil, "secret2", false},
+		{"comment as token", nil, "# devices", false},
+		{"token", nil, "secret1", true},
+		{"token from environment", []string{"OTA_TOKEN=secret1"}, "", true},
+	}
+	for _, tt := range tests {
+		args := []string{"-src", url, "-dst", dst + "/", "-ref", ref}
+		if tt.token != "" {
+			args = append(args, "-token", tt.token)
+		}
+		out, err := runclientenv(t, tt.env, args...)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v\n%s", tt.name, err, out)
+		}
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+
+	// the token file is reloaded on change
+	if err := os.WriteFile(tokens, []byte("secret2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(tokens, later, later)
+	if out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-token", "secret2"); err != nil {
+		t.Errorf("new token: %s%s", out, err)
+	}
+	if out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-token", "secret1"); err == nil {
+		t.Errorf("removed token accepted:\n%s", out)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	// openssl passwd -apr1 -salt saltsalt password
+	if err := os.WriteFile(htpasswd, []byte("alice:$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	url, ref, dst := testsetup(t, testimage, testref, "-htpasswd", htpasswd)
+	credurl := strings.Replace(url, "http://", "http://alice:password@", 1)
+
+	tests := []struct {
+		name string
+		env  []string
+		args []string
+		ok   bool
+	}{
+		{"no credentials", nil, []string{"-src", url}, false},
+		{"wrong password", nil, []string{"-src", url, "-user", "alice", "-password", "secret"}, false},
+		{"unknown user", nil, []string{"-src", url, "-user", "bob", "-password", "password"}, false},
+		{"credentials", nil, []string{"-src", url, "-user", "alice", "-password", "password"}, true},
+		{"password from environment", []string{"OTA_PASSWORD=password"}, []string{"-src", url, "-user", "alice"}, true},
+		{"credentials in the url", nil, []string{"-src", credurl}, true},
+	}
+	for _, tt := range tests {
+		out, err := runclientenv(t, tt.env, append(tt.args, "-dst", dst+"/", "-ref", ref)...)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v\n%s", tt.name, err, out)
+		}
+		if strings.Contains(out, ":password@") {
+			t.Errorf("%s: password in the output:\n%s", tt.name, out)
+		}
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+}
+
+func TestTransportCommand(t *testing.T) {
+
+	url, ref, dst := testsetup(t, testimage, testref, "-token", "secret1")
+
+	out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-transport-cmd", clientbin+" fetch -token secret1")
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+
+	if out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-transport-cmd", clientbin+" fetch -token secret2"); err == nil {
+		t.Errorf("failing transport command ignored:\n%s", out)
+	}
+}
+
+func TestPrivsep(t *testing.T) {
+
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+
+	pki := t.TempDir()
+	testpki(t, pki)
+	// the helper reads the ca and the device certificate as nobody
+	for _, name := range []string{filepath.Dir(pki), pki} {
+		os.Chmod(name, 0755)
+	}
+	for _, name := range []string{"ca.pem", "device.pem"} {
+		os.Chmod(filepath.Join(pki, name), 0644)
+	}
+	url, ref, dst := testsetup(t, testimage, testref, "-tls-cert", filepath.Join(pki, "cert.pem"), "-tls-key", filepath.Join(pki, "cert-key.pem"), "-tls-client-ca", filepath.Join(pki, "ca.pem"), "-token", "secret1")
+	env := []string{"SSL_CERT_FILE=" + filepath.Join(pki, "ca.pem")}
+	args := []string{"-src", url, "-dst", dst + "/", "-ref", ref, "-privsep-user", "nobody", "-token", "secret1", "-cert", filepath.Join(pki, "device.pem"), "-key", filepath.Join(pki, "device-key.pem")}
+
+	// the device key is only readable by root
+	if out, err := runclientenv(t, env, args...); err == nil {
+		t.Fatalf("helper read a file of root:\n%s", out)
+	}
+
+	os.Chmod(filepath.Join(pki, "device-key.pem"), 0644)
+	out, err := runclientenv(t, env, args...)
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+}
+
+// minturl signs url with server mint-url
+func minturl(t *testing.T, secretfile, url, ttl string) string {
+
+	out, err := exec.Command(serverbin, "mint-url", "-url-secret-file", secretfile, "-ttl="+ttl, url).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestSignedURL(t *testing.T) {
+
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("url secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	url, ref, dst := testsetup(t, testimage, testref, "-url-secret-file", secret, "-token", "secret1")
+	other := strings.TrimSuffix(url, "image-1.tgz") + "image-2.tgz"
+	signed := minturl(t, secret, url, "1h")
+	if !strings.Contains(signed, "signature=") || !strings.Contains(signed, "expires=") {
+		t.Fatalf("got %s", signed)
+	}
+
+	out, err := runclient(t, "-src", signed, "-dst", dst+"/", "-ref", ref)
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+
+	// through a transport command
+	if out, err := runclient(t, "-src", signed, "-dst", dst+"/", "-ref", ref, "-transport-cmd", clientbin+" fetch"); err != nil {
+		t.Errorf("-transport-cmd: %s%s", out, err)
+	}
+
+	// the index hash is added by the client
+	for _, hash := range []string{"sha256", "blake3"} {
+		if out, err := runclient(t, "-src", signed, "-dst", dst+"/", "-ref", ref, "-hash", hash); err != nil {
+			t.Errorf("-hash %s: %s%s", hash, out, err)
+		}
+	}
+
+	// async is signed, urls for -async clients are minted with it, job is
+	// added by the client
+	out, err = runclient(t, "-src", minturl(t, secret, url+"?async", "1h"), "-dst", dst+"/", "-ref", ref, "-async")
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	if out, err = runclient(t, "-src", signed, "-dst", dst+"/", "-ref", ref, "-async"); err == nil {
+		t.Errorf("async added to a signed url\n%s", out)
+	}
+
+	otherkey := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(otherkey, []byte("other secret\n"), 0600)
+	tampered := []byte(signed)
+	tampered[len(tampered)-1] ^= 1
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"unsigned", url},
+		{"expired", minturl(t, secret, url, "-1m")},
+		{"tampered signature", string(tampered)},
+		{"other image", strings.Replace(minturl(t, secret, other, "1h"), "image-2.tgz", "image-1.tgz", 1)},
+		{"other secret", minturl(t, otherkey, url, "1h")},
+		{"added parameter", signed + "&x=1"},
+	}
+	for _, tt := range tests {
+		if out, err := runclient(t, "-src", tt.src, "-dst", dst+"/", "-ref", ref); err == nil {
+			t.Errorf("%s: accepted\n%s", tt.name, out)
+		}
+	}
+}
+
+func TestSandbox(t *testing.T) {
+
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+
+	src := t.TempDir()
+	os.Chmod(src, 0755)
+	os.Chmod(filepath.Dir(src), 0755)
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	ref := t.TempDir()
+	writeref(t, ref, testref)
+	dst := t.TempDir()
+	url := startserver(t, src, "-sandbox", "-run-as", "nobody") + "image-1.tgz"
+
+	out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref)
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+}
+
+// servercmd runs a command of the server in dir
+func servercmd(t *testing.T, dir string, args ...string) {
+
+	t.Helper()
+	cmd := exec.Command(serverbin, args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("server %s: %s%s", strings.Join(args, " "), out, err)
+	}
+}
+
+func TestSignature(t *testing.T) {
+
+	keys := t.TempDir()
+	servercmd(t, keys, "genkey", "k1")
+	servercmd(t, keys, "genkey", "k2")
+
+	src := t.TempDir()
+	changed := append([]testentry{}, testimage...)
+	changed[1].body = "tampered\n"
+	for _, name := range []string{"image-1.tgz", "image-2.tgz", "image-3.tgz"} {
+		writetgz(t, filepath.Join(src, name), testimage)
+	}
+	servercmd(t, src, "sign", "-key", filepath.Join(keys, "k1.key"), "image-1.tgz", "image-3.tgz")
+	// signature of the previous content
+	writetgz(t, filepath.Join(src, "image-3.tgz"), changed)
+	url := startserver(t, src)
+	ref := t.TempDir()
+	writeref(t, ref, testref)
+	dst := t.TempDir()
+
+	tests := []struct {
+		name   string
+		image  string
+		pubkey string
+		ok     bool
+	}{
+		{"signed", "image-1.tgz", "k1.pub", true},
+		{"other key", "image-1.tgz", "k2.pub", false},
+		{"unsigned", "image-2.tgz", "k1.pub", false},
+		{"modified after signing", "image-3.tgz", "k1.pub", false},
+		{"unsigned without key", "image-2.tgz", "", true},
+	}
+	for _, tt := range tests {
+		args := []string{"-src", url + tt.image, "-dst", dst + "/", "-ref", ref}
+		if tt.pubkey != "" {
+			args = append(args, "-pubkey", filepath.Join(keys, tt.pubkey))
+		}
+		out, err := runclient(t, args...)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v\n%s", tt.name, err, out)
+			continue
+		}
+		if tt.ok {
+			checktgz(t, filepath.Join(dst, tt.image), testimage)
+		}
+	}
+}
+
+func TestPGPSignature(t *testing.T) {
+
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("needs gpg")
+	}
+	home := t.TempDir()
+	env := append(os.Environ(), "GNUPGHOME="+home)
+	gpg := func(stdin []byte, args ...string) []byte {
+		t.Helper()
+		cmd := exec.Command("gpg", append([]string{"--batch", "--passphrase", "", "--pinentry-mode", "loopback"}, args...)...)
+		cmd.Env = env
+		cmd.Stdin = bytes.NewReader(stdin)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("gpg %s: %s%s", strings.Join(args, " "), stderr.String(), err)
+		}
+		return out
+	}
+	t.Cleanup(func() {
+		cmd := exec.Command("gpgconf", "--kill", "gpg-agent")
+		cmd.Env = env
+		cmd.Run()
+	})
+	for _, uid := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		gpg(nil, "--quick-gen-key", uid, "ed25519", "sign", "never")
+	}
+
+	// a keyring of concatenated armored exports
+	keyring := filepath.Join(t.TempDir(), "keyring.asc")
+	data := append(gpg(nil, "--armor", "--export", "a@example.com"), gpg(nil, "--armor", "--export", "b@example.com")...)
+	if err := os.WriteFile(keyring, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src := t.TempDir()
+	for i, uid := range []string{"b@example.com", "c@example.com"} {
+		name := filepath.Join(src, fmt.Sprintf("image-%d.tgz", i+1))
+		writetgz(t, name, testimage)
+		manifest, err := exec.Command(serverbin, "manifest", name).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := gpg(manifest, "--armor", "--detach-sign", "--local-user", uid)
+		if err := os.WriteFile(name+".asc", sig, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writetgz(t, filepath.Join(src, "image-3.tgz"), testimage)
+	url := startserver(t, src)
+	ref := t.TempDir()
+	writeref(t, ref, testref)
+	dst := t.TempDir()
+
+	tests := []struct {
+		name  string
+		image string
+		ok    bool
+	}{
+		{"signed by the second key of the keyring", "image-1.tgz", true},
+		{"signed by a key not in the keyring", "image-2.tgz", false},
+		{"unsigned", "image-3.tgz", false},
+	}
+	for _, tt := range tests {
+		out, err := runclient(t, "-src", url+tt.image, "-dst", dst+"/", "-ref", ref, "-keyring", keyring)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v\n%s", tt.name, err, out)
+		}
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+}
+
+// testproxy forwards requests to the server at url and returns its own url,
+// requests for which handle returns true are answered by handle instead
+func testproxy(t *testing.T, url string, handle func(http.ResponseWriter, *http.Request) bool) string {
+
+	backend, err := neturl.Parse(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(backend)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if !handle(w, r) {
+			proxy.ServeHTTP(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL + "/"
+}
+
+// relay forwards r to the server at url and copies the response to w, with
+// cut the connection breaks after half of the body
+func relay(t *testing.T, url string, w http.ResponseWriter, r *http.Request, cut bool) *http.Response {
+
+	req, err := http.NewRequest(r.Method, strings.TrimSuffix(url, "/")+r.URL.RequestURI(), r.Body)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	req.Header = r.Header.Clone()
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+	w.WriteHeader(resp.StatusCode)
+	if !cut {
+		w.Write(body)
+		return resp
+	}
+	w.Write(body[:len(body)/2])
+	w.(http.Flusher).Flush()
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	conn.Close()
+	return resp
+}
+
+func TestAsync(t *testing.T) {
+
+	url, ref, dst := testsetup(t, testimage, testref)
+
+	resp, err := http.Post(url+"?async", "application/octet-stream", testbitmap(t, []byte{0x60}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || !strings.Contains(resp.Header.Get("Location"), "job=") {
+		t.Fatalf("got %s, Location %q", resp.Status, resp.Header.Get("Location"))
+	}
+
+	out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-async")
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+
+	// the first download of the diff breaks off
+	server := strings.TrimSuffix(url, "image-1.tgz")
+	cuts, ranges := 0, 0
+	proxy := testproxy(t, server, func(w http.ResponseWriter, r *http.Request) bool {
+		if !r.URL.Query().Has("job") {
+			return false
+		}
+		if r.Header.Get("Range") != "" {
+			ranges++
+			return false
+		}
+		cuts++
+		if cuts > 1 {
+			return false
+		}
+		relay(t, server, w, r, true)
+		return true
+	})
+	os.Remove(filepath.Join(dst, "image-1.tgz"))
+	out, err = runclient(t, "-src", proxy+"image-1.tgz", "-dst", dst+"/", "-ref", ref, "-async")
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	if ranges != 1 {
+		t.Errorf("download resumed %d times, want 1", ranges)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+}
+
+func TestRollback(t *testing.T) {
+
+	keys := t.TempDir()
+	servercmd(t, keys, "genkey", "k1")
+	src := t.TempDir()
+	versions := map[string]string{"image-1.tgz": "5", "image-2.tgz": "3", "image-4.tgz": "6", "image-5.tgz": "5"}
+	for _, name := range []string{"image-1.tgz", "image-2.tgz", "image-3.tgz", "image-4.tgz", "image-5.tgz"} {
+		writetgz(t, filepath.Join(src, name), testimage)
+		if v, ok := versions[name]; ok {
+			if err := os.WriteFile(filepath.Join(src, name+".version"), []byte(v+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	servercmd(t, src, "sign", "-key", filepath.Join(keys, "k1.key"), "image-1.tgz", "image-4.tgz")
+	// version raised after signing
+	os.WriteFile(filepath.Join(src, "image-4.tgz.version"), []byte("7\n"), 0644)
+	url := startserver(t, src)
+	ref := t.TempDir()
+	writeref(t, ref, testref)
+	dst := t.TempDir()
+	state := t.TempDir()
+
+	tests := []struct {
+		name  string
+		image string
+		args  []string
+		ok    bool
+	}{
+		{"signed version", "image-1.tgz", []string{"-pubkey", filepath.Join(keys, "k1.pub")}, true},
+		{"older version", "image-2.tgz", nil, false},
+		{"no version", "image-3.tgz", nil, false},
+		{"version changed after signing", "image-4.tgz", []string{"-pubkey", filepath.Join(keys, "k1.pub")}, false},
+		{"same version", "image-5.tgz", nil, true},
+		{"older version allowed", "image-2.tgz", []string{"-allow-downgrade"}, true},
+		{"same version after the downgrade", "image-2.tgz", nil, true},
+		{"no version without state", "image-3.tgz", []string{"-statedir="}, true},
+	}
+	for _, tt := range tests {
+		args := append([]string{"-src", url + tt.image, "-dst", dst + "/", "-ref", ref, "-statedir", state}, tt.args...)
+		out, err := runclient(t, args...)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v\n%s", tt.name, err, out)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+
+	url, ref, dst := testsetup(t, testimage, testref, "-token", "secret1")
+	server := strings.TrimSuffix(url, "image-1.tgz")
+
+	resp, err := http.Get(server + "capabilities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var caps struct {
+		Protocols []int    `json:"protocols"`
+		Features  []string `json:"features"`
+		Auth      []string `json:"auth"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&caps)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("%s: %v", resp.Status, err)
+	}
+	if fmt.Sprint(caps.Protocols) != "[1]" || !strings.Contains(fmt.Sprint(caps.Features), "async") || fmt.Sprint(caps.Auth) != "[bearer]" {
+		t.Errorf("got %+v", caps)
+	}
+
+	// servers answering with other protocol versions, or without the
+	// endpoint and without the async feature
+	var protocols string
+	asyncs := 0
+	proxy := testproxy(t, server, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Query().Has("async") {
+			asyncs++
+		}
+		if !strings.HasSuffix(r.URL.Path, "/capabilities") {
+			return false
+		}
+		if protocols == "" {
+			http.NotFound(w, r)
+			return true
+		}
+		fmt.Fprintf(w, `{"protocols":%s}`, protocols)
+		return true
+	})
+	tests := []struct {
+		protocols string
+		ok        bool
+	}{
+		{"", true},
+		{"[1,2]", true},
+		{"[2]", false},
+	}
+	for _, tt := range tests {
+		protocols = tt.protocols
+		out, err := runclient(t, "-src", proxy+"image-1.tgz", "-dst", dst+"/", "-ref", ref, "-token", "secret1", "-async")
+		if (err == nil) != tt.ok {
+			t.Errorf("protocols %q: got %v\n%s", tt.protocols, err, out)
+		}
+	}
+	if asyncs != 0 {
+		t.Errorf("async requested %d times without the feature", asyncs)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+}
+
+func TestUnsafeEntries(t *testing.T) {
+
+	src := t.TempDir()
+	images := [][]testentry{
+		{{"../etc/passwd", tar.TypeReg, "root::0:0::/:/bin/sh\n"}},
+		{{"/etc/passwd", tar.TypeReg, "root::0:0::/:/bin/sh\n"}},
+		{{"etc/passwd", tar.TypeLink, "../../etc/shadow"}},
+		{{"dev/null", tar.TypeChar, ""}},
+	}
+	for i, image := range images {
+		writetgz(t, filepath.Join(src, fmt.Sprintf("image-%d.tgz", i+1)), image)
+	}
+	writetgz(t, filepath.Join(src, "image-9.tgz"), testimage)
+	url := startserver(t, src)
+	ref := t.TempDir()
+	writeref(t, ref, testref)
+	dst := t.TempDir()
+
+	for i, image := range images {
+		name := fmt.Sprintf("image-%d.tgz", i+1)
+		if out, err := runclient(t, "-src", url+name, "-dst", dst+"/", "-ref", ref); err == nil {
+			t.Errorf("%q accepted:\n%s", image[0].name, out)
+		}
+	}
+	if out, err := runclient(t, "-src", url+"image-4.tgz", "-dst", dst+"/", "-ref", ref, "-allow-devices"); exitcode(err) != noupdate {
+		t.Errorf("device node with -allow-devices: %s%s", out, err)
+	}
+
+	// a diff with the requested files and one the client did not request
+	var diff bytes.Buffer
+	gw := gzip.NewWriter(&diff)
+	tw := tar.NewWriter(gw)
+	for _, e := range append(testimage[2:4:4], testentry{"etc/same", tar.TypeReg, "evil\n"}) {
+		tw.WriteHeader(&tar.Header{Name: e.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(e.body))})
+		tw.Write([]byte(e.body))
+	}
+	tw.Close()
+	gw.Close()
+	proxy := testproxy(t, url, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodPost {
+			return false
+		}
+		w.Write(diff.Bytes())
+		return true
+	})
+	if out, err := runclient(t, "-src", proxy+"image-9.tgz", "-dst", dst+"/", "-ref", ref); err == nil {
+		t.Errorf("unrequested diff entry accepted:\n%s", out)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+
+	// the first index exceeds the byte budget of a second
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"requests", []string{"-rate-limit", "0.01", "-rate-limit-burst", "2"}, "[200 200 429]"},
+		{"bandwidth", []string{"-bandwidth-limit", "100"}, "[200 429 429]"},
+	}
+	for _, tt := range tests {
+		url, _, _ := testsetup(t, testimage, nil, tt.args...)
+		var codes []int
+		var retry string
+		for i := 0; i < 3; i++ {
+			resp, err := http.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			codes = append(codes, resp.StatusCode)
+			retry = resp.Header.Get("Retry-After")
+		}
+		if fmt.Sprint(codes) != tt.want || retry == "" {
+			t.Errorf("%s: got %v, Retry-After %q, want %s", tt.name, codes, retry, tt.want)
+		}
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+
+	url, ref, dst := testsetup(t, testimage, testref)
+	bundle := t.TempDir()
+
+	out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-record", bundle)
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	for _, name := range []string{"meta.json", "index.tgz", "bitmap.gz", "diff.tgz", "manifest"} {
+		if _, err := os.Stat(filepath.Join(bundle, name)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// offline, with the same reference
+	replayed := t.TempDir()
+	out, err = runclient(t, "-replay", bundle, "-dst", replayed+"/", "-ref", ref)
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(replayed, "image-1.tgz"), testimage)
+
+	// a reference needing other files than recorded
+	other := t.TempDir()
+	if out, err := runclient(t, "-replay", bundle, "-dst", replayed+"/", "-ref", other); err == nil {
+		t.Errorf("replay with another request bitmap succeeded:\n%s", out)
+	}
+
+	// the server side against the published and a changed image
+	image := filepath.Join(t.TempDir(), "image-1.tgz")
+	writetgz(t, image, testimage)
+	if out, err := exec.Command(serverbin, "replay", "-image", image, bundle).CombinedOutput(); err != nil {
+		t.Errorf("server replay: %s%s", out, err)
+	}
+	changed := append([]testentry{}, testimage...)
+	changed[2].body = "changed again\n"
+	writetgz(t, image, changed)
+	if out, err := exec.Command(serverbin, "replay", "-image", image, bundle).CombinedOutput(); err == nil {
+		t.Errorf("server replay of a changed image succeeded:\n%s", out)
+	}
+}
+
+// testrequest sends a request with an optional bearer token and returns
+// the response with its body
+func testrequest(t *testing.T, method, url, token string, body io.Reader) (*http.Response, []byte) {
+
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+func TestAdminSearch(t *testing.T) {
+
+	url, _, _ := testsetup(t, testimage, nil, "-token", "device", "-admin-token", "admin")
+	server := strings.TrimSuffix(url, "image-1.tgz")
+
+	for _, token := range []string{"", "device"} {
+		if resp, _ := testrequest(t, "GET", server+"admin/search?path=changed", token, nil); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("token %q: got %s", token, resp.Status)
+		}
+	}
+
+	added := sha256.Sum256([]byte("added file\n"))
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"path=changed", []string{"etc/changed"}},
+		{"path=etc/", []string{"etc/", "etc/same", "etc/changed", "etc/added", "etc/empty", "etc/link"}},
+		{"hash=" + hex.EncodeToString(added[:]), []string{"etc/added"}},
+		{"path=missing", nil},
+	}
+	for _, tt := range tests {
+		resp, body := testrequest(t, "GET", server+"admin/search?"+tt.query, "admin", nil)
+		var results []struct {
+			Image string `json:"image"`
+			Name  string `json:"name"`
+		}
+		if err := json.Unmarshal(body, &results); err != nil || resp.StatusCode != 200 {
+			t.Fatalf("%s: %s %v", tt.query, resp.Status, err)
+		}
+		var names []string
+		for _, r := range results {
+			if r.Image != "image-1.tgz" {
+				t.Errorf("%s: image %q", tt.query, r.Image)
+			}
+			names = append(names, r.Name)
+		}
+		if fmt.Sprint(names) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.query, names, tt.want)
+		}
+	}
+
+	// the admin api is off without admin tokens
+	url, _, _ = testsetup(t, testimage, nil)
+	if resp, _ := testrequest(t, "GET", strings.TrimSuffix(url, "image-1.tgz")+"admin/search?path=etc", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("without admin tokens: got %s", resp.Status)
+	}
+}
+
+// tesths256 returns a JWT with claims signed by secret
+func tesths256(secret string, claims map[string]interface{}) string {
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + b64(mac.Sum(nil))
+}
+
+func TestJWT(t *testing.T) {
+
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("jwt secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	url, ref, dst := testsetup(t, testimage, testref, "-jwt-secret-file", secret, "-jwt-issuer", "issuer", "-jwt-audience", "ota")
+	now := time.Now().Unix()
+	valid := map[string]interface{}{"iss": "issuer", "aud": "ota", "sub": "device-1", "exp": now + 600}
+	expired := map[string]interface{}{"iss": "issuer", "aud": "ota", "sub": "device-1", "exp": now - 600}
+	other := map[string]interface{}{"iss": "other", "aud": "ota", "sub": "device-1", "exp": now + 600}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", tesths256("jwt secret", valid), true},
+		{"expired", tesths256("jwt secret", expired), false},
+		{"other issuer", tesths256("jwt secret", other), false},
+		{"other secret", tesths256("other secret", valid), false},
+	}
+	for _, tt := range tests {
+		out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-token", tt.token)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v\n%s", tt.name, err, out)
+		}
+	}
+
+	// the first token of the endpoint is rejected, the client fetches a
+	// new one
+	var grants []string
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, password, _ := r.BasicAuth()
+		r.ParseForm()
+		grants = append(grants, r.PostForm.Get("grant_type")+" "+id+" "+password)
+		claims := valid
+		if len(grants) == 1 {
+			claims = expired
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": tesths256("jwt secret", claims), "token_type": "Bearer", "expires_in": 600})
+	}))
+	defer tokens.Close()
+	out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-token-url", tokens.URL, "-client-id", "device-1", "-client-secret", "s3cret")
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	if len(grants) != 2 || grants[1] != "client_credentials device-1 s3cret" {
+		t.Errorf("got token requests %q", grants)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+}
+
+func TestIndexDelta(t *testing.T) {
+
+	src := t.TempDir()
+	image2 := append([]testentry{}, testimage...)
+	image2[3].body = "added file, changed\n"
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	writetgz(t, filepath.Join(src, "image-2.tgz"), image2)
+	server := startserver(t, src)
+	ref := t.TempDir()
+	writeref(t, ref, testref)
+	dst := t.TempDir()
+	state := t.TempDir()
+
+	var query, contenttype string
+	var size int
+	proxy := testproxy(t, server, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodGet || !strings.HasSuffix(r.URL.Path, ".tgz") {
+			return false
+		}
+		query = r.URL.RawQuery
+		resp := relay(t, server, w, r, false)
+		contenttype = resp.Header.Get("Content-Type")
+		size, _ = strconv.Atoi(resp.Header.Get("Content-Length"))
+		return true
+	})
+	update := func(image string) error {
+		out, err := runclient(t, "-src", proxy+image, "-dst", dst+"/", "-ref", ref, "-statedir", state)
+		if err != nil {
+			return fmt.Errorf("%s%s", out, err)
+		}
+		return nil
+	}
+
+	if err := update("image-1.tgz"); err != nil {
+		t.Fatal(err)
+	}
+	full := size
+	if query != "" || contenttype == "application/x-ota-index-delta" {
+		t.Errorf("first update: got %q %s", query, contenttype)
+	}
+
+	if err := update("image-2.tgz"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(query, "base=image-1.tgz") || !strings.Contains(query, "base-sha256=") || contenttype != "application/x-ota-index-delta" || size >= full {
+		t.Errorf("second update: got %q %s, %d bytes for a full index of %d", query, contenttype, size, full)
+	}
+	checktgz(t, filepath.Join(dst, "image-2.tgz"), image2)
+
+	// a damaged kept index fails the update once, the next one requests the
+	// full index
+	if err := os.WriteFile(filepath.Join(state, "index.tgz"), []byte("damaged"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := update("image-1.tgz"); err == nil {
+		t.Errorf("update with a damaged kept index succeeded")
+	}
+	if err := update("image-1.tgz"); err != nil {
+		t.Fatal(err)
+	}
+	if query != "" {
+		t.Errorf("full index expected, got %q", query)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+
+	// a base unknown to the server gets the full index
+	_, index := testrequest(t, "GET", server+"image-2.tgz", "", nil)
+	resp, body := testrequest(t, "GET", server+"image-2.tgz?base=image-1.tgz&base-sha256="+strings.Repeat("00", 32), "", nil)
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") == "application/x-ota-index-delta" || !bytes.Equal(body, index) {
+		t.Errorf("unknown base: got %s %s, %d bytes", resp.Status, resp.Header.Get("Content-Type"), len(body))
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+
+	keyfile := filepath.Join(t.TempDir(), "keys")
+	url, ref, dst := testsetup(t, testimage, testref, "-api-key-file", keyfile, "-admin-token", "admin")
+	admin := strings.TrimSuffix(url, "image-1.tgz") + "admin/keys"
+
+	issue := func(device string) (string, string) {
+		resp, body := testrequest(t, "POST", admin+"?device="+device, "admin", nil)
+		var k struct {
+			ID  string `json:"id"`
+			Key string `json:"key"`
+		}
+		if err := json.Unmarshal(body, &k); err != nil || resp.StatusCode != http.StatusCreated || k.ID == "" || k.Key == "" {
+			t.Fatalf("issue: %s %s", resp.Status, body)
+		}
+		return k.ID, k.Key
+	}
+	update := func(key string) error {
+		out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-token", key)
+		if err != nil {
+			return fmt.Errorf("%s%s", out, err)
+		}
+		return nil
+	}
+
+	if resp, _ := testrequest(t, "POST", admin+"?device=dev1", "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("issue without admin token: got %s", resp.Status)
+	}
+	if resp, _ := testrequest(t, "POST", admin, "admin", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("issue without device: got %s", resp.Status)
+	}
+
+	id1, key1 := issue("dev1")
+	_, key2 := issue("dev1")
+	_, key3 := issue("dev2")
+	for _, key := range []string{key1, key2, key3} {
+		if err := update(key); err != nil {
+			t.Error(err)
+		}
+	}
+	data, _ := os.ReadFile(keyfile)
+	if strings.Contains(string(data), key1) {
+		t.Errorf("plain key in the key file")
+	}
+	if err := update(key1 + "x"); err == nil {
+		t.Errorf("unknown key accepted")
+	}
+
+	if resp, body := testrequest(t, "DELETE", admin+"?id="+id1, "admin", nil); resp.StatusCode != 200 {
+		t.Errorf("revoke %s: %s %s", id1, resp.Status, body)
+	}
+	if err := update(key1); err == nil {
+		t.Errorf("revoked key accepted")
+	}
+	if err := update(key2); err != nil {
+		t.Error(err)
+	}
+
+	if resp, body := testrequest(t, "DELETE", admin+"?device=dev1", "admin", nil); resp.StatusCode != 200 {
+		t.Errorf("revoke dev1: %s %s", resp.Status, body)
+	}
+	if err := update(key2); err == nil {
+		t.Errorf("key of a revoked device accepted")
+	}
+	if err := update(key3); err != nil {
+		t.Error(err)
+	}
+	if resp, _ := testrequest(t, "DELETE", admin+"?device=dev1", "admin", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("revoke again: got %s", resp.Status)
+	}
+}
+
+// testkey writes a random AES-256 payload key in hex to a new file
+func testkey(t *testing.T, dir, name string) string {
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	fname := filepath.Join(dir, name)
+	if err := os.WriteFile(fname, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func TestPayloadEncryption(t *testing.T) {
+
+	keys := t.TempDir()
+	fleet := testkey(t, keys, "fleet")
+	other := testkey(t, keys, "other")
+	devices := t.TempDir()
+	device := testkey(t, devices, "dev1.key")
+	secret := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(secret, []byte("jwt secret\n"), 0600)
+	url, ref, dst := testsetup(t, testimage, testref, "-payload-key-file", fleet, "-payload-key-dir", devices, "-jwt-secret-file", secret)
+	plainurl, _, _ := testsetup(t, testimage, testref)
+	jwt := func(sub string) string {
+		return tesths256("jwt secret", map[string]interface{}{"sub": sub, "exp": time.Now().Unix() + 600})
+	}
+
+	// the index and diff as sent: magic, key id, salt and the chunks
+	header := 8 + 8 + 32
+	var chunks [][]byte
+	tamper := func(body []byte) []byte { return body }
+	proxy := testproxy(t, url, func(w http.ResponseWriter, r *http.Request) bool {
+		if !strings.HasSuffix(r.URL.Path, ".tgz") {
+			return false
+		}
+		rec := httptest.NewRecorder()
+		relay(t, url, rec, r, false)
+		body := rec.Body.Bytes()
+		if rec.Code != 200 || !bytes.HasPrefix(body, []byte("OTAGCM1\n")) {
+			t.Errorf("%s: %d %q", r.URL, rec.Code, body)
+			return false
+		}
+		chunks = nil
+		for rest := body[header:]; len(rest) >= 4; {
+			n := 4 + int(binary.BigEndian.Uint32(rest))
+			chunks = append(chunks, rest[:n])
+			rest = rest[n:]
+		}
+		body = tamper(body)
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		w.WriteHeader(rec.Code)
+		w.Write(body)
+		return true
+	})
+
+	tests := []struct {
+		name  string
+		src   string
+		token string
+		key   string
+		ok    bool
+	}{
+		{"fleet key", url, jwt("dev2"), fleet, true},
+		{"device key", url, jwt("dev1"), device, true},
+		{"fleet key for a device with its own key", url, jwt("dev1"), fleet, false},
+		{"other key", url, jwt("dev2"), other, false},
+		{"no key", url, jwt("dev2"), "", false},
+		{"plain payload", plainurl, "", fleet, false},
+		{"through the proxy", proxy + "image-1.tgz", jwt("dev2"), fleet, true},
+	}
+	for _, tt := range tests {
+		args := []string{"-src", tt.src, "-dst", dst + "/", "-ref", ref}
+		if tt.token != "" {
+			args = append(args, "-token", tt.token)
+		}
+		if tt.key != "" {
+			args = append(args, "-payload-key", tt.key)
+		}
+		out, err := runclient(t, args...)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v\n%s", tt.name, err, out)
+		}
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+	if len(chunks) == 0 {
+		t.Fatal("no payload chunks")
+	}
+
+	modifications := []struct {
+		name   string
+		tamper func([]byte) []byte
+	}{
+		{"flipped bit", func(body []byte) []byte {
+			body[len(body)-20] ^= 1
+			return body
+		}},
+		{"last chunk dropped", func(body []byte) []byte {
+			return body[:len(body)-len(chunks[len(chunks)-1])]
+		}},
+		{"chunk appended", func(body []byte) []byte {
+			return append(body, chunks[len(chunks)-1]...)
+		}},
+		{"other salt", func(body []byte) []byte {
+			body[20] ^= 1
+			return body
+		}},
+	}
+	for _, m := range modifications {
+		tamper = m.tamper
+		if out, err := runclient(t, "-src", proxy+"image-1.tgz", "-dst", dst+"/", "-ref", ref, "-token", jwt("dev2"), "-payload-key", fleet); err == nil {
+			t.Errorf("%s: accepted\n%s", m.name, out)
+		}
+	}
+}
+
+func TestUsage(t *testing.T) {
+
+	url, ref, dst := testsetup(t, testimage, testref, "-admin-token", "admin")
+	if out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	server := strings.TrimSuffix(url, "image-1.tgz")
+
+	for _, by := range []string{"image", "client"} {
+		resp, body := testrequest(t, "GET", server+"admin/usage?sort=requests&by="+by, "admin", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("by %s: got %s %s", by, resp.Status, body)
+		}
+		var totals []struct {
+			Name     string
+			Requests int64
+			Read     int64
+			Written  int64
+		}
+		if err := json.Unmarshal(body, &totals); err != nil {
+			t.Fatalf("by %s: %v\n%s", by, err, body)
+		}
+		// the index and the diff
+		if len(totals) != 1 || totals[0].Requests != 2 || totals[0].Read == 0 || totals[0].Written == 0 {
+			t.Errorf("by %s: got %s", by, body)
+		}
+		if by == "image" && len(totals) > 0 && totals[0].Name != "image-1.tgz" {
+			t.Errorf("by image: got %s", body)
+		}
+	}
+
+	for _, query := range []string{"sort=memory", "by=group", "n=-1"} {
+		if resp, body := testrequest(t, "GET", server+"admin/usage?"+query, "admin", nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: got %s %s", query, resp.Status, body)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+
+	// a line per file
+	logfile := filepath.Join(t.TempDir(), "audit.log")
+	url, ref, dst := testsetup(t, testimage, testref, "-audit-log", logfile, "-audit-log-max-size", "1", "-audit-log-keep", "3")
+	if out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+
+	readentry := func(fname string) map[string]interface{} {
+		data, err := os.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			t.Fatalf("%s: %v\n%s", fname, err, data)
+		}
+		return entry
+	}
+	for fname, request := range map[string]string{logfile + ".1": "index", logfile: "diff"} {
+		entry := readentry(fname)
+		if entry["request"] != request || entry["image"] != "image-1.tgz" || entry["status"] != 200.0 || entry["bytes"] == 0.0 || entry["ip"] != "127.0.0.1" {
+			t.Errorf("%s: got %v", request, entry)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		testrequest(t, "GET", strings.TrimSuffix(url, "image-1.tgz")+"missing.tgz", "", nil)
+	}
+	if entry := readentry(logfile); entry["status"] != 404.0 || entry["image"] != "missing.tgz" {
+		t.Errorf("missing image: got %v", entry)
+	}
+	if entry := readentry(logfile + ".3"); entry["request"] != "diff" {
+		t.Errorf("rotated: got %v", entry)
+	}
+	if _, err := os.Stat(logfile + ".4"); err == nil {
+		t.Errorf("more than 3 rotated logs kept")
+	}
+}
+
+func TestDuplicatePaths(t *testing.T) {
+
+	// both copies of etc/changed differ from the reference
+	image := append([]testentry{
+		{"etc/", tar.TypeDir, ""},
+		{"etc/changed", tar.TypeReg, "first content\n"},
+		{"etc/Same", tar.TypeReg, "other case\n"},
+	}, testimage...)
+
+	tests := []struct {
+		name       string
+		serverargs []string
+		clientargs []string
+		ok         bool
+	}{
+		{"last wins", nil, nil, true},
+		{"client refuses", nil, []string{"-duplicates", "error"}, false},
+		{"server refuses", []string{"-duplicates", "error"}, nil, false},
+		{"case insensitive client", nil, []string{"-duplicates", "error", "-case-insensitive"}, false},
+		{"case insensitive server", []string{"-duplicates", "error", "-case-insensitive"}, nil, false},
+	}
+	for _, tt := range tests {
+		url, ref, dst := testsetup(t, image, testref, tt.serverargs...)
+		out, err := runclient(t, append([]string{"-src", url, "-dst", dst + "/", "-ref", ref}, tt.clientargs...)...)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v\n%s", tt.name, err, out)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if !strings.Contains(out, `msg="duplicate path, the last one wins" path=etc/changed`) {
+			t.Errorf("%s: no warning\n%s", tt.name, out)
+		}
+		f, err := os.Open(filepath.Join(dst, "image-1.tgz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// unchanged files come first, but the copies keep their order
+		got := readtgz(t, f)
+		want := append([]testentry{}, image...)
+		for _, entries := range [][]testentry{got, want} {
+			sort.SliceStable(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, want)
+		}
+		f.Close()
+	}
+
+	// only differing in case without -case-insensitive
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), image[2:])
+	servercmd(t, src, "check", "image-1.tgz")
+	writetgz(t, filepath.Join(src, "image-2.tgz"), image)
+	for _, args := range [][]string{{"check", "image-2.tgz"}, {"check", "-case-insensitive", "image-1.tgz"}} {
+		cmd := exec.Command(serverbin, args...)
+		cmd.Dir = src
+		if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "duplicate path") {
+			t.Errorf("%s: got %v\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+}
+
+func TestInstallHeaders(t *testing.T) {
+
+	url, ref, dst := testsetup(t, testimage, testref)
+	contexts := filepath.Join(t.TempDir(), "file_contexts")
+	os.WriteFile(contexts, []byte(`# the last matching line wins
+/etc(/.*)?	system_u:object_r:etc_t:s0
+/etc/link	-l	system_u:object_r:link_t:s0
+/etc/link	--	system_u:object_r:file_t:s0
+/etc/empty	<<none>>
+`), 0644)
+	out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-selinux-contexts", contexts, "-owner", "1000:1001", "-umask", "027")
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+
+	labels := map[string]string{
+		"etc/":        "system_u:object_r:etc_t:s0",
+		"etc/same":    "system_u:object_r:etc_t:s0",
+		"etc/changed": "system_u:object_r:etc_t:s0",
+		"etc/added":   "system_u:object_r:etc_t:s0",
+		"etc/empty":   "",
+		"etc/link":    "system_u:object_r:link_t:s0",
+	}
+	f, err := os.Open(filepath.Join(dst, "image-1.tgz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, found := labels[hdr.Name]
+		if !found {
+			t.Errorf("%s: unexpected entry", hdr.Name)
+			continue
+		}
+		delete(labels, hdr.Name)
+		if got := hdr.PAXRecords["SCHILY.xattr.security.selinux"]; got != want {
+			t.Errorf("%s: got label %q, want %q", hdr.Name, got, want)
+		}
+		if hdr.Uid != 1000 || hdr.Gid != 1001 {
+			t.Errorf("%s: got owner %d:%d", hdr.Name, hdr.Uid, hdr.Gid)
+		}
+		if hdr.Mode&027 != 0 {
+			t.Errorf("%s: got mode %o", hdr.Name, hdr.Mode)
+		}
+	}
+	for name := range labels {
+		t.Errorf("%s: missing", name)
+	}
+
+	for _, args := range [][]string{{"-owner", "root"}, {"-umask", "1777"}, {"-selinux-contexts", contexts + ".missing"}} {
+		if out, err := runclient(t, append([]string{"-src", url, "-dst", dst + "/", "-ref", ref}, args...)...); err == nil {
+			t.Errorf("%s accepted\n%s", strings.Join(args, " "), out)
+		}
+	}
+}
+
+func TestScratchDir(t *testing.T) {
+
+	url, ref, dst := testsetup(t, testimage, testref)
+	tmpdir := t.TempDir()
+	if out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-tmpdir", tmpdir); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	if entries, _ := os.ReadDir(tmpdir); len(entries) != 0 {
+		t.Errorf("scratch files left: %v", entries)
+	}
+
+	// interrupted while waiting for the diff
+	posted := make(chan bool)
+	release := make(chan bool)
+	defer close(release)
+	proxy := testproxy(t, strings.TrimSuffix(url, "image-1.tgz"), func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodPost {
+			return false
+		}
+		posted <- true
+		<-release
+		return true
+	})
+	cmd := exec.Command(clientbin, "-statedir", t.TempDir(), "-src", proxy+"image-1.tgz", "-dst", dst+"/", "-ref", ref, "-tmpdir", tmpdir)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-posted:
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Fatalf("no diff request\n%s", out.String())
+	}
+
+	entries, _ := os.ReadDir(tmpdir)
+	if len(entries) != 1 || !strings.HasPrefix(entries[0].Name(), "ota-client-") {
+		t.Fatalf("got scratch directories %v", entries)
+	}
+	if fi, err := os.Stat(filepath.Join(tmpdir, entries[0].Name())); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0700 {
+		t.Errorf("scratch directory not private: %v", fi.Mode())
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+	if err := cmd.Wait(); cmd.ProcessState.ExitCode() != 128+int(syscall.SIGTERM) {
+		t.Errorf("got %v\n%s", err, out.String())
+	}
+	if entries, _ := os.ReadDir(tmpdir); len(entries) != 0 {
+		t.Errorf("scratch files left after SIGTERM: %v", entries)
+	}
+}
+
+func TestWarm(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	url := startserver(t, src, "-warm-cpu", "0.5", "-warm-interval", "100ms")
+	plain := startserver(t, src)
+
+	// an image published after the start
+	writetgz(t, filepath.Join(src, "image-2.tgz"), testref)
+	time.Sleep(300 * time.Millisecond)
+	for _, image := range []string{"image-1.tgz", "image-2.tgz"} {
+		_, want := testrequest(t, "GET", plain+image, "", nil)
+		if resp, body := testrequest(t, "GET", url+image, "", nil); resp.StatusCode != http.StatusOK || !bytes.Equal(body, want) {
+			t.Errorf("%s: got %s, %d bytes, want %d", image, resp.Status, len(body), len(want))
+		}
+	}
+
+	ref, dst := t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+	if out, err := runclient(t, "-src", url+"image-1.tgz", "-dst", dst+"/", "-ref", ref); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+}
+
+func TestDiffCache(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	cache := t.TempDir()
+	url := startserver(t, src, "-diff-cache", cache, "-admin-token", "admin")
+	ref := t.TempDir()
+	writeref(t, ref, testref)
+
+	update := func(url string) {
+		t.Helper()
+		dst := t.TempDir()
+		if out, err := runclient(t, "-statedir", t.TempDir(), "-src", url+"image-1.tgz", "-dst", dst+"/", "-ref", ref); err != nil {
+			t.Fatalf("%s%s", out, err)
+		}
+		checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+	}
+	stats := func(url string) (hits, misses int64, entries int) {
+		t.Helper()
+		resp, body := testrequest(t, "GET", url+"admin/cache", "admin", nil)
+		var s struct {
+			Hits    int64
+			Misses  int64
+			Entries []json.RawMessage
+		}
+		if err := json.Unmarshal(body, &s); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s", resp.Status, body)
+		}
+		return s.Hits, s.Misses, len(s.Entries)
+	}
+
+	update(url)
+	update(url)
+	if hits, misses, entries := stats(url); hits != 1 || misses != 1 || entries != 1 {
+		t.Errorf("got %d hits, %d misses, %d entries", hits, misses, entries)
+	}
+
+	// purging nothing saves the cache index, a restarted server answers
+	// from it
+	if resp, body := testrequest(t, "DELETE", url+"admin/cache?key=none", "admin", nil); string(bytes.TrimSpace(body)) != `{"purged":0}` {
+		t.Fatalf("%s %s", resp.Status, body)
+	}
+	restarted := startserver(t, src, "-diff-cache", cache, "-admin-token", "admin")
+	update(restarted)
+	if hits, misses, entries := stats(restarted); hits != 2 || misses != 1 || entries != 1 {
+		t.Errorf("restarted: got %d hits, %d misses, %d entries", hits, misses, entries)
+	}
+
+	if resp, body := testrequest(t, "DELETE", restarted+"admin/cache?image=image-1.tgz", "admin", nil); string(bytes.TrimSpace(body)) != `{"purged":1}` {
+		t.Fatalf("%s %s", resp.Status, body)
+	}
+	if files, _ := os.ReadDir(cache); len(files) != 1 || files[0].Name() != "index.json" {
+		t.Errorf("purged diffs left: %v", files)
+	}
+}
+
+// retgz rewrites the tgz data, calling change for every header
+func retgz(t *testing.T, data []byte, change func(*tar.Header)) []byte {
+
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tr := tar.NewReader(gr)
+	tw := tar.NewWriter(gw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		change(hdr)
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+	gw.Close()
+	return buf.Bytes()
+}
+
+func TestManifestDigest(t *testing.T) {
+
+	url, ref, dst := testsetup(t, testimage, testref)
+	server := strings.TrimSuffix(url, "image-1.tgz")
+
+	change := func(*tar.Header) {}
+	proxy := testproxy(t, server, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodGet || !strings.HasSuffix(r.URL.Path, ".tgz") {
+			return false
+		}
+		rec := httptest.NewRecorder()
+		relay(t, server, rec, r, false)
+		body := retgz(t, rec.Body.Bytes(), change)
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		w.WriteHeader(rec.Code)
+		w.Write(body)
+		return true
+	})
+
+	tests := []struct {
+		name   string
+		change func(*tar.Header)
+		ok     bool
+	}{
+		{"unchanged", func(*tar.Header) {}, true},
+		{"mode", func(hdr *tar.Header) {
+			if hdr.Name == "etc/same" {
+				hdr.Mode = 0600
+			}
+		}, false},
+		{"symlink target", func(hdr *tar.Header) {
+			if hdr.Name == "etc/link" {
+				hdr.Linkname = "added"
+			}
+		}, false},
+		{"digest", func(hdr *tar.Header) {
+			if hdr.Typeflag == tar.TypeXGlobalHeader {
+				hdr.PAXRecords["OTA.manifest-sha256"] = strings.Repeat("0", 64)
+			}
+		}, false},
+	}
+	for _, tt := range tests {
+		change = tt.change
+		out, err := runclient(t, "-statedir", t.TempDir(), "-src", proxy+"image-1.tgz", "-dst", dst+"/", "-ref", ref)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v\n%s", tt.name, err, out)
+		}
+		if tt.ok {
+			checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+		} else if !strings.Contains(out, "Index does not match the image manifest") {
+			t.Errorf("%s: not refused for the digest\n%s", tt.name, out)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+
+	image := append([]testentry{
+		{"boot/", tar.TypeDir, ""},
+		{"boot/kernel", tar.TypeReg, "kernel image\n"},
+		{"boot/kernel.old", tar.TypeLink, "boot/kernel"},
+		{"opt/", tar.TypeDir, ""},
+		{"opt/app/", tar.TypeDir, ""},
+		{"opt/app/bin", tar.TypeReg, "app binary\n"},
+		{"opt/app/link", tar.TypeSymlink, "bin"},
+	}, testimage...)
+	url, ref, dst := testsetup(t, image, testref)
+	boot := t.TempDir()
+	app := filepath.Join(t.TempDir(), "app.tgz")
+
+	out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-split", "/boot="+boot+",opt/app="+app)
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), append([]testentry{{"opt/", tar.TypeDir, ""}}, testimage...))
+	checktgz(t, app, []testentry{
+		{"./", tar.TypeDir, ""},
+		{"./bin", tar.TypeReg, "app binary\n"},
+		{"./link", tar.TypeSymlink, "bin"},
+	})
+	for name, want := range map[string]string{"kernel": "kernel image\n", "kernel.old": "kernel image\n"} {
+		if data, err := os.ReadFile(filepath.Join(boot, name)); err != nil || string(data) != want {
+			t.Errorf("%s: got %q %v", name, data, err)
+		}
+	}
+	if fi1, err := os.Stat(filepath.Join(boot, "kernel")); err == nil {
+		if fi2, err := os.Stat(filepath.Join(boot, "kernel.old")); err != nil || !os.SameFile(fi1, fi2) {
+			t.Errorf("kernel.old is not a hard link")
+		}
+	}
+
+	// hard links must stay within their subtree
+	crossing := append(append([]testentry{}, testimage...), testentry{"boot/", tar.TypeDir, ""}, testentry{"boot/same", tar.TypeLink, "etc/same"})
+	url, ref, dst = testsetup(t, crossing, testref)
+	if out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-split", "/boot="+t.TempDir()); err == nil || !strings.Contains(out, "crosses the split") {
+		t.Errorf("hard link across the split: got %v\n%s", err, out)
+	}
+
+	for _, split := range []string{"/boot", "/=" + boot, "/boot=" + boot + ",boot/=" + app} {
+		if out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-split", split); err == nil {
+			t.Errorf("-split %s accepted\n%s", split, out)
+		}
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+
+	url, ref, dst := testsetup(t, testimage, testref, "-max-request-body", "100", "-max-bitmap", "1000")
+
+	// a bitmap of zeros compresses well
+	random := make([]byte, 200)
+	rand.Read(random)
+	gzipped := func(bitmap []byte) []byte {
+		data, _ := io.ReadAll(testbitmap(t, bitmap))
+		return data
+	}
+	tests := []struct {
+		name   string
+		body   []byte
+		status int
+	}{
+		{"valid", gzipped([]byte{0x60}), http.StatusOK},
+		{"body too large", gzipped(random), http.StatusRequestEntityTooLarge},
+		{"gzip bomb", gzipped(make([]byte, 1001)), http.StatusRequestEntityTooLarge},
+		{"at the limit", gzipped(append([]byte{0x60}, make([]byte, 999)...)), http.StatusOK},
+		{"not gzipped", []byte("bitmap"), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		for _, query := range []string{"", "?simulate", "?async"} {
+			resp, err := http.Post(url+query, "application/octet-stream", bytes.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			want := tt.status
+			if want == http.StatusOK && query == "?async" {
+				want = http.StatusAccepted
+			}
+			if resp.StatusCode != want {
+				t.Errorf("%s%s: got %s, want %d", tt.name, query, resp.Status, want)
+			}
+		}
+	}
+
+	resp, body := testrequest(t, "GET", strings.TrimSuffix(url, "image-1.tgz")+"capabilities", "", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"max_request":1000`) {
+		t.Errorf("capabilities: %s", body)
+	}
+	if out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+}
+
+func TestAllowImages(t *testing.T) {
+
+	src := t.TempDir()
+	for _, name := range []string{"image-1.tgz", "rootfs-2.tgz", "boot.tgz"} {
+		writetgz(t, filepath.Join(src, name), testimage)
+	}
+	list := filepath.Join(t.TempDir(), "images")
+	os.WriteFile(list, []byte("# served\nboot.tgz\n"), 0644)
+	server := startserver(t, src, "-allow-images", "rootfs-*.tgz", "-allow-images-file", list)
+
+	check := func(allowed map[string]bool) {
+		t.Helper()
+		for name, ok := range allowed {
+			resp, _ := testrequest(t, "GET", server+name, "", nil)
+			if (resp.StatusCode == http.StatusOK) != ok || (!ok && resp.StatusCode != http.StatusNotFound) {
+				t.Errorf("%s: got %s", name, resp.Status)
+			}
+		}
+	}
+	check(map[string]bool{"image-1.tgz": false, "rootfs-2.tgz": true, "boot.tgz": true})
+
+	// the file is reloaded on change
+	os.WriteFile(list, []byte("image-*.tgz\n"), 0644)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(list, future, future)
+	check(map[string]bool{"image-1.tgz": true, "rootfs-2.tgz": true, "boot.tgz": false})
+
+	ref, dst := t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+	if out, err := runclient(t, "-src", server+"boot.tgz", "-dst", dst+"/", "-ref", ref); err == nil {
+		t.Errorf("image not allowed: updated\n%s", out)
+	}
+	if out, err := runclient(t, "-src", server+"rootfs-2.tgz", "-dst", dst+"/", "-ref", ref); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "rootfs-2.tgz"), testimage)
+}
+
+func TestVerifyArchive(t *testing.T) {
+
+	keys := t.TempDir()
+	servercmd(t, keys, "genkey", "k1")
+	servercmd(t, keys, "genkey", "k2")
+	url, ref, dst := testsetup(t, testimage, testref)
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	servercmd(t, src, "sign", "-key", filepath.Join(keys, "k1.key"), "image-1.tgz")
+	cmd := exec.Command(serverbin, "manifest", "image-1.tgz")
+	cmd.Dir = src
+	manifest, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(src, "manifest"), manifest, 0644)
+
+	if out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	assembled := filepath.Join(dst, "image-1.tgz")
+	changed := append([]testentry{}, testimage...)
+	changed[2].body = "other content\n"
+	writetgz(t, filepath.Join(dst, "changed.tgz"), changed)
+	writetgz(t, filepath.Join(dst, "missing.tgz"), testimage[:len(testimage)-1])
+	writetgz(t, filepath.Join(dst, "extra.tgz"), append([]testentry{{"etc/extra", tar.TypeReg, "extra\n"}}, testimage...))
+
+	tests := []struct {
+		name   string
+		pubkey string
+		tgz    string
+		status int
+		output string
+	}{
+		{"assembled", "k1.pub", assembled, 0, "all 6 entries match the manifest"},
+		{"changed", "k1.pub", filepath.Join(dst, "changed.tgz"), 1, `MISMATCH "etc/changed"`},
+		{"missing", "k1.pub", filepath.Join(dst, "missing.tgz"), 1, `MISSING "etc/link"`},
+		{"extra", "k1.pub", filepath.Join(dst, "extra.tgz"), 1, `EXTRA "etc/extra"`},
+		{"other key", "k2.pub", assembled, 1, "FAIL signature"},
+	}
+	for _, tt := range tests {
+		cmd := exec.Command(clientbin, "verify-archive", "-manifest", filepath.Join(src, "manifest"),
+			"-sig", filepath.Join(src, "image-1.tgz.sig"), "-pubkey", filepath.Join(keys, tt.pubkey), tt.tgz)
+		out, _ := cmd.CombinedOutput()
+		if cmd.ProcessState.ExitCode() != tt.status || !strings.Contains(string(out), tt.output) {
+			t.Errorf("%s: exit status %d\n%s", tt.name, cmd.ProcessState.ExitCode(), out)
+		}
+	}
+
+	// a signature without its key
+	cmd = exec.Command(clientbin, "verify-archive", "-manifest", filepath.Join(src, "manifest"), "-sig", filepath.Join(src, "image-1.tgz.sig"), assembled)
+	if out, _ := cmd.CombinedOutput(); cmd.ProcessState.ExitCode() != 2 {
+		t.Errorf("without -pubkey: exit status %d\n%s", cmd.ProcessState.ExitCode(), out)
+	}
+}
+
+func TestTUF(t *testing.T) {
+
+	keys, meta := t.TempDir(), t.TempDir()
+	src := t.TempDir()
+	changed := append([]testentry{}, testimage...)
+	changed[2].body = "tampered\n"
+	for _, name := range []string{"image-1.tgz", "image-2.tgz", "image-3.tgz"} {
+		writetgz(t, filepath.Join(src, name), testimage)
+	}
+	servercmd(t, src, "tuf", "init", "-keys", keys, "-meta", meta, "image-1.tgz", "image-3.tgz")
+	writetgz(t, filepath.Join(src, "image-3.tgz"), changed)
+	url := startserver(t, src, "-tuf-dir", meta)
+	root := filepath.Join(t.TempDir(), "root.json")
+	data, err := os.ReadFile(filepath.Join(meta, "root.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(root, data, 0644)
+	ref, dst := t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+
+	update := func(image string, ok bool) {
+		t.Helper()
+		out, err := runclient(t, "-src", url+image, "-dst", dst+"/", "-ref", ref, "-tuf", root)
+		if (err == nil) != ok {
+			t.Errorf("%s: got %v\n%s", image, err, out)
+		} else if ok {
+			checktgz(t, filepath.Join(dst, image), testimage)
+		}
+	}
+	update("image-1.tgz", true)
+	update("image-2.tgz", false)
+	update("image-3.tgz", false)
+
+	// the client keeps the trusted metadata, older versions are refused
+	old := t.TempDir()
+	for _, name := range []string{"timestamp.json", "snapshot.json", "targets.json"} {
+		data, _ := os.ReadFile(filepath.Join(meta, name))
+		os.WriteFile(filepath.Join(old, name), data, 0644)
+	}
+	servercmd(t, src, "tuf", "publish", "-keys", keys, "-meta", meta, "image-2.tgz")
+	update("image-2.tgz", true)
+	for _, name := range []string{"timestamp.json", "snapshot.json", "targets.json"} {
+		data, _ := os.ReadFile(filepath.Join(old, name))
+		os.WriteFile(filepath.Join(meta, name), data, 0644)
+	}
+	update("image-1.tgz", false)
+
+	// clients walk from their initial root to a rotated one
+	servercmd(t, src, "tuf", "publish", "-keys", keys, "-meta", meta, "image-2.tgz")
+	servercmd(t, src, "tuf", "rotate", "-role", "root", "-keys", keys, "-meta", meta)
+	servercmd(t, src, "tuf", "rotate", "-role", "targets", "-keys", keys, "-meta", meta)
+	update("image-1.tgz", true)
+}
+
+func TestIndexToken(t *testing.T) {
+
+	url, ref, dst := testsetup(t, testimage, testref, "-require-index-token")
+
+	// through http and through a transport command
+	for _, args := range [][]string{nil, {"-transport-cmd", clientbin + " fetch"}} {
+		out, err := runclient(t, append([]string{"-statedir", t.TempDir(), "-src", url, "-dst", dst + "/", "-ref", ref}, args...)...)
+		if err != nil {
+			t.Fatalf("%s%s", out, err)
+		}
+		checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+	}
+
+	resp, _ := testrequest(t, "GET", url, "", nil)
+	token := resp.Header.Get("OTA-Index-Token")
+	if token == "" {
+		t.Fatal("no index token")
+	}
+	for _, tt := range []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"without token", "", http.StatusPreconditionRequired},
+		{"with token", token, http.StatusOK},
+		{"replayed", token, http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest("POST", url, testbitmap(t, []byte{0x60}))
+		if tt.token != "" {
+			req.Header.Set("OTA-Index-Token", tt.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: got %s, want %d", tt.name, resp.Status, tt.status)
+		}
+	}
+}
+
+func TestIndexHash(t *testing.T) {
+
+	// a file of several BLAKE3 chunks, changed after the first one
+	large := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	changed := append([]byte{}, large...)
+	changed[2000] = 'x'
+	image := append([]testentry{{"large", tar.TypeReg, string(large)}}, testimage...)
+	ref := append([]testentry{{"large", tar.TypeReg, string(changed)}}, testref...)
+	url, refdir, dst := testsetup(t, image, ref)
+
+	for _, name := range []string{"sha1", "sha256", "blake3", "auto"} {
+		out, err := runclient(t, "-statedir", t.TempDir(), "-src", url, "-dst", dst+"/", "-ref", refdir, "-hash", name)
+		if err != nil {
+			t.Fatalf("%s: %s%s", name, out, err)
+		}
+		if !strings.Contains(out, `msg="downloading missing files" files=3`) {
+			t.Errorf("%s: changed files not requested\n%s", name, out)
+		}
+		checktgz(t, filepath.Join(dst, "image-1.tgz"), image)
+	}
+
+	sum := sha256.Sum256(large)
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"sha256", string(sum[:])},
+		{"blake3", ""},
+	} {
+		resp, body := testrequest(t, "GET", url+"?hash="+tt.name, "", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: %s", tt.name, resp.Status)
+		}
+		found := false
+		for _, e := range readtgz(t, bytes.NewReader(body)) {
+			if e.name == "large" {
+				found = true
+				if len(e.body) != 32 || (tt.want != "" && e.body != tt.want) {
+					t.Errorf("%s: got %x", tt.name, e.body)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("%s: large file not in the index", tt.name)
+		}
+	}
+	if resp, _ := testrequest(t, "GET", url+"?hash=md5", "", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown hash: got %s", resp.Status)
+	}
+}
+
+func TestUnsafeEntryPolicy(t *testing.T) {
+
+	image := append([]testentry{
+		{"dev/", tar.TypeDir, ""},
+		{"dev/null", tar.TypeChar, ""},
+		{"dev/null2", tar.TypeLink, "dev/null"},
+		{"etc/su", tar.TypeReg, "setuid\n"},
+		{"etc/out", tar.TypeSymlink, "../../outside"},
+	}, testimage...)
+	src := t.TempDir()
+	fname := filepath.Join(src, "image-1.tgz")
+	writetgz(t, fname, image)
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(fname, retgz(t, data, func(hdr *tar.Header) {
+		if hdr.Name == "etc/su" {
+			hdr.Mode = 04755
+		}
+	}), 0644)
+	url := startserver(t, src) + "image-1.tgz"
+	ref, dst := t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+
+	// the headers of the assembled image by name
+	headers := func() map[string]*tar.Header {
+		f, err := os.Open(filepath.Join(dst, "image-1.tgz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(gr)
+		hdrs := map[string]*tar.Header{}
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return hdrs
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			hdrs[hdr.Name] = hdr
+		}
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		ok      bool
+		dropped []string
+	}{
+		{"device", nil, false, nil},
+		{"allowed device", []string{"-allow-devices"}, true, nil},
+		{"sanitized device", []string{"-unsafe-entries", "sanitize"}, true, []string{"dev/null", "dev/null2"}},
+		{"setuid", []string{"-allow-devices", "-no-setuid"}, false, nil},
+		{"escaping symlink", []string{"-allow-devices", "-no-escaping-symlinks"}, false, nil},
+		{"sanitized", []string{"-no-setuid", "-no-escaping-symlinks", "-unsafe-entries", "sanitize"}, true, []string{"dev/null", "dev/null2", "etc/out"}},
+	}
+	for _, tt := range tests {
+		os.Remove(filepath.Join(dst, "image-1.tgz"))
+		out, err := runclient(t, append([]string{"-src", url, "-dst", dst + "/", "-ref", ref}, tt.args...)...)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v\n%s", tt.name, err, out)
+			continue
+		}
+		if !tt.ok {
+			if !strings.Contains(out, "Unsafe entry") {
+				t.Errorf("%s: not rejected as unsafe\n%s", tt.name, out)
+			}
+			if _, err := os.Stat(filepath.Join(dst, "image-1.tgz")); err == nil {
+				t.Errorf("%s: image written", tt.name)
+			}
+			continue
+		}
+		hdrs := headers()
+		for _, name := range tt.dropped {
+			if hdrs[name] != nil {
+				t.Errorf("%s: %s not dropped", tt.name, name)
+			}
+			delete(hdrs, name)
+		}
+		if len(hdrs) != len(image)-len(tt.dropped) {
+			t.Errorf("%s: got %d entries, want %d", tt.name, len(hdrs), len(image)-len(tt.dropped))
+		}
+		// cleared when sanitizing with -no-setuid only
+		want := int64(04755)
+		if strings.Contains(strings.Join(tt.args, " "), "-no-setuid") {
+			want = 0755
+		}
+		if su := hdrs["etc/su"]; su == nil || su.Mode != want {
+			t.Errorf("%s: got etc/su %+v, want mode %o", tt.name, su, want)
+		}
+	}
+}
+
+func TestGzipDelta(t *testing.T) {
+
+	// an app bundle with a small change, gzipped like the build does
+	var v1, v2 bytes.Buffer
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&v1, "line %d %x\n", i, sha256.Sum256([]byte(fmt.Sprint(i))))
+		if i == 2500 {
+			v2.WriteString("changed line\n")
+		} else {
+			fmt.Fprintf(&v2, "line %d %x\n", i, sha256.Sum256([]byte(fmt.Sprint(i))))
+		}
+	}
+	gzipped := func(data []byte) string {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		gw.Write(data)
+		gw.Close()
+		return buf.String()
+	}
+	image1 := append([]testentry{{"app.gz", tar.TypeReg, gzipped(v1.Bytes())}}, testimage...)
+	image2 := append([]testentry{{"app.gz", tar.TypeReg, gzipped(v2.Bytes())}}, testimage...)
+	image2[len(image2)-4].body = "newer content\n"
+
+	// the client adds the gzip delta parameters to signed urls
+	secret := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(secret, []byte("url secret\n"), 0600)
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), image1)
+	server := startserver(t, src, "-gzip-delta-max-size", "10000000", "-url-secret-file", secret, "-token", "secret1")
+	var query neturl.Values
+	var size int
+	proxy := testproxy(t, server, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodPost {
+			return false
+		}
+		query = r.URL.Query()
+		rec := httptest.NewRecorder()
+		relay(t, server, rec, r, false)
+		size = rec.Body.Len()
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+		return true
+	})
+
+	ref := t.TempDir()
+	writeref(t, ref, append([]testentry{{"app.gz", tar.TypeReg, image1[0].body}}, testref...))
+	dst := t.TempDir()
+	if out, err := runclient(t, "-src", minturl(t, secret, proxy+"image-1.tgz", "1h"), "-dst", dst+"/", "-ref", ref); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	if query.Has("gzip-files") {
+		t.Errorf("gzip delta without a kept index: %v", query)
+	}
+
+	writetgz(t, filepath.Join(src, "image-2.tgz"), image2)
+	// with the delta first, the index kept afterwards is the one of image-2
+	for _, delta := range []bool{true, false} {
+		out, err := runclient(t, "-src", minturl(t, secret, proxy+"image-2.tgz", "1h"), "-dst", dst+"/", "-ref", ref, fmt.Sprintf("-gzip-delta=%v", delta))
+		if err != nil {
+			t.Fatalf("%s%s", out, err)
+		}
+		// rebuilt to the same bytes
+		checktgz(t, filepath.Join(dst, "image-2.tgz"), image2)
+		if !delta {
+			if query.Has("gzip-files") || size < len(image2[0].body) {
+				t.Errorf("without -gzip-delta: %v, %d bytes", query, size)
+			}
+			continue
+		}
+		if query.Get("gzip-base") != "image-1.tgz" || !strings.HasPrefix(query.Get("gzip-files"), "0:") {
+			t.Errorf("got query %v", query)
+		}
+		if size > len(image2[0].body)/2 {
+			t.Errorf("diff of %d bytes for a gzip member of %d bytes", size, len(image2[0].body))
+		}
+	}
+}
+
+func TestIndexMaxAge(t *testing.T) {
+
+	keys := t.TempDir()
+	servercmd(t, keys, "genkey", "k1")
+	src := t.TempDir()
+	for _, name := range []string{"image-1.tgz", "image-2.tgz", "image-3.tgz", "image-4.tgz"} {
+		writetgz(t, filepath.Join(src, name), testimage)
+	}
+	key := filepath.Join(keys, "k1.key")
+	servercmd(t, src, "sign", "-key", key, "-max-age", "1h", "image-1.tgz")
+	servercmd(t, src, "sign", "-key", key, "-timestamp", "image-2.tgz")
+	servercmd(t, src, "sign", "-key", key, "-max-age", "1s", "image-3.tgz")
+	servercmd(t, src, "sign", "-key", key, "-timestamp", "image-4.tgz")
+	// an older signing time than signed
+	os.WriteFile(filepath.Join(src, "image-4.tgz.sigtime"), []byte(fmt.Sprintf("%d 0\n", time.Now().Unix()-10)), 0644)
+	url := startserver(t, src)
+	ref, dst := t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+	time.Sleep(2 * time.Second)
+
+	tests := []struct {
+		name  string
+		image string
+		args  []string
+		ok    bool
+	}{
+		{"within max-age", "image-1.tgz", nil, true},
+		{"timestamp", "image-2.tgz", nil, true},
+		{"timestamp within -max-index-age", "image-2.tgz", []string{"-max-index-age", "1h"}, true},
+		{"timestamp beyond -max-index-age", "image-2.tgz", []string{"-max-index-age", "1s"}, false},
+		{"beyond max-age", "image-3.tgz", nil, false},
+		{"changed signing time", "image-4.tgz", nil, false},
+	}
+	for _, tt := range tests {
+		args := append([]string{"-src", url + tt.image, "-dst", dst + "/", "-ref", ref, "-pubkey", filepath.Join(keys, "k1.pub")}, tt.args...)
+		out, err := runclient(t, args...)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v\n%s", tt.name, err, out)
+		}
+	}
+}
+
+func TestFIPS(t *testing.T) {
+
+	keys := t.TempDir()
+	servercmd(t, keys, "genkey", "k1")
+	t.Setenv("GODEBUG", "fips140=on")
+
+	url, ref, dst := testsetup(t, testimage, testref)
+	resp, body := testrequest(t, "GET", strings.TrimSuffix(url, "image-1.tgz")+"capabilities", "", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"hashes":["sha256"]`) || !strings.Contains(string(body), `"fips"`) {
+		t.Errorf("capabilities: %s", body)
+	}
+	for query, status := range map[string]int{"": http.StatusBadRequest, "?hash=sha1": http.StatusBadRequest, "?hash=blake3": http.StatusBadRequest, "?hash=sha256": http.StatusOK} {
+		if resp, _ := testrequest(t, "GET", url+query, "", nil); resp.StatusCode != status {
+			t.Errorf("index%s: got %s, want %d", query, resp.Status, status)
+		}
+	}
+
+	out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref)
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+	if out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-pubkey", filepath.Join(keys, "k1.pub")); err == nil {
+		t.Errorf("ed25519 signature accepted\n%s", out)
+	}
+
+	cmd := exec.Command(serverbin, "genkey", "k2")
+	cmd.Dir = keys
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Errorf("genkey: ed25519 key written\n%s", out)
+	}
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	os.WriteFile(htpasswd, []byte("user:{SHA}qUqP5cyxm6YcTAhz05Hph5gvu9M=\n"), 0644)
+	cmd = exec.Command(serverbin, "-src", t.TempDir(), "-bind", "127.0.0.1:0", "-htpasswd", htpasswd)
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "FIPS") {
+		t.Errorf("-htpasswd: got %v\n%s", err, out)
+	}
+}
+
+// testsmtp runs a minimal SMTP server, the data of every mail is sent to
+// mails
+func testsmtp(t *testing.T, mails chan<- string) string {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				fmt.Fprintf(conn, "220 localhost\r\n")
+				var data strings.Builder
+				indata := false
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch {
+					case indata && line == ".\r\n":
+						indata = false
+						mails <- data.String()
+						fmt.Fprintf(conn, "250 ok\r\n")
+					case indata:
+						data.WriteString(line)
+					case strings.HasPrefix(line, "DATA"):
+						indata = true
+						data.Reset()
+						fmt.Fprintf(conn, "354 go ahead\r\n")
+					case strings.HasPrefix(line, "QUIT"):
+						fmt.Fprintf(conn, "221 bye\r\n")
+						return
+					default:
+						fmt.Fprintf(conn, "250 ok\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestNotifications(t *testing.T) {
+
+	events := make(chan string, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		events <- "webhook " + string(body)
+	}))
+	defer hook.Close()
+	slack := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		events <- "slack " + string(body)
+	}))
+	defer slack.Close()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	writepem(t, ca, "CERTIFICATE", slack.Certificate().Raw)
+	t.Setenv("SSL_CERT_FILE", ca)
+	mails := make(chan string, 10)
+	smtpaddr := testsmtp(t, mails)
+
+	targets := filepath.Join(t.TempDir(), "targets")
+	os.WriteFile(targets, []byte("# events\nimage-*.tgz "+hook.URL+"/events\n"+
+		"*.tgz slack+"+slack.URL+"/services/x\n"+
+		"rootfs-*.tgz smtp://"+smtpaddr+"/?from=ota@example.com&to=ops@example.com\n"), 0644)
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	startserver(t, src, "-notify-file", targets, "-notify-interval", "50ms")
+	time.Sleep(200 * time.Millisecond)
+
+	// the events in any order
+	expect := func(ch chan string, want ...string) {
+		t.Helper()
+		var got []string
+		for range want {
+			select {
+			case ev := <-ch:
+				got = append(got, ev)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		}
+		all := strings.Join(got, "\n")
+		for _, w := range want {
+			if !strings.Contains(all, w) {
+				t.Errorf("got %q, want %s", got, w)
+			}
+		}
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("image present at the start announced: %s", ev)
+	default:
+	}
+
+	// by rename, like images should be published
+	writetgz(t, filepath.Join(src, ".image-2.tgz"), testimage)
+	os.Rename(filepath.Join(src, ".image-2.tgz"), filepath.Join(src, "image-2.tgz"))
+	expect(events, `"event":"published","image":"image-2.tgz"`, "Image image-2.tgz published")
+
+	writetgz(t, filepath.Join(src, ".image-2.tgz"), testref)
+	os.Rename(filepath.Join(src, ".image-2.tgz"), filepath.Join(src, "image-2.tgz"))
+	expect(events, `"event":"updated","image":"image-2.tgz"`, "Image image-2.tgz updated")
+
+	os.Remove(filepath.Join(src, "image-1.tgz"))
+	expect(events, `"event":"removed","image":"image-1.tgz"`, "Image image-1.tgz removed")
+
+	writetgz(t, filepath.Join(src, "rootfs-1.tgz"), testimage)
+	expect(events, "Image rootfs-1.tgz published")
+	expect(mails, "Subject: [ota] Image rootfs-1.tgz published")
+}
+
+func TestStatus(t *testing.T) {
+
+	url, ref, dst := testsetup(t, testimage, testref, "-token", "secret1")
+	state := t.TempDir()
+	status := func() (updatestatus map[string]interface{}, exit int) {
+		t.Helper()
+		cmd := exec.Command(clientbin, "status", "-statedir", state, "-json")
+		out, _ := cmd.Output()
+		if cmd.ProcessState.ExitCode() != 2 {
+			if err := json.Unmarshal(out, &updatestatus); err != nil {
+				t.Fatalf("%v\n%s", err, out)
+			}
+		}
+		return updatestatus, cmd.ProcessState.ExitCode()
+	}
+	if _, exit := status(); exit != 2 {
+		t.Errorf("no update: exit status %d", exit)
+	}
+
+	if out, err := runclient(t, "-statedir", state, "-src", url, "-dst", dst+"/", "-ref", ref, "-token", "secret1"); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	s, exit := status()
+	if exit != 0 || s["result"] != "success" || s["image"] != "image-1.tgz" || s["files"] != 2.0 || s["bytes"] == 0.0 {
+		t.Errorf("success: exit status %d, %v", exit, s)
+	}
+
+	if out, err := runclient(t, "-statedir", state, "-src", url, "-dst", dst+"/", "-ref", ref, "-token", "secret2"); err == nil {
+		t.Fatalf("wrong token accepted\n%s", out)
+	}
+	s, exit = status()
+	if exit != 1 || s["result"] != "failure" || s["error"] == nil {
+		t.Errorf("failure: exit status %d, %v", exit, s)
+	}
+
+	// the human readable form
+	cmd := exec.Command(clientbin, "status", "-statedir", state)
+	if out, _ := cmd.Output(); !strings.Contains(string(out), "result:   failure") {
+		t.Errorf("got %s", out)
+	}
+}
+
+func TestCatalog(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	writetgz(t, filepath.Join(src, "image-2.tgz"), testref)
+	os.WriteFile(filepath.Join(src, "image-2.tgz.version"), []byte("42\n"), 0644)
+	published := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(filepath.Join(src, "image-2.tgz"), published, published)
+	server := startserver(t, src, "-token", "secret1")
+
+	if resp, _ := testrequest(t, "GET", server+"images", "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without token: got %s", resp.Status)
+	}
+	resp, body := testrequest(t, "GET", server+"images", "secret1", nil)
+	var catalog []struct {
+		Name        string
+		Size        int64
+		Version     string
+		SHA256      string
+		PublishedAt time.Time `json:"published_at"`
+	}
+	if err := json.Unmarshal(body, &catalog); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s %v\n%s", resp.Status, err, body)
+	}
+	if len(catalog) != 2 {
+		t.Fatalf("got %s", body)
+	}
+	for _, e := range catalog {
+		data, err := os.ReadFile(filepath.Join(src, e.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+		if e.Size != int64(len(data)) || e.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s: got %d bytes, sha256 %s", e.Name, e.Size, e.SHA256)
+		}
+		if e.Name == "image-2.tgz" && (e.Version != "42" || !e.PublishedAt.Equal(published)) {
+			t.Errorf("%s: got version %q, published at %s", e.Name, e.Version, e.PublishedAt)
+		}
+	}
+
+	if resp, _ := testrequest(t, "POST", server+"images", "secret1", nil); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got %s", resp.Status)
+	}
+}
+
+func TestUpload(t *testing.T) {
+
+	src := t.TempDir()
+	server := startserver(t, src, "-upload-token", "upload", "-token", "device")
+	ref, dst := t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+	image := filepath.Join(t.TempDir(), "image.tgz")
+	writetgz(t, image, testimage)
+	data, err := os.ReadFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+
+	tests := []struct {
+		name   string
+		url    string
+		token  string
+		body   []byte
+		status int
+	}{
+		{"without token", "images/image-1.tgz", "", data, http.StatusUnauthorized},
+		{"device token", "images/image-1.tgz", "device", data, http.StatusUnauthorized},
+		{"not an image", "images/image-1.tgz", "upload", []byte("not gzipped"), http.StatusBadRequest},
+		{"truncated", "images/image-1.tgz", "upload", data[:len(data)/2], http.StatusBadRequest},
+		{"wrong sha256", "images/image-1.tgz?sha256=" + strings.Repeat("0", 64), "upload", data, http.StatusBadRequest},
+		{"invalid version", "images/image-1.tgz?version=x", "upload", data, http.StatusBadRequest},
+		{"not a tgz", "images/image-1.zip", "upload", data, http.StatusNotFound},
+		{"new", "images/image-1.tgz?version=7&sha256=" + hex.EncodeToString(sum[:]), "upload", data, http.StatusCreated},
+		{"replaced", "images/image-1.tgz?version=8", "upload", data, http.StatusOK},
+	}
+	for _, tt := range tests {
+		resp, body := testrequest(t, "PUT", server+tt.url, tt.token, bytes.NewReader(tt.body))
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: got %s %s, want %d", tt.name, resp.Status, body, tt.status)
+		}
+	}
+
+	// only the image and its version were written
+	files, _ := os.ReadDir(src)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if strings.Join(names, " ") != "image-1.tgz image-1.tgz.version" {
+		t.Errorf("got files %v", names)
+	}
+	if version, _ := os.ReadFile(filepath.Join(src, "image-1.tgz.version")); strings.TrimSpace(string(version)) != "8" {
+		t.Errorf("got version %q", version)
+	}
+	if out, err := runclient(t, "-src", server+"image-1.tgz", "-dst", dst+"/", "-ref", ref, "-token", "device"); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+}
+
+func TestAdminOps(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	cache := t.TempDir()
+	url := startserver(t, src, "-diff-cache", cache, "-admin-token", "admin")
+	ref := t.TempDir()
+	writeref(t, ref, testref)
+	if out, err := runclient(t, "-src", url+"image-1.tgz", "-dst", t.TempDir()+"/", "-ref", ref); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+
+	type opstatus struct {
+		ID    string
+		Kind  string
+		State string
+		Error string
+		Done  int64
+		Total int64
+		Log   []string
+	}
+	start := func(query string) opstatus {
+		t.Helper()
+		resp, body := testrequest(t, "POST", url+"admin/ops?"+query, "admin", nil)
+		var op opstatus
+		if err := json.Unmarshal(body, &op); err != nil || resp.StatusCode != http.StatusAccepted || resp.Header.Get("Location") != "/admin/ops?id="+op.ID {
+			t.Fatalf("%s: %s %s", query, resp.Status, body)
+		}
+		return op
+	}
+	wait := func(id string) opstatus {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			resp, body := testrequest(t, "GET", url+"admin/ops?id="+id, "admin", nil)
+			var op opstatus
+			if err := json.Unmarshal(body, &op); err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("%s %s", resp.Status, body)
+			}
+			if op.State != "running" {
+				return op
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("operation %s still running", id)
+		return opstatus{}
+	}
+
+	for _, query := range []string{"kind=index", "kind=delta&image=image-1.tgz", "kind=delta&hash=sha256"} {
+		op := wait(start(query).ID)
+		if op.State != "done" || op.Done != op.Total || op.Total == 0 {
+			t.Errorf("%s: got %+v", query, op)
+		}
+	}
+
+	// the replaced image makes its cached diff stale
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(src, "image-1.tgz"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	op := wait(start("kind=gc").ID)
+	if op.State != "done" || len(op.Log) == 0 || !strings.HasSuffix(op.Log[0], " diff cache: 1 stale diffs removed") {
+		t.Errorf("gc: got %+v", op)
+	}
+	if files, _ := os.ReadDir(cache); len(files) != 1 {
+		t.Errorf("stale diffs left: %v", files)
+	}
+
+	resp, body := testrequest(t, "GET", url+"admin/ops", "admin", nil)
+	var list []opstatus
+	if err := json.Unmarshal(body, &list); err != nil || len(list) != 4 || list[0].Kind != "gc" {
+		t.Errorf("list: %s %s", resp.Status, body)
+	}
+
+	tests := []struct {
+		method string
+		query  string
+		token  string
+		status int
+	}{
+		{"POST", "kind=index", "", http.StatusUnauthorized},
+		{"POST", "kind=rebuild", "admin", http.StatusBadRequest},
+		{"POST", "kind=delta&hash=md5", "admin", http.StatusBadRequest},
+		{"POST", "kind=index&image=image-2.tgz", "admin", http.StatusNotFound},
+		{"GET", "id=none", "admin", http.StatusNotFound},
+		{"DELETE", "id=none", "admin", http.StatusNotFound},
+		{"DELETE", "id=" + op.ID, "admin", http.StatusConflict},
+		{"PUT", "", "admin", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		if resp, body := testrequest(t, tt.method, url+"admin/ops?"+tt.query, tt.token, nil); resp.StatusCode != tt.status {
+			t.Errorf("%s %s: got %s %s, want %d", tt.method, tt.query, resp.Status, body, tt.status)
+		}
+	}
+}
+
+func TestChannels(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testref)
+	writetgz(t, filepath.Join(src, "image-2.tgz"), testimage)
+	channelsfile := filepath.Join(t.TempDir(), "channels.json")
+	url := startserver(t, src, "-channels-file", channelsfile, "-admin-token", "admin")
+
+	tests := []struct {
+		method string
+		query  string
+		status int
+	}{
+		{"POST", "channel=stable&image=image-1.tgz", http.StatusOK},
+		{"POST", "channel=beta&image=image-2.tgz", http.StatusOK},
+		{"POST", "channel=nightly&from=none", http.StatusNotFound},
+		{"POST", "channel=nightly&image=image-3.tgz", http.StatusNotFound},
+		{"POST", "channel=nightly&image=../image-1.tgz", http.StatusNotFound},
+		{"POST", "channel=../x&image=image-1.tgz", http.StatusBadRequest},
+		{"POST", "channel=nightly", http.StatusBadRequest},
+		{"DELETE", "channel=none", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if resp, body := testrequest(t, tt.method, url+"admin/channels?"+tt.query, "admin", nil); resp.StatusCode != tt.status {
+			t.Errorf("%s %s: got %s %s, want %d", tt.method, tt.query, resp.Status, body, tt.status)
+		}
+	}
+
+	resolve := func(channel string) string {
+		t.Helper()
+		req, _ := http.NewRequest("GET", url+"channel/"+channel+"/latest", nil)
+		req.Header.Set("Accept", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var entry struct{ Channel, Image, URL string }
+		if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil || resp.StatusCode != http.StatusOK || entry.Channel != channel || entry.URL != "/"+entry.Image {
+			t.Fatalf("%s: %s %+v", channel, resp.Status, entry)
+		}
+		return entry.Image
+	}
+	if image := resolve("beta"); image != "image-2.tgz" {
+		t.Errorf("beta: got %s", image)
+	}
+
+	// without Accept: application/json the channel redirects to its image
+	noredirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noredirect.Get(url + "channel/stable/latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/image-1.tgz" {
+		t.Errorf("stable: got %s to %q", resp.Status, resp.Header.Get("Location"))
+	}
+	if resp, _ := testrequest(t, "GET", url+"channel/none/latest", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown channel: got %s", resp.Status)
+	}
+
+	// promoting beta to stable updates clients following stable, the
+	// channels survive a restart
+	if resp, body := testrequest(t, "POST", url+"admin/channels?channel=stable&from=beta", "admin", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s %s", resp.Status, body)
+	}
+	restarted := startserver(t, src, "-channels-file", channelsfile, "-admin-token", "admin")
+	ref, dst := t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+	out, err := runclient(t, "-src", restarted+"channel/stable/latest", "-dst", dst+"/", "-ref", ref)
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	if !strings.Contains(string(out), "src="+restarted+"image-2.tgz") {
+		t.Errorf("got output %s", out)
+	}
+	checktgz(t, filepath.Join(dst, "image-2.tgz"), testimage)
+
+	if resp, _ := testrequest(t, "DELETE", restarted+"admin/channels?channel=beta", "admin", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: got %s", resp.Status)
+	}
+	resp, body := testrequest(t, "GET", restarted+"admin/channels", "admin", nil)
+	var list []struct{ Channel, Image string }
+	if err := json.Unmarshal(body, &list); err != nil || len(list) != 1 || list[0].Channel != "stable" || list[0].Image != "image-2.tgz" {
+		t.Errorf("list: %s %s", resp.Status, body)
+	}
+}
+
+func TestImageKey(t *testing.T) {
+
+	src := t.TempDir()
+	image := filepath.Join(src, "image-1.tgz")
+	writetgz(t, image, testimage)
+	plain, err := os.ReadFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyfile := filepath.Join(t.TempDir(), "image.key")
+	if err := os.WriteFile(keyfile, []byte(strings.Repeat("ab", 32)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	servercmd(t, src, "encrypt-image", "-image-key-file", keyfile, "image-1.tgz")
+	encrypted, err := os.ReadFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(encrypted, plain) || bytes.Contains(encrypted, plain[:16]) {
+		t.Fatal("image not encrypted")
+	}
+
+	// the key from a file or a command, e.g. a KMS client
+	for _, args := range [][]string{
+		{"-image-key-file", keyfile},
+		{"-image-key-cmd", "cat " + keyfile},
+	} {
+		server := startserver(t, src, append(args, "-token", "device", "-upload-token", "upload")...)
+		resp, body := testrequest(t, "GET", server+"images", "device", nil)
+		var catalog []struct {
+			Name   string
+			Size   int64
+			SHA256 string
+		}
+		sum := sha256.Sum256(plain)
+		if err := json.Unmarshal(body, &catalog); err != nil || len(catalog) != 1 || catalog[0].Size != int64(len(plain)) || catalog[0].SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s: catalog %s %s", args[0], resp.Status, body)
+		}
+
+		ref, dst := t.TempDir(), t.TempDir()
+		writeref(t, ref, testref)
+		if out, err := runclient(t, "-src", server+"image-1.tgz", "-dst", dst+"/", "-ref", ref, "-token", "device"); err != nil {
+			t.Fatalf("%s: %s%s", args[0], out, err)
+		}
+		checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+	}
+
+	// uploads are stored encrypted
+	server := startserver(t, src, "-image-key-file", keyfile, "-upload-token", "upload")
+	if resp, body := testrequest(t, "PUT", server+"images/image-2.tgz", "upload", bytes.NewReader(plain)); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload: %s %s", resp.Status, body)
+	}
+	uploaded, err := os.ReadFile(filepath.Join(src, "image-2.tgz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(uploaded, plain[:16]) {
+		t.Error("upload not encrypted")
+	}
+
+	// a wrong key fails, -decrypt restores the plaintext
+	wrongkey := filepath.Join(t.TempDir(), "wrong.key")
+	os.WriteFile(wrongkey, []byte(strings.Repeat("cd", 32)+"\n"), 0600)
+	cmd := exec.Command(serverbin, "encrypt-image", "-decrypt", "-image-key-file", wrongkey, "image-1.tgz")
+	cmd.Dir = src
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Errorf("wrong key: decrypted: %s", out)
+	}
+	if data, _ := os.ReadFile(image); !bytes.Equal(data, encrypted) {
+		t.Error("wrong key: image changed")
+	}
+	servercmd(t, src, "encrypt-image", "-decrypt", "-image-key-file", keyfile, "image-1.tgz", "image-2.tgz")
+	for _, name := range []string{"image-1.tgz", "image-2.tgz"} {
+		if data, _ := os.ReadFile(filepath.Join(src, name)); !bytes.Equal(data, plain) {
+			t.Errorf("%s: not decrypted to the plaintext", name)
+		}
+	}
+}
+
+func TestSignCommand(t *testing.T) {
+
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("needs openssl")
+	}
+	keys := t.TempDir()
+	servercmd(t, keys, "genkey", "k1")
+	servercmd(t, keys, "genkey", "k2")
+	k1 := filepath.Join(keys, "k1")
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	ref, dst := t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+
+	// openssl stands in for the client of a KMS or HSM, it signs files only
+	openssl := func(key string) string {
+		return "f=$(mktemp) && cat >$f && openssl pkeyutl -sign -rawin -inkey " + key + " -in $f; r=$?; rm -f $f; exit $r"
+	}
+	tests := []struct {
+		name string
+		cmd  string
+		ok   bool
+	}{
+		{"raw", openssl(k1 + ".key"), true},
+		{"base64", "(" + openssl(k1+".key") + ") | base64", true},
+		{"other key", openssl(filepath.Join(keys, "k2.key")), false},
+		{"no signature", "echo signature", false},
+		{"failing", "exit 1", false},
+	}
+	for _, tt := range tests {
+		os.Remove(filepath.Join(src, "image-1.tgz.sig"))
+		cmd := exec.Command(serverbin, "sign", "-key-cmd", tt.cmd, "-pubkey", k1+".pub", "image-1.tgz")
+		cmd.Dir = src
+		out, err := cmd.CombinedOutput()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v\n%s", tt.name, err, out)
+			continue
+		}
+		if !tt.ok {
+			if _, err := os.Stat(filepath.Join(src, "image-1.tgz.sig")); err == nil {
+				t.Errorf("%s: signature written", tt.name)
+			}
+			continue
+		}
+		url := startserver(t, src)
+		if out, err := runclient(t, "-src", url+"image-1.tgz", "-dst", dst+"/", "-ref", ref, "-pubkey", k1+".pub"); err != nil {
+			t.Fatalf("%s: %s%s", tt.name, out, err)
+		}
+		checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+	}
+
+	// -key-cmd needs the public key
+	cmd := exec.Command(serverbin, "sign", "-key-cmd", "true", "image-1.tgz")
+	cmd.Dir = src
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Errorf("without -pubkey: %s", out)
+	}
+}
+
+func TestRollout(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testref)
+	writetgz(t, filepath.Join(src, "image-2.tgz"), testimage)
+	keyfile := filepath.Join(t.TempDir(), "keys")
+	url := startserver(t, src, "-channels-file", filepath.Join(t.TempDir(), "channels.json"), "-api-key-file", keyfile, "-admin-token", "admin")
+
+	keys := map[string]string{}
+	for i := 0; i < 20; i++ {
+		device := fmt.Sprintf("dev%d", i)
+		resp, body := testrequest(t, "POST", url+"admin/keys?device="+device, "admin", nil)
+		var k struct{ Key string }
+		if err := json.Unmarshal(body, &k); err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("%s %s", resp.Status, body)
+		}
+		keys[device] = k.Key
+	}
+	set := func(query string) {
+		t.Helper()
+		if resp, body := testrequest(t, "POST", url+"admin/channels?channel=stable&"+query, "admin", nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: %s %s", query, resp.Status, body)
+		}
+	}
+	// offered returns the devices getting image-2.tgz
+	offered := func() map[string]bool {
+		t.Helper()
+		got := map[string]bool{}
+		for device, key := range keys {
+			req, _ := http.NewRequest("GET", url+"channel/stable/latest", nil)
+			req.Header.Set("Accept", "application/json")
+			req.Header.Set("Authorization", "Bearer "+key)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var entry struct{ Image string }
+			json.NewDecoder(resp.Body).Decode(&entry)
+			resp.Body.Close()
+			if entry.Image == "image-2.tgz" {
+				got[device] = true
+			} else if entry.Image != "image-1.tgz" {
+				t.Fatalf("%s: got %s %q", device, resp.Status, entry.Image)
+			}
+		}
+		return got
+	}
+	// bucket is the rollout bucket of the server
+	bucket := func(device string) int {
+		sum := sha256.Sum256([]byte("stable\x00image-2.tgz\x00" + device))
+		return int(binary.BigEndian.Uint64(sum[:8]) % 100)
+	}
+
+	set("image=image-1.tgz")
+	if got := offered(); len(got) != 0 {
+		t.Errorf("before the rollout: got %v", got)
+	}
+	var previous map[string]bool
+	for _, rollout := range []int{30, 0, 60} {
+		if rollout == 30 {
+			set("image=image-2.tgz&rollout=30%25")
+		} else {
+			set(fmt.Sprintf("rollout=%d", rollout))
+		}
+		got := offered()
+		for device := range keys {
+			if got[device] != (bucket(device) < rollout) {
+				t.Errorf("rollout %d: %s (bucket %d) got image-2.tgz: %v", rollout, device, bucket(device), got[device])
+			}
+		}
+		// widening keeps the devices which got the image
+		for device := range previous {
+			if rollout > 30 && !got[device] {
+				t.Errorf("rollout %d: %s lost image-2.tgz", rollout, device)
+			}
+		}
+		if rollout == 30 {
+			previous = got
+		}
+	}
+
+	resp, body := testrequest(t, "GET", url+"admin/channels", "admin", nil)
+	if !strings.Contains(string(body), `"image":"image-2.tgz"`) || !strings.Contains(string(body), `"previous":"image-1.tgz","rollout":60`) {
+		t.Errorf("list: %s %s", resp.Status, body)
+	}
+
+	// the client follows its rollout bucket
+	var in, out string
+	for device := range keys {
+		if bucket(device) < 60 {
+			in = device
+		} else {
+			out = device
+		}
+	}
+	ref := t.TempDir()
+	writeref(t, ref, testref)
+	for device, want := range map[string][]testentry{in: testimage, out: testref} {
+		dst := t.TempDir()
+		status := 0
+		if device == out {
+			status = noupdate
+		}
+		if output, err := runclient(t, "-src", url+"channel/stable/latest", "-dst", dst+"/x.tgz", "-ref", ref, "-token", keys[device]); exitcode(err) != status {
+			t.Fatalf("%s: %s%s", device, output, err)
+		}
+		checktgz(t, filepath.Join(dst, "x.tgz"), want)
+	}
+
+	set("rollout=100")
+	if got := offered(); len(got) != len(keys) {
+		t.Errorf("full rollout: got %v", got)
+	}
+	_, body = testrequest(t, "GET", url+"admin/channels", "admin", nil)
+	if strings.Contains(string(body), "previous") {
+		t.Errorf("previous image kept after the full rollout: %s", body)
+	}
+
+	for _, query := range []string{"rollout=101", "rollout=x", "image=image-2.tgz&rollout=-1"} {
+		if resp, _ := testrequest(t, "POST", url+"admin/channels?channel=stable&"+query, "admin", nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: got %s", query, resp.Status)
+		}
+	}
+}
+
+func TestChannelEpoch(t *testing.T) {
+
+	keys := t.TempDir()
+	servercmd(t, keys, "genkey", "k1")
+	servercmd(t, keys, "genkey", "k2")
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testref)
+	writetgz(t, filepath.Join(src, "image-2.tgz"), testimage)
+	channelsfile := filepath.Join(t.TempDir(), "channels.json")
+	args := []string{"-channels-file", channelsfile, "-admin-token", "admin", "-channel-key", filepath.Join(keys, "k1.key")}
+	url := startserver(t, src, args...)
+	set := func(url string, query string) {
+		t.Helper()
+		if resp, body := testrequest(t, "POST", url+"admin/channels?channel=stable&"+query, "admin", nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: %s %s", query, resp.Status, body)
+		}
+	}
+
+	set(url, "image=image-1.tgz")
+	set(url, "image=image-2.tgz")
+
+	// the signed message of README.md
+	req, _ := http.NewRequest("GET", url+"channel/stable/latest", nil)
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry struct {
+		Epoch          uint64
+		ManifestSHA256 string `json:"manifest_sha256"`
+		Signature      string
+	}
+	json.NewDecoder(resp.Body).Decode(&entry)
+	resp.Body.Close()
+	signature, _ := base64.StdEncoding.DecodeString(entry.Signature)
+	message := fmt.Sprintf("ota-channel 1\nchannel \"stable\"\nimage \"image-2.tgz\"\nversion \"\"\nepoch %d\n", entry.Epoch)
+	if entry.ManifestSHA256 != "" {
+		message += fmt.Sprintf("manifest-sha256 %q\n", entry.ManifestSHA256)
+	}
+	pem1, _ := os.ReadFile(filepath.Join(keys, "k1.pub"))
+	block, _ := pem.Decode(pem1)
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Epoch != 2 || !ed25519.Verify(pub.(ed25519.PublicKey), []byte(message), signature) {
+		t.Errorf("got epoch %d, signature %q", entry.Epoch, entry.Signature)
+	}
+
+	ref, statedir := t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+	update := func(url string, pubkey string) error {
+		dst := t.TempDir()
+		out, err := runclient(t, "-statedir", statedir, "-src", url+"channel/stable/latest", "-dst", dst+"/x.tgz", "-ref", ref, "-channel-pubkey", filepath.Join(keys, pubkey))
+		if err != nil {
+			return fmt.Errorf("%s%s", out, err)
+		}
+		checktgz(t, filepath.Join(dst, "x.tgz"), testimage)
+		return nil
+	}
+	if err := update(url, "k1.pub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := update(url, "k1.pub"); err != nil {
+		t.Fatalf("same epoch: %s", err)
+	}
+	if err := update(url, "k2.pub"); err == nil || !strings.Contains(err.Error(), "signature verification failed") {
+		t.Errorf("other key: got %v", err)
+	}
+	unsigned := startserver(t, src, "-channels-file", channelsfile)
+	if err := update(unsigned, "k1.pub"); err == nil || !strings.Contains(err.Error(), "signature verification failed") {
+		t.Errorf("unsigned: got %v", err)
+	}
+
+	// metadata older than seen before, e.g. replayed by a mirror
+	fname := filepath.Join(statedir, "channels.json")
+	epochs := map[string]uint64{}
+	if data, err := os.ReadFile(fname); err != nil || json.Unmarshal(data, &epochs) != nil || epochs[url+"channel/stable/latest"] != 2 {
+		t.Fatalf("got epochs %v", epochs)
+	}
+	epochs[url+"channel/stable/latest"] = 3
+	data, _ := json.Marshal(epochs)
+	os.WriteFile(fname, data, 0644)
+	if err := update(url, "k1.pub"); err == nil || !strings.Contains(err.Error(), "older than the last seen epoch 3") {
+		t.Errorf("older epoch: got %v", err)
+	}
+
+	// removing and setting the channel again does not reset the epoch
+	if resp, _ := testrequest(t, "DELETE", url+"admin/channels?channel=stable", "admin", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: got %s", resp.Status)
+	}
+	set(url, "image=image-2.tgz")
+	if err := update(url, "k1.pub"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeviceGroups(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testref)
+	writetgz(t, filepath.Join(src, "image-2-factory.tgz"), testimage)
+	dir := t.TempDir()
+	groupsfile := filepath.Join(dir, "groups")
+	os.WriteFile(groupsfile, []byte("# test devices\ngroup factory id:dev-00* id:lab\ntarget *-factory.tgz factory\n"), 0644)
+	url := startserver(t, src, "-groups-file", groupsfile, "-api-key-file", filepath.Join(dir, "keys"), "-channels-file", filepath.Join(dir, "channels.json"), "-admin-token", "admin")
+
+	keys := map[string]string{}
+	for _, device := range []string{"dev-0001", "dev-1001"} {
+		resp, body := testrequest(t, "POST", url+"admin/keys?device="+device, "admin", nil)
+		var k struct{ Key string }
+		if err := json.Unmarshal(body, &k); err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("%s %s", resp.Status, body)
+		}
+		keys[device] = k.Key
+	}
+	member, other := keys["dev-0001"], keys["dev-1001"]
+
+	tests := []struct {
+		name   string
+		url    string
+		token  string
+		status int
+	}{
+		{"member", "image-2-factory.tgz", member, http.StatusOK},
+		{"other device", "image-2-factory.tgz", other, http.StatusNotFound},
+		{"image without rule", "image-1.tgz", other, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if resp, _ := testrequest(t, "GET", url+tt.url, tt.token, nil); resp.StatusCode != tt.status {
+			t.Errorf("%s: got %s, want %d", tt.name, resp.Status, tt.status)
+		}
+	}
+	for token, want := range map[string]int{member: 2, other: 1} {
+		_, body := testrequest(t, "GET", url+"images", token, nil)
+		var catalog []json.RawMessage
+		if err := json.Unmarshal(body, &catalog); err != nil || len(catalog) != want {
+			t.Errorf("catalog: got %s, want %d images", body, want)
+		}
+	}
+
+	ref := t.TempDir()
+	writeref(t, ref, testref)
+	dst := t.TempDir()
+	if out, err := runclient(t, "-src", url+"image-2-factory.tgz", "-dst", dst+"/", "-ref", ref, "-token", member); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-2-factory.tgz"), testimage)
+	if out, err := runclient(t, "-src", url+"image-2-factory.tgz", "-dst", dst+"/other.tgz", "-ref", ref, "-token", other); err == nil {
+		t.Errorf("other device updated: %s", out)
+	}
+
+	// channels offered to groups
+	for query, status := range map[string]int{
+		"image=image-1.tgz&groups=none":    http.StatusBadRequest,
+		"image=image-1.tgz&groups=factory": http.StatusOK,
+	} {
+		if resp, body := testrequest(t, "POST", url+"admin/channels?channel=lab&"+query, "admin", nil); resp.StatusCode != status {
+			t.Errorf("%s: got %s %s, want %d", query, resp.Status, body, status)
+		}
+	}
+	for token, status := range map[string]int{member: http.StatusOK, other: http.StatusNotFound} {
+		req, _ := http.NewRequest("GET", url+"channel/lab/latest", nil)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("channel: got %s, want %d", resp.Status, status)
+		}
+	}
+
+	// the groups file is reloaded on change
+	os.WriteFile(groupsfile, []byte("group factory id:dev-*\ntarget *-factory.tgz factory\n"), 0644)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(groupsfile, future, future)
+	if resp, _ := testrequest(t, "GET", url+"image-2-factory.tgz", other, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("after reload: got %s", resp.Status)
+	}
+}
+
+func TestRequestHeaders(t *testing.T) {
+
+	url, ref, dst := testsetup(t, testimage, testref)
+	server := strings.TrimSuffix(url, "image-1.tgz")
+	var mu sync.Mutex
+	var seen []http.Header
+	proxy := testproxy(t, server, func(w http.ResponseWriter, r *http.Request) bool {
+		mu.Lock()
+		seen = append(seen, r.Header.Clone())
+		mu.Unlock()
+		return false
+	})
+	headerfile := filepath.Join(t.TempDir(), "headers")
+	os.WriteFile(headerfile, []byte("# gateway\nX-Gateway-Key: secret\n\nX-Fleet: a\n"), 0600)
+
+	tests := []struct {
+		name   string
+		args   []string
+		ua     string
+		header map[string][]string
+		ok     bool
+	}{
+		{"default", nil, "ota-client/", nil, true},
+		{"headers", []string{"-header", "X-Fleet: b", "-header", "X-Site:  lab ", "-header-file", headerfile, "-user-agent", "updater/1"}, "updater/1",
+			map[string][]string{"X-Gateway-Key": {"secret"}, "X-Fleet": {"b", "a"}, "X-Site": {"lab"}}, true},
+		{"invalid header", []string{"-header", "X Fleet: b"}, "", nil, false},
+		{"missing colon", []string{"-header", "X-Fleet"}, "", nil, false},
+	}
+	for _, tt := range tests {
+		seen = nil
+		out, err := runclient(t, append([]string{"-src", proxy + "image-1.tgz", "-dst", dst + "/", "-ref", ref}, tt.args...)...)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v\n%s", tt.name, err, out)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+		if len(seen) == 0 {
+			t.Fatalf("%s: no requests", tt.name)
+		}
+		for _, h := range seen {
+			if !strings.HasPrefix(h.Get("User-Agent"), tt.ua) {
+				t.Errorf("%s: got User-Agent %q", tt.name, h.Get("User-Agent"))
+			}
+			for name, want := range tt.header {
+				if got := h.Values(name); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: got %s %q, want %q", tt.name, name, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	var out bytes.Buffer
+	cmd := exec.Command(serverbin, "-src", src, "-bind", addr, "-drain-timeout", "10s")
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	for i := 0; i < 100; i++ {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// a diff request still sending its bitmap when the server is stopped
+	bitmap, _ := io.ReadAll(testbitmap(t, []byte{0x60}))
+	pr, pw := io.Pipe()
+	type result struct {
+		status int
+		body   []byte
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.Post("http://"+addr+"/image-1.tgz", "application/octet-stream", pr)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		done <- result{resp.StatusCode, body, err}
+	}()
+	pw.Write(bitmap[:5])
+	time.Sleep(200 * time.Millisecond)
+	cmd.Process.Signal(syscall.SIGTERM)
+	time.Sleep(200 * time.Millisecond)
+
+	if _, err := http.Get("http://" + addr + "/image-1.tgz"); err == nil {
+		t.Error("new request accepted while draining")
+	}
+	pw.Write(bitmap[5:])
+	pw.Close()
+	r := <-done
+	if r.err != nil || r.status != http.StatusOK {
+		t.Errorf("running request: got %d %v", r.status, r.err)
+	}
+	if len(readtgz(t, bytes.NewReader(r.body))) == 0 {
+		t.Error("running request: empty diff")
+	}
+	if err := cmd.Wait(); err != nil || !strings.Contains(out.String(), `msg="draining connections" signal=terminated`) || !strings.HasSuffix(out.String(), "msg=done\n") {
+		t.Errorf("got %v\n%s", err, out.String())
+	}
+}
+
+func TestPromote(t *testing.T) {
+
+	keys := t.TempDir()
+	servercmd(t, keys, "genkey", "k1")
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	writetgz(t, filepath.Join(src, "image-2.tgz"), testref)
+	data, _ := os.ReadFile(filepath.Join(src, "image-1.tgz"))
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	url := startserver(t, src, "-environments", "dev,staging,production", "-channels-file", filepath.Join(t.TempDir(), "channels.json"),
+		"-admin-token", "admin", "-channel-key", filepath.Join(keys, "k1.key"))
+
+	tests := []struct {
+		name   string
+		path   string
+		query  string
+		status int
+	}{
+		{"without environment", "promote", "channel=stable&image=image-1.tgz&sha256=" + digest + "&approved-by=alice", http.StatusBadRequest},
+		{"without approval", "promote", "channel=dev.stable&image=image-1.tgz&sha256=" + digest, http.StatusBadRequest},
+		{"wrong digest", "promote", "channel=dev.stable&image=image-1.tgz&sha256=" + strings.Repeat("0", 64) + "&approved-by=alice", http.StatusConflict},
+		{"skipping dev", "promote", "channel=staging.stable&sha256=" + digest + "&approved-by=bob", http.StatusNotFound},
+		{"dev", "promote", "channel=dev.stable&image=image-1.tgz&sha256=" + digest + "&approved-by=alice", http.StatusOK},
+		{"other digest to staging", "promote", "channel=staging.stable&sha256=" + strings.Repeat("0", 64) + "&approved-by=bob", http.StatusConflict},
+		{"staging", "promote", "channel=staging.stable&sha256=" + digest + "&approved-by=bob", http.StatusOK},
+		{"production by name", "channels", "channel=production.stable&image=image-2.tgz", http.StatusConflict},
+		{"production", "promote", "channel=production.stable&sha256=" + digest + "&approved-by=carol", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if resp, body := testrequest(t, "POST", url+"admin/"+tt.path+"?"+tt.query, "admin", nil); resp.StatusCode != tt.status {
+			t.Errorf("%s: got %s %s, want %d", tt.name, resp.Status, body, tt.status)
+		}
+	}
+
+	resp, body := testrequest(t, "GET", url+"admin/channels", "admin", nil)
+	var list []struct {
+		Channel   string
+		Image     string
+		Approvals []struct{ Environment, By string }
+	}
+	if err := json.Unmarshal(body, &list); err != nil || len(list) != 3 {
+		t.Fatalf("%s %s", resp.Status, body)
+	}
+	for _, c := range list {
+		if c.Channel == "production.stable" && (c.Image != "image-1.tgz" || len(c.Approvals) != 3 || c.Approvals[2].By != "carol") {
+			t.Errorf("got %+v", c)
+		}
+	}
+
+	ref := t.TempDir()
+	writeref(t, ref, testref)
+	update := func() error {
+		dst := t.TempDir()
+		out, err := runclient(t, "-src", url+"channel/production.stable/latest", "-dst", dst+"/x.tgz", "-ref", ref, "-channel-pubkey", filepath.Join(keys, "k1.pub"))
+		if err != nil {
+			return fmt.Errorf("%s%s", out, err)
+		}
+		checktgz(t, filepath.Join(dst, "x.tgz"), testimage)
+		return nil
+	}
+	if err := update(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the image replaced after its promotion
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testref)
+	if err := update(); err == nil || !strings.Contains(err.Error(), "does not match the image promoted") {
+		t.Errorf("replaced image: got %v", err)
+	}
+}
+
+func TestBudget(t *testing.T) {
+
+	image := append([]testentry{}, testimage...)
+	for i := 0; i < 4; i++ {
+		data := make([]byte, 20000)
+		rand.Read(data)
+		image = append(image, testentry{fmt.Sprintf("large-%d", i), tar.TypeReg, string(data)})
+	}
+	url, ref, dst := testsetup(t, image, testref)
+	statedir := t.TempDir()
+
+	if out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-budget-bytes", "30000", "-statedir", ""); err == nil || !strings.Contains(out, "need a -statedir") {
+		t.Errorf("without statedir: got %v\n%s", err, out)
+	}
+
+	// every run stages at least one more file until the image is complete
+	staged := 0
+	var stagedbytes int64
+	for run := 1; ; run++ {
+		out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-budget-bytes", "30000", "-statedir", statedir)
+		if err == nil {
+			if run < 3 {
+				t.Errorf("finished in %d runs", run)
+			}
+			// staged files are no savings of the reference
+			if want := fmt.Sprintf("reused_bytes=18 staged_bytes=%d", stagedbytes); !strings.Contains(out, want) || !strings.Contains(out, " staged by earlier runs)") {
+				t.Errorf("missing %s in\n%s", want, out)
+			}
+			break
+		}
+		if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() != 4 || run > 5 {
+			t.Fatalf("run %d: %s%s", run, out, err)
+		}
+		files, _ := os.ReadDir(filepath.Join(statedir, "staging"))
+		if len(files) <= staged {
+			t.Fatalf("run %d: %d files staged, %d before", run, len(files), staged)
+		}
+		for _, f := range files {
+			if strings.HasPrefix(f.Name(), ".part-") {
+				t.Errorf("run %d: partial file %s left", run, f.Name())
+			}
+		}
+		staged = len(files)
+		stagedbytes = 0
+		for _, f := range files {
+			if fi, err := f.Info(); err == nil {
+				stagedbytes += fi.Size()
+			}
+		}
+		if _, err := os.Stat(filepath.Join(dst, "image-1.tgz")); err == nil {
+			t.Fatalf("run %d: incomplete image written", run)
+		}
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), image)
+	if _, err := os.Stat(filepath.Join(statedir, "staging")); !os.IsNotExist(err) {
+		t.Errorf("staging left after the update: %v", err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	dir := t.TempDir()
+	config := filepath.Join(dir, "server.yaml")
+	os.WriteFile(config, []byte(`# server settings
+token: "secret1"
+admin:
+  token: admin # nested keys are joined with -
+channels:
+  file: `+filepath.Join(dir, "channels.json")+`
+`), 0600)
+
+	url := startserver(t, src, "-config", config)
+	tests := []struct {
+		url    string
+		token  string
+		status int
+	}{
+		{"image-1.tgz", "", http.StatusUnauthorized},
+		{"image-1.tgz", "secret1", http.StatusOK},
+		{"admin/channels", "admin", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if resp, _ := testrequest(t, "GET", url+tt.url, tt.token, nil); resp.StatusCode != tt.status {
+			t.Errorf("%s with %q: got %s, want %d", tt.url, tt.token, resp.Status, tt.status)
+		}
+	}
+
+	// flags on the command line take precedence
+	url = startserver(t, src, "-config", config, "-token", "secret2")
+	if resp, _ := testrequest(t, "GET", url+"image-1.tgz", "secret1", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("token of the config: got %s", resp.Status)
+	}
+	ref, dst := t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+	if out, err := runclient(t, "-src", url+"image-1.tgz", "-dst", dst+"/", "-ref", ref, "-token", "secret2"); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+
+	os.WriteFile(config, []byte("token: secret1\nunknown: 1\n"), 0600)
+	cmd := exec.Command(serverbin, "-src", src, "-config", config)
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "server.yaml:2: unknown setting unknown") {
+		t.Errorf("unknown setting: got %v\n%s", err, out)
+	}
+}
+
+func TestSystemd(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+
+	// the socket systemd passes as fd 3, for the pid exec keeps
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lf, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+
+	notifyaddr := filepath.Join(t.TempDir(), "notify")
+	notify, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: notifyaddr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notify.Close()
+
+	var out bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", `LISTEN_PID=$$ LISTEN_FDS=1 exec "$0" "$@"`, serverbin, "-src", src, "-bind", "127.0.0.1:1")
+	cmd.Env = append(os.Environ(), "NOTIFY_SOCKET="+notifyaddr, "WATCHDOG_USEC=200000")
+	cmd.ExtraFiles = []*os.File{lf}
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	messages := make(chan string, 100)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := notify.Read(buf)
+			if err != nil {
+				close(messages)
+				return
+			}
+			messages <- string(buf[:n])
+		}
+	}()
+	next := func() string {
+		t.Helper()
+		select {
+		case m := <-messages:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no notification\n%s", out.String())
+			return ""
+		}
+	}
+
+	if m := next(); m != "READY=1" {
+		t.Fatalf("got %q", m)
+	}
+	// served on the passed socket, not on -bind
+	url := "http://" + l.Addr().String() + "/"
+	ref, dst := t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+	if out, err := runclient(t, "-src", url+"image-1.tgz", "-dst", dst+"/", "-ref", ref); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+
+	for i := 0; i < 2; i++ {
+		if m := next(); m != "WATCHDOG=1" {
+			t.Fatalf("got %q", m)
+		}
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+	for m := next(); m != "STOPPING=1"; m = next() {
+		if m != "WATCHDOG=1" {
+			t.Fatalf("got %q", m)
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("%s\n%s", err, out.String())
+	}
+}
+
+func TestETag(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	url := startserver(t, src) + "image-1.tgz"
+	request := func(method, query string, ifnonematch string) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(method, url+query, nil)
+		if ifnonematch != "" {
+			req.Header.Set("If-None-Match", ifnonematch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+	get := func(query string, ifnonematch string) (*http.Response, []byte) {
+		t.Helper()
+		return request("GET", query, ifnonematch)
+	}
+
+	resp, index := get("", "")
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("got %s, ETag %q", resp.Status, etag)
+	}
+	if resp, body := get("", `"other", `+etag); resp.StatusCode != http.StatusNotModified || len(body) != 0 || resp.Header.Get("ETag") != etag {
+		t.Errorf("matching: got %s, %d bytes, ETag %q", resp.Status, len(body), resp.Header.Get("ETag"))
+	}
+	if resp, body := get("", `"other"`); resp.StatusCode != http.StatusOK || !bytes.Equal(body, index) {
+		t.Errorf("other tag: got %s", resp.Status)
+	}
+	if resp, _ := get("?hash=sha256", etag); resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag {
+		t.Errorf("other hash: got %s, ETag %q", resp.Status, resp.Header.Get("ETag"))
+	}
+
+	if resp, _ := get("", "*"); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("any tag: got %s", resp.Status)
+	}
+
+	// HEAD answers the ETag without the index
+	if resp, body := request("HEAD", "", ""); resp.StatusCode != http.StatusOK || len(body) != 0 || resp.Header.Get("ETag") != etag {
+		t.Errorf("HEAD: got %s, %d bytes, ETag %q", resp.Status, len(body), resp.Header.Get("ETag"))
+	}
+	if resp, _ := request("HEAD", "", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("HEAD matching: got %s", resp.Status)
+	}
+
+	// the replaced image
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testref)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(src, "image-1.tgz"), future, future)
+	if resp, _ := get("", etag); resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag {
+		t.Errorf("replaced image: got %s, ETag %q", resp.Status, resp.Header.Get("ETag"))
+	}
+}
+
+func TestCacheHeaders(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	data, _ := os.ReadFile(filepath.Join(src, "image-1.tgz"))
+	sum := sha256.Sum256(data)
+	byhash := "by-hash/" + hex.EncodeToString(sum[:]) + ".tgz"
+
+	tests := []struct {
+		name   string
+		args   []string
+		url    string
+		auth   string
+		status int
+		cache  string
+		token  bool
+	}{
+		{"default", nil, "image-1.tgz", "", http.StatusOK, "private, no-cache", true},
+		{"max age", []string{"-index-max-age", "1m"}, "image-1.tgz", "", http.StatusOK, "private, max-age=60", true},
+		{"public", []string{"-cache-public"}, "image-1.tgz", "", http.StatusOK, "public, no-cache", false},
+		{"public authenticated", []string{"-cache-public"}, "image-1.tgz", "Bearer x", http.StatusOK, "private, no-cache", true},
+		{"by hash", nil, byhash, "", http.StatusOK, "private, max-age=31536000, immutable", true},
+		{"by hash public", []string{"-cache-public"}, byhash, "", http.StatusOK, "public, max-age=31536000, immutable", false},
+		{"unknown hash", nil, "by-hash/" + strings.Repeat("0", 64) + ".tgz", "", http.StatusNotFound, "", false},
+	}
+	for _, tt := range tests {
+		url := startserver(t, src, tt.args...)
+		req, _ := http.NewRequest("GET", url+tt.url, nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status || resp.Header.Get("Cache-Control") != tt.cache || (resp.Header.Get("OTA-Index-Token") != "") != tt.token {
+			t.Errorf("%s: got %s, Cache-Control %q, index token %q", tt.name, resp.Status, resp.Header.Get("Cache-Control"), resp.Header.Get("OTA-Index-Token"))
+		}
+		if tt.cache != "" && resp.Header.Get("Expires") == "" {
+			t.Errorf("%s: no Expires", tt.name)
+		}
+	}
+
+	// updates and full images by hash
+	url := startserver(t, src)
+	ref, dst := t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+	if out, err := runclient(t, "-src", url+byhash, "-dst", dst+"/image-1.tgz", "-ref", ref); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+	if resp, body := testrequest(t, "GET", url+byhash+"?full", "", nil); resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Errorf("full image: got %s, %d bytes", resp.Status, len(body))
+	}
+	// full is added to signed by-hash urls
+	secret := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(secret, []byte("url secret\n"), 0600)
+	signed := minturl(t, secret, startserver(t, src, "-url-secret-file", secret, "-token", "secret1")+byhash, "1h")
+	if resp, body := testrequest(t, "GET", signed+"&full", "", nil); resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Errorf("signed full image: got %s, %d bytes", resp.Status, len(body))
+	}
+
+	// the digest of the replaced image is gone
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testref)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(src, "image-1.tgz"), future, future)
+	if resp, _ := testrequest(t, "GET", url+byhash, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("replaced image: got %s", resp.Status)
+	}
+}
+
+func TestBuildLimit(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	url := startserver(t, src, "-max-builds", "1", "-build-queue", "1", "-build-wait", "300ms") + "image-1.tgz"
+
+	// a diff request holds the only build slot while it sends its bitmap
+	bitmap, _ := io.ReadAll(testbitmap(t, []byte{0x60}))
+	pr, pw := io.Pipe()
+	done := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(url, "application/octet-stream", pr)
+		if err != nil {
+			done <- 0
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	pw.Write(bitmap[:5])
+	time.Sleep(200 * time.Millisecond)
+
+	// one request waits in the queue and gives up, the next finds the
+	// queue full
+	waited := make(chan *http.Response, 1)
+	go func() {
+		resp, _ := testrequest(t, "GET", url, "", nil)
+		waited <- resp
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	if resp, _ := testrequest(t, "GET", url, "", nil); resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "1" || time.Since(start) > 150*time.Millisecond {
+		t.Errorf("full queue: got %s, Retry-After %q after %s", resp.Status, resp.Header.Get("Retry-After"), time.Since(start))
+	}
+	if resp := <-waited; resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("queued: got %s", resp.Status)
+	}
+
+	pw.Write(bitmap[5:])
+	pw.Close()
+	if status := <-done; status != http.StatusOK {
+		t.Errorf("diff: got %d", status)
+	}
+	ref, dst := t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+	if out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+}
+
+func TestAdminImages(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	writetgz(t, filepath.Join(src, "image-2.tgz"), testref)
+	for _, ext := range []string{".version", ".sig"} {
+		os.WriteFile(filepath.Join(src, "image-1.tgz"+ext), []byte("1\n"), 0644)
+	}
+	url := startserver(t, src, "-admin-token", "admin", "-token", "device", "-channels-file", filepath.Join(t.TempDir(), "channels.json"))
+	ref, dst := t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+	if out, err := runclient(t, "-src", url+"image-1.tgz", "-dst", dst+"/", "-ref", ref, "-token", "device"); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	if resp, body := testrequest(t, "POST", url+"admin/channels?channel=stable&image=image-2.tgz", "admin", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s %s", resp.Status, body)
+	}
+
+	type adminimage struct {
+		Name     string
+		Version  string
+		Retired  bool
+		Indexed  bool
+		Channels []string
+		Usage    *struct{ Requests int64 }
+	}
+	list := func() map[string]adminimage {
+		t.Helper()
+		resp, body := testrequest(t, "GET", url+"admin/images", "admin", nil)
+		var images []adminimage
+		if err := json.Unmarshal(body, &images); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s", resp.Status, body)
+		}
+		m := map[string]adminimage{}
+		for _, image := range images {
+			m[image.Name] = image
+		}
+		return m
+	}
+	images := list()
+	if i := images["image-1.tgz"]; len(images) != 2 || !i.Indexed || i.Version != "1" || i.Usage == nil || i.Usage.Requests == 0 {
+		t.Errorf("image-1.tgz: got %+v", i)
+	}
+	if i := images["image-2.tgz"]; !reflect.DeepEqual(i.Channels, []string{"stable"}) {
+		t.Errorf("image-2.tgz: got %+v", i)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		status int
+	}{
+		{"retire", "POST", "image=image-1.tgz&action=retire", http.StatusOK},
+		{"retire again", "POST", "image=image-1.tgz&action=retire", http.StatusNotFound},
+		{"used by channel", "POST", "image=image-2.tgz&action=retire", http.StatusConflict},
+		{"delete used by channel", "DELETE", "image=image-2.tgz", http.StatusConflict},
+		{"unknown", "POST", "image=image-3.tgz&action=retire", http.StatusNotFound},
+		{"invalid image", "POST", "image=../image-2.tgz&action=retire", http.StatusBadRequest},
+		{"invalid action", "POST", "image=image-1.tgz&action=publish", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if resp, body := testrequest(t, tt.method, url+"admin/images?"+tt.query, "admin", nil); resp.StatusCode != tt.status {
+			t.Errorf("%s: got %s %s, want %d", tt.name, resp.Status, body, tt.status)
+		}
+	}
+	for _, name := range []string{"image-1.tgz", "image-1.tgz.version", "image-1.tgz.sig"} {
+		if _, err := os.Stat(filepath.Join(src, "retired", name)); err != nil {
+			t.Errorf("not retired: %s", err)
+		}
+	}
+	if resp, _ := testrequest(t, "GET", url+"image-1.tgz", "device", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("retired image: got %s", resp.Status)
+	}
+	if i := list()["image-1.tgz"]; !i.Retired {
+		t.Errorf("retired: got %+v", i)
+	}
+
+	// published again under the name of the retired image
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testref)
+	for _, action := range []string{"retire", "restore"} {
+		if resp, _ := testrequest(t, "POST", url+"admin/images?image=image-1.tgz&action="+action, "admin", nil); resp.StatusCode != http.StatusConflict {
+			t.Errorf("%s with both: got %s", action, resp.Status)
+		}
+	}
+	os.Remove(filepath.Join(src, "image-1.tgz"))
+
+	if resp, body := testrequest(t, "POST", url+"admin/images?image=image-1.tgz&action=restore", "admin", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("restore: %s %s", resp.Status, body)
+	}
+	if out, err := runclient(t, "-src", url+"image-1.tgz", "-dst", dst+"/", "-ref", ref, "-token", "device"); err != nil {
+		t.Fatalf("restored: %s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+
+	if resp, _ := testrequest(t, "DELETE", url+"admin/images?image=image-1.tgz", "admin", nil); resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		t.Errorf("delete: got %s", resp.Status)
+	}
+	files, _ := filepath.Glob(filepath.Join(src, "image-1.tgz*"))
+	retired, _ := filepath.Glob(filepath.Join(src, "retired", "image-1.tgz*"))
+	if len(files)+len(retired) != 0 {
+		t.Errorf("deleted image left %v %v", files, retired)
+	}
+
+	// the config, without secrets
+	resp, body := testrequest(t, "GET", url+"admin/config", "admin", nil)
+	var settings []struct {
+		Name  string
+		Value string
+		Set   bool
+	}
+	if err := json.Unmarshal(body, &settings); err != nil {
+		t.Fatalf("%s %s", resp.Status, body)
+	}
+	for _, s := range settings {
+		if (s.Name == "token" || s.Name == "admin-token") && (s.Value != "<redacted>" || !s.Set) {
+			t.Errorf("got %+v", s)
+		}
+	}
+	if strings.Contains(string(body), `"device"`) || strings.Contains(string(body), `"admin"`) {
+		t.Errorf("token in config: %s", body)
+	}
+}
+
+// tests3 serves the objects as bucket of an S3 compatible api, checking
+// the signature of every request, and lists one object per page
+func tests3(t *testing.T, bucket string, objects map[string][]byte, accesskey, secretkey string) string {
+
+	modtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// AWS signature version 4
+		auth := r.Header.Get("Authorization")
+		var credential, signed, signature string
+		fmt.Sscanf(strings.ReplaceAll(auth, ",", ""), "AWS4-HMAC-SHA256 Credential=%s SignedHeaders=%s Signature=%s", &credential, &signed, &signature)
+		scope := strings.SplitN(credential, "/", 2)
+		var params []string
+		for name, values := range r.URL.Query() {
+			for _, value := range values {
+				params = append(params, neturl.QueryEscape(name)+"="+strings.ReplaceAll(neturl.QueryEscape(value), "+", "%20"))
+			}
+		}
+		sort.Strings(params)
+		var headers string
+		for _, name := range strings.Split(signed, ";") {
+			value := r.Header.Get(name)
+			if name == "host" {
+				value = r.Host
+			}
+			headers += name + ":" + value + "\n"
+		}
+		canonical := strings.Join([]string{r.Method, r.URL.EscapedPath(), strings.Join(params, "&"), headers, signed, r.Header.Get("x-amz-content-sha256")}, "\n")
+		canonicalhash := sha256.Sum256([]byte(canonical))
+		mac := func(key []byte, data string) []byte {
+			h := hmac.New(sha256.New, key)
+			h.Write([]byte(data))
+			return h.Sum(nil)
+		}
+		key := []byte("AWS4" + secretkey)
+		for _, part := range strings.Split(scope[len(scope)-1], "/") {
+			key = mac(key, part)
+		}
+		want := hex.EncodeToString(mac(key, "AWS4-HMAC-SHA256\n"+r.Header.Get("x-amz-date")+"\n"+scope[len(scope)-1]+"\n"+hex.EncodeToString(canonicalhash[:])))
+		if scope[0] != accesskey || signature != want {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		name := strings.TrimPrefix(r.URL.Path, "/"+bucket+"/")
+		if name == "" && r.URL.Query().Get("list-type") == "2" {
+			var keys []string
+			for key := range objects {
+				if strings.HasPrefix(key, r.URL.Query().Get("prefix")) && !strings.Contains(strings.TrimPrefix(key, r.URL.Query().Get("prefix")), "/") {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			start := 0
+			if token := r.URL.Query().Get("continuation-token"); token != "" {
+				start, _ = strconv.Atoi(token)
+			}
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult>`)
+			if start < len(keys) {
+				fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>", keys[start], len(objects[keys[start]]), modtime.Format(time.RFC3339))
+			}
+			if start+1 < len(keys) {
+				fmt.Fprintf(w, "<IsTruncated>true</IsTruncated><NextContinuationToken>%d</NextContinuationToken>", start+1)
+			}
+			fmt.Fprintf(w, "</ListBucketResult>")
+			return
+		}
+		data, found := objects[name]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", modtime.Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+func TestS3Store(t *testing.T) {
+
+	tmp := t.TempDir()
+	writetgz(t, filepath.Join(tmp, "image-1.tgz"), testimage)
+	writetgz(t, filepath.Join(tmp, "image-2.tgz"), testref)
+	image1, _ := os.ReadFile(filepath.Join(tmp, "image-1.tgz"))
+	image2, _ := os.ReadFile(filepath.Join(tmp, "image-2.tgz"))
+	objects := map[string][]byte{
+		"releases/image-1.tgz":         image1,
+		"releases/image-1.tgz.version": []byte("7\n"),
+		"releases/image 2.tgz":         image2,
+		"releases/old/image-3.tgz":     image2,
+		"other/image-4.tgz":            image2,
+	}
+	endpoint := tests3(t, "firmware", objects, "AKID", "secret")
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	url := startserver(t, t.TempDir(), "-store", "s3://firmware/releases/", "-store-endpoint", endpoint, "-s3-region", "eu-west-1")
+
+	resp, body := testrequest(t, "GET", url+"images", "", nil)
+	var catalog []struct{ Name, Version string }
+	if err := json.Unmarshal(body, &catalog); err != nil || len(catalog) != 2 || catalog[0].Name != "image 2.tgz" || catalog[1].Version != "7" {
+		t.Errorf("catalog: %s %s", resp.Status, body)
+	}
+	ref, dst := t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+	if out, err := runclient(t, "-src", url+"image-1.tgz", "-dst", dst+"/", "-ref", ref); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+	if out, err := runclient(t, "-statedir", t.TempDir(), "-src", url+"image%202.tgz", "-dst", dst+"/image-2.tgz", "-ref", ref); exitcode(err) != noupdate {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-2.tgz"), testref)
+	if resp, _ := testrequest(t, "GET", url+"image-4.tgz", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("object outside the prefix: got %s", resp.Status)
+	}
+
+	// requests with wrong credentials fail
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "wrong")
+	url = startserver(t, t.TempDir(), "-store", "s3://firmware/releases/", "-store-endpoint", endpoint)
+	if resp, _ := testrequest(t, "GET", url+"image-1.tgz", "", nil); resp.StatusCode == http.StatusOK {
+		t.Errorf("wrong secret: got %s", resp.Status)
+	}
+}
+
+// testobjects are the objects of a fake bucket
+type testobjects struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (o *testobjects) get(name string) ([]byte, bool) {
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	data, found := o.objects[name]
+	return data, found
+}
+
+func (o *testobjects) put(name string, data []byte) {
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.objects[name] = data
+}
+
+// list returns the names directly below prefix
+func (o *testobjects) list(prefix string) []string {
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var names []string
+	for name := range o.objects {
+		if strings.HasPrefix(name, prefix) && !strings.Contains(strings.TrimPrefix(name, prefix), "/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+var testmodtime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// testgcs serves the objects as bucket of the Google Cloud Storage JSON
+// api, requiring the bearer token if not "", one object per listed page
+func testgcs(t *testing.T, bucket string, objects *testobjects, token string) string {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		query := r.URL.Query()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/upload/storage/v1/b/"+bucket+"/o":
+			data, _ := io.ReadAll(r.Body)
+			objects.put(query.Get("name"), data)
+			fmt.Fprintf(w, `{"name":%q}`, query.Get("name"))
+		case r.URL.Path == "/storage/v1/b/"+bucket+"/o":
+			names := objects.list(query.Get("prefix"))
+			start, _ := strconv.Atoi(query.Get("pageToken"))
+			page := map[string]interface{}{"items": []interface{}{}}
+			if start < len(names) {
+				data, _ := objects.get(names[start])
+				page["items"] = []interface{}{map[string]string{"name": names[start], "size": strconv.Itoa(len(data)), "updated": testmodtime.Format(time.RFC3339Nano)}}
+			}
+			if start+1 < len(names) {
+				page["nextPageToken"] = strconv.Itoa(start + 1)
+			}
+			json.NewEncoder(w).Encode(page)
+		case strings.HasPrefix(r.URL.Path, "/storage/v1/b/"+bucket+"/o/"):
+			name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/"+bucket+"/o/")
+			data, found := objects.get(name)
+			if !found {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if query.Get("alt") == "media" {
+				w.Header().Set("Last-Modified", testmodtime.Format(http.TimeFormat))
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+				w.Write(data)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"name": name, "size": strconv.Itoa(len(data)), "updated": testmodtime.Format(time.RFC3339Nano)})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+// testazure serves the objects as container of the Azure Blob Storage api,
+// checking the Shared Key signature with key, or the SAS token sas
+func testazure(t *testing.T, account, container string, objects *testobjects, key []byte, sas string) string {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		query := r.URL.Query()
+		if sas != "" {
+			if query.Get("sig") != sas {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			query.Del("sig")
+		} else {
+			var headers []string
+			for name := range r.Header {
+				if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+					headers = append(headers, lower+":"+r.Header.Get(name))
+				}
+			}
+			sort.Strings(headers)
+			resource := "/" + account + r.URL.EscapedPath()
+			var params []string
+			for name, values := range query {
+				params = append(params, strings.ToLower(name)+":"+strings.Join(values, ","))
+			}
+			sort.Strings(params)
+			for _, param := range params {
+				resource += "\n" + param
+			}
+			length := ""
+			if r.ContentLength > 0 {
+				length = strconv.FormatInt(r.ContentLength, 10)
+			}
+			fields := []string{r.Method, "", "", length, "", "", "", "", "", "", "", ""}
+			mac := hmac.New(sha256.New, key)
+			io.WriteString(mac, strings.Join(fields, "\n")+"\n"+strings.Join(headers, "\n")+"\n"+resource)
+			if r.Header.Get("Authorization") != "SharedKey "+account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
+		name := strings.TrimPrefix(r.URL.Path, "/"+container+"/")
+		switch {
+		case r.URL.Path == "/"+container && query.Get("comp") == "list":
+			names := objects.list(query.Get("prefix"))
+			start, _ := strconv.Atoi(query.Get("marker"))
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?><EnumerationResults><Blobs>`)
+			if start < len(names) {
+				data, _ := objects.get(names[start])
+				fmt.Fprintf(w, "<Blob><Name>%s</Name><Properties><Last-Modified>%s</Last-Modified><Content-Length>%d</Content-Length></Properties></Blob>", names[start], testmodtime.Format(http.TimeFormat), len(data))
+			}
+			fmt.Fprintf(w, "</Blobs>")
+			if start+1 < len(names) {
+				fmt.Fprintf(w, "<NextMarker>%d</NextMarker>", start+1)
+			}
+			fmt.Fprintf(w, "</EnumerationResults>")
+		case r.Method == http.MethodPut && r.Header.Get("x-ms-blob-type") == "BlockBlob":
+			data, _ := io.ReadAll(r.Body)
+			objects.put(name, data)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			data, found := objects.get(name)
+			if !found {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Last-Modified", testmodtime.Format(http.TimeFormat))
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			if r.Method == http.MethodGet {
+				w.Write(data)
+			}
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+func TestCloudStores(t *testing.T) {
+
+	tmp := t.TempDir()
+	writetgz(t, filepath.Join(tmp, "image-1.tgz"), testimage)
+	writetgz(t, filepath.Join(tmp, "image-2.tgz"), testref)
+	image1, _ := os.ReadFile(filepath.Join(tmp, "image-1.tgz"))
+	image2, _ := os.ReadFile(filepath.Join(tmp, "image-2.tgz"))
+	newobjects := func() *testobjects {
+		return &testobjects{objects: map[string][]byte{
+			"releases/image-1.tgz":         image1,
+			"releases/image-1.tgz.version": []byte("7\n"),
+			"releases/old/image-3.tgz":     image2,
+			"other/image-4.tgz":            image2,
+		}}
+	}
+
+	// a service account exchanging its signed assertion for a token
+	rsakey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(rsakey)
+	tokenserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[len(parts)-1])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if len(parts) != 3 || rsa.VerifyPKCS1v15(&rsakey.PublicKey, crypto.SHA256, digest[:], signature) != nil || !strings.Contains(string(claims), `"iss":"ota@example.iam.gserviceaccount.com"`) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":"gcs-token","expires_in":3600}`)
+	}))
+	defer tokenserver.Close()
+	credentials := filepath.Join(t.TempDir(), "account.json")
+	account, _ := json.Marshal(map[string]string{
+		"client_email": "ota@example.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    tokenserver.URL,
+	})
+	os.WriteFile(credentials, account, 0600)
+	azurekey := []byte("azure account key")
+
+	tests := []struct {
+		name    string
+		store   string
+		server  func(*testobjects) string
+		env     map[string]string
+		written string
+	}{
+		{"gcs emulator", "gs://firmware/releases/", func(o *testobjects) string { return testgcs(t, "firmware", o, "") },
+			map[string]string{"STORAGE_EMULATOR_HOST": "<server>"}, "releases/image-5.tgz"},
+		{"gcs service account", "gs://firmware/releases/", func(o *testobjects) string { return testgcs(t, "firmware", o, "gcs-token") },
+			map[string]string{"GOOGLE_APPLICATION_CREDENTIALS": credentials}, "releases/image-5.tgz"},
+		{"azure shared key", "az://account/firmware/releases/", func(o *testobjects) string { return testazure(t, "account", "firmware", o, azurekey, "") },
+			map[string]string{"AZURE_STORAGE_KEY": base64.StdEncoding.EncodeToString(azurekey)}, "releases/image-5.tgz"},
+		{"azure sas", "az://account/firmware/releases/", func(o *testobjects) string { return testazure(t, "account", "firmware", o, nil, "sas-signature") },
+			map[string]string{"AZURE_STORAGE_SAS_TOKEN": "?sv=2020-10-02&sig=sas-signature"}, "releases/image-5.tgz"},
+	}
+	for _, tt := range tests {
+		objects := newobjects()
+		endpoint := tt.server(objects)
+		for name, value := range tt.env {
+			t.Setenv(name, strings.ReplaceAll(value, "<server>", strings.TrimPrefix(endpoint, "http://")))
+		}
+		args := []string{"-store", tt.store, "-upload-token", "upload"}
+		if _, emulator := tt.env["STORAGE_EMULATOR_HOST"]; !emulator {
+			args = append(args, "-store-endpoint", endpoint)
+		}
+		url := startserver(t, t.TempDir(), args...)
+
+		resp, body := testrequest(t, "GET", url+"images", "", nil)
+		var catalog []struct{ Name, Version string }
+		if err := json.Unmarshal(body, &catalog); err != nil || len(catalog) != 1 || catalog[0].Name != "image-1.tgz" || catalog[0].Version != "7" {
+			t.Errorf("%s: catalog %s %s", tt.name, resp.Status, body)
+		}
+		ref, dst := t.TempDir(), t.TempDir()
+		writeref(t, ref, testref)
+		if out, err := runclient(t, "-src", url+"image-1.tgz", "-dst", dst+"/", "-ref", ref); err != nil {
+			t.Errorf("%s: %s%s", tt.name, out, err)
+		} else {
+			checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+		}
+
+		// uploads write the image and its version as objects
+		if resp, body := testrequest(t, "PUT", url+"images/image-5.tgz?version=9", "upload", bytes.NewReader(image2)); resp.StatusCode != http.StatusCreated {
+			t.Errorf("%s: upload %s %s", tt.name, resp.Status, body)
+		}
+		if data, _ := objects.get(tt.written); !bytes.Equal(data, image2) {
+			t.Errorf("%s: uploaded object %s not written", tt.name, tt.written)
+		}
+		if data, _ := objects.get(tt.written + ".version"); strings.TrimSpace(string(data)) != "9" {
+			t.Errorf("%s: got version object %q", tt.name, data)
+		}
+		for name := range tt.env {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestFileStore(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	url := startserver(t, t.TempDir(), "-store", "file://"+src, "-upload-token", "upload")
+
+	ref, dst := t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+	if out, err := runclient(t, "-src", url+"image-1.tgz", "-dst", dst+"/", "-ref", ref); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+
+	image, _ := os.ReadFile(filepath.Join(dst, "image-1.tgz"))
+	if resp, body := testrequest(t, "PUT", url+"images/image-2.tgz", "upload", bytes.NewReader(image)); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload %s %s", resp.Status, body)
+	}
+	if data, err := os.ReadFile(filepath.Join(src, "image-2.tgz")); err != nil || !bytes.Equal(data, image) {
+		t.Errorf("uploaded image not written to the store: %v", err)
+	}
+}
+
+func TestMetadataDB(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	db := filepath.Join(t.TempDir(), "metadata.json")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	// the first run scans the image, stopping it writes the database
+	var out bytes.Buffer
+	cmd := exec.Command(serverbin, "-src", src, "-bind", addr, "-metadata-db", db, "-admin-token", "admin")
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	for i := 0; i < 100; i++ {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	ref, dst := t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+	if out, err := runclient(t, "-src", "http://"+addr+"/image-1.tgz", "-dst", dst+"/", "-ref", ref); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+	cmd.Wait()
+
+	data, err := os.ReadFile(db)
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out.String())
+	}
+	var saved struct {
+		Images map[string]struct {
+			SHA256  string
+			Entries []json.RawMessage
+		}
+		Usage struct {
+			Images []struct {
+				Name     string
+				Requests int64
+			}
+		}
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if m := saved.Images["image-1.tgz"]; m.SHA256 == "" || len(m.Entries) != len(testimage) {
+		t.Errorf("manifest not saved: %s", data)
+	}
+	if len(saved.Usage.Images) != 1 || saved.Usage.Images[0].Name != "image-1.tgz" || saved.Usage.Images[0].Requests == 0 {
+		t.Errorf("usage not saved: %s", data)
+	}
+
+	// a restarted server knows the image as indexed with its usage
+	url := startserver(t, src, "-metadata-db", db, "-admin-token", "admin")
+	resp, body := testrequest(t, "GET", url+"admin/images", "admin", nil)
+	var images []struct {
+		Name    string
+		Indexed bool
+		SHA256  string
+		Usage   *struct{ Requests int64 }
+	}
+	if err := json.Unmarshal(body, &images); err != nil || len(images) != 1 {
+		t.Fatalf("%s %s", resp.Status, body)
+	}
+	if !images[0].Indexed || images[0].SHA256 != saved.Images["image-1.tgz"].SHA256 || images[0].Usage == nil || images[0].Usage.Requests != saved.Usage.Images[0].Requests {
+		t.Errorf("got %s", body)
+	}
+
+	// an image changed since is scanned again
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testref)
+	os.Chtimes(filepath.Join(src, "image-1.tgz"), time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if out, err := runclient(t, "-src", url+"image-1.tgz", "-dst", dst+"/", "-ref", ref); exitcode(err) != noupdate {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testref)
+}
+
+func TestRetention(t *testing.T) {
+
+	src := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"image-1.tgz", "image-2.tgz", "image-3.tgz", "image-4.tgz", "image-5.tgz"} {
+		writetgz(t, filepath.Join(src, name), testimage)
+		os.Chtimes(filepath.Join(src, name), old, old)
+	}
+	os.WriteFile(filepath.Join(src, "image-1.tgz.version"), []byte("1\n"), 0644)
+	os.Chtimes(filepath.Join(src, "image-5.tgz"), time.Now(), time.Now())
+	// temp files of interrupted uploads
+	os.WriteFile(filepath.Join(src, ".image-6.tgz.123"), []byte("partial"), 0644)
+	os.Chtimes(filepath.Join(src, ".image-6.tgz.123"), old, old)
+	os.WriteFile(filepath.Join(src, ".image-7.tgz.456"), []byte("uploading"), 0644)
+
+	url := startserver(t, src, "-admin-token", "admin", "-channels-file", filepath.Join(t.TempDir(), "channels.json"),
+		"-retain-per-channel", "2", "-retain-max-age", "24h")
+	for _, image := range []string{"image-1.tgz", "image-2.tgz", "image-3.tgz"} {
+		if resp, body := testrequest(t, "POST", url+"admin/channels?channel=stable&image="+image, "admin", nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s", resp.Status, body)
+		}
+	}
+
+	log := testgc(t, url)
+	if !strings.Contains(log, "image-1.tgz: removed (channel history)") || strings.Contains(log, "image-4.tgz") ||
+		!strings.Contains(log, ".image-6.tgz.123: stale temp file removed") || !strings.Contains(log, "retention: 1 expired images removed") {
+		t.Errorf("got log\n%s", log)
+	}
+
+	// the last 2 images of the channel and images never assigned to a
+	// channel are kept
+	for name, kept := range map[string]bool{"image-1.tgz": false, "image-1.tgz.version": false, "image-2.tgz": true, "image-3.tgz": true,
+		"image-4.tgz": true, "image-5.tgz": true, ".image-6.tgz.123": false, ".image-7.tgz.456": true} {
+		if _, err := os.Stat(filepath.Join(src, name)); (err == nil) != kept {
+			t.Errorf("%s: kept %v, expected %v", name, err == nil, kept)
+		}
+	}
+	if resp, _ := testrequest(t, "GET", url+"image-1.tgz", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expired image served: %s", resp.Status)
+	}
+	ref, dst := t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+	if out, err := runclient(t, "-src", url+"channel/stable/latest", "-dst", dst+"/", "-ref", ref); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-3.tgz"), testimage)
+
+	// without -retain-per-channel old images of the channel history expire,
+	// not the image it serves and image-2 it rolls out from
+	src = t.TempDir()
+	for _, name := range []string{"image-1.tgz", "image-2.tgz", "image-3.tgz", "image-4.tgz"} {
+		writetgz(t, filepath.Join(src, name), testimage)
+		os.Chtimes(filepath.Join(src, name), old, old)
+	}
+	url = startserver(t, src, "-admin-token", "admin", "-channels-file", filepath.Join(t.TempDir(), "channels.json"), "-retain-max-age", "24h")
+	for _, image := range []string{"image-1.tgz", "image-2.tgz", "image-3.tgz&rollout=50"} {
+		if resp, body := testrequest(t, "POST", url+"admin/channels?channel=stable&image="+image, "admin", nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s", resp.Status, body)
+		}
+	}
+	if log := testgc(t, url); !strings.Contains(log, "image-1.tgz: removed (max age)") || !strings.Contains(log, "retention: 1 expired images removed") {
+		t.Errorf("max age: got log\n%s", log)
+	}
+	for name, kept := range map[string]bool{"image-1.tgz": false, "image-2.tgz": true, "image-3.tgz": true, "image-4.tgz": true} {
+		if _, err := os.Stat(filepath.Join(src, name)); (err == nil) != kept {
+			t.Errorf("max age: %s: kept %v, expected %v", name, err == nil, kept)
+		}
+	}
+}
+
+// testgc runs gc on the server at url and returns its log
+func testgc(t *testing.T, url string) string {
+
+	t.Helper()
+	resp, body := testrequest(t, "POST", url+"admin/ops?kind=gc", "admin", nil)
+	var op struct {
+		ID    string
+		State string
+		Log   []string
+	}
+	if err := json.Unmarshal(body, &op); err != nil || resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("%s %s", resp.Status, body)
+	}
+	for i := 0; i < 100 && op.State != "done"; i++ {
+		time.Sleep(50 * time.Millisecond)
+		_, body = testrequest(t, "GET", url+"admin/ops?id="+op.ID, "admin", nil)
+		json.Unmarshal(body, &op)
+	}
+	if op.State != "done" {
+		t.Fatalf("got %s", body)
+	}
+	return strings.Join(op.Log, "\n")
+}
+
+func TestDownloadEvents(t *testing.T) {
+
+	type event struct {
+		body      string
+		signature string
+	}
+	events := make(chan event, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		events <- event{string(body), r.Header.Get("OTA-Signature")}
+	}))
+	defer hook.Close()
+	secret := filepath.Join(t.TempDir(), "hook.secret")
+	os.WriteFile(secret, []byte("hook secret\n"), 0600)
+	targets := filepath.Join(t.TempDir(), "targets")
+	os.WriteFile(targets, []byte("*.tgz "+hook.URL+" events=downloaded,rejected secret-file="+secret+"\n"), 0644)
+	url, ref, dst := testsetup(t, testimage, testref, "-notify-file", targets, "-notify-interval", "50ms")
+
+	next := func() map[string]interface{} {
+		t.Helper()
+		select {
+		case ev := <-events:
+			mac := hmac.New(sha256.New, []byte("hook secret"))
+			io.WriteString(mac, ev.body)
+			if ev.signature != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+				t.Errorf("got signature %q", ev.signature)
+			}
+			var fields map[string]interface{}
+			if err := json.Unmarshal([]byte(ev.body), &fields); err != nil {
+				t.Fatal(err)
+			}
+			return fields
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+		return nil
+	}
+
+	if out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	if ev := next(); ev["event"] != "downloaded" || ev["image"] != "image-1.tgz" || ev["bytes"] == nil || ev["bytes"].(float64) <= 0 {
+		t.Errorf("diff: got %v", ev)
+	}
+
+	resp, body := testrequest(t, "GET", url+"?full", "", nil)
+	if ev := next(); resp.StatusCode != http.StatusOK || ev["event"] != "downloaded" || ev["bytes"] != float64(len(body)) {
+		t.Errorf("full image: got %v", ev)
+	}
+
+	// an index request is no download, a bitmap of the wrong size is rejected
+	testrequest(t, "GET", url+"?index", "", nil)
+	if resp, _ := testrequest(t, "POST", url, "", bytes.NewReader([]byte{1, 2, 3})); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got %s", resp.Status)
+	}
+	if ev := next(); ev["event"] != "rejected" || ev["status"] != float64(http.StatusBadRequest) || ev["bytes"] != nil {
+		t.Errorf("rejected: got %v", ev)
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected event %s", ev.body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestPregen(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testref)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(src, "image-1.tgz"), old, old)
+	url := startserver(t, src, "-diff-cache", t.TempDir(), "-admin-token", "admin", "-pregen-deltas", "1", "-pregen-interval", "50ms")
+	stats := func() (hits, misses int64, entries int) {
+		t.Helper()
+		resp, body := testrequest(t, "GET", url+"admin/cache", "admin", nil)
+		var s struct {
+			Hits    int64
+			Misses  int64
+			Entries []json.RawMessage
+		}
+		if err := json.Unmarshal(body, &s); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s", resp.Status, body)
+		}
+		return s.Hits, s.Misses, len(s.Entries)
+	}
+
+	// a new image gets its diff from the image before it
+	time.Sleep(200 * time.Millisecond)
+	writetgz(t, filepath.Join(src, ".image-2.tgz"), testimage)
+	os.Rename(filepath.Join(src, ".image-2.tgz"), filepath.Join(src, "image-2.tgz"))
+	for i := 0; i < 100; i++ {
+		if _, _, entries := stats(); entries == 1 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// a device with image-1 installed gets it from the cache
+	ref, dst := t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+	if out, err := runclient(t, "-src", url+"image-2.tgz", "-dst", dst+"/", "-ref", ref); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-2.tgz"), testimage)
+	if hits, misses, entries := stats(); hits != 1 || misses != 0 || entries != 1 {
+		t.Errorf("got %d hits, %d misses, %d entries", hits, misses, entries)
+	}
+
+	resp, body := testrequest(t, "POST", url+"admin/ops?kind=pregen&image=image-2.tgz", "admin", nil)
+	var op struct {
+		ID    string
+		State string
+		Log   []string
+	}
+	if err := json.Unmarshal(body, &op); err != nil || resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("%s %s", resp.Status, body)
+	}
+	for i := 0; i < 100 && op.State != "done"; i++ {
+		time.Sleep(50 * time.Millisecond)
+		_, body = testrequest(t, "GET", url+"admin/ops?id="+op.ID, "admin", nil)
+		json.Unmarshal(body, &op)
+	}
+	if len(op.Log) != 1 || !strings.HasSuffix(op.Log[0], "image-2.tgz: diff from image-1.tgz cached already") {
+		t.Errorf("got %s", body)
+	}
+
+	// pregen requires -pregen-deltas
+	other := startserver(t, src, "-diff-cache", t.TempDir(), "-admin-token", "admin")
+	if resp, _ := testrequest(t, "POST", other+"admin/ops?kind=pregen", "admin", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %s", resp.Status)
+	}
+}
+
+func TestDiffCacheByContent(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	data, _ := os.ReadFile(filepath.Join(src, "image-1.tgz"))
+	os.WriteFile(filepath.Join(src, "image-2.tgz"), data, 0644)
+	url := startserver(t, src, "-diff-cache", t.TempDir(), "-admin-token", "admin")
+	ref := t.TempDir()
+	writeref(t, ref, testref)
+
+	// copies of an image, a touched image and its by-hash url share the diff
+	sum := sha256.Sum256(data)
+	for _, image := range []string{"image-1.tgz", "image-2.tgz", "touch", "by-hash/" + hex.EncodeToString(sum[:]) + ".tgz"} {
+		if image == "touch" {
+			image = "image-1.tgz"
+			now := time.Now().Add(time.Minute)
+			os.Chtimes(filepath.Join(src, image), now, now)
+		}
+		dst := t.TempDir()
+		if out, err := runclient(t, "-src", url+image, "-dst", dst+"/", "-ref", ref); err != nil {
+			t.Fatalf("%s: %s%s", image, out, err)
+		}
+		files, _ := os.ReadDir(dst)
+		if len(files) != 1 {
+			t.Fatalf("%s: got %v", image, files)
+		}
+		checktgz(t, filepath.Join(dst, files[0].Name()), testimage)
+	}
+	resp, body := testrequest(t, "GET", url+"admin/cache", "admin", nil)
+	var s struct {
+		Hits    int64
+		Misses  int64
+		Entries []json.RawMessage
+	}
+	if err := json.Unmarshal(body, &s); err != nil || s.Hits != 3 || s.Misses != 1 || len(s.Entries) != 1 {
+		t.Errorf("%s %s", resp.Status, body)
+	}
+}
+
+func TestResumeDownload(t *testing.T) {
+
+	url, ref, dst := testsetup(t, testimage, testref)
+	resp, err := http.Post(url, "application/octet-stream", testbitmap(t, []byte{0x60}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Location"), "job=") {
+		t.Fatalf("got %s, Content-Location %q", resp.Status, resp.Header.Get("Content-Location"))
+	}
+
+	// the diff breaks off, the client resumes it from the job
+	server := strings.TrimSuffix(url, "image-1.tgz")
+	posts, ranges := 0, 0
+	proxy := testproxy(t, server, func(w http.ResponseWriter, r *http.Request) bool {
+		switch {
+		case r.Method == http.MethodPost:
+			posts++
+			relay(t, server, w, r, true)
+			return true
+		case r.URL.Query().Has("job") && r.Header.Get("Range") != "":
+			ranges++
+		}
+		return false
+	})
+	out, err := runclient(t, "-src", proxy+"image-1.tgz", "-dst", dst+"/", "-ref", ref)
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	if posts != 1 || ranges != 1 {
+		t.Errorf("%d diff requests, resumed %d times, want 1 and 1", posts, ranges)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+}
+
+func TestWatchDir(t *testing.T) {
+
+	src, incoming := t.TempDir(), t.TempDir()
+	writetgz(t, filepath.Join(incoming, "image-1.tgz"), testref)
+	url := startserver(t, src, "-watch-dir", incoming)
+
+	os.WriteFile(filepath.Join(incoming, "image-2.tgz.version"), []byte("2\n"), 0644)
+	writetgz(t, filepath.Join(incoming, ".image-2.tgz"), testimage)
+	os.Rename(filepath.Join(incoming, ".image-2.tgz"), filepath.Join(incoming, "image-2.tgz"))
+	os.WriteFile(filepath.Join(incoming, "image-3.tgz"), []byte("no tgz"), 0644)
+
+	type image struct{ Name, Version, SHA256 string }
+	var catalog []image
+	for i := 0; i < 100; i++ {
+		_, body := testrequest(t, "GET", url+"images", "", nil)
+		catalog = nil
+		json.Unmarshal(body, &catalog)
+		if _, err := os.Stat(filepath.Join(incoming, "image-3.tgz.rejected")); len(catalog) == 2 && err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if len(catalog) != 2 || catalog[0].Name != "image-1.tgz" || catalog[1].Name != "image-2.tgz" || catalog[1].Version != "2" || catalog[1].SHA256 == "" {
+		t.Fatalf("got catalog %+v", catalog)
+	}
+	files, _ := os.ReadDir(incoming)
+	if len(files) != 1 || files[0].Name() != "image-3.tgz.rejected" {
+		t.Errorf("left in the watched directory: %v", files)
+	}
+	for _, name := range []string{"image-1.tgz", "image-2.tgz", "image-2.tgz.version"} {
+		if _, err := os.Stat(filepath.Join(src, name)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	ref, dst := t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+	if out, err := runclient(t, "-src", url+"image-2.tgz", "-dst", dst+"/", "-ref", ref); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-2.tgz"), testimage)
+}
+
+func TestProgress(t *testing.T) {
+
+	url, ref, dst := testsetup(t, testimage, testref)
+	out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-progress", "plain")
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+	if !strings.Contains(out, "files  1 reused, 2 to fetch\n") || !regexp.MustCompile(`\ndiff   \d+ B of \d+ B`).MatchString(out) {
+		t.Errorf("got\n%s", out)
+	}
+
+	// not shown if stderr is no terminal
+	os.Remove(filepath.Join(dst, "image-1.tgz"))
+	if out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref); err != nil || strings.Contains(out, "to fetch") {
+		t.Errorf("%s%v", out, err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+
+	url, ref, dst := testsetup(t, testimage, testref)
+	out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-dry-run", "-progress", "none")
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	if !regexp.MustCompile(`(?m)^etc/changed\netc/added\n\d+ B would be downloaded \(\d+ B of files\)$`).MatchString(out) || strings.Contains(out, "etc/same") {
+		t.Errorf("got\n%s", out)
+	}
+	if files, _ := os.ReadDir(dst); len(files) != 0 {
+		t.Errorf("dry run wrote %v", files)
+	}
+
+	// with the image installed nothing is requested
+	ref2 := t.TempDir()
+	writeref(t, ref2, testimage)
+	out, err = runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref2, "-dry-run", "-progress", "none")
+	if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() != 3 || !strings.Contains(out, "nothing would be downloaded") {
+		t.Errorf("%s%v", out, err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+
+	if os.Getuid() != 0 {
+		t.Skip("the entries of the test image are owned by root")
+	}
+	url, _, dst := testsetup(t, testimage, testref)
+	ref := t.TempDir()
+	writeref(t, ref, testimage)
+	out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-verify", "-progress", "none")
+	if err != nil || !strings.Contains(out, `ok "etc/changed"`) || !strings.Contains(out, `ok "etc/link"`) || !strings.HasSuffix(out, "all 6 entries match the image\n") {
+		t.Fatalf("%s%v", out, err)
+	}
+
+	os.WriteFile(filepath.Join(ref, "etc/changed"), []byte("old content\n"), 0644)
+	os.Remove(filepath.Join(ref, "etc/added"))
+	os.Chmod(filepath.Join(ref, "etc/same"), 0600)
+	os.Remove(filepath.Join(ref, "etc/link"))
+	os.Symlink("changed", filepath.Join(ref, "etc/link"))
+	out, err = runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-verify", "-progress", "none")
+	for _, want := range []string{`ok "etc/"`, `MISMATCH "etc/same"`, `MISMATCH "etc/changed"`, `MISSING "etc/added"`, `ok "etc/empty"`, `MISMATCH "etc/link"`, "4 of 6 entries do not match the image\n"} {
+		if !strings.Contains(out, want+"\n") && !strings.HasSuffix(out, want) {
+			t.Errorf("missing %s in\n%s", want, out)
+		}
+	}
+	if exitcode(err) != 5 {
+		t.Errorf("got %v", err)
+	}
+	if files, _ := os.ReadDir(dst); len(files) != 0 {
+		t.Errorf("verify wrote %v", files)
+	}
+}
+
+func TestApply(t *testing.T) {
+
+	url, ref, dst := testsetup(t, testimage, testref)
+	parent := t.TempDir()
+	target := filepath.Join(parent, "rootfs")
+	writeref(t, target, testref)
+	os.WriteFile(filepath.Join(target, "stale"), []byte("of the old tree\n"), 0644)
+
+	if out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-apply", "-target", target); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+	for _, e := range testimage {
+		fname := filepath.Join(target, e.name)
+		switch e.typeflag {
+		case tar.TypeReg:
+			if data, err := os.ReadFile(fname); err != nil || string(data) != e.body {
+				t.Errorf("%s: got %q, %v", e.name, data, err)
+			}
+		case tar.TypeSymlink:
+			if link, err := os.Readlink(fname); err != nil || link != e.body {
+				t.Errorf("%s: got %q, %v", e.name, link, err)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(target, "stale")); err == nil {
+		t.Error("old tree not replaced")
+	}
+	// the old tree is kept for rollback
+	if files, _ := os.ReadDir(parent); len(files) != 2 || files[1].Name() != "rootfs.previous" {
+		t.Errorf("staging directory left: %v", files)
+	}
+	if _, err := os.Stat(filepath.Join(target+".previous", "stale")); err != nil {
+		t.Error(err)
+	}
+
+	// a target that does not exist yet
+	if out, err := runclient(t, "-src", url, "-dst", t.TempDir()+"/", "-ref", ref, "-apply", "-target", filepath.Join(parent, "new")); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(parent, "new", "etc/added")); err != nil || string(data) != "added file\n" {
+		t.Errorf("got %q, %v", data, err)
+	}
+
+	if out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-apply"); err == nil {
+		t.Errorf("-apply without -target accepted\n%s", out)
+	}
+}
+
+func TestApplySandbox(t *testing.T) {
+
+	if os.Getuid() != 0 {
+		t.Skip("-apply-sandbox requires root")
+	}
+	image := append(append([]testentry{}, testimage...), testentry{"dev/", tar.TypeDir, ""}, testentry{"dev/null", tar.TypeChar, ""})
+	url, ref, _ := testsetup(t, image, testref)
+	target := filepath.Join(t.TempDir(), "rootfs")
+
+	// the device node needs CAP_MKNOD, which the helper keeps
+	out, err := runclient(t, "-src", url, "-dst", t.TempDir()+"/", "-ref", ref, "-allow-devices", "-apply", "-target", target, "-apply-sandbox", "-apply-seccomp", "-log-level", "debug")
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(target, "etc/added")); err != nil || string(data) != "added file\n" {
+		t.Errorf("got %q, %v", data, err)
+	}
+	if link, err := os.Readlink(filepath.Join(target, "etc/link")); err != nil || link != "same" {
+		t.Errorf("got %q, %v", link, err)
+	}
+	if fi, err := os.Lstat(filepath.Join(target, "dev/null")); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		t.Errorf("device node: got %v, %v", fi, err)
+	}
+	if !strings.Contains(out, `msg="extracting in sandbox"`) || !strings.Contains(out, "seccomp=true") {
+		t.Errorf("got\n%s", out)
+	}
+
+	for _, args := range [][]string{{"-apply-sandbox"}, {"-apply", "-target", target, "-apply-seccomp"}} {
+		out, err := runclient(t, append([]string{"-src", url, "-dst", t.TempDir() + "/", "-ref", ref}, args...)...)
+		if exitcode(err) != 2 {
+			t.Errorf("%v: got %v\n%s", args, err, out)
+		}
+	}
+}
+
+func TestRootlessApply(t *testing.T) {
+
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to run the client as nobody")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip(err)
+	}
+	uid, _ := strconv.Atoi(nobody.Uid)
+	gid, _ := strconv.Atoi(nobody.Gid)
+
+	// an image with entries only root can create
+	src := t.TempDir()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	mtime := time.Unix(1500000000, 0)
+	for _, hdr := range []*tar.Header{
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime},
+		{Name: "usr/su", Typeflag: tar.TypeReg, Mode: 04755, Uid: 1000, Gid: 1000, Size: 3, ModTime: mtime},
+		{Name: "dev/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3, ModTime: mtime},
+	} {
+		tw.WriteHeader(hdr)
+		if hdr.Size > 0 {
+			tw.Write([]byte("su\n"))
+		}
+	}
+	tw.Close()
+	gw.Close()
+	os.WriteFile(filepath.Join(src, "image-1.tgz"), buf.Bytes(), 0644)
+	url := startserver(t, src) + "image-1.tgz"
+
+	work := t.TempDir()
+	os.Chmod(filepath.Dir(work), 0755)
+	for _, dir := range []string{work, filepath.Join(work, "dst")} {
+		os.MkdirAll(dir, 0755)
+		os.Chown(dir, uid, gid)
+	}
+	ref := filepath.Join(work, "ref")
+	writeref(t, ref, testref)
+	target := filepath.Join(work, "rootfs")
+	apply := func(args ...string) (string, error) {
+		t.Helper()
+		args = append([]string{"-statedir", filepath.Join(work, "state"), "-src", url, "-dst", filepath.Join(work, "dst") + "/", "-ref", ref, "-allow-devices", "-apply", "-target", target}, args...)
+		cmd := exec.Command(clientbin, args...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}}
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	if out, err := apply(); err == nil || !strings.Contains(out, "operation not permitted") {
+		t.Errorf("device node created without root: %v\n%s", err, out)
+	}
+	if out, err := apply("-rootless"); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	if fi, err := os.Lstat(filepath.Join(target, "usr/su")); err != nil || fi.Mode() != 0755 || fi.Sys().(*syscall.Stat_t).Uid != uint32(uid) {
+		t.Errorf("usr/su: got %v, %v", fi, err)
+	}
+	if fi, err := os.Lstat(filepath.Join(target, "dev/null")); err != nil || !fi.Mode().IsRegular() || fi.Size() != 0 {
+		t.Errorf("dev/null: got %v, %v", fi, err)
+	}
+	// the manifest keeps the owners, modes and device numbers of the image
+	manifest, _ := os.ReadFile(filepath.Join(target, ".ota-manifest"))
+	for _, want := range []string{"ota-manifest 2\n", `0 4755 1000:1000 1500000000 0:0 `, `3 666 0:0 1500000000 1:3 - "dev/null"`} {
+		if !strings.Contains(string(manifest), want) {
+			t.Errorf("missing %q in\n%s", want, manifest)
+		}
+	}
+
+	if out, err := runclient(t, "-src", url, "-dst", t.TempDir()+"/", "-ref", ref, "-rootless"); exitcode(err) != 2 {
+		t.Errorf("-rootless without -apply: got %v\n%s", err, out)
+	}
+}
+
+func TestSlot(t *testing.T) {
+
+	url, ref, _ := testsetup(t, testimage, testref)
+	parent, state := t.TempDir(), t.TempDir()
+	slotfile := filepath.Join(state, "slot")
+	target := filepath.Join(parent, "rootfs-%s")
+
+	// a device running slot a installs to b
+	out, err := runclient(t, "-statedir", state, "-src", url, "-dst", t.TempDir()+"/", "-ref", ref, "-apply", "-slot", "auto", "-target", target)
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(parent, "rootfs-b", "etc/changed")); err != nil || string(data) != "new content\n" {
+		t.Errorf("slot b: got %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(parent, "rootfs-a")); err == nil {
+		t.Error("running slot a written")
+	}
+	if data, _ := os.ReadFile(slotfile); string(data) != "b\n" {
+		t.Errorf("bootable slot %q", data)
+	}
+	cmd := exec.Command(clientbin, "status", "-statedir", state)
+	if out, _ := cmd.Output(); !strings.Contains(string(out), "slot:     b\n") {
+		t.Errorf("status: got %s", out)
+	}
+
+	// until the next boot the device still runs a, though b is bootable
+	os.RemoveAll(filepath.Join(parent, "rootfs-b"))
+	if out, err := runclient(t, "-statedir", state, "-src", url, "-dst", t.TempDir()+"/", "-ref", ref, "-apply", "-slot", "auto", "-target", target); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	if _, err := os.Stat(filepath.Join(parent, "rootfs-a")); err == nil {
+		t.Error("running slot a written before a reboot")
+	}
+	// after the reboot into b, a is updated
+	os.Remove(filepath.Join(state, "booted-slot"))
+	if out, err := runclient(t, "-statedir", state, "-src", url, "-dst", t.TempDir()+"/", "-ref", ref, "-apply", "-slot", "auto", "-target", target); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	if data, _ := os.ReadFile(slotfile); string(data) != "a\n" {
+		t.Errorf("after reboot: bootable slot %q", data)
+	}
+
+	// an explicit slot with another provider
+	other := filepath.Join(t.TempDir(), "bootslot")
+	if out, err := runclient(t, "-src", url, "-dst", t.TempDir()+"/", "-ref", ref, "-apply", "-slot", "a", "-slot-provider", "file:"+other, "-target", target); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	if data, _ := os.ReadFile(other); string(data) != "a\n" {
+		t.Errorf("bootable slot %q", data)
+	}
+
+	for _, args := range [][]string{{"-slot", "c", "-target", target}, {"-slot", "a", "-target", parent}, {"-slot", "a", "-target", target, "-check"}} {
+		if out, err := runclient(t, append([]string{"-src", url, "-dst", t.TempDir() + "/", "-ref", ref, "-apply"}, args...)...); err == nil {
+			t.Errorf("%v accepted\n%s", args, out)
+		}
+	}
+}
+
+func TestRollbackCommand(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testref)
+	writetgz(t, filepath.Join(src, "image-2.tgz"), testimage)
+	os.WriteFile(filepath.Join(src, "image-1.tgz.version"), []byte("1\n"), 0644)
+	os.WriteFile(filepath.Join(src, "image-2.tgz.version"), []byte("2\n"), 0644)
+	url := startserver(t, src)
+	ref := t.TempDir()
+	writeref(t, ref, testref)
+	rollback := func(state string) (string, int) {
+		t.Helper()
+		cmd := exec.Command(clientbin, "rollback", "-statedir", state)
+		out, _ := cmd.CombinedOutput()
+		return string(out), cmd.ProcessState.ExitCode()
+	}
+	content := func(dir string) string {
+		data, _ := os.ReadFile(filepath.Join(dir, "etc/changed"))
+		return string(data)
+	}
+
+	tests := []struct {
+		name   string
+		args   []string
+		target string
+	}{
+		{"target", nil, "rootfs"},
+		{"slot", []string{"-slot", "auto"}, "rootfs-%s"},
+	}
+	for _, tt := range tests {
+		parent, state := t.TempDir(), t.TempDir()
+		target := filepath.Join(parent, tt.target)
+		if out, code := rollback(state); code != 2 || !strings.Contains(out, "no update to roll back") {
+			t.Errorf("%s: nothing applied: %d %s", tt.name, code, out)
+		}
+		// image-1 is the reference, nothing is downloaded
+		for i, image := range []string{"image-1.tgz", "image-2.tgz"} {
+			args := append([]string{"-statedir", state, "-src", url + image, "-dst", t.TempDir() + "/", "-ref", ref, "-apply", "-target", target}, tt.args...)
+			if out, err := runclient(t, args...); exitcode(err) != []int{noupdate, 0}[i] {
+				t.Fatalf("%s: %s%s", tt.name, out, err)
+			}
+			// rebooted into the updated slot
+			os.Remove(filepath.Join(state, "booted-slot"))
+		}
+		journal, _ := os.ReadFile(filepath.Join(state, "journal"))
+		if lines := strings.Split(strings.TrimSpace(string(journal)), "\n"); len(lines) != 2 || !strings.Contains(lines[1], `"action":"apply","image":"image-2.tgz","version":"2"`) {
+			t.Errorf("%s: journal %s", tt.name, journal)
+		}
+
+		out, code := rollback(state)
+		if code != 0 {
+			t.Fatalf("%s: rollback: %d %s", tt.name, code, out)
+		}
+		if tt.args == nil {
+			if content(target) != "old content\n" || content(target+".previous") != "new content\n" {
+				t.Errorf("%s: not restored: %s", tt.name, out)
+			}
+		} else if slot, _ := os.ReadFile(filepath.Join(state, "slot")); string(slot) != "b\n" {
+			t.Errorf("%s: bootable slot %q: %s", tt.name, slot, out)
+		}
+		if version, _ := os.ReadFile(filepath.Join(state, "version")); strings.TrimSpace(string(version)) != "1" {
+			t.Errorf("%s: version %q", tt.name, version)
+		}
+		journal, _ = os.ReadFile(filepath.Join(state, "journal"))
+		if lines := strings.Split(strings.TrimSpace(string(journal)), "\n"); len(lines) != 3 || !strings.Contains(lines[2], `"action":"rollback","image":"image-1.tgz"`) {
+			t.Errorf("%s: journal %s", tt.name, journal)
+		}
+		if out, code := rollback(state); code != 2 {
+			t.Errorf("%s: rolled back twice: %d %s", tt.name, code, out)
+		}
+	}
+}
+
+func TestLimitRate(t *testing.T) {
+
+	url, ref, dst := testsetup(t, testimage, testref)
+	start := time.Now()
+	if out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-limit-rate", "1k"); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	// the index and diff are about 800 bytes
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("downloaded in %s", elapsed)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+
+	if out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref, "-limit-rate", "fast"); err == nil {
+		t.Errorf("invalid rate accepted\n%s", out)
+	}
+}
+
+func TestProxy(t *testing.T) {
+
+	url, ref, _ := testsetup(t, testimage, testref)
+	server := strings.TrimPrefix(strings.TrimSuffix(url, "/image-1.tgz"), "http://")
+	// a forward proxy, which alone resolves the name of the server
+	var mu sync.Mutex
+	var proxied []string
+	forward := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host != "ota.test" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		mu.Lock()
+		proxied = append(proxied, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		r.URL.Host = server
+		r.RequestURI = ""
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	})
+	plain := httptest.NewServer(forward)
+	defer plain.Close()
+	tlsproxy := httptest.NewTLSServer(forward)
+	defer tlsproxy.Close()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	writepem(t, ca, "CERTIFICATE", tlsproxy.Certificate().Raw)
+
+	tests := []struct {
+		name  string
+		proxy string
+		env   []string
+	}{
+		{"http", plain.URL, nil},
+		{"https", tlsproxy.URL, []string{"SSL_CERT_FILE=" + ca}},
+		{"environment", "", []string{"HTTP_PROXY=" + plain.URL}},
+	}
+	for _, tt := range tests {
+		proxied = nil
+		args := []string{"-src", "http://ota.test/image-1.tgz", "-dst", t.TempDir() + "/", "-ref", ref}
+		if tt.proxy != "" {
+			args = append(args, "-proxy", tt.proxy)
+		}
+		dst := args[3]
+		if out, err := runclientenv(t, tt.env, args...); err != nil {
+			t.Errorf("%s: %s%s", tt.name, out, err)
+			continue
+		}
+		checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+		mu.Lock()
+		if got := strings.Join(proxied, ","); got != "GET /capabilities,GET /image-1.tgz,POST /image-1.tgz" {
+			t.Errorf("%s: proxied %s", tt.name, got)
+		}
+		mu.Unlock()
+	}
+
+	// a proxy certificate the system CAs do not trust
+	if out, err := runclient(t, "-src", "http://ota.test/image-1.tgz", "-dst", t.TempDir()+"/", "-ref", ref, "-proxy", tlsproxy.URL); err == nil {
+		t.Errorf("unverified proxy used\n%s", out)
+	}
+	if out, err := runclient(t, "-src", url, "-dst", t.TempDir()+"/", "-ref", ref, "-proxy", "ftp://proxy"); err == nil {
+		t.Errorf("invalid proxy accepted\n%s", out)
+	}
+}
+
+func TestScratchDirDefault(t *testing.T) {
+
+	// the scratch directory is below $TMPDIR without -tmpdir
+	url, ref, dst := testsetup(t, testimage, testref)
+	tmpdir := t.TempDir()
+	posted := make(chan []os.DirEntry, 1)
+	proxy := testproxy(t, strings.TrimSuffix(url, "image-1.tgz"), func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodPost {
+			entries, _ := os.ReadDir(tmpdir)
+			posted <- entries
+		}
+		return false
+	})
+	if out, err := runclientenv(t, []string{"TMPDIR=" + tmpdir}, "-src", proxy+"image-1.tgz", "-dst", dst+"/", "-ref", ref); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	if entries := <-posted; len(entries) != 1 || !strings.HasPrefix(entries[0].Name(), "ota-client-") {
+		t.Errorf("got scratch directories %v", entries)
+	}
+	if entries, _ := os.ReadDir(tmpdir); len(entries) != 0 {
+		t.Errorf("scratch files left: %v", entries)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+}
+
+func TestDaemon(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	url := startserver(t, src)
+	var mu sync.Mutex
+	var requests []string
+	proxy := testproxy(t, url, func(w http.ResponseWriter, r *http.Request) bool {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		mu.Unlock()
+		return false
+	})
+	ref, dst, state := t.TempDir(), t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+
+	var out bytes.Buffer
+	cmd := exec.Command(clientbin, "-statedir", state, "-src", proxy+"image-1.tgz", "-dst", dst+"/", "-ref", ref, "-daemon", "-interval", "100ms")
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("client output:\n%s", out.String())
+		}
+	}()
+
+	status := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", filepath.Join(state, "daemon.sock"))
+	}}}
+	var s struct {
+		State   string
+		Source  string
+		Updates int
+		Last    *struct{ Image, Result string } `json:"last_update"`
+	}
+	waitupdates := func(n int) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			if resp, err := status.Get("http://ota/"); err == nil {
+				json.NewDecoder(resp.Body).Decode(&s)
+				resp.Body.Close()
+				if s.Updates == n {
+					return
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("got status %+v", s)
+	}
+
+	waitupdates(1)
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+	if s.Source != proxy+"image-1.tgz" || s.Last == nil || s.Last.Image != "image-1.tgz" || s.Last.Result != "success" {
+		t.Errorf("got status %+v", s)
+	}
+	// unchanged images are not downloaded again, polls only ask for the ETag
+	mu.Lock()
+	updated := len(requests)
+	mu.Unlock()
+	time.Sleep(300 * time.Millisecond)
+	mu.Lock()
+	if posts := strings.Count(strings.Join(requests, "\n"), "POST "); posts != 1 {
+		t.Errorf("%d diff requests: %q", posts, requests)
+	}
+	polls := requests[updated:]
+	if len(polls) == 0 {
+		t.Errorf("no polls: %q", requests)
+	}
+	for _, r := range polls {
+		if !strings.HasPrefix(r, "HEAD ") {
+			t.Errorf("poll %q, want HEAD", r)
+		}
+	}
+	mu.Unlock()
+
+	changed := append([]testentry{}, testimage...)
+	changed[2].body = "newer content\n"
+	writetgz(t, filepath.Join(src, ".image-1.tgz"), changed)
+	os.Rename(filepath.Join(src, ".image-1.tgz"), filepath.Join(src, "image-1.tgz"))
+	waitupdates(2)
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), changed)
+	var last map[string]string
+	data, _ := os.ReadFile(filepath.Join(state, "poll.json"))
+	if err := json.Unmarshal(data, &last); err != nil || last["etag"] == "" {
+		t.Errorf("got %s", data)
+	}
+}
+
+func TestDaemonSystemd(t *testing.T) {
+
+	url, ref, dst := testsetup(t, testimage, testref)
+	state := t.TempDir()
+	notify := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: notify, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	messages := make(chan string, 100)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			messages <- string(buf[:n])
+		}
+	}()
+	expect := func(prefix string) string {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case m := <-messages:
+				if strings.HasPrefix(m, prefix) {
+					return m
+				}
+			case <-timeout:
+				t.Fatalf("no %s", prefix)
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command(clientbin, "-statedir", state, "-src", url, "-dst", dst+"/", "-ref", ref, "-daemon", "-interval", "1h")
+	cmd.Env = append(os.Environ(), "NOTIFY_SOCKET="+notify, "WATCHDOG_USEC=200000")
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	expect("READY=1")
+	if status := expect("STATUS=idle, next check "); strings.Contains(status, "failed") {
+		t.Errorf("got %s\n%s", status, out.String())
+	}
+	expect("WATCHDOG=1")
+	expect("WATCHDOG=1")
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	expect("STOPPING=1")
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("got %v\n%s", err, out.String())
+	}
+	if _, err := os.Stat(filepath.Join(state, "daemon.sock")); err == nil {
+		t.Error("status socket left")
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+
+	keys := t.TempDir()
+	servercmd(t, keys, "genkey", "k1")
+	servercmd(t, keys, "genkey", "k2")
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	servercmd(t, src, "sign", "-key", filepath.Join(keys, "k1.key"), "image-1.tgz")
+	url := startserver(t, src) + "image-1.tgz"
+	ref, installed := t.TempDir(), t.TempDir()
+	writeref(t, ref, testref)
+	writeref(t, installed, testimage)
+	readonly := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(readonly, nil, 0644)
+	// an index with file contents shorter than any hash
+	badindex := filepath.Join(t.TempDir(), "index.tgz")
+	writetgz(t, badindex, []testentry{{"etc/same", tar.TypeReg, "abc"}})
+	hashformat := testproxy(t, strings.TrimSuffix(url, "image-1.tgz"), func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodGet || r.URL.Path != "/image-1.tgz" {
+			return false
+		}
+		http.ServeFile(w, r, badindex)
+		return true
+	}) + "image-1.tgz"
+
+	tests := []struct {
+		name   string
+		args   []string
+		status int
+	}{
+		{"success", []string{"-src", url, "-ref", ref}, 0},
+		{"nothing to download", []string{"-src", url, "-ref", installed}, 3},
+		{"check with an update", []string{"-src", url, "-ref", ref, "-check"}, 0},
+		{"check without update", []string{"-src", url, "-ref", installed, "-check"}, 3},
+		{"server not reached", []string{"-src", "http://127.0.0.1:1/image-1.tgz", "-ref", ref}, 4},
+		{"signature", []string{"-src", url, "-ref", ref, "-pubkey", filepath.Join(keys, "k2.pub")}, 5},
+		{"unknown hash format", []string{"-src", hashformat, "-ref", ref}, 5},
+		{"verify mismatch", []string{"-src", url, "-ref", ref, "-verify"}, 5},
+		{"disk", []string{"-src", url, "-ref", ref, "-dst", readonly + "/image-1.tgz"}, 6},
+		{"no src", []string{"-ref", ref}, 2},
+		{"unknown flag", []string{"-src", url, "-no-such-flag"}, 2},
+		{"invalid option", []string{"-src", url, "-workers", "0"}, 2},
+		{"no .tgz suffix", []string{"-src", url + "/x", "-ref", ref}, 2},
+	}
+	for _, tt := range tests {
+		args := tt.args
+		if !strings.Contains(strings.Join(args, " "), "-dst") {
+			args = append(args, "-dst", t.TempDir()+"/")
+		}
+		out, err := runclient(t, args...)
+		status := 0
+		if exit, ok := err.(*exec.ExitError); ok {
+			status = exit.ExitCode()
+		}
+		if status != tt.status {
+			t.Errorf("%s: exit status %d, want %d\n%s", tt.name, status, tt.status, out)
+		}
+	}
+}
+
+func TestSavings(t *testing.T) {
+
+	url, ref, dst := testsetup(t, testimage, testref)
+	state := t.TempDir()
+	out, err := runclient(t, "-statedir", state, "-src", url, "-dst", dst+"/", "-ref", ref)
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	// etc/same is reused, etc/changed and etc/added are new
+	summary := regexp.MustCompile(`image 41 B, 18 B \(43\.9%\) reused from the reference, 23 B of new files, (\d+) B downloaded \(ratio`)
+	if !summary.MatchString(out) || !strings.Contains(out, "image_bytes=41 reused_bytes=18") {
+		t.Errorf("got\n%s", out)
+	}
+	status, _ := exec.Command(clientbin, "status", "-statedir", state).Output()
+	if !strings.Contains(string(status), "savings:  image 41 B, 18 B (43.9%) reused") {
+		t.Errorf("status: got\n%s", status)
+	}
+	var s map[string]interface{}
+	status, _ = exec.Command(clientbin, "status", "-statedir", state, "-json").Output()
+	if err := json.Unmarshal(status, &s); err != nil || s["image_bytes"] != 41.0 || s["reused_bytes"] != 18.0 {
+		t.Errorf("status: got %s", status)
+	}
+}
+
+func TestHashCache(t *testing.T) {
+
+	url, ref, _ := testsetup(t, testimage, testref)
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"etc/same", "etc/changed"} {
+		os.Chtimes(filepath.Join(ref, name), old, old)
+	}
+	state := t.TempDir()
+	update := func(args ...string) string {
+		t.Helper()
+		dst := t.TempDir()
+		out, err := runclient(t, append([]string{"-statedir", state, "-src", url, "-dst", dst + "/", "-ref", ref, "-log-level", "debug"}, args...)...)
+		if err != nil {
+			t.Fatalf("%s%s", out, err)
+		}
+		checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+		return out
+	}
+
+	update()
+	fname := filepath.Join(state, "hashcache.json")
+	data, _ := os.ReadFile(fname)
+	var cache map[string]map[string]interface{}
+	same := filepath.Join(ref, "etc/same")
+	if err := json.Unmarshal(data, &cache); err != nil || len(cache) != 2 || cache[same]["hashes"] == nil {
+		t.Fatalf("got %s, %v", data, err)
+	}
+
+	// the cached hash is used instead of reading the file
+	var sums []string
+	for _, sum := range cache[same]["hashes"].(map[string]interface{}) {
+		sums = append(sums, sum.(string))
+	}
+	for _, sum := range sums {
+		data = bytes.ReplaceAll(data, []byte(sum), bytes.Repeat([]byte("0"), len(sum)))
+	}
+	os.WriteFile(fname, data, 0644)
+	if out := update(); !strings.Contains(out, `msg="file exists, cached hash does not match" path=etc/same`) {
+		t.Errorf("cached hash not used\n%s", out)
+	}
+	os.WriteFile(fname, data, 0644)
+	if out := update("-no-cache"); strings.Contains(out, "cached hash does not match") {
+		t.Errorf("-no-cache: cached hash used\n%s", out)
+	}
+
+	// a replaced file is hashed again
+	os.WriteFile(fname, data, 0644)
+	os.WriteFile(same+".new", []byte("unchanged content\n"), 0644)
+	os.Rename(same+".new", same)
+	os.Chtimes(same, old, old)
+	if out := update(); strings.Contains(out, `cached hash does not match" path=etc/same`) {
+		t.Errorf("replaced file: cached hash used\n%s", out)
+	}
+}
+
+func TestReferenceInPlace(t *testing.T) {
+
+	// reference files are hashed and read where they are, no copies are
+	// left in the scratch directory
+	url, ref, dst := testsetup(t, testimage, testref)
+	tmpdir := t.TempDir()
+	var scratch []string
+	proxy := testproxy(t, strings.TrimSuffix(url, "image-1.tgz"), func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodPost {
+			filepath.Walk(tmpdir, func(name string, fi os.FileInfo, err error) error {
+				if err == nil && !fi.IsDir() {
+					scratch = append(scratch, filepath.Base(name))
+				}
+				return nil
+			})
+		}
+		return false
+	})
+	if out, err := runclient(t, "-src", proxy+"image-1.tgz", "-dst", dst+"/", "-ref", ref, "-tmpdir", tmpdir); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+	for _, name := range scratch {
+		if strings.HasSuffix(name, ".tmp") {
+			t.Errorf("reference file copied: %s", name)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(ref, "etc/same")); string(data) != "unchanged content\n" {
+		t.Errorf("reference file changed: %q", data)
+	}
+}
+
+func TestWorkers(t *testing.T) {
+
+	// many reference files, the entries keep their order whatever the
+	// number of hashing workers
+	image := []testentry{{"etc/", tar.TypeDir, ""}}
+	ref := []testentry{{"etc/", tar.TypeDir, ""}}
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("etc/file%02d", i)
+		image = append(image, testentry{name, tar.TypeReg, fmt.Sprintf("content %d\n", i)})
+		switch i % 3 {
+		case 0: // same
+			ref = append(ref, testentry{name, tar.TypeReg, fmt.Sprintf("content %d\n", i)})
+		case 1: // changed
+			ref = append(ref, testentry{name, tar.TypeReg, fmt.Sprintf("old %d\n", i)})
+		}
+	}
+	for _, workers := range []string{"1", "5"} {
+		url, refdir, dst := testsetup(t, image, ref)
+		out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", refdir, "-workers", workers)
+		if err != nil {
+			t.Fatalf("-workers %s: %s%s", workers, out, err)
+		}
+		checktgz(t, filepath.Join(dst, "image-1.tgz"), image)
+	}
+	if out, err := runclient(t, "-src", "http://127.0.0.1:1/image-1.tgz", "-dst", t.TempDir()+"/", "-workers", "0"); err == nil || !strings.Contains(out, "-workers must be at least 1") {
+		t.Errorf("-workers 0: got %s%v", out, err)
+	}
+}
+
+func TestDeviceHeaders(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-2-legacy.tgz"), testimage)
+	groupsfile := filepath.Join(t.TempDir(), "groups")
+	os.WriteFile(groupsfile, []byte("group legacy version:1*\ntarget *-legacy.tgz legacy\n"), 0644)
+	url := startserver(t, src, "-groups-file", groupsfile)
+
+	var mu sync.Mutex
+	headers := http.Header{}
+	proxy := testproxy(t, url, func(w http.ResponseWriter, r *http.Request) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, name := range []string{"X-Device-Id", "X-Hardware-Revision", "X-Current-Version"} {
+			headers[name] = r.Header[name]
+		}
+		return false
+	})
+
+	// the installed version of the state directory selects the group
+	state := t.TempDir()
+	os.WriteFile(filepath.Join(state, "version"), []byte("12\n"), 0644)
+	ref := t.TempDir()
+	writeref(t, ref, testref)
+	dst := t.TempDir()
+	out, err := runclient(t, "-statedir", state, "-src", proxy+"image-2-legacy.tgz", "-dst", dst+"/", "-ref", ref,
+		"-device-id", "dev-0042", "-hardware-revision", "rev-b", "-allow-downgrade")
+	if err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-2-legacy.tgz"), testimage)
+	mu.Lock()
+	got := fmt.Sprint(headers.Get("X-Device-Id"), " ", headers.Get("X-Hardware-Revision"), " ", headers.Get("X-Current-Version"))
+	mu.Unlock()
+	if got != "dev-0042 rev-b 12" {
+		t.Errorf("headers: got %q", got)
+	}
+
+	tests := []struct {
+		version string
+		status  int
+	}{
+		{"12", http.StatusOK},
+		{"2", http.StatusNotFound},
+		{"", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", url+"image-2-legacy.tgz", nil)
+		if tt.version != "" {
+			req.Header.Set("X-Current-Version", tt.version)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("version %q: got %s, want %d", tt.version, resp.Status, tt.status)
+		}
+		if cc := resp.Header.Get("Cache-Control"); tt.status == http.StatusOK && strings.Contains(cc, "public") {
+			t.Errorf("version %q: shared caching of a version selected image: %s", tt.version, cc)
+		}
+	}
+}
+
+func TestSignedNamesAndRecords(t *testing.T) {
+
+	keys := t.TempDir()
+	servercmd(t, keys, "genkey", "k1")
+
+	// etc/same with owner names and an xattr, changed after signing
+	write := func(name, uname, xattr string) {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		tw.WriteHeader(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: time.Unix(1500000000, 0)})
+		body := "unchanged content\n"
+		tw.WriteHeader(&tar.Header{Name: "etc/same", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(body)), ModTime: time.Unix(1500000000, 0),
+			Uname: uname, Gname: "root", Format: tar.FormatPAX, PAXRecords: map[string]string{"SCHILY.xattr.user.test": xattr}})
+		tw.Write([]byte(body))
+		tw.Close()
+		gw.Close()
+		if err := os.WriteFile(name, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src := t.TempDir()
+	for _, name := range []string{"image-1.tgz", "image-2.tgz", "image-3.tgz"} {
+		write(filepath.Join(src, name), "root", "a")
+	}
+	servercmd(t, src, "sign", "-key", filepath.Join(keys, "k1.key"), "image-1.tgz", "image-2.tgz", "image-3.tgz")
+	write(filepath.Join(src, "image-2.tgz"), "admin", "a")
+	write(filepath.Join(src, "image-3.tgz"), "root", "b")
+	url := startserver(t, src)
+	ref := t.TempDir()
+	writeref(t, ref, testref)
+	dst := t.TempDir()
+
+	// the signed image is assembled from the reference alone, exit status 3
+	tests := []struct {
+		name   string
+		image  string
+		status int
+	}{
+		{"signed", "image-1.tgz", 3},
+		{"user name changed", "image-2.tgz", 5},
+		{"xattr changed", "image-3.tgz", 5},
+	}
+	for _, tt := range tests {
+		out, err := runclient(t, "-src", url+tt.image, "-dst", dst+"/", "-ref", ref, "-pubkey", filepath.Join(keys, "k1.pub"))
+		if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() != tt.status {
+			t.Errorf("%s: got %v, want exit status %d\n%s", tt.name, err, tt.status, out)
+		}
+	}
+	f, err := os.Open(filepath.Join(dst, "image-1.tgz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("etc/same not found: %v", err)
+		}
+		if hdr.Name == "etc/same" {
+			if hdr.Uname != "root" || hdr.PAXRecords["SCHILY.xattr.user.test"] != "a" {
+				t.Errorf("signed image: got %+v", hdr)
+			}
+			break
+		}
+	}
+}
+
+func TestVersionAfterApply(t *testing.T) {
+
+	src := t.TempDir()
+	writetgz(t, filepath.Join(src, "image-1.tgz"), testimage)
+	os.WriteFile(filepath.Join(src, "image-1.tgz.version"), []byte("7\n"), 0644)
+	url := startserver(t, src)
+	ref := t.TempDir()
+	writeref(t, ref, testref)
+	state := t.TempDir()
+
+	// the image is downloaded but cannot be applied, it is not installed
+	blocked := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(blocked, nil, 0644)
+	if out, err := runclient(t, "-statedir", state, "-src", url+"image-1.tgz", "-dst", t.TempDir()+"/", "-ref", ref, "-apply", "-target", filepath.Join(blocked, "rootfs")); err == nil {
+		t.Fatalf("apply below a file succeeded\n%s", out)
+	}
+	if data, err := os.ReadFile(filepath.Join(state, "version")); err == nil {
+		t.Errorf("version persisted for a failed apply: %q", data)
+	}
+
+	target := filepath.Join(t.TempDir(), "rootfs")
+	if out, err := runclient(t, "-statedir", state, "-src", url+"image-1.tgz", "-dst", t.TempDir()+"/", "-ref", ref, "-apply", "-target", target); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(state, "version")); err != nil || strings.TrimSpace(string(data)) != "7" {
+		t.Errorf("version: got %q, %v", data, err)
+	}
+}
+
+func TestJobLimits(t *testing.T) {
+
+	url, ref, dst := testsetup(t, testimage, testref, "-max-jobs", "1")
+
+	post := func(bitmap byte) *http.Response {
+		resp, err := http.Post(url+"?async", "application/octet-stream", testbitmap(t, []byte{bitmap}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := post(0x60); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("got %s", resp.Status)
+	}
+	// the same diff is the same job
+	if resp := post(0x60); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("same diff: got %s", resp.Status)
+	}
+	if resp := post(0x40); resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("over the limit: got %s, Retry-After %q", resp.Status, resp.Header.Get("Retry-After"))
+	}
+
+	// downloads are still sent, without resume url
+	resp, err := http.Post(url, "application/octet-stream", testbitmap(t, []byte{0x40}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("download: got %s", resp.Status)
+	}
+	if out, err := runclient(t, "-src", url, "-dst", dst+"/", "-ref", ref); err != nil {
+		t.Fatalf("%s%s", out, err)
+	}
+	checktgz(t, filepath.Join(dst, "image-1.tgz"), testimage)
+}
@@ -0,0 +1,832 @@
+package main
+
+// client.go and server.go are separate programs, run the tests of each
+// with its own file: go test server.go server_test.go
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAPR1(t *testing.T) {
+
+	// openssl passwd -apr1 -salt <salt> <password>
+	tests := []struct {
+		password string
+		salt     string
+		want     string
+	}{
+		{password: "password", salt: "saltsalt", want: "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/"},
+		{password: "secret", salt: "12345678", want: "$apr1$12345678$0lqb/6VUFP8JY/s/jTrIk0"},
+		{password: "secret", salt: "123456789abc", want: "$apr1$12345678$0lqb/6VUFP8JY/s/jTrIk0"},
+		{password: "", salt: "abc", want: "$apr1$abc$BfqKdn9xFDWJPa3kcp/PH0"},
+		{password: "a-much-longer-password-than-sixteen-bytes", salt: "xY.z/9", want: "$apr1$xY.z/9$klhD2QjFNSdmLBslAakL81"},
+	}
+	for _, tt := range tests {
+		if got := apr1(tt.password, tt.salt); got != tt.want {
+			t.Errorf("apr1(%q, %q) = %s, want %s", tt.password, tt.salt, got, tt.want)
+		}
+	}
+}
+
+func TestUserstore(t *testing.T) {
+
+	fname := filepath.Join(t.TempDir(), "htpasswd")
+	htpasswd := strings.Join([]string{
+		"# users",
+		"alice:$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/",
+		"bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		"  carol:$apr1$12345678$0lqb/6VUFP8JY/s/jTrIk0  ",
+		"dave:$2y$05$c4WoMPo3SXsafkva.HHa6uXQZWr7oboPiC2bT/r7q1BB8I2s0BRqC",
+		"erin:password",
+		"frank",
+		"mallory:$apr1$saltsalt$",
+		"",
+	}, "\n")
+	if err := os.WriteFile(fname, []byte(htpasswd), 0600); err != nil {
+		t.Fatal(err)
+	}
+	users := &userstore{file: fname}
+
+	tests := []struct {
+		user     string
+		password string
+		valid    bool
+	}{
+		{user: "alice", password: "password", valid: true},
+		{user: "alice", password: "Password"},
+		{user: "alice", password: ""},
+		{user: "bob", password: "password", valid: true},
+		{user: "bob", password: "password "},
+		{user: "carol", password: "secret", valid: true},
+		{user: "dave", password: "password"},   // bcrypt is not supported
+		{user: "erin", password: "password"},   // plain text is not supported
+		{user: "frank", password: ""},          // no password
+		{user: "mallory", password: ""},        // truncated hash
+		{user: "# users", password: ""},        // comment
+		{user: "nobody", password: "password"}, // unknown
+	}
+	for _, tt := range tests {
+		if got := users.valid(tt.user, tt.password); got != tt.valid {
+			t.Errorf("valid(%q, %q) = %v, want %v", tt.user, tt.password, got, tt.valid)
+		}
+	}
+}
+
+func TestImagePath(t *testing.T) {
+
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	os.Mkdir(src, 0755)
+	for _, name := range []string{"src/image-1.tgz", "src/image-1.tgz.sig", "src/.hidden.tgz", "outside.tgz"} {
+		if err := os.WriteFile(filepath.Join(root, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Symlink("image-1.tgz", filepath.Join(src, "inside.tgz"))
+	os.Symlink("../outside.tgz", filepath.Join(src, "outside.tgz"))
+	tgzsrc = src + "/"
+
+	tests := []struct {
+		urlpath string
+		want    string
+	}{
+		{"/image-1.tgz", "image-1.tgz"},
+		{"/dir/image-1.tgz", "image-1.tgz"},
+		{"/../../image-1.tgz", "image-1.tgz"},
+		{"/missing.tgz", "missing.tgz"},
+		{"/inside.tgz", "inside.tgz"},
+		{"/outside.tgz", ""},
+		{"/image-1.tgz.sig", ""},
+		{"/.hidden.tgz", ""},
+		{"/image-1.tgz/..", ""},
+		{"/", ""},
+	}
+	for _, tt := range tests {
+		want := ""
+		if tt.want != "" {
+			want = tgzsrc + tt.want
+		}
+		if got := imagepath(tt.urlpath); got != want {
+			t.Errorf("imagepath(%q) = %q, want %q", tt.urlpath, got, want)
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config string
+		want   []string // name and quoted values of the settings
+		err    string
+	}{
+		{
+			name:   "scalars",
+			config: "---\nsrc: /srv/images\nbind: :8080   # all interfaces\nurl: http://host:80/a#b\n\n# comment\nhash: \"sha#256\"\nname: 'it''s'\nempty: \"\"\n",
+			want:   []string{`src ["/srv/images"]`, `bind [":8080"]`, `url ["http://host:80/a#b"]`, `hash ["sha#256"]`, `name ["it's"]`, `empty [""]`},
+		},
+		{
+			name:   "nested",
+			config: "tls:\n  cert: /etc/ota/cert.pem\n  key: /etc/ota/key.pem\n  client:\n    ca: ca.pem\nlog:\n  level: debug\nbind: :443\n",
+			want:   []string{`tls []`, `tls-cert ["/etc/ota/cert.pem"]`, `tls-key ["/etc/ota/key.pem"]`, `tls-client []`, `tls-client-ca ["ca.pem"]`, `log []`, `log-level ["debug"]`, `bind [":443"]`},
+		},
+		{
+			name:   "list",
+			config: "environments:\n  - dev\n  - \"staging\"   # comment\n  - 'prod'\nbind: :80\n",
+			want:   []string{`environments ["dev" "staging" "prod"]`, `bind [":80"]`},
+		},
+		{
+			name:   "list without indent",
+			config: "environments:\n- dev\n-\n",
+			want:   []string{`environments ["dev" ""]`},
+		},
+		{
+			name:   "escapes",
+			config: "secret: \"a\\\"b\\\\c\\n\" # comment\n",
+			want:   []string{`secret ["a\"b\\c\n"]`},
+		},
+		{name: "tab indentation", config: "tls:\n\tcert: cert.pem\n", err: ":2: tabs are not allowed for indentation"},
+		{name: "list item without key", config: "- dev\n", err: ":1: list item without key"},
+		{name: "list item after value", config: "bind: :80\n  - dev\n", err: ":2: list item without key"},
+		{name: "no key", config: "bind\n", err: ":1: expected <key>: <value>"},
+		{name: "no space after colon", config: "bind:8080\n", err: ":1: expected <key>: <value>"},
+		{name: "flow sequence", config: "environments: [dev, prod]\n", err: ":1: flow collections are not supported: [dev, prod]"},
+		{name: "flow mapping", config: "tls: {cert: a}\n", err: ":1: flow collections are not supported: {cert: a}"},
+		{name: "unterminated single quote", config: "name: 'abc\n", err: ":1: unterminated string 'abc"},
+		{name: "unterminated double quote", config: "name: \"abc\n", err: ":1: invalid syntax"},
+		{name: "invalid escape", config: "name: \"\\q\"\n", err: ":1: invalid syntax"},
+		{name: "invalid list item", config: "environments:\n  - 'dev\n", err: ":2: unterminated string 'dev"},
+	}
+	dir := t.TempDir()
+	for i, tt := range tests {
+		fname := filepath.Join(dir, fmt.Sprintf("%d.yaml", i))
+		if err := os.WriteFile(fname, []byte(tt.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		settings, err := parseconfig(fname)
+		if tt.err != "" {
+			if err == nil || err.Error() != fname+tt.err {
+				t.Errorf("%s: got error %v, want %s%s", tt.name, err, fname, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, setting := range settings {
+			got = append(got, fmt.Sprintf("%s %q", setting.name, setting.values))
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+}
+
+func TestJWKPublicKey(t *testing.T) {
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y := b64(ec.X.FillBytes(make([]byte, 32))), b64(ec.Y.FillBytes(make([]byte, 32)))
+	offcurve := b64(new(big.Int).Add(ec.Y, big.NewInt(1)).FillBytes(make([]byte, 32)))
+
+	tests := []struct {
+		name string
+		key  jwtkey
+		err  string
+	}{
+		{name: "rsa", key: jwtkey{Kty: "RSA", N: b64(make([]byte, 256)), E: "AQAB"}},
+		{name: "ec", key: jwtkey{Kty: "EC", Crv: "P-256", X: x, Y: y}},
+		{name: "ed25519", key: jwtkey{Kty: "OKP", Crv: "Ed25519", X: b64(make([]byte, 32))}},
+		{name: "rsa exponent 1", key: jwtkey{Kty: "RSA", N: b64(make([]byte, 256)), E: "AQ"}, err: "invalid rsa exponent"},
+		{name: "rsa exponent too large", key: jwtkey{Kty: "RSA", N: b64(make([]byte, 256)), E: "AQAAAAE"}, err: "invalid rsa exponent"},
+		{name: "rsa modulus not base64url", key: jwtkey{Kty: "RSA", N: "a+b/", E: "AQAB"}, err: "illegal base64 data at input byte 1"},
+		{name: "ec unsupported curve", key: jwtkey{Kty: "EC", Crv: "secp256k1", X: x, Y: y}, err: `unsupported curve "secp256k1"`},
+		{name: "ec point not on curve", key: jwtkey{Kty: "EC", Crv: "P-256", X: x, Y: offcurve}, err: "invalid ec point"},
+		{name: "ec point on another curve", key: jwtkey{Kty: "EC", Crv: "P-384", X: x, Y: y}, err: "invalid ec point"},
+		{name: "x25519", key: jwtkey{Kty: "OKP", Crv: "X25519", X: b64(make([]byte, 32))}, err: `unsupported curve "X25519"`},
+		{name: "ed25519 short", key: jwtkey{Kty: "OKP", Crv: "Ed25519", X: b64(make([]byte, 31))}, err: "invalid ed25519 key"},
+		{name: "symmetric", key: jwtkey{Kty: "oct"}, err: `unsupported key type "oct"`},
+	}
+	for _, tt := range tests {
+		_, err := tt.key.publickey()
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		} else if tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("%s: got error %v, want %s", tt.name, err, tt.err)
+		}
+	}
+}
+
+// testjwt returns a token with the header and claims, signed by sign
+func testjwt(t *testing.T, header map[string]interface{}, claims map[string]interface{}, sign func(signed []byte) []byte) string {
+
+	b64 := base64.RawURLEncoding
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := b64.EncodeToString(h) + "." + b64.EncodeToString(c)
+	return signed + "." + b64.EncodeToString(sign([]byte(signed)))
+}
+
+func TestJWTVerify(t *testing.T) {
+
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	rsakey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eckey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edpub, edkey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	rsapub := jwtkey{Kty: "RSA", Kid: "rsa", Use: "sig", N: b64(rsakey.N.Bytes()), E: b64(big.NewInt(int64(rsakey.E)).Bytes())}
+	jwks, err := json.Marshal(map[string][]jwtkey{"keys": {
+		rsapub,
+		{Kty: "EC", Kid: "ec", Crv: "P-256", X: b64(eckey.X.FillBytes(make([]byte, 32))), Y: b64(eckey.Y.FillBytes(make([]byte, 32)))},
+		{Kty: "OKP", Kid: "ed", Crv: "Ed25519", X: b64(edpub)},
+		{Kty: "RSA", Kid: "enc", Use: "enc", N: rsapub.N, E: rsapub.E},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwks)
+	}))
+	defer server.Close()
+
+	hs := func(key []byte) func([]byte) []byte {
+		return func(signed []byte) []byte {
+			mac := hmac.New(sha256.New, key)
+			mac.Write(signed)
+			return mac.Sum(nil)
+		}
+	}
+	rs := func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, rsakey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	es := func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, eckey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	esasn1 := func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		sig, err := ecdsa.SignASN1(rand.Reader, eckey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	ed := func(signed []byte) []byte {
+		return ed25519.Sign(edkey, signed)
+	}
+	none := func(signed []byte) []byte {
+		return nil
+	}
+
+	now := time.Now().Unix()
+	valid := map[string]interface{}{"sub": "device-1", "hw": "rev-b", "groups": []string{"beta", "lab"}, "iss": "https://issuer", "aud": "ota", "exp": now + 60}
+	with := func(claims map[string]interface{}, name string, value interface{}) map[string]interface{} {
+		c := map[string]interface{}{}
+		for k, v := range claims {
+			c[k] = v
+		}
+		if value == nil {
+			delete(c, name)
+		} else {
+			c[name] = value
+		}
+		return c
+	}
+	header := func(alg string, kid string) map[string]interface{} {
+		return map[string]interface{}{"alg": alg, "kid": kid, "typ": "JWT"}
+	}
+	token := func(alg string, kid string, claims map[string]interface{}, sign func([]byte) []byte) string {
+		return testjwt(t, header(alg, kid), claims, sign)
+	}
+
+	hsverifier := &jwtverifier{secret: secret, issuer: "https://issuer", audience: "ota", deviceclaim: "sub", hardwareclaim: "hw", groupsclaim: "groups"}
+	jwksverifier := &jwtverifier{jwksurl: server.URL, issuer: "https://issuer", audience: "ota", deviceclaim: "sub", hardwareclaim: "hw", groupsclaim: "groups"}
+	rsapem := []byte(fmt.Sprintf("%x%x", rsakey.N, rsakey.E))
+
+	tests := []struct {
+		name     string
+		verifier *jwtverifier
+		token    string
+		err      string
+	}{
+		{name: "HS256", verifier: hsverifier, token: token("HS256", "", valid, hs(secret))},
+		{name: "RS256", verifier: jwksverifier, token: token("RS256", "rsa", valid, rs)},
+		{name: "ES256", verifier: jwksverifier, token: token("ES256", "ec", valid, es)},
+		{name: "EdDSA", verifier: jwksverifier, token: token("EdDSA", "ed", valid, ed)},
+		{name: "expired within leeway", verifier: hsverifier, token: token("HS256", "", with(valid, "exp", now-30), hs(secret))},
+		{name: "not yet valid within leeway", verifier: hsverifier, token: token("HS256", "", with(valid, "nbf", now+30), hs(secret))},
+		{name: "audience list", verifier: hsverifier, token: token("HS256", "", with(valid, "aud", []string{"other", "ota"}), hs(secret))},
+
+		{name: "expired", verifier: hsverifier, token: token("HS256", "", with(valid, "exp", now-120), hs(secret)), err: "token expired"},
+		{name: "no expiry", verifier: hsverifier, token: token("HS256", "", with(valid, "exp", nil), hs(secret)), err: "token without expiry"},
+		{name: "expiry no number", verifier: hsverifier, token: token("HS256", "", with(valid, "exp", fmt.Sprint(now+60)), hs(secret)), err: "token without expiry"},
+		{name: "not yet valid", verifier: hsverifier, token: token("HS256", "", with(valid, "nbf", now+300), hs(secret)), err: "token not yet valid"},
+		{name: "wrong issuer", verifier: hsverifier, token: token("HS256", "", with(valid, "iss", "https://other"), hs(secret)), err: "wrong token issuer"},
+		{name: "wrong audience", verifier: hsverifier, token: token("HS256", "", with(valid, "aud", []string{"other"}), hs(secret)), err: "wrong token audience"},
+		{name: "no audience", verifier: hsverifier, token: token("HS256", "", with(valid, "aud", nil), hs(secret)), err: "wrong token audience"},
+
+		{name: "wrong secret", verifier: hsverifier, token: token("HS256", "", valid, hs([]byte("guessed"))), err: "invalid signature"},
+		{name: "modified claims", verifier: hsverifier, token: testjwtswap(token("HS256", "", valid, hs(secret)), with(valid, "sub", "device-2")), err: "invalid signature"},
+		{name: "alg none", verifier: hsverifier, token: token("none", "", valid, none), err: `unsupported algorithm "none"`},
+		{name: "alg none jwks", verifier: jwksverifier, token: token("none", "rsa", valid, none), err: `unsupported algorithm "none"`},
+		{name: "alg empty", verifier: hsverifier, token: token("", "", valid, none), err: `unsupported algorithm ""`},
+		{name: "HS256 with the rsa key as secret", verifier: jwksverifier, token: token("HS256", "rsa", valid, hs(rsapem)), err: `unsupported algorithm "HS256"`},
+		{name: "RS256 without jwks", verifier: hsverifier, token: token("RS256", "rsa", valid, rs), err: `unsupported algorithm "RS256"`},
+		{name: "RS256 with the ec key", verifier: jwksverifier, token: token("RS256", "ec", valid, rs), err: "invalid signature"},
+		{name: "ES256 with the rsa key", verifier: jwksverifier, token: token("ES256", "rsa", valid, rs), err: "invalid signature"},
+		{name: "EdDSA with the ec key", verifier: jwksverifier, token: token("EdDSA", "ec", valid, ed), err: "invalid signature"},
+		{name: "ES256 asn.1 signature", verifier: jwksverifier, token: token("ES256", "ec", valid, esasn1), err: "invalid signature"},
+		{name: "ES384 with a P-256 key", verifier: jwksverifier, token: token("ES384", "ec", valid, es), err: "invalid signature"},
+		{name: "PS256", verifier: jwksverifier, token: token("PS256", "rsa", valid, rs), err: `unsupported algorithm "PS256"`},
+		{name: "RS1", verifier: jwksverifier, token: token("RS1", "rsa", valid, rs), err: `unsupported algorithm "RS1"`},
+		{name: "unknown kid", verifier: jwksverifier, token: token("RS256", "rotated", valid, rs), err: `unknown key "rotated"`},
+		{name: "encryption key", verifier: jwksverifier, token: token("RS256", "enc", valid, rs), err: `unknown key "enc"`},
+		{name: "critical header", verifier: hsverifier, token: testjwt(t, map[string]interface{}{"alg": "HS256", "crit": []string{"exp"}}, valid, hs(secret)), err: "unsupported critical header"},
+
+		{name: "two parts", verifier: hsverifier, token: "eyJhbGciOiJIUzI1NiJ9.e30", err: "malformed token"},
+		{name: "four parts", verifier: hsverifier, token: token("HS256", "", valid, hs(secret)) + ".x", err: "malformed token"},
+		{name: "header not base64url", verifier: hsverifier, token: "eyJ+.e30.", err: "malformed token header"},
+		{name: "header not json", verifier: hsverifier, token: b64([]byte("alg")) + ".e30.", err: "malformed token header"},
+		{name: "signature not base64url", verifier: hsverifier, token: b64([]byte(`{"alg":"HS256"}`)) + ".e30.a+b", err: "malformed token signature"},
+		{name: "signature padded", verifier: hsverifier, token: token("HS256", "", valid, hs(secret)) + "=", err: "malformed token signature"},
+		{name: "claims not json", verifier: hsverifier, token: testjwtraw(t, `{"alg":"HS256"}`, "claims", hs(secret)), err: "malformed token claims"},
+		{name: "claims not an object", verifier: hsverifier, token: testjwtraw(t, `{"alg":"HS256"}`, `["exp"]`, hs(secret)), err: "malformed token claims"},
+	}
+	for _, tt := range tests {
+		claims, err := tt.verifier.verify(tt.token)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: got error %v, want %s", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if claims.ID != "device-1" || claims.Hardware != "rev-b" || strings.Join(claims.Groups, ",") != "beta,lab" {
+			t.Errorf("%s: got claims %+v", tt.name, claims)
+		}
+	}
+}
+
+// testjwtraw returns a token of the raw header and claims, signed by sign
+func testjwtraw(t *testing.T, header string, claims string, sign func(signed []byte) []byte) string {
+
+	b64 := base64.RawURLEncoding
+	signed := b64.EncodeToString([]byte(header)) + "." + b64.EncodeToString([]byte(claims))
+	return signed + "." + b64.EncodeToString(sign([]byte(signed)))
+}
+
+// testjwtswap replaces the claims of token, keeping its signature
+func testjwtswap(token string, claims map[string]interface{}) string {
+
+	parts := strings.Split(token, ".")
+	c, _ := json.Marshal(claims)
+	parts[1] = base64.RawURLEncoding.EncodeToString(c)
+	return strings.Join(parts, ".")
+}
+
+func TestJWKSFetch(t *testing.T) {
+
+	edpub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, _ := json.Marshal(map[string][]jwtkey{"keys": {
+		{Kty: "OKP", Kid: "old", Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(edpub)},
+		{Kty: "OKP", Kid: "rotated", Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(edpub)},
+	}})
+	var mu sync.Mutex
+	requests := 0
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		<-release
+		w.Write(jwks)
+	}))
+	defer server.Close()
+
+	// keys fetched more than an hour ago are refetched
+	v := &jwtverifier{jwksurl: server.URL, keys: map[string]interface{}{"old": edpub}, fetched: time.Now().Add(-2 * time.Hour)}
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := v.key("rotated")
+			errs <- err
+		}()
+	}
+	// known keys do not wait for the fetch in progress
+	time.Sleep(100 * time.Millisecond)
+	done := make(chan error)
+	go func() {
+		_, err := v.key("old")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("known key waits for the fetch")
+	}
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("got %d requests, want 1", requests)
+	}
+
+	// a stalled endpoint times out
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer stalled.Close()
+	timeout := jwksclient.Timeout
+	jwksclient.Timeout = 100 * time.Millisecond
+	defer func() { jwksclient.Timeout = timeout }()
+	v = &jwtverifier{jwksurl: stalled.URL}
+	if _, err := v.key("rotated"); err == nil || err.Error() != `unknown key "rotated"` {
+		t.Errorf("stalled: got %v", err)
+	}
+}
+
+func TestThrottledReader(t *testing.T) {
+
+	// 2ms of work per read at a quarter of a CPU
+	r := &throttledreader{r: strings.NewReader(strings.Repeat("x", 20)), share: 0.25}
+	buf := make([]byte, 1)
+	start := time.Now()
+	for {
+		if _, err := r.Read(buf); err != nil {
+			break
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	// the work between 19 reads, up to 10ms of sleep are still due
+	work := 19 * 2 * time.Millisecond
+	if elapsed := time.Since(start); elapsed < time.Duration(float64(work)/0.25)-10*time.Millisecond {
+		t.Errorf("%s of work took %s", work, elapsed)
+	}
+}
+
+func TestLintImage(t *testing.T) {
+
+	random := make([]byte, 1000)
+	rand.Read(random)
+	dir := func(name string) *tar.Header { return &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755} }
+	file := func(name string) *tar.Header { return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644} }
+	symlink := func(name, target string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target, Mode: 0777}
+	}
+
+	tests := []struct {
+		name     string
+		entries  []*tar.Header
+		warnings int
+	}{
+		{"clean", []*tar.Header{dir("etc/"), file("etc/a"), file("etc/b"), symlink("etc/c", "a"), symlink("etc/d", "/etc/a"),
+			{Name: "etc/e", Typeflag: tar.TypeLink, Linkname: "etc/a"}, {Name: "tmp/", Typeflag: tar.TypeDir, Mode: 01777}}, 0},
+		{"unsafe path", []*tar.Header{file("../a")}, 1},
+		{"absolute path", []*tar.Header{file("/etc/a")}, 1},
+		{"duplicate", []*tar.Header{dir("etc/"), file("etc/a"), file("etc/a")}, 1},
+		{"unsorted once", []*tar.Header{file("b"), file("a"), file("0")}, 1},
+		{"sorted per directory", []*tar.Header{dir("b/"), file("b/z"), file("a")}, 1},
+		{"device", []*tar.Header{{Name: "dev/null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}}, 1},
+		{"symlink escaping", []*tar.Header{dir("etc/"), symlink("etc/a", "../../x")}, 1},
+		{"absolute symlink outside", []*tar.Header{symlink("a", "/missing")}, 1},
+		{"hard link forward", []*tar.Header{{Name: "a", Typeflag: tar.TypeLink, Linkname: "b"}, file("b")}, 1},
+		{"world-writable", []*tar.Header{{Name: "a", Typeflag: tar.TypeReg, Mode: 0666}, {Name: "b/", Typeflag: tar.TypeDir, Mode: 0777}}, 2},
+		{"huge", []*tar.Header{{Name: "a", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(random))}}, 1},
+		{"huge compressible", []*tar.Header{{Name: "a", Typeflag: tar.TypeReg, Mode: 0644, Size: 1000}}, 0},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		for _, hdr := range tt.entries {
+			tw.WriteHeader(hdr)
+			if tt.name == "huge" {
+				tw.Write(random)
+			} else if hdr.Size > 0 {
+				tw.Write(make([]byte, hdr.Size))
+			}
+		}
+		tw.Close()
+		gw.Close()
+		if n, err := lintimage(tt.name, &buf, 100, false); n != tt.warnings || err != nil {
+			t.Errorf("%s: got %d warnings, %v, want %d", tt.name, n, err, tt.warnings)
+		}
+	}
+}
+
+func TestIndexToken(t *testing.T) {
+
+	indextokensecret = []byte("index token secret")
+	image := filepath.Join(t.TempDir(), "image-1.tgz")
+	os.WriteFile(image, []byte("image"), 0644)
+	fi, err := os.Stat(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(image, []byte("image, replaced"), 0644)
+	replaced, err := os.Stat(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(device string) *http.Request {
+		r := httptest.NewRequest("POST", "/image-1.tgz", nil)
+		if device != "" {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: device}}
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		return r
+	}
+	check := func(token string, r *http.Request, fi os.FileInfo, consume bool) int {
+		if token != "" {
+			r.Header.Set(indextokenheader, token)
+		}
+		w := httptest.NewRecorder()
+		if !checkindextoken(w, r, image, fi, consume) {
+			return w.Code
+		}
+		return 0
+	}
+
+	token := issueindextoken(request("dev1"), image, fi)
+	raw, _ := base64.RawURLEncoding.DecodeString(token)
+	raw[len(raw)-1] ^= 1
+	forged := base64.RawURLEncoding.EncodeToString(raw)
+	indextokenttl = -time.Second
+	expired := issueindextoken(request("dev1"), image, fi)
+	indextokenttl = 10 * time.Minute
+
+	tests := []struct {
+		name    string
+		token   string
+		device  string
+		fi      os.FileInfo
+		consume bool
+		require bool
+		status  int
+	}{
+		{"simulated", token, "dev1", fi, false, false, 0},
+		{"diff", token, "dev1", fi, true, false, 0},
+		{"replayed", token, "dev1", fi, true, false, http.StatusForbidden},
+		{"replayed simulation", token, "dev1", fi, false, false, 0},
+		{"other device", issueindextoken(request("dev1"), image, fi), "dev2", fi, true, false, http.StatusForbidden},
+		{"without device", issueindextoken(request("dev1"), image, fi), "", fi, true, false, http.StatusForbidden},
+		{"forged mac", forged, "dev1", fi, true, false, http.StatusForbidden},
+		{"truncated", token[:20], "dev1", fi, true, false, http.StatusForbidden},
+		{"expired", expired, "dev1", fi, true, false, http.StatusForbidden},
+		{"image replaced", issueindextoken(request("dev1"), image, fi), "dev1", replaced, true, false, http.StatusConflict},
+		{"no token", "", "dev1", fi, true, false, 0},
+		{"no token required", "", "dev1", fi, true, true, http.StatusPreconditionRequired},
+	}
+	for _, tt := range tests {
+		requireindextoken = tt.require
+		if got := check(tt.token, request(tt.device), tt.fi, tt.consume); got != tt.status {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.status)
+		}
+	}
+	requireindextoken = false
+
+	// used nonces are kept until the token expires
+	usednonces.expire()
+	if got := check(token, request("dev1"), fi, true); got != http.StatusForbidden {
+		t.Errorf("replayed after expire: got %d", got)
+	}
+	usednonces.use("expired", time.Now().Add(-time.Second))
+	usednonces.expire()
+	if !usednonces.use("expired", time.Now().Add(time.Minute)) {
+		t.Errorf("expired nonce kept")
+	}
+}
+
+func TestBLAKE3(t *testing.T) {
+
+	// the official test vectors, input bytes i % 251, and lengths across the
+	// subtree size of the reference implementation, 32 bytes of output
+	tests := []struct {
+		length int
+		hash   string
+	}{
+		{0, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+		{1, "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+		{1023, "10108970eeda3eb932baac1428c7a2163b0e924c9a9e25b35bba72b28f70bd11"},
+		{1024, "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+		{1025, "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+		{2048, "e776b6028c7cd22a4d0ba182a8bf62205d2ef576467e838ed6f2529b85fba24a"},
+		{2049, "5f4d72f40d7a5f82b15ca2b2e44b1de3c2ef86c426c95c1af0b6879522563030"},
+		{3072, "b98cb0ff3623be03326b373de6b9095218513e64f1ee2edd2525c7ad1e5cffd2"},
+		{3073, "7124b49501012f81cc7f11ca069ec9226cecb8a2c850cfe644e327d22d3e1cd3"},
+		{4096, "015094013f57a5277b59d8475c0501042c0b642e531b0a1c8f58d2163229e969"},
+		{4097, "9b4052b38f1c5fc8b1f9ff7ac7b27cd242487b3d890d15c96a1c25b8aa0fb995"},
+		{5120, "9cadc15fed8b5d854562b26a9536d9707cadeda9b143978f319ab34230535833"},
+		{5121, "628bd2cb2004694adaab7bbd778a25df25c47b9d4155a55f8fbd79f2fe154cff"},
+		{6144, "3e2e5b74e048f3add6d21faab3f83aa44d3b2278afb83b80b3c35164ebeca205"},
+		{6145, "f1323a8631446cc50536a9f705ee5cb619424d46887f3c376c695b70e0f0507f"},
+		{7168, "61da957ec2499a95d6b8023e2b0e604ec7f6b50e80a9678b89d2628e99ada77a"},
+		{7169, "a003fc7a51754a9b3c7fae0367ab3d782dccf28855a03d435f8cfe74605e7817"},
+		{8192, "aae792484c8efe4f19e2ca7d371d8c467ffb10748d8a5a1ae579948f718a2a63"},
+		{8193, "bab6c09cb8ce8cf459261398d2e7aef35700bf488116ceb94a36d0f5f1b7bc3b"},
+		{16384, "f875d6646de28985646f34ee13be9a576fd515f76b5b0a26bb324735041ddde4"},
+		{31744, "62b6960e1a44bcc1eb1a611a8d6235b6b4b78f32e7abc4fb4c6cdcce94895c47"},
+		{102400, "bc3e3d41a1146b069abffad3c0d44860cf664390afce4d9661f7902e7943e085"},
+		{1048576, "74cb441fd087764ca9c3694da742ebe30cbeb3060a17009ca81825c7a8d10343"},
+		{1049601, "860f19b5fefff01454de342be87a20059449529116a20fb22a21da665aafa071"},
+		{3146752, "f50b9c7a909d3a613ef6d072d3a17eb3818537b26bd1d708094ec887b344ea37"},
+	}
+	input := make([]byte, 3146752)
+	for i := range input {
+		input[i] = byte(i % 251)
+	}
+	// writes not aligned to blocks and chunks
+	pieces := []int{1, 63, 64, 65, 1000, 1024, 1025, 4096, 70000}
+
+	for _, tt := range tests {
+		h := newblake3()
+		h.Write(input[:tt.length])
+		if got := hex.EncodeToString(h.Sum(nil)); got != tt.hash {
+			t.Errorf("%d bytes: got %s, want %s", tt.length, got, tt.hash)
+		}
+
+		h.Reset()
+		for i, n := 0, 0; n < tt.length; i++ {
+			end := n + pieces[i%len(pieces)]
+			if end > tt.length {
+				end = tt.length
+			}
+			h.Write(input[n:end])
+			n = end
+			// Sum does not change the state
+			if i == 3 {
+				h.Sum(nil)
+			}
+		}
+		if got := hex.EncodeToString(h.Sum([]byte{})); got != tt.hash {
+			t.Errorf("%d bytes incrementally: got %s, want %s", tt.length, got, tt.hash)
+		}
+	}
+	if h := newblake3(); h.Size() != 32 || h.BlockSize() != 64 {
+		t.Errorf("got size %d, block size %d", h.Size(), h.BlockSize())
+	}
+}
+
+func TestETagMatch(t *testing.T) {
+
+	tests := []struct {
+		ifnonematch string
+		etag        string
+		match       bool
+	}{
+		{`"a"`, `"a"`, true},
+		{`"b", "a"`, `"a"`, true},
+		{`W/"a"`, `"a"`, true},
+		{`"a"`, `W/"a"`, true},
+		{`*`, `"a"`, true},
+		{`"b"`, `"a"`, false},
+		{``, `"a"`, false},
+		{`"a`, `"a"`, false},
+	}
+	for _, tt := range tests {
+		if got := etagmatch(tt.ifnonematch, tt.etag); got != tt.match {
+			t.Errorf("etagmatch(%q, %q) = %v, want %v", tt.ifnonematch, tt.etag, got, tt.match)
+		}
+	}
+}
+
+func TestJobStoreFull(t *testing.T) {
+
+	finished := make(chan struct{})
+	close(finished)
+	s := &jobstore{byid: map[string]*diffjob{
+		"1": {client: "a", done: make(chan struct{})},
+		"2": {client: "b", done: make(chan struct{})},
+		"3": {client: "a", done: finished, size: 100},
+	}}
+
+	tests := []struct {
+		name                           string
+		maxjobs, maxrunning, perclient int
+		maxspool                       int64
+		client                         string
+		size                           int64
+		full                           bool
+	}{
+		{"no limits", 0, 0, 0, 0, "a", -1, false},
+		{"jobs", 3, 0, 0, 0, "c", 10, true},
+		{"jobs below", 4, 0, 0, 0, "c", 10, false},
+		{"running", 0, 2, 0, 0, "c", -1, true},
+		{"running not for downloads", 0, 2, 0, 0, "c", 10, false},
+		{"client", 0, 0, 1, 0, "a", -1, true},
+		{"other client", 0, 0, 1, 0, "c", -1, false},
+		{"spool", 0, 0, 0, 150, "c", 60, true},
+		{"spool below", 0, 0, 0, 160, "c", 60, false},
+	}
+	for _, tt := range tests {
+		s.maxjobs, s.maxrunning, s.maxperclient, s.maxspool = tt.maxjobs, tt.maxrunning, tt.perclient, tt.maxspool
+		if full := s.full(tt.client, tt.size); full != tt.full {
+			t.Errorf("%s: got %v", tt.name, full)
+		}
+	}
+}
+
+func TestKeyLocks(t *testing.T) {
+
+	k := &keylocks{locks: map[string]*keylock{}}
+	var mu sync.Mutex
+	running := map[string]int{}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		key := []string{"a", "b"}[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := k.lock(key)
+			mu.Lock()
+			running[key]++
+			if running[key] > 1 {
+				t.Errorf("%s locked twice", key)
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			running[key]--
+			mu.Unlock()
+			unlock()
+		}()
+	}
+	wg.Wait()
+	if len(k.locks) != 0 {
+		t.Errorf("%d locks left", len(k.locks))
+	}
+}